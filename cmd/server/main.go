@@ -3,26 +3,36 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"laughing-barnacle/internal/agent"
 	"laughing-barnacle/internal/config"
 	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/httpclient"
+	"laughing-barnacle/internal/llm"
 	"laughing-barnacle/internal/llm/cerber"
+	"laughing-barnacle/internal/llm/ollama"
 	"laughing-barnacle/internal/llmlog"
 	"laughing-barnacle/internal/mcp"
+	"laughing-barnacle/internal/metrics"
+	"laughing-barnacle/internal/redact"
 	"laughing-barnacle/internal/skills"
 	"laughing-barnacle/internal/web"
 )
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatalf("server error: %v", err)
+		slog.Error("server error", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -31,16 +41,35 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	if err := cfg.CheckDataPaths(); err != nil {
+		return err
+	}
 
-	logStore, err := llmlog.NewStoreWithFile(cfg.LLMLogLimit, cfg.LLMLogFile)
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.LogLevel))
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	logStore, err := llmlog.NewStoreWithOptions(cfg.LLMLogLimit, cfg.LLMLogFile, llmlog.Options{
+		MaxAge:      cfg.LLMLogMaxAge,
+		RotateBytes: int64(cfg.LLMLogRotateBytes),
+	})
 	if err != nil {
 		return err
 	}
-	convStore, err := conversation.NewStoreWithFile(cfg.ConversationFile)
+	logStore.SetLogger(logger.With("component", "llmlog"))
+	convStore, err := conversation.NewStoreWithOptions(cfg.ConversationFile, conversation.Options{
+		AppendLog: cfg.ConversationAppendLog,
+	})
 	if err != nil {
 		return err
 	}
-	skillStore, err := skills.NewStore(cfg.SkillsDir, cfg.SkillsStateFile)
+	convStore.SetLogger(logger.With("component", "conversation"))
+	convStore.SetMaxStoredMessages(cfg.MaxStoredMessages, func(summary string, dropped []conversation.Message) string {
+		logger.Warn("conversation exceeded storage cap; folding oldest messages into the summary", "dropped", len(dropped))
+		return foldDroppedMessages(summary, dropped)
+	})
+	skillStore, err := newSkillStore(cfg)
 	if err != nil {
 		return err
 	}
@@ -48,59 +77,205 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	mcpHTTPClient := mcp.NewHTTPClient(cfg.MCPRequestTimeout, cfg.MCPProtocolVersion)
+	if n := migrateLegacySkills(logger, mcpStore, skillStore); n > 0 {
+		logger.Info("migrated settings-file skills into the skills dir", "count", n)
+	}
+	if cfg.MCPInsecureSkipVerify {
+		logger.Warn("MCP_TLS_INSECURE_SKIP_VERIFY is set; MCP server certificates are NOT verified")
+	}
+	mcpHTTP, err := httpclient.New(httpclient.Options{
+		Timeout:            cfg.MCPRequestTimeout,
+		ProxyURL:           cfg.OutboundProxyURL,
+		CAFile:             cfg.MCPCAFile,
+		InsecureSkipVerify: cfg.MCPInsecureSkipVerify,
+		NoRedirects:        !cfg.MCPFollowRedirects,
+	})
+	if err != nil {
+		return fmt.Errorf("build mcp http client: %w", err)
+	}
+	mcpHTTPClient := mcp.NewHTTPClientWith(mcpHTTP, cfg.MCPProtocolVersion)
+	mcpHTTPClient.SetSSEIdleTimeout(cfg.MCPSSEIdleTimeout)
 	mcpToolProvider := mcp.NewToolProvider(mcpStore, mcpHTTPClient, cfg.MCPToolCacheTTL)
+	appMetrics := metrics.New()
+	mcpToolProvider.SetMetrics(appMetrics)
+	secrets := newSecretRedactor(cfg, mcpStore)
+
+	if cfg.LLMInsecureSkipVerify {
+		logger.Warn("LLM_TLS_INSECURE_SKIP_VERIFY is set; LLM API certificates are NOT verified")
+	}
+	llmHTTP, err := httpclient.New(httpclient.Options{
+		Timeout:            cfg.RequestTimeout,
+		ProxyURL:           cfg.OutboundProxyURL,
+		CAFile:             cfg.LLMCAFile,
+		InsecureSkipVerify: cfg.LLMInsecureSkipVerify,
+	})
+	if err != nil {
+		return fmt.Errorf("build llm http client: %w", err)
+	}
+
+	var llmClient interface {
+		llm.Client
+		llm.EmbeddingClient
+	}
+	switch cfg.LLMProvider {
+	case "ollama":
+		llmClient = ollama.NewClient(ollama.Config{
+			BaseURL:          cfg.OllamaBaseURL,
+			Timeout:          cfg.RequestTimeout,
+			HTTPClient:       llmHTTP,
+			LogStore:         logStore,
+			Metrics:          appMetrics,
+			MaxLogFieldBytes: cfg.LLMLogMaxFieldBytes,
+			Redactor:         secrets,
+		})
+	default:
+		if cfg.CerberAPIKey == "" {
+			logger.Warn("CERBER_API_KEY is not set; LLM calls will fail until it is configured")
+		}
+		llmClient = cerber.NewClient(cerber.Config{
+			BaseURL:          cfg.CerberBaseURL,
+			APIKey:           cfg.CerberAPIKey,
+			Timeout:          cfg.RequestTimeout,
+			HTTPClient:       llmHTTP,
+			LogStore:         logStore,
+			Metrics:          appMetrics,
+			MaxLogFieldBytes: cfg.LLMLogMaxFieldBytes,
+			Redactor:         secrets,
+		})
+	}
 
-	llmClient := cerber.NewClient(cerber.Config{
-		BaseURL:  cfg.CerberBaseURL,
-		APIKey:   cfg.CerberAPIKey,
-		Timeout:  cfg.RequestTimeout,
-		LogStore: logStore,
+	skillStore.SetDescriptionSummarizer(func(ctx context.Context, name, prompt string) (string, error) {
+		resp, err := llmClient.Chat(ctx, llm.ChatRequest{
+			Purpose: "skill_description",
+			Model:   cfg.Model,
+			Messages: []llm.Message{
+				{Role: "system", Content: "你是 Skill 描述生成器。用一句中文（不超过 60 字）说明该 Skill 适用的场景，以“当”开头，只输出这句话。"},
+				{Role: "user", Content: "Skill 名称：" + name + "\n\nSkill 指令：\n" + prompt},
+			},
+			Temperature: 0,
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.Content, nil
 	})
 
 	agentSvc := agent.New(agent.Config{
-		Model:                      cfg.CerberModel,
-		Temperature:                cfg.Temperature,
-		MaxRecentMessages:          cfg.MaxRecentMessages,
-		CompressionTriggerMessages: cfg.CompressionTriggerMessages,
-		CompressionTriggerChars:    cfg.CompressionTriggerChars,
-		KeepRecentAfterCompression: cfg.KeepRecentAfterCompression,
-		MaxCompressionLoopsPerTurn: cfg.MaxCompressionLoopsPerTurn,
-		MaxToolCallRounds:          cfg.MaxToolCallRounds,
-		SystemPrompt:               cfg.AgentSystemPrompt,
-		CompressionSystemPrompt:    cfg.CompressionSystemPrompt,
-		EnforceHumanRoutine:        true,
+		Model:         cfg.Model,
+		FallbackModel: cfg.FallbackModel,
+		Purposes: map[string]agent.PurposeConfig{
+			"chat_reply":                 {Model: cfg.ChatModel},
+			"compress_context":           {Model: cfg.CompressionModel},
+			"morning_planning":           {Model: cfg.PlanningModel},
+			"night_reflection_evolution": {Model: cfg.ReflectionModel},
+		},
+		Temperature:                 cfg.Temperature,
+		CompressionTemperature:      &cfg.CompressionTemperature,
+		MorningPlanTemperature:      &cfg.PlanningTemperature,
+		NightReflectionTemperature:  &cfg.ReflectionTemperature,
+		MaxRecentMessages:           cfg.MaxRecentMessages,
+		CompressionTriggerMessages:  cfg.CompressionTriggerMessages,
+		CompressionTriggerChars:     cfg.CompressionTriggerChars,
+		KeepRecentAfterCompression:  cfg.KeepRecentAfterCompression,
+		MaxCompressionLoopsPerTurn:  cfg.MaxCompressionLoopsPerTurn,
+		MaxToolCallRounds:           cfg.MaxToolCallRounds,
+		MaxToolResultsRunes:         cfg.MaxToolResultsRunes,
+		MaxTurnDuration:             cfg.MaxTurnDuration,
+		MaxPendingTurns:             cfg.MaxPendingTurns,
+		MaxContextTokens:            cfg.MaxContextTokens,
+		ContextTokenRatio:           cfg.ContextTokenRatio,
+		SystemPrompt:                cfg.AgentSystemPrompt,
+		CompressionSystemPrompt:     cfg.CompressionSystemPrompt,
+		EnforceHumanRoutine:         true,
+		SkipMorningPlanForUrgent:    cfg.SkipMorningPlanForUrgent,
+		PersonaName:                 cfg.PersonaName,
+		ForbidEmoji:                 cfg.ForbidEmoji,
+		SystemPromptPrefix:          cfg.SystemPromptPrefix,
+		SystemPromptSuffix:          cfg.SystemPromptSuffix,
+		CompressionUserTemplate:     cfg.CompressionUserPrompt,
+		MorningPlanUserTemplate:     cfg.MorningPlanUserPrompt,
+		NightReflectionUserTemplate: cfg.ReflectionUserPrompt,
+		Timezone:                    cfg.Timezone,
+		MaxInjectedSkillPrompts:     cfg.MaxInjectedSkills,
+		MaxInjectedSkillPromptRunes: cfg.MaxInjectedSkillRunes,
+		MaxSingleSkillPromptRunes:   cfg.MaxSingleSkillRunes,
+		MaxInjectedAutoSkillPrompts: cfg.MaxInjectedAutoSkills,
+		ToolRouting:                 cfg.ToolRouting != "off",
+		NoToolsPrefix:               cfg.NoToolsPrefix,
+		SuppressBuiltinToolsNotice:  !cfg.BuiltinToolsNotice,
+		DisabledBuiltinTools:        cfg.DisabledBuiltinTools,
+		MessageTimestamps:           cfg.MessageTimestamps,
+		KeepRecentTurns:             cfg.KeepRecentTurns,
+		NightReflectionLookback:     cfg.NightReflectionLookback,
+		MorningPlanLookback:         cfg.MorningPlanLookback,
+		BashJSONOutput:              cfg.BashJSONOutput,
+		BashMaxStdoutRunes:          cfg.BashMaxStdoutRunes,
+		BashMaxStderrRunes:          cfg.BashMaxStderrRunes,
+		BashShell:                   cfg.BashShell,
+		BashShellArgs:               cfg.BashShellArgs,
+		BashNoLogin:                 !cfg.BashLogin,
+		BashWorkDirRoot:             cfg.BashWorkDirRoot,
+		Metrics:                     appMetrics,
+		Redactor:                    secrets,
+		TurnTraceLimit:              cfg.TurnTraceLimit,
 	}, convStore, llmClient, mcpToolProvider)
 	agentSvc.SetSkillProvider(skillStore)
+	agentSvc.SetSkillCatalog(skillStore)
+	if cfg.SkillSelector == "embedding" {
+		agentSvc.SetSkillSelector(agent.NewEmbeddingSkillSelector(llmClient, cfg.EmbeddingModel))
+	}
+	if cfg.ToolRouting == "llm" {
+		agentSvc.SetToolClassifier(agent.NewLLMToolClassifier(llmClient, cfg.Model))
+	}
+	agentSvc.SetPromptTemplateProvider(mcpToolProvider)
 	agentSvc.SetPromptProvider(mcpStore)
 	agentSvc.SetPromptUpdater(mcpStore)
 	agentSvc.SetHabitProvider(mcpStore)
+	agentSvc.SetLogger(logger.With("component", "agent"))
 
 	webServer, err := web.NewServer(agentSvc, convStore, logStore, mcpStore, mcpToolProvider, skillStore)
 	if err != nil {
 		return err
 	}
+	webServer.SetRateLimit(cfg.RateLimitPerMinute)
+	webServer.SetMetrics(appMetrics)
+	webServer.SetAPIKeyConfigured(cfg.LLMProvider != "cerber" || cfg.CerberAPIKey != "")
+	if cfg.ReadyzCheckLLM {
+		llmBaseURL := cfg.CerberBaseURL
+		if cfg.LLMProvider == "ollama" {
+			llmBaseURL = cfg.OllamaBaseURL
+		}
+		webServer.AddReadyCheck("llm", web.CachedCheck(30*time.Second, web.PingURLCheck(llmHTTP, llmBaseURL)))
+	}
 
 	mux := http.NewServeMux()
 	webServer.RegisterRoutes(mux)
 
+	handler := web.WithAuth(mux, web.AuthConfig{
+		Token:    cfg.AuthToken,
+		Username: cfg.AuthUsername,
+		Password: cfg.AuthPassword,
+	})
+
 	httpServer := &http.Server{
 		Addr:              cfg.Addr,
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
 	go func() {
-		log.Printf("HTTP server listening on %s", cfg.Addr)
+		logger.Info("HTTP server listening", "addr", cfg.Addr)
 		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("listen error: %v", err)
+			logger.Error("listen error", "error", err)
 		}
 	}()
 
 	routineCtx, routineCancel := context.WithCancel(context.Background())
 	defer routineCancel()
 	go func() {
-		_ = agentSvc.RunScheduledHumanRoutine(routineCtx)
+		if err := agentSvc.RunScheduledHumanRoutine(routineCtx); err != nil {
+			logger.Warn("human routine tick error", "error", err)
+		}
 		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
 		for {
@@ -109,7 +284,7 @@ func run() error {
 				return
 			case <-ticker.C:
 				if err := agentSvc.RunScheduledHumanRoutine(routineCtx); err != nil {
-					log.Printf("human routine tick error: %v", err)
+					logger.Warn("human routine tick error", "error", err)
 				}
 			}
 		}
@@ -124,3 +299,133 @@ func run() error {
 	defer cancel()
 	return httpServer.Shutdown(ctx)
 }
+
+// newSkillStore builds the file-backed skills.Store. It is the single source
+// of skills: the agent injects from it and the settings page edits it.
+func newSkillStore(cfg config.Config) (*skills.Store, error) {
+	skillStore, err := skills.NewStore(cfg.SkillsDir, cfg.SkillsStateFile)
+	if err != nil {
+		return nil, fmt.Errorf("open skills store: %w", err)
+	}
+	skillStore.SetMaxEnabledSkillCandidates(cfg.MaxSkillCandidates)
+	skillStore.SetSkillLimits(skills.SkillLimits{
+		MaxNameRunes:        cfg.SkillMaxNameRunes,
+		MaxDescriptionRunes: cfg.SkillMaxDescriptionRunes,
+		MaxPromptRunes:      cfg.SkillMaxPromptRunes,
+	})
+	skillStore.SetCloneLimits(skills.CloneLimits{
+		Timeout:      cfg.SkillsCloneTimeout,
+		MaxRepoBytes: int64(cfg.SkillsMaxRepoBytes),
+	})
+	return skillStore, nil
+}
+
+const (
+	droppedExcerptStart = "【因超出存储上限移除的较早消息摘录】"
+	droppedExcerptEnd   = "【摘录结束】"
+	// droppedExcerptRunes bounds the whole excerpt; the newest lines win.
+	droppedExcerptRunes = 2000
+	droppedLineRunes    = 160
+)
+
+// foldDroppedMessages appends a truncated "role: content" excerpt of dropped
+// to summary without calling the model, since it runs under the
+// conversation lock. The excerpt from an earlier trim is merged into the new
+// one rather than stacked, so the summary stays bounded.
+func foldDroppedMessages(summary string, dropped []conversation.Message) string {
+	var lines []string
+	if start := strings.Index(summary, droppedExcerptStart); start >= 0 {
+		if end := strings.Index(summary[start:], droppedExcerptEnd); end >= 0 {
+			end += start
+			body := strings.TrimSpace(summary[start+len(droppedExcerptStart) : end])
+			if body != "" {
+				lines = strings.Split(body, "\n")
+			}
+			summary = strings.TrimSpace(summary[:start]) + "\n\n" + strings.TrimSpace(summary[end+len(droppedExcerptEnd):])
+		}
+	}
+	for _, msg := range dropped {
+		content := strings.Join(strings.Fields(msg.Content), " ")
+		if content == "" {
+			continue
+		}
+		if runes := []rune(content); len(runes) > droppedLineRunes {
+			content = string(runes[:droppedLineRunes]) + "…"
+		}
+		lines = append(lines, msg.Role+": "+content)
+	}
+
+	total := 0
+	first := len(lines)
+	for first > 0 {
+		n := utf8.RuneCountInString(lines[first-1]) + 1
+		if total+n > droppedExcerptRunes {
+			break
+		}
+		total += n
+		first--
+	}
+	lines = lines[first:]
+	summary = strings.TrimSpace(summary)
+	if len(lines) == 0 {
+		return summary
+	}
+	excerpt := droppedExcerptStart + "\n" + strings.Join(lines, "\n") + "\n" + droppedExcerptEnd
+	return strings.TrimSpace(summary + "\n\n" + excerpt)
+}
+
+// migrateLegacySkills moves the skills older versions kept in the settings
+// file into the skills store, then drops them from the settings file. A skill
+// whose ID already exists in the skills store keeps the skills-store version.
+// Failures are logged and never stop startup; the settings file keeps its
+// skills until every one of them has moved, so a later start retries.
+func migrateLegacySkills(logger *slog.Logger, mcpStore *mcp.Store, skillStore *skills.Store) int {
+	legacy := mcpStore.LegacySkills()
+	if len(legacy) == 0 {
+		return 0
+	}
+	existing := make(map[string]struct{})
+	for _, skill := range skillStore.ListSkills() {
+		existing[skill.ID] = struct{}{}
+	}
+	migrated, failed := 0, 0
+	for _, item := range legacy {
+		if _, ok := existing[item.ID]; ok {
+			continue
+		}
+		// Legacy skills predate the length limits, so they are imported
+		// without them rather than rejected.
+		err := skillStore.ImportSkill(skills.Skill{
+			ID:          item.ID,
+			Name:        item.Name,
+			Description: item.Description,
+			Prompt:      item.Prompt,
+			Enabled:     item.Enabled,
+		})
+		if err != nil {
+			logger.Warn("migrate settings-file skill failed; skipped", "skill", item.ID, "error", err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+	if failed > 0 {
+		return migrated
+	}
+	if err := mcpStore.ClearLegacySkills(); err != nil {
+		logger.Warn("clear migrated settings-file skills failed", "error", err)
+	}
+	return migrated
+}
+
+// newSecretRedactor masks the LLM API key and every MCP service auth token;
+// tokens are read from the settings store on each use so edits apply at once.
+func newSecretRedactor(cfg config.Config, mcpStore *mcp.Store) *redact.Redactor {
+	return redact.New(func() []string {
+		secrets := []string{cfg.CerberAPIKey}
+		for _, service := range mcpStore.ListServices() {
+			secrets = append(secrets, service.AuthToken)
+		}
+		return secrets
+	})
+}
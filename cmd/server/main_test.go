@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"laughing-barnacle/internal/agent"
+	"laughing-barnacle/internal/config"
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/mcp"
+	"laughing-barnacle/internal/skills"
+	"laughing-barnacle/internal/web"
+)
+
+func TestNewSkillStore_AgentAndSettingsShareOneStore(t *testing.T) {
+	t.Setenv("CERBER_API_KEY", "test-key")
+	t.Setenv("APP_DATA_DIR", t.TempDir())
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	skillStore, err := newSkillStore(cfg)
+	if err != nil {
+		t.Fatalf("newSkillStore error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.SkillsDir, "skills-config-maintainer", "SKILL.md")); err != nil {
+		t.Fatalf("expected builtin skill under APP_SKILLS_DIR: %v", err)
+	}
+
+	agentSvc := agent.New(agent.Config{Model: "test-model", SystemPrompt: "system", CompressionSystemPrompt: "compressor"}, conversation.NewStore(), nil, nil)
+	agentSvc.SetSkillProvider(skillStore)
+	srv, err := web.NewServer(agentSvc, conversation.NewStore(), llmlog.NewStore(10), nil, nil, skillStore)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/skills", nil))
+	var payload struct {
+		Skills []struct {
+			ID      string `json:"id"`
+			Enabled bool   `json:"enabled"`
+		} `json:"skills"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode /api/skills: %v (%s)", err, rec.Body.String())
+	}
+
+	index := strings.Join(skillStore.ListEnabledSkillIndex(), "\n")
+	for _, item := range payload.Skills {
+		if item.Enabled && !strings.Contains(index, "skill_id="+item.ID+" ") {
+			t.Fatalf("settings lists enabled skill %q that the agent index lacks:\n%s", item.ID, index)
+		}
+	}
+	if len(payload.Skills) == 0 {
+		t.Fatalf("expected builtin skills from the shared store")
+	}
+}
+
+func TestMigrateLegacySkills_MovesSettingsSkillsIntoSkillsDir(t *testing.T) {
+	root := t.TempDir()
+	settingsPath := filepath.Join(root, "settings.json")
+	settings := `{"skills":{"items":[
+		{"id":"research","name":"Research","prompt":"先检索再回答。","enabled":true},
+		{"id":"skills-config-maintainer","name":"stale copy","prompt":"stale-legacy-prompt","enabled":true}
+	]}}`
+	if err := os.WriteFile(settingsPath, []byte(settings), 0o600); err != nil {
+		t.Fatalf("write settings: %v", err)
+	}
+	mcpStore, err := mcp.NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("mcp.NewStore error: %v", err)
+	}
+	skillStore, err := skills.NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("skills.NewStore error: %v", err)
+	}
+
+	n := migrateLegacySkills(slog.New(slog.NewTextHandler(io.Discard, nil)), mcpStore, skillStore)
+	if n != 1 {
+		t.Fatalf("expected 1 migrated skill, got %d", n)
+	}
+	prompt, ok := skillStore.ReadEnabledSkillPrompt("research")
+	if !ok || !strings.Contains(prompt, "先检索再回答。") {
+		t.Fatalf("expected migrated skill to be enabled in the skills store, got %q", prompt)
+	}
+	if prompt, _ := skillStore.ReadEnabledSkillPrompt("skills-config-maintainer"); strings.Contains(prompt, "stale-legacy-prompt") {
+		t.Fatalf("expected existing skill to win over the legacy copy")
+	}
+	if len(mcpStore.LegacySkills()) != 0 {
+		t.Fatalf("expected legacy skills cleared")
+	}
+	reopened, err := mcp.NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("reopen settings: %v", err)
+	}
+	if len(reopened.LegacySkills()) != 0 {
+		t.Fatalf("expected cleared skills to stay cleared after reload")
+	}
+}
+
+func TestMigrateLegacySkills_ImportsSkillsOverTheManualSaveLimits(t *testing.T) {
+	root := t.TempDir()
+	settingsPath := filepath.Join(root, "settings.json")
+	longPrompt := strings.Repeat("长", skills.DefaultSkillLimits().MaxPromptRunes+100)
+	longName := strings.Repeat("n", skills.DefaultSkillLimits().MaxNameRunes+10)
+	settings, err := json.Marshal(map[string]any{"skills": map[string]any{"items": []map[string]any{
+		{"id": "huge", "name": longName, "prompt": longPrompt, "enabled": true},
+	}}})
+	if err != nil {
+		t.Fatalf("marshal settings: %v", err)
+	}
+	if err := os.WriteFile(settingsPath, settings, 0o600); err != nil {
+		t.Fatalf("write settings: %v", err)
+	}
+	mcpStore, err := mcp.NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("mcp.NewStore error: %v", err)
+	}
+	skillStore, err := skills.NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("skills.NewStore error: %v", err)
+	}
+
+	if n := migrateLegacySkills(slog.New(slog.NewTextHandler(io.Discard, nil)), mcpStore, skillStore); n != 1 {
+		t.Fatalf("expected the over-limit skill to migrate, got %d", n)
+	}
+	prompt, ok := skillStore.ReadEnabledSkillPrompt("huge")
+	if !ok || !strings.Contains(prompt, longPrompt) {
+		t.Fatalf("expected the full legacy prompt in the skills store")
+	}
+	if len(mcpStore.LegacySkills()) != 0 {
+		t.Fatalf("expected legacy skills cleared")
+	}
+}
+
+func TestFoldDroppedMessages_KeepsContentAndReplacesEarlierExcerpt(t *testing.T) {
+	summary := foldDroppedMessages("已有摘要", []conversation.Message{
+		{Role: "user", Content: "帮我记下\n周五开会"},
+		{Role: "assistant", Content: strings.Repeat("长", droppedLineRunes+10)},
+	})
+	if !strings.HasPrefix(summary, "已有摘要") || !strings.Contains(summary, "user: 帮我记下 周五开会") {
+		t.Fatalf("expected dropped content folded into the summary, got %q", summary)
+	}
+	if !strings.Contains(summary, "assistant: "+strings.Repeat("长", droppedLineRunes)+"…") {
+		t.Fatalf("expected long messages truncated, got %q", summary)
+	}
+
+	summary = foldDroppedMessages(summary, []conversation.Message{{Role: "user", Content: "第二批"}})
+	if strings.Count(summary, droppedExcerptStart) != 1 || strings.Count(summary, droppedExcerptEnd) != 1 {
+		t.Fatalf("expected one merged excerpt, got %q", summary)
+	}
+	if !strings.Contains(summary, "帮我记下") || !strings.HasSuffix(summary, "user: 第二批\n"+droppedExcerptEnd) {
+		t.Fatalf("expected earlier and new lines in order, got %q", summary)
+	}
+
+	for i := 0; i < 100; i++ {
+		summary = foldDroppedMessages(summary, []conversation.Message{{Role: "user", Content: strings.Repeat("字", 100)}})
+	}
+	if n := len([]rune(summary)); n > len([]rune("已有摘要"))+droppedExcerptRunes+100 {
+		t.Fatalf("expected the excerpt to stay within its budget, got %d runes", n)
+	}
+	if !strings.HasPrefix(summary, "已有摘要") {
+		t.Fatalf("expected the compressed summary kept, got %q", summary[:40])
+	}
+}
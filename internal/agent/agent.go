@@ -6,20 +6,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"laughing-barnacle/internal/conversation"
 	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/metrics"
+	"laughing-barnacle/internal/redact"
 )
 
 type Config struct {
 	Model                      string
+	FallbackModel              string
 	Temperature                float64
 	MaxRecentMessages          int
 	CompressionTriggerMessages int
@@ -27,9 +34,110 @@ type Config struct {
 	KeepRecentAfterCompression int
 	MaxCompressionLoopsPerTurn int
 	MaxToolCallRounds          int
+	MaxTurnDuration            time.Duration
 	SystemPrompt               string
 	CompressionSystemPrompt    string
 	EnforceHumanRoutine        bool
+	SkipMorningPlanForUrgent   bool
+	// MaxContextTokens forces compression when the estimated reply prompt
+	// exceeds ContextTokenRatio (default 0.8) of it; 0 disables the guard.
+	MaxContextTokens  int
+	ContextTokenRatio float64
+	// PersonaName must survive prompt evolution; empty derives it from the
+	// current system prompt ("名字叫“X”"). ForbidEmoji additionally requires
+	// the evolved prompt to keep its no-emoji rule and contain no emoji.
+	PersonaName string
+	ForbidEmoji bool
+	// SystemPromptPrefix and SystemPromptSuffix wrap the resolved system
+	// prompt of every reply request. They are never shown to prompt
+	// evolution, so operational rules placed here cannot be rewritten.
+	SystemPromptPrefix string
+	SystemPromptSuffix string
+	// Purposes overrides model/temperature per request purpose
+	// (chat_reply, compress_context, morning_planning, night_reflection_evolution).
+	Purposes map[string]PurposeConfig
+	// Timezone is the IANA zone used for the sleep window and per-day dedup
+	// dates; empty means the server's local zone.
+	Timezone string
+	// ToolRouting exposes only the external tool categories relevant to the
+	// latest user message (see ToolClassifier).
+	ToolRouting bool
+	// KeepRecentTurns, when > 0, keeps that many complete turns (a user
+	// message through its replies and tool output) after compression instead
+	// of KeepRecentAfterCompression messages.
+	KeepRecentTurns int
+	// NightReflectionLookback and MorningPlanLookback bound how many recent
+	// messages the reflection and planning prompts include (default 20).
+	NightReflectionLookback int
+	MorningPlanLookback     int
+	// MessageTimestamps prefixes recent messages with their relative age
+	// ("[3小时前]") in reply requests.
+	MessageTimestamps          bool
+	SuppressBuiltinToolsNotice bool
+	// DisabledBuiltinTools hides the named builtin tools (e.g. "linux__bash",
+	// "skills__catalog_search") from the model and rejects calls to them; the
+	// builtin tools notice lists only the ones left.
+	DisabledBuiltinTools []string
+	// BashJSONOutput makes linux__bash return a JSON object (exit_code,
+	// stdout, stderr, timed_out, ...) instead of labelled text. The rune caps
+	// apply per stream in both formats; zero uses 4000/2000.
+	BashJSONOutput     bool
+	BashMaxStdoutRunes int
+	BashMaxStderrRunes int
+	// BashShell replaces the default bash-then-sh lookup; when it is not
+	// found the default lookup is used. BashShellArgs precede the command
+	// (default "-lc", or "-c" when BashNoLogin skips login profile files).
+	BashShell     string
+	BashShellArgs []string
+	BashNoLogin   bool
+	// BashWorkDirRoot confines linux__bash to this directory tree: it is the
+	// default working_dir, relative paths resolve against it and anything
+	// outside (after following symlinks) is rejected.
+	BashWorkDirRoot string
+	// Skill injection caps; zero values fall back to the package defaults.
+	MaxInjectedSkillPrompts     int
+	MaxInjectedSkillPromptRunes int
+	MaxSingleSkillPromptRunes   int
+	// MaxInjectedAutoSkillPrompts caps auto-evolved skills per turn; 0 means no separate cap.
+	MaxInjectedAutoSkillPrompts int
+	// MaxToolResultsRunes bounds the tool results carried through one tool
+	// loop: once exceeded, the oldest results are elided (their tool messages
+	// stay, so every call keeps its result) while the latest round is always
+	// kept whole. 0 disables the bound.
+	MaxToolResultsRunes int
+	// Metrics receives turn, tool call and compression counts; nil disables them.
+	Metrics *metrics.Metrics
+	// Redactor masks secrets in tool results before they are persisted or
+	// sent back to the model; nil keeps results verbatim.
+	Redactor *redact.Redactor
+	// NoToolsPrefix, when set, marks messages starting with it (case
+	// insensitive) as pure chat: the prefix is stripped and the reply is
+	// generated without builtin or MCP tools.
+	NoToolsPrefix string
+	// TurnTraceLimit is how many turn traces are kept in memory (default 50).
+	TurnTraceLimit int
+	// MaxPendingTurns bounds how many turns may wait behind the running one;
+	// further turns fail with ErrAgentBusy. 0 means no bound.
+	MaxPendingTurns int
+	// CompressionUserTemplate, MorningPlanUserTemplate and
+	// NightReflectionUserTemplate replace the user prompts of those calls;
+	// empty uses the agentprompt defaults, which list the placeholders.
+	CompressionUserTemplate     string
+	MorningPlanUserTemplate     string
+	NightReflectionUserTemplate string
+	// CompressionTemperature, MorningPlanTemperature and
+	// NightReflectionTemperature set the temperature of those calls; nil
+	// keeps 0, 0.2 and 0.1. A Purposes temperature still takes precedence.
+	CompressionTemperature     *float64
+	MorningPlanTemperature     *float64
+	NightReflectionTemperature *float64
+}
+
+// PurposeConfig overrides the global model and the call's temperature for
+// one request purpose. Empty/nil fields keep the defaults.
+type PurposeConfig struct {
+	Model       string
+	Temperature *float64
 }
 
 type ToolProvider interface {
@@ -37,14 +145,127 @@ type ToolProvider interface {
 	CallTool(ctx context.Context, call llm.ToolCall) (string, error)
 }
 
+// ToolUsageRecorder is implemented by tool providers that keep per-tool usage
+// statistics; linux__bash calls are reported to it as well.
+type ToolUsageRecorder interface {
+	RecordToolCall(name string, latency time.Duration, err error)
+}
+
 type SkillProvider interface {
 	ListEnabledSkillPrompts() []string
+	// ListEnabledAutoSkillPrompts is the subset written by night evolution.
+	ListEnabledAutoSkillPrompts() []string
+	// ListEnabledSkillTags maps tagged prompts to their tags.
+	ListEnabledSkillTags() map[string][]string
+	// ListEnabledSkillPriorities maps prompts with a non-zero priority to it.
+	ListEnabledSkillPriorities() map[string]int
+	// ListEnabledSkillIndex returns one line per enabled skill with its ID,
+	// name and a brief, injected so the model can pick skills to read.
+	ListEnabledSkillIndex() []string
+	// ReadEnabledSkillPrompt returns the full SKILL.md of an enabled skill,
+	// looked up by ID or, when unambiguous, by name.
+	ReadEnabledSkillPrompt(skillID string) (string, bool)
 }
 
 type AutoSkillWriter interface {
 	UpsertAutoSkill(name, prompt string) error
 }
 
+// SkillInjectionLimits bounds how many skill prompts (and runes) one turn may inject.
+// When MaxAutoPrompts > 0, prompts reported by IsAuto may take at most that many
+// slots so auto-evolved skills cannot crowd out manual ones. TagsOf, when set,
+// lets ranking boost skills tagged with the turn's inferred task category.
+// PriorityOf, when set, breaks relevance ties in favor of higher priorities.
+type SkillInjectionLimits struct {
+	MaxPrompts     int
+	MaxTotalRunes  int
+	MaxSingleRunes int
+	MaxAutoPrompts int
+	IsAuto         func(prompt string) bool
+	TagsOf         func(prompt string) []string
+	PriorityOf     func(prompt string) int
+}
+
+func defaultSkillInjectionLimits() SkillInjectionLimits {
+	return SkillInjectionLimits{
+		MaxPrompts:     maxInjectedSkillPrompts,
+		MaxTotalRunes:  maxInjectedSkillPromptRunes,
+		MaxSingleRunes: maxSingleSkillPromptRunes,
+	}
+}
+
+func (a *Agent) skillInjectionLimits() SkillInjectionLimits {
+	limits := defaultSkillInjectionLimits()
+	if a.cfg.MaxInjectedSkillPrompts > 0 {
+		limits.MaxPrompts = a.cfg.MaxInjectedSkillPrompts
+	}
+	if a.cfg.MaxInjectedSkillPromptRunes > 0 {
+		limits.MaxTotalRunes = a.cfg.MaxInjectedSkillPromptRunes
+	}
+	if a.cfg.MaxSingleSkillPromptRunes > 0 {
+		limits.MaxSingleRunes = a.cfg.MaxSingleSkillPromptRunes
+	}
+	limits.MaxAutoPrompts = a.cfg.MaxInjectedAutoSkillPrompts
+	return limits
+}
+
+// enabledSkillPrompts returns the enabled prompts of skills and the
+// injection limits annotated with their auto, tag and priority metadata.
+func (a *Agent) enabledSkillPrompts(skills SkillProvider) ([]string, SkillInjectionLimits) {
+	limits := a.skillInjectionLimits().
+		withAutoSkills(skills.ListEnabledAutoSkillPrompts()).
+		withSkillTags(skills.ListEnabledSkillTags()).
+		withSkillPriorities(skills.ListEnabledSkillPriorities())
+	return skills.ListEnabledSkillPrompts(), limits
+}
+
+// withSkillTags attaches tags keyed by raw prompt, normalized like injected prompts.
+func (l SkillInjectionLimits) withSkillTags(tagsByPrompt map[string][]string) SkillInjectionLimits {
+	if len(tagsByPrompt) == 0 {
+		return l
+	}
+	tags := make(map[string][]string, len(tagsByPrompt))
+	for prompt, promptTags := range tagsByPrompt {
+		tags[trimRunes(strings.TrimSpace(prompt), l.MaxSingleRunes)] = promptTags
+	}
+	l.TagsOf = func(prompt string) []string {
+		return tags[prompt]
+	}
+	return l
+}
+
+// withSkillPriorities attaches priorities keyed by raw prompt, normalized like injected prompts.
+func (l SkillInjectionLimits) withSkillPriorities(priorityByPrompt map[string]int) SkillInjectionLimits {
+	if len(priorityByPrompt) == 0 {
+		return l
+	}
+	priorities := make(map[string]int, len(priorityByPrompt))
+	for prompt, priority := range priorityByPrompt {
+		priorities[trimRunes(strings.TrimSpace(prompt), l.MaxSingleRunes)] = priority
+	}
+	l.PriorityOf = func(prompt string) int {
+		return priorities[prompt]
+	}
+	return l
+}
+
+// withAutoSkills marks autoPrompts (normalized the same way as injected prompts)
+// as auto-evolved for the quota check.
+func (l SkillInjectionLimits) withAutoSkills(autoPrompts []string) SkillInjectionLimits {
+	if len(autoPrompts) == 0 {
+		return l
+	}
+	auto := make(map[string]struct{}, len(autoPrompts))
+	for _, prompt := range normalizeSkillPrompts(autoPrompts, l.MaxSingleRunes) {
+		auto[prompt] = struct{}{}
+	}
+	l.IsAuto = func(prompt string) bool {
+		_, ok := auto[prompt]
+		return ok
+	}
+	return l
+}
+
 type evolvedSkill struct {
 	Name   string
 	Prompt string
@@ -85,26 +306,104 @@ type HabitProvider interface {
 }
 
 type Agent struct {
-	cfg     Config
-	llm     llm.Client
-	tools   ToolProvider
-	skills  SkillProvider
-	prompts PromptProvider
-	updater PromptUpdater
-	habits  HabitProvider
-	store   *conversation.Store
-	nowFn   func() time.Time
-	mu      sync.Mutex
+	cfg       Config
+	llm       llm.Client
+	tools     ToolProvider
+	skills    SkillProvider
+	prompts   PromptProvider
+	updater   PromptUpdater
+	habits    HabitProvider
+	events    *eventDispatcher
+	skillSel  SkillSelector
+	toolClass ToolClassifier
+	templates PromptTemplateProvider
+	catalog   SkillCatalog
+	store     *conversation.Store
+	nowFn     func() time.Time
+	loc       *time.Location
+	logger    *slog.Logger
+	traces    *traceStore
+	trace     *TurnTrace // current turn, owned by the gate holder
+	// gate serializes turns on the single conversation. A turn holds mu
+	// only for reading, so accessors such as GetEffectivePrompts are not
+	// held up by its LLM and tool calls; setters take mu for writing.
+	gate *turnGate
+	mu   sync.RWMutex
 }
 
 func New(cfg Config, store *conversation.Store, llmClient llm.Client, tools ToolProvider) *Agent {
+	loc := time.Local
+	if name := strings.TrimSpace(cfg.Timezone); name != "" {
+		if loaded, err := time.LoadLocation(name); err == nil {
+			loc = loaded
+		}
+	}
 	return &Agent{
-		cfg:   cfg,
-		llm:   llmClient,
-		tools: tools,
-		store: store,
-		nowFn: time.Now,
+		cfg:    cfg,
+		llm:    llmClient,
+		tools:  tools,
+		store:  store,
+		nowFn:  time.Now,
+		loc:    loc,
+		logger: slog.Default(),
+		traces: newTraceStore(cfg.TurnTraceLimit),
+		gate:   newTurnGate(cfg.MaxPendingTurns),
+	}
+}
+
+// SetLogger routes the agent's warnings (ignored persistence and tool-list
+// failures) to logger; nil restores slog.Default().
+func (a *Agent) SetLogger(logger *slog.Logger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if logger == nil {
+		logger = slog.Default()
+	}
+	a.logger = logger
+}
+
+// warnIfErr logs a non-fatal failure that must not abort the turn.
+func (a *Agent) warnIfErr(op string, err error) {
+	if err != nil {
+		a.logger.Warn(op+" failed", "error", err)
+	}
+}
+
+// chat applies the purpose override, tags req with the running turn's ID, sends it and retries once on the
+// fallback model when the failure is transient. The retry is logged under "<purpose>_fallback".
+func (a *Agent) chat(ctx context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	if override, ok := a.cfg.Purposes[req.Purpose]; ok {
+		if model := strings.TrimSpace(override.Model); model != "" {
+			req.Model = model
+		}
+		if override.Temperature != nil {
+			req.Temperature = *override.Temperature
+		}
+	}
+	if req.TurnID == "" && a.trace != nil {
+		req.TurnID = a.trace.ID
+	}
+	resp, err := a.llm.Chat(ctx, req)
+	fallback := strings.TrimSpace(a.cfg.FallbackModel)
+	if err == nil || fallback == "" || fallback == req.Model || !llm.IsRetryable(err) || ctx.Err() != nil {
+		return resp, err
+	}
+	req.Model = fallback
+	req.Purpose += "_fallback"
+	fallbackResp, fallbackErr := a.llm.Chat(ctx, req)
+	if fallbackErr != nil {
+		return llm.ChatResponse{}, fmt.Errorf("%w (fallback model %s: %v)", err, fallback, fallbackErr)
 	}
+	return fallbackResp, nil
+}
+
+// localNow is the current time in the configured timezone; routine windows
+// and dedup dates are always computed from it.
+func (a *Agent) localNow() time.Time {
+	if a.loc == nil {
+		return a.nowFn()
+	}
+	return a.nowFn().In(a.loc)
 }
 
 func (a *Agent) SetSkillProvider(provider SkillProvider) {
@@ -132,66 +431,108 @@ func (a *Agent) SetHabitProvider(provider HabitProvider) {
 }
 
 func (a *Agent) GetEffectivePrompts() (systemPrompt string, compressionSystemPrompt string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	return a.resolvePromptsLocked()
 }
 
+// RunScheduledHumanRoutine runs the routine work due now (night reflection,
+// morning plan, deferred replies) as a turn: it waits for the running turn
+// like any other, and a tick finding too many turns pending is skipped.
 func (a *Agent) RunScheduledHumanRoutine(ctx context.Context) error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	release, err := a.gate.acquire(ctx)
+	if errors.Is(err, ErrAgentBusy) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 
-	if !a.cfg.EnforceHumanRoutine || a.habits == nil {
+	if !a.cfg.EnforceHumanRoutine {
 		return nil
 	}
 
-	now := a.nowFn()
+	now := a.localNow()
 	if isSleepWindow(now) {
 		reflection := strings.TrimSpace(a.runNightReflectionAndEvolution(ctx, now))
 		if reflection != "" {
-			a.store.Append("assistant", "【夜间复盘（自动）】\n"+reflection)
+			if err := a.store.Append("assistant", "【夜间复盘（自动）】\n"+reflection); err != nil {
+				return fmt.Errorf("persist night reflection: %w", err)
+			}
 		}
 		return nil
 	}
 
 	plan := strings.TrimSpace(a.runMorningPlanning(ctx, now))
 	if plan != "" {
-		a.store.Append("assistant", "【晨间规划（自动）】\n"+plan)
+		if err := a.store.Append("assistant", "【晨间规划（自动）】\n"+plan); err != nil {
+			return fmt.Errorf("persist morning plan: %w", err)
+		}
 	}
+	a.answerDeferredLocked(ctx, now)
 	return nil
 }
 
 // HandleUserMessage processes one user turn, updating shared conversation state.
-func (a *Agent) HandleUserMessage(ctx context.Context, userInput string) (string, error) {
-	text := strings.TrimSpace(userInput)
+func (a *Agent) HandleUserMessage(ctx context.Context, userInput string) (reply string, err error) {
+	text, noTools := a.stripNoToolsPrefix(strings.TrimSpace(userInput))
 	if text == "" {
 		return "", fmt.Errorf("empty input")
 	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	release, err := a.gate.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.beginTrace(text, false)
+	defer func() {
+		a.endTrace(reply, err)
+		a.cfg.Metrics.IncTurn(err)
+	}()
 
-	a.store.Append("user", text)
-	now := a.nowFn()
+	ctx, cancel := a.withTurnDeadline(ctx)
+	defer cancel()
+
+	now := a.localNow()
 	if a.cfg.EnforceHumanRoutine && shouldEnforceSleepReply(text, now) {
+		if err := a.store.AppendMessage(conversation.Message{Role: "user", Content: text, Deferred: true, NoTools: noTools}); err != nil {
+			return "", fmt.Errorf("persist user message: %w", err)
+		}
+		phaseStart := time.Now()
 		reflection := strings.TrimSpace(a.runNightReflectionAndEvolution(ctx, now))
-		reply := sleepWindowReply()
+		a.trace.phase("night_reflection", phaseStart)
+		reply := sleepWindowReply(a.store.DeferredCount())
 		if reflection != "" {
 			reply = "【夜间复盘】\n" + reflection + "\n\n" + reply
 		}
-		a.store.Append("assistant", reply)
-		return reply, nil
+		return a.appendReply(reply, nil)
+	}
+	if err := a.store.AppendMessage(conversation.Message{Role: "user", Content: text, NoTools: noTools}); err != nil {
+		return "", fmt.Errorf("persist user message: %w", err)
 	}
-	morningPlan := strings.TrimSpace(a.runMorningPlanning(ctx, now))
+	phaseStart := time.Now()
+	morningPlan := a.morningPlanForMessage(ctx, text, now)
+	a.trace.phase("morning_plan", phaseStart)
 
+	phaseStart = time.Now()
 	if err := a.autonomousCompressionLoop(ctx); err != nil {
 		return "", err
 	}
+	a.trace.phase("compression", phaseStart)
 
 	_, messages := a.store.Snapshot()
-	reply, toolCalls, err := a.generateReply(ctx, messages)
-	_ = a.store.SetLatestUserToolCalls(toolCalls)
+	phaseStart = time.Now()
+	reply, toolCalls, err := a.generateReply(ctx, messages, nil)
+	a.trace.phase("reply", phaseStart)
 	if err != nil {
+		// No reply to attach to; keep the executed calls on the pending user message.
+		a.warnIfErr("record tool calls", a.store.SetLatestUserToolCalls(toolCalls))
 		return "", err
 	}
 
@@ -199,44 +540,71 @@ func (a *Agent) HandleUserMessage(ctx context.Context, userInput string) (string
 	if morningPlan != "" {
 		reply = strings.TrimSpace("【晨间规划】\n" + morningPlan + "\n\n" + reply)
 	}
-	a.store.Append("assistant", reply)
-	return reply, nil
+	return a.appendReply(reply, toolCalls)
 }
 
 // RetryLastUserMessage retries generating assistant output for the latest pending user message.
-func (a *Agent) RetryLastUserMessage(ctx context.Context) (string, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+func (a *Agent) RetryLastUserMessage(ctx context.Context) (reply string, err error) {
+	release, err := a.gate.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.beginTrace("", true)
+	defer func() {
+		a.endTrace(reply, err)
+		a.cfg.Metrics.IncTurn(err)
+	}()
+
+	ctx, cancel := a.withTurnDeadline(ctx)
+	defer cancel()
 
 	_, messages := a.store.Snapshot()
 	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
 		return "", fmt.Errorf("no pending user message to retry")
 	}
 	pendingUserMessage := messages[len(messages)-1].Content
-	now := a.nowFn()
+	a.trace.Input = pendingUserMessage
+	now := a.localNow()
 	if a.cfg.EnforceHumanRoutine && shouldEnforceSleepReply(pendingUserMessage, now) {
+		if err := a.store.DeferLatestUserMessage(); err != nil {
+			return "", fmt.Errorf("defer user message: %w", err)
+		}
+		phaseStart := time.Now()
 		reflection := strings.TrimSpace(a.runNightReflectionAndEvolution(ctx, now))
-		reply := sleepWindowReply()
+		a.trace.phase("night_reflection", phaseStart)
+		reply := sleepWindowReply(a.store.DeferredCount())
 		if reflection != "" {
 			reply = "【夜间复盘】\n" + reflection + "\n\n" + reply
 		}
-		a.store.Append("assistant", reply)
-		return reply, nil
+		return a.appendReply(reply, nil)
 	}
-	morningPlan := strings.TrimSpace(a.runMorningPlanning(ctx, now))
+	phaseStart := time.Now()
+	morningPlan := a.morningPlanForMessage(ctx, pendingUserMessage, now)
+	a.trace.phase("morning_plan", phaseStart)
 
+	phaseStart = time.Now()
 	if err := a.autonomousCompressionLoop(ctx); err != nil {
 		return "", err
 	}
+	a.trace.phase("compression", phaseStart)
 
 	_, messages = a.store.Snapshot()
 	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
 		return "", fmt.Errorf("no pending user message to retry")
 	}
 
-	reply, toolCalls, err := a.generateReply(ctx, messages)
-	_ = a.store.SetLatestUserToolCalls(toolCalls)
+	replay := newToolReplay(messages[len(messages)-1].ToolCalls)
+	phaseStart = time.Now()
+	reply, toolCalls, err := a.generateReply(ctx, messages, replay)
+	a.trace.phase("reply", phaseStart)
 	if err != nil {
+		// Calls completed by an earlier attempt but not reached this time
+		// still happened; keep them for the next retry.
+		toolCalls = append(toolCalls, replay.remaining()...)
+		a.warnIfErr("record tool calls", a.store.SetLatestUserToolCalls(toolCalls))
 		return "", err
 	}
 
@@ -244,31 +612,121 @@ func (a *Agent) RetryLastUserMessage(ctx context.Context) (string, error) {
 	if morningPlan != "" {
 		reply = strings.TrimSpace("【晨间规划】\n" + morningPlan + "\n\n" + reply)
 	}
-	a.store.Append("assistant", reply)
+	return a.appendReply(reply, toolCalls)
+}
+
+// appendReply records and announces reply with the tool calls its turn
+// executed. A persistence failure is returned alongside the reply, which
+// stays visible in memory.
+func (a *Agent) appendReply(reply string, toolCalls []conversation.ToolCall) (string, error) {
+	err := a.store.Append("assistant", reply)
+	if err == nil && len(toolCalls) > 0 {
+		err = a.store.SetLatestToolCalls(toolCalls)
+	}
+	a.emitReply(reply)
+	if err != nil {
+		return reply, fmt.Errorf("persist reply: %w", err)
+	}
 	return reply, nil
 }
 
+// withTurnDeadline bounds a whole user turn (compression, tool loop, reply) by MaxTurnDuration.
+func (a *Agent) withTurnDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.cfg.MaxTurnDuration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, a.cfg.MaxTurnDuration)
+}
+
+func turnDeadlineError(ctx context.Context, executedCalls []conversation.ToolCall, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("turn deadline exceeded after %d completed tool calls: %w", len(executedCalls), err)
+}
+
 func (a *Agent) autonomousCompressionLoop(ctx context.Context) error {
+	overhead := 0
+	if a.contextTokenBudget() > 0 {
+		overhead = a.promptOverheadTokens(ctx)
+	}
 	for i := 0; i < a.cfg.MaxCompressionLoopsPerTurn; i++ {
 		summary, messages := a.store.Snapshot()
-		if !a.shouldCompress(summary, messages) {
+		if !a.shouldCompress(summary, messages, overhead) {
 			return nil
 		}
 
+		a.emitCompression(len(messages))
 		compressed, err := a.compressContext(ctx, summary, messages)
 		if err != nil {
 			return err
 		}
-		a.store.SetSummaryAndTrim(strings.TrimSpace(compressed), a.cfg.KeepRecentAfterCompression)
+		if err := a.applyCompression(strings.TrimSpace(compressed)); err != nil {
+			return fmt.Errorf("persist compressed context: %w", err)
+		}
+		a.trace.noteCompression()
 	}
 
 	return nil
 }
 
-func (a *Agent) shouldCompress(summary string, messages []conversation.Message) bool {
+// applyCompression stores summary and trims the history per the configured
+// keep mode.
+func (a *Agent) applyCompression(summary string) error {
+	a.cfg.Metrics.IncCompression()
+	if a.cfg.KeepRecentTurns > 0 {
+		return a.store.SetSummaryAndTrimTurns(summary, a.cfg.KeepRecentTurns)
+	}
+	return a.store.SetSummaryAndTrim(summary, a.cfg.KeepRecentAfterCompression)
+}
+
+// ErrSleepWindow is returned by RecompressNow during the sleep window of the
+// human routine unless force is set.
+var ErrSleepWindow = errors.New("sleep window: recompression skipped")
+
+// RecompressNow folds the current summary and messages into a fresh summary
+// regardless of the compression triggers, then trims as a triggered
+// compression would. It returns the new summary.
+func (a *Agent) RecompressNow(ctx context.Context, force bool) (string, error) {
+	release, err := a.gate.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !force && a.cfg.EnforceHumanRoutine && isSleepWindow(a.localNow()) {
+		return "", ErrSleepWindow
+	}
+
+	ctx, cancel := a.withTurnDeadline(ctx)
+	defer cancel()
+
+	summary, messages := a.store.Snapshot()
+	if strings.TrimSpace(summary) == "" && len(messages) == 0 {
+		return "", fmt.Errorf("conversation is empty")
+	}
+	a.emitCompression(len(messages))
+	compressed, err := a.compressContext(ctx, summary, messages)
+	if err != nil {
+		return "", err
+	}
+	compressed = strings.TrimSpace(compressed)
+	if err := a.applyCompression(compressed); err != nil {
+		return compressed, fmt.Errorf("persist compressed context: %w", err)
+	}
+	return compressed, nil
+}
+
+func (a *Agent) shouldCompress(summary string, messages []conversation.Message, overheadTokens int) bool {
 	if len(messages) >= a.cfg.CompressionTriggerMessages {
 		return true
 	}
+	if budget := a.contextTokenBudget(); budget > 0 &&
+		overheadTokens+estimateTokens(summary)+estimateMessageTokens(messages) >= budget {
+		return true
+	}
 	if a.cfg.CompressionTriggerChars <= 0 {
 		return false
 	}
@@ -282,26 +740,17 @@ func (a *Agent) shouldCompress(summary string, messages []conversation.Message)
 func (a *Agent) compressContext(ctx context.Context, summary string, messages []conversation.Message) (string, error) {
 	_, compressionSystemPrompt := a.resolvePromptsLocked()
 
-	prompt := strings.Builder{}
-	prompt.WriteString("当前历史摘要：\n")
-	if strings.TrimSpace(summary) == "" {
-		prompt.WriteString("(无)\n")
-	} else {
-		prompt.WriteString(summary)
-		prompt.WriteString("\n")
-	}
-	prompt.WriteString("\n最近对话：\n")
-	prompt.WriteString(renderConversation(messages))
-	prompt.WriteString("\n\n请输出新的合并摘要，包含：事实、约束、待办、用户偏好。")
-
-	resp, err := a.llm.Chat(ctx, llm.ChatRequest{
-		Purpose: "compress_context",
-		Model:   a.cfg.Model,
+	prompt := a.compressionUserPrompt(summary, renderConversation(messages))
+
+	resp, err := a.chat(ctx, llm.ChatRequest{
+		Purpose:    "compress_context",
+		Model:      a.cfg.Model,
+		ToolChoice: llm.ToolChoiceNone,
 		Messages: []llm.Message{
 			{Role: "system", Content: compressionSystemPrompt},
-			{Role: "user", Content: prompt.String()},
+			{Role: "user", Content: prompt},
 		},
-		Temperature: 0,
+		Temperature: temperatureOrDefault(a.cfg.CompressionTemperature, 0),
 	})
 	if err != nil {
 		return "", fmt.Errorf("compress context failed: %w", err)
@@ -309,23 +758,49 @@ func (a *Agent) compressContext(ctx context.Context, summary string, messages []
 	return resp.Content, nil
 }
 
-func (a *Agent) generateReply(ctx context.Context, messages []conversation.Message) (string, []conversation.ToolCall, error) {
+// generateReply runs the tool loop for the latest user message. Calls found in
+// replay are answered from their recorded results instead of executing again.
+func (a *Agent) generateReply(ctx context.Context, messages []conversation.Message, replay *toolReplay) (string, []conversation.ToolCall, error) {
 	summary, _ := a.store.Snapshot()
-	systemPrompt, _ := a.resolvePromptsLocked()
+	systemPrompt := a.replySystemPromptLocked()
 
 	requestMessages := make([]llm.Message, 0, 2+len(messages))
 	requestMessages = append(requestMessages, llm.Message{
 		Role:    "system",
 		Content: systemPrompt,
 	})
-	builtinToolDefs := []llm.ToolDefinition{linuxBashToolDefinition()}
-	requestMessages = append(requestMessages, llm.Message{
-		Role:    "system",
-		Content: "内置工具仅有 linux__bash（用于本机命令执行）；其他能力应通过已加载的 MCP 工具完成。",
+	// A message sent with the no-tools prefix gets no tool of any kind, so
+	// answering it cannot have side effects.
+	toolsOff := latestUserMessage(messages).NoTools
+	builtinToolDefs := make([]llm.ToolDefinition, 0, 5)
+	if !toolsOff {
+		builtinToolDefs = append(builtinToolDefs, linuxBashToolDefinition())
+	}
+	if def, ok := a.promptTemplateToolDefinition(ctx); ok && !toolsOff {
+		builtinToolDefs = append(builtinToolDefs, def)
+	}
+	if a.skills != nil && len(a.skills.ListEnabledSkillIndex()) > 0 && !toolsOff {
+		builtinToolDefs = append(builtinToolDefs, skillReadToolDefinition())
+		if def, ok := a.skillFileToolDefinition(); ok {
+			builtinToolDefs = append(builtinToolDefs, def)
+		}
+	}
+	if a.catalog != nil && !toolsOff {
+		builtinToolDefs = append(builtinToolDefs, skillCatalogToolDefinition())
+	}
+	builtinToolDefs = slices.DeleteFunc(builtinToolDefs, func(def llm.ToolDefinition) bool {
+		return !a.builtinToolEnabled(def.Function.Name)
 	})
+	if len(builtinToolDefs) > 0 && !a.cfg.SuppressBuiltinToolsNotice {
+		requestMessages = append(requestMessages, llm.Message{
+			Role:    "system",
+			Content: builtinToolsNotice(builtinToolDefs),
+		})
+	}
 	if a.skills != nil {
-		allSkillPrompts := a.skills.ListEnabledSkillPrompts()
-		skillPrompts := selectSkillPromptsForTurn(allSkillPrompts, summary, messages)
+		allSkillPrompts, limits := a.enabledSkillPrompts(a.skills)
+		skillPrompts := a.skillSelector().SelectSkillPrompts(ctx, allSkillPrompts, summary, messages, limits)
+		a.trace.setSkills(skillPrompts)
 		if len(skillPrompts) > 0 {
 			var b strings.Builder
 			b.WriteString("已启用技能（系统已按相关性和长度裁剪，按需遵循）：\n")
@@ -340,6 +815,12 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 				Content: strings.TrimSpace(b.String()),
 			})
 		}
+		if index := a.skillIndexMessage(); index != "" && !toolsOff {
+			requestMessages = append(requestMessages, llm.Message{
+				Role:    "system",
+				Content: index,
+			})
+		}
 	}
 	if strings.TrimSpace(summary) != "" {
 		requestMessages = append(requestMessages, llm.Message{
@@ -352,24 +833,32 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 	if len(messages) > a.cfg.MaxRecentMessages {
 		start = len(messages) - a.cfg.MaxRecentMessages
 	}
+	now := a.nowFn()
 	for _, msg := range messages[start:] {
+		content := msg.Content
+		if a.cfg.MessageTimestamps && !msg.CreatedAt.IsZero() {
+			content = "[" + relativeAge(now.Sub(msg.CreatedAt)) + "] " + content
+		}
 		requestMessages = append(requestMessages, llm.Message{
 			Role:    msg.Role,
-			Content: msg.Content,
+			Content: content,
 		})
 	}
 
 	toolDefs := make([]llm.ToolDefinition, 0, len(builtinToolDefs)+4)
 	toolDefs = append(toolDefs, builtinToolDefs...)
-	if a.tools != nil {
+	if a.tools != nil && !toolsOff {
 		externalDefs, err := a.tools.ListTools(ctx)
 		if err == nil {
-			toolDefs = append(toolDefs, externalDefs...)
+			toolDefs = append(toolDefs, a.routeExternalTools(ctx, lastUserInput(messages), externalDefs)...)
+		} else {
+			a.logger.Warn("list external tools failed; replying without them", "error", err)
 		}
 	}
 
 	if len(toolDefs) == 0 {
-		resp, err := a.llm.Chat(ctx, llm.ChatRequest{
+		a.trace.noteRound(1)
+		resp, err := a.chat(ctx, llm.ChatRequest{
 			Purpose:     "chat_reply",
 			Model:       a.cfg.Model,
 			Messages:    requestMessages,
@@ -388,7 +877,12 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 	executedCalls := make([]conversation.ToolCall, 0)
 
 	for i := 0; i < maxRounds; i++ {
-		resp, err := a.llm.Chat(ctx, llm.ChatRequest{
+		if err := ctx.Err(); err != nil {
+			return "", executedCalls, turnDeadlineError(ctx, executedCalls, fmt.Errorf("generate reply failed: %w", err))
+		}
+		a.emitRound(i + 1)
+		a.trace.noteRound(i + 1)
+		resp, err := a.chat(ctx, llm.ChatRequest{
 			Purpose:     "chat_reply",
 			Model:       a.cfg.Model,
 			Messages:    requestMessages,
@@ -396,13 +890,14 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 			Temperature: a.cfg.Temperature,
 		})
 		if err != nil {
-			return "", executedCalls, fmt.Errorf("generate reply failed: %w", err)
+			return "", executedCalls, turnDeadlineError(ctx, executedCalls, fmt.Errorf("generate reply failed: %w", err))
 		}
 
 		if len(resp.ToolCalls) == 0 {
 			return resp.Content, executedCalls, nil
 		}
 
+		roundStart := len(requestMessages)
 		requestMessages = append(requestMessages, llm.Message{
 			Role:      "assistant",
 			Content:   resp.Content,
@@ -410,10 +905,6 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 		})
 
 		for _, call := range resp.ToolCalls {
-			result, callErr := a.callTool(ctx, call)
-			if callErr != nil {
-				result = "tool execution error: " + callErr.Error()
-			}
 			callName := strings.TrimSpace(call.Function.Name)
 			if callName == "" {
 				callName = "(unknown)"
@@ -422,17 +913,35 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 			if callArgs == "" {
 				callArgs = "{}"
 			}
-			callRecord := conversation.ToolCall{
-				ID:        strings.TrimSpace(call.ID),
-				Name:      callName,
-				Arguments: callArgs,
-				Result:    strings.TrimSpace(result),
-				CreatedAt: a.nowFn(),
-			}
-			if callErr != nil {
-				callRecord.Error = callErr.Error()
+			var result string
+			var callRecord conversation.ToolCall
+			if recorded, ok := replay.take(callName, callArgs); ok {
+				a.logger.Info("replaying tool call completed by an earlier attempt", "tool", callName)
+				result = recorded.Result
+				callRecord = recorded
+				callRecord.ID = strings.TrimSpace(call.ID)
+			} else {
+				var callErr error
+				result, callErr = a.callTool(ctx, call)
+				a.cfg.Metrics.IncToolCall(callName, callErr)
+				if callErr != nil {
+					result = formatToolError(callErr)
+				}
+				result = a.cfg.Redactor.Redact(result)
+				callRecord = conversation.ToolCall{
+					ID:        strings.TrimSpace(call.ID),
+					Name:      callName,
+					Arguments: callArgs,
+					Result:    strings.TrimSpace(result),
+					CreatedAt: a.nowFn(),
+				}
+				if callErr != nil {
+					callRecord.Error = a.cfg.Redactor.Redact(callErr.Error())
+				}
 			}
 			executedCalls = append(executedCalls, callRecord)
+			a.emitToolCall(callRecord)
+			a.trace.noteToolCall(callRecord)
 
 			toolCallID := strings.TrimSpace(call.ID)
 			if toolCallID == "" {
@@ -444,42 +953,225 @@ func (a *Agent) generateReply(ctx context.Context, messages []conversation.Messa
 				Content:    result,
 			})
 		}
+		requestMessages = elideOldToolResults(requestMessages, roundStart, a.cfg.MaxToolResultsRunes)
 	}
 
 	return "", executedCalls, fmt.Errorf("tool call rounds exceeded %d", maxRounds)
 }
 
+const elidedToolResult = "（较早的工具结果已省略以控制上下文长度）"
+
+var elidedToolResultRunes = utf8.RuneCountInString(elidedToolResult)
+
+// elideOldToolResults replaces the content of the oldest tool results before
+// keepFrom with a placeholder until all tool results fit in maxRunes. The
+// messages themselves are kept so no tool call loses its result. messages is
+// copied before any change, since earlier requests may still share it.
+func elideOldToolResults(messages []llm.Message, keepFrom, maxRunes int) []llm.Message {
+	if maxRunes <= 0 {
+		return messages
+	}
+	total := 0
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			total += utf8.RuneCountInString(msg.Content)
+		}
+	}
+	copied := false
+	for i := 0; i < keepFrom && total > maxRunes; i++ {
+		msg := messages[i]
+		runes := utf8.RuneCountInString(msg.Content)
+		if msg.Role != "tool" || runes <= elidedToolResultRunes {
+			continue
+		}
+		if !copied {
+			messages = slices.Clone(messages)
+			copied = true
+		}
+		total -= runes - elidedToolResultRunes
+		messages[i].Content = elidedToolResult
+	}
+	return messages
+}
+
+const (
+	maxRenderedToolCalls     = 8
+	maxRenderedToolArgRunes  = 120
+	maxRenderedToolTextRunes = 160
+)
+
+func relativeAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "刚刚"
+	case d < time.Hour:
+		return fmt.Sprintf("%d分钟前", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%d小时前", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%d天前", int(d/(24*time.Hour)))
+	}
+}
+
 func renderConversation(messages []conversation.Message) string {
 	var b strings.Builder
 	for i, msg := range messages {
 		b.WriteString(fmt.Sprintf("%d. [%s] %s\n", i+1, msg.Role, msg.Content))
+		renderToolCalls(&b, msg.ToolCalls)
 	}
 	return b.String()
 }
 
+// renderToolCalls appends a bounded one-line-per-call view of the tools used
+// in a turn, so summaries can keep facts learned from tool results.
+func renderToolCalls(b *strings.Builder, calls []conversation.ToolCall) {
+	for i, call := range calls {
+		if i == maxRenderedToolCalls {
+			b.WriteString(fmt.Sprintf("   - (另有 %d 次工具调用省略)\n", len(calls)-i))
+			return
+		}
+		line := fmt.Sprintf("   - 工具 %s(%s)", call.Name, trimRunes(flattenLine(call.Arguments), maxRenderedToolArgRunes))
+		switch {
+		case strings.TrimSpace(call.Error) != "":
+			line += " 失败: " + trimRunes(flattenLine(call.Error), maxRenderedToolTextRunes)
+		case strings.TrimSpace(call.Result) != "":
+			line += " => " + trimRunes(flattenLine(call.Result), maxRenderedToolTextRunes)
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+// builtinToolsNotice names exactly the builtin tools sent with the request,
+// so the model is never told about tools it does not have.
+func builtinToolsNotice(defs []llm.ToolDefinition) string {
+	names := make([]string, 0, len(defs))
+	for _, def := range defs {
+		names = append(names, def.Function.Name)
+	}
+	return "内置工具仅有 " + strings.Join(names, "、") + "；其他能力应通过已加载的 MCP 工具完成。"
+}
+
+func flattenLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
 func (a *Agent) callTool(ctx context.Context, call llm.ToolCall) (string, error) {
 	if result, err, handled := a.callBuiltinTool(ctx, call); handled {
 		return result, err
 	}
 	if a.tools == nil {
-		return "", fmt.Errorf("unknown tool %q", strings.TrimSpace(call.Function.Name))
+		return "", fmt.Errorf("%w: unknown tool %q", llm.ErrToolUnavailable, strings.TrimSpace(call.Function.Name))
 	}
+	name := strings.TrimSpace(call.Function.Name)
+	ctx = llm.WithToolProgress(ctx, func(progress llm.ToolProgress) {
+		a.logger.Debug("tool progress", "tool", name, "progress", progress.Progress, "total", progress.Total, "message", progress.Message)
+		a.emitToolProgress(name, progress)
+	})
 	return a.tools.CallTool(ctx, call)
 }
 
+const (
+	toolErrorInvalidArgs     = "ERROR_INVALID_ARGS"
+	toolErrorToolUnavailable = "ERROR_TOOL_UNAVAILABLE"
+	toolErrorTimeout         = "ERROR_TIMEOUT"
+	toolErrorExecution       = "ERROR_EXECUTION"
+)
+
+// classifyToolError maps a tool failure to a category the model can act on:
+// fix arguments, pick another tool, retry later, or give up.
+func classifyToolError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return toolErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return toolErrorTimeout
+	}
+
+	switch {
+	case errors.Is(err, llm.ErrInvalidToolArgs):
+		return toolErrorInvalidArgs
+	case errors.Is(err, llm.ErrToolUnavailable):
+		return toolErrorToolUnavailable
+	default:
+		return toolErrorExecution
+	}
+}
+
+func formatToolError(err error) string {
+	category := classifyToolError(err)
+	hint := ""
+	switch category {
+	case toolErrorInvalidArgs:
+		hint = "fix the arguments according to the tool schema and retry"
+	case toolErrorToolUnavailable:
+		hint = "tool is unavailable; do not retry it in this turn, use another tool or answer directly"
+	case toolErrorTimeout:
+		hint = "tool timed out; retry at most once with a smaller request"
+	default:
+		hint = "tool ran but failed; inspect the message before retrying"
+	}
+	return fmt.Sprintf("%s: tool execution error: %s\nhint: %s", category, err.Error(), hint)
+}
+
+// callBuiltinTool runs call when it names a builtin tool; handled is false
+// otherwise. Disabled builtin tools are rejected here, so every tool in
+// builtinToolHandler honours DisabledBuiltinTools.
 func (a *Agent) callBuiltinTool(ctx context.Context, call llm.ToolCall) (result string, err error, handled bool) {
 	name := strings.TrimSpace(call.Function.Name)
+	run, ok := a.builtinToolHandler(name)
+	if !ok {
+		return "", nil, false
+	}
+	if !a.builtinToolEnabled(name) {
+		return "", fmt.Errorf("%w: builtin tool %s is disabled", llm.ErrToolUnavailable, name), true
+	}
+	out, err := run(ctx, call.Function.Arguments)
+	return out, err, true
+}
+
+// builtinToolHandler returns the function running the builtin tool name.
+func (a *Agent) builtinToolHandler(name string) (func(ctx context.Context, arguments string) (string, error), bool) {
 	switch name {
 	case builtinLinuxBashToolName:
-		req, err := parseLinuxBashArguments(call.Function.Arguments)
-		if err != nil {
-			return "", err, true
-		}
-		out, err := runLinuxBash(ctx, req)
-		return out, err, true
+		return a.callLinuxBashTool, true
+	case builtinMCPPromptToolName:
+		return a.callPromptTemplateTool, true
+	case builtinSkillReadToolName:
+		return func(_ context.Context, arguments string) (string, error) {
+			return a.callSkillReadTool(arguments)
+		}, true
+	case builtinSkillReadFileToolName:
+		return func(_ context.Context, arguments string) (string, error) {
+			return a.callSkillFileTool(arguments)
+		}, true
+	case builtinSkillCatalogToolName:
+		return a.callSkillCatalogTool, true
 	default:
-		return "", nil, false
+		return nil, false
+	}
+}
+
+func (a *Agent) callLinuxBashTool(ctx context.Context, arguments string) (string, error) {
+	req, err := parseLinuxBashArguments(arguments)
+	if err != nil {
+		return "", err
 	}
+	start := time.Now()
+	out, err := runLinuxBash(ctx, req, a.bashOptions())
+	if recorder, ok := a.tools.(ToolUsageRecorder); ok {
+		recorder.RecordToolCall(builtinLinuxBashToolName, time.Since(start), err)
+	}
+	return out, err
+}
+
+// builtinToolEnabled reports whether the builtin tool name may be offered to
+// and called by the model.
+func (a *Agent) builtinToolEnabled(name string) bool {
+	return !slices.Contains(a.cfg.DisabledBuiltinTools, name)
 }
 
 func (a *Agent) resolvePromptsLocked() (systemPrompt string, compressionSystemPrompt string) {
@@ -498,6 +1190,19 @@ func (a *Agent) resolvePromptsLocked() (systemPrompt string, compressionSystemPr
 	return systemPrompt, compressionSystemPrompt
 }
 
+// replySystemPromptLocked is the resolved system prompt wrapped in the fixed
+// prefix and suffix.
+func (a *Agent) replySystemPromptLocked() string {
+	systemPrompt, _ := a.resolvePromptsLocked()
+	parts := make([]string, 0, 3)
+	for _, part := range []string{a.cfg.SystemPromptPrefix, systemPrompt, a.cfg.SystemPromptSuffix} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
 func shouldEnforceSleepReply(userInput string, now time.Time) bool {
 	if !isSleepWindow(now) {
 		return false
@@ -530,8 +1235,10 @@ func isUrgentMessage(userInput string) bool {
 	return false
 }
 
-func sleepWindowReply() string {
-	return "当前是我的休息时段（00:30-08:30）。我已记录你的请求；若不是紧急事项，我会在醒来后优先处理。如有硬截止，请补充时间与优先级。"
+// sleepWindowReply acknowledges a deferred request; pending counts the
+// requests queued so far, this one included.
+func sleepWindowReply(pending int) string {
+	return fmt.Sprintf("当前是我的休息时段（00:30-08:30）。你的请求已加入待处理队列（目前共 %d 条），我会在醒来后按顺序逐条处理并回复。如有硬截止，请补充时间与优先级；紧急事项请注明“紧急”。", pending)
 }
 
 func (a *Agent) runNightReflectionAndEvolution(ctx context.Context, now time.Time) string {
@@ -546,20 +1253,20 @@ func (a *Agent) runNightReflectionAndEvolution(ctx context.Context, now time.Tim
 	summary, messages := a.store.Snapshot()
 	reflection, systemPrompt, compressionPrompt, evolvedSkills, err := a.generateNightReflectionPayload(ctx, summary, messages)
 	if err != nil {
-		_ = a.habits.SetLastSleepReviewDate(today)
+		a.warnIfErr("record sleep review date", a.habits.SetLastSleepReviewDate(today))
 		return "生活：已进入休息阶段并记录今日状态。\n工作：关键任务与风险已归档，明天继续推进。\n学习：延续每日学习节奏，明天聚焦一个短板。"
 	}
 
 	if strings.TrimSpace(systemPrompt) != "" &&
 		strings.TrimSpace(compressionPrompt) != "" &&
 		a.updater != nil &&
-		isValidEvolvedPrompt(systemPrompt, compressionPrompt) {
-		_ = a.updater.UpdateAgentPrompts(systemPrompt, compressionPrompt)
-		_ = a.habits.SetLastPromptEvolutionDate(today)
+		isValidEvolvedPrompt(systemPrompt, compressionPrompt, a.personaInvariantsLocked()) {
+		a.warnIfErr("update evolved prompts", a.updater.UpdateAgentPrompts(systemPrompt, compressionPrompt))
+		a.warnIfErr("record prompt evolution date", a.habits.SetLastPromptEvolutionDate(today))
 	}
 	evolvedCount := a.applyNightEvolvedSkills(evolvedSkills)
 
-	_ = a.habits.SetLastSleepReviewDate(today)
+	a.warnIfErr("record sleep review date", a.habits.SetLastSleepReviewDate(today))
 	reflection = strings.TrimSpace(reflection)
 	if reflection == "" {
 		reflection = "生活：今日作息已收束，保持稳定节律。\n工作：今日进度已复盘，明天按优先级继续。\n学习：保持小步快跑，明天继续迭代。"
@@ -570,6 +1277,58 @@ func (a *Agent) runNightReflectionAndEvolution(ctx context.Context, now time.Tim
 	return reflection
 }
 
+// PromptEvolutionResult reports the outcome of an on-demand evolution run.
+type PromptEvolutionResult struct {
+	Reflection     string
+	PromptsUpdated bool
+	EvolvedSkills  int
+	Skipped        bool
+}
+
+// RunPromptEvolutionNow runs reflection and prompt/skill evolution outside the
+// sleep window. A run already recorded today is skipped unless force is set.
+func (a *Agent) RunPromptEvolutionNow(ctx context.Context, force bool) (PromptEvolutionResult, error) {
+	release, err := a.gate.acquire(ctx)
+	if err != nil {
+		return PromptEvolutionResult{}, err
+	}
+	defer release()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.updater == nil {
+		return PromptEvolutionResult{}, fmt.Errorf("prompt updater is not configured")
+	}
+	today := a.localNow().Format("2006-01-02")
+	if !force && a.habits != nil && strings.TrimSpace(a.habits.GetLastPromptEvolutionDate()) == today {
+		return PromptEvolutionResult{Skipped: true}, nil
+	}
+
+	ctx, cancel := a.withTurnDeadline(ctx)
+	defer cancel()
+
+	summary, messages := a.store.Snapshot()
+	reflection, systemPrompt, compressionPrompt, evolvedSkills, err := a.generateNightReflectionPayload(ctx, summary, messages)
+	if err != nil {
+		return PromptEvolutionResult{}, fmt.Errorf("generate evolution payload: %w", err)
+	}
+
+	result := PromptEvolutionResult{Reflection: strings.TrimSpace(reflection)}
+	if strings.TrimSpace(systemPrompt) != "" &&
+		strings.TrimSpace(compressionPrompt) != "" &&
+		isValidEvolvedPrompt(systemPrompt, compressionPrompt, a.personaInvariantsLocked()) {
+		if err := a.updater.UpdateAgentPrompts(systemPrompt, compressionPrompt); err != nil {
+			return PromptEvolutionResult{}, fmt.Errorf("update prompts: %w", err)
+		}
+		result.PromptsUpdated = true
+	}
+	result.EvolvedSkills = a.applyNightEvolvedSkills(evolvedSkills)
+	if a.habits != nil {
+		a.warnIfErr("record prompt evolution date", a.habits.SetLastPromptEvolutionDate(today))
+	}
+	return result, nil
+}
+
 func (a *Agent) runMorningPlanning(ctx context.Context, now time.Time) string {
 	if !a.cfg.EnforceHumanRoutine || isSleepWindow(now) || a.habits == nil {
 		return ""
@@ -582,18 +1341,33 @@ func (a *Agent) runMorningPlanning(ctx context.Context, now time.Time) string {
 	summary, messages := a.store.Snapshot()
 	plan, err := a.generateMorningPlan(ctx, summary, messages)
 	if err != nil {
-		_ = a.habits.SetLastWakePlanDate(today)
+		a.warnIfErr("record wake plan date", a.habits.SetLastWakePlanDate(today))
 		return "任务回顾：请先确认昨日未完成事项并标注阻塞原因。\n今日 Top 3：1) 最关键交付 2) 次关键推进 3) 学习巩固。\n能力提升：今天复盘一个问题并沉淀为可复用方法。"
 	}
 	plan = strings.TrimSpace(plan)
 	if plan == "" {
-		_ = a.habits.SetLastWakePlanDate(today)
+		a.warnIfErr("record wake plan date", a.habits.SetLastWakePlanDate(today))
 		return "任务回顾：昨日进度已记录，请先对未完成项做风险评估。\n今日 Top 3：按优先级推进核心交付、风险治理、学习巩固。\n能力提升：今天完成一次针对性复盘。"
 	}
-	_ = a.habits.SetLastWakePlanDate(today)
+	a.warnIfErr("record wake plan date", a.habits.SetLastWakePlanDate(today))
 	return plan
 }
 
+// morningPlanForMessage skips the planning preamble for urgent first-morning messages,
+// still marking the day as planned so the plan is not forced on the next message.
+func (a *Agent) morningPlanForMessage(ctx context.Context, userInput string, now time.Time) string {
+	if a.cfg.SkipMorningPlanForUrgent && isUrgentMessage(userInput) {
+		if a.cfg.EnforceHumanRoutine && !isSleepWindow(now) && a.habits != nil {
+			today := now.Format("2006-01-02")
+			if strings.TrimSpace(a.habits.GetLastWakePlanDate()) != today {
+				a.warnIfErr("record wake plan date", a.habits.SetLastWakePlanDate(today))
+			}
+		}
+		return ""
+	}
+	return strings.TrimSpace(a.runMorningPlanning(ctx, now))
+}
+
 func (a *Agent) generateNightReflectionPayload(ctx context.Context, summary string, messages []conversation.Message) (reflection, systemPrompt, compressionPrompt string, skills []evolvedSkill, err error) {
 	currentSystemPrompt, currentCompressionPrompt := a.resolvePromptsLocked()
 
@@ -604,27 +1378,24 @@ func (a *Agent) generateNightReflectionPayload(ctx context.Context, summary stri
 		},
 		{
 			Role: "user",
-			Content: strings.TrimSpace(
-				"请基于以下信息执行两件事：\n" +
-					"1) 生成夜间复盘（生活/工作/学习三段，各 1-2 行）\n" +
-					"2) 生成升级后的系统提示词与压缩提示词\n" +
-					"3) 提炼 0-3 条可复用能力 Skill（用于后续自动注入，不要冗长）\n\n" +
-					"约束：必须保持名字“傻毛”、女性、8年全栈开发经验、不使用表情符号。\n" +
-					"输出 JSON 字段：reflection, system_prompt, compression_system_prompt, skills。\n" +
-					"skills 为数组；每项字段：name, prompt。name 2-20字，prompt 1 行且不超过 120 字。\n\n" +
-					"当前系统提示词：\n" + currentSystemPrompt + "\n\n" +
-					"当前压缩提示词：\n" + currentCompressionPrompt + "\n\n" +
-					"历史摘要：\n" + safeOrEmpty(summary) + "\n\n" +
-					"最近对话：\n" + renderConversation(lastN(messages, 20)),
+			Content: a.nightReflectionUserPrompt(
+				a.personaInvariantsLocked().constraintText(),
+				summary,
+				currentSystemPrompt,
+				currentCompressionPrompt,
+				renderConversation(lastN(messages, lookbackOrDefault(a.cfg.NightReflectionLookback))),
 			),
 		},
 	}
 
-	resp, err := a.llm.Chat(ctx, llm.ChatRequest{
+	resp, err := a.chat(ctx, llm.ChatRequest{
 		Purpose:     "night_reflection_evolution",
 		Model:       a.cfg.Model,
 		Messages:    msgs,
-		Temperature: 0.1,
+		ToolChoice:  llm.ToolChoiceNone,
+		Temperature: temperatureOrDefault(a.cfg.NightReflectionTemperature, 0.1),
+		// extractJSONObject below still copes with providers that ignore it.
+		ResponseFormat: llm.ResponseFormatJSON,
 	})
 	if err != nil {
 		return "", "", "", nil, err
@@ -649,27 +1420,21 @@ func (a *Agent) generateNightReflectionPayload(ctx context.Context, summary stri
 }
 
 func (a *Agent) generateMorningPlan(ctx context.Context, summary string, messages []conversation.Message) (string, error) {
-	resp, err := a.llm.Chat(ctx, llm.ChatRequest{
-		Purpose: "morning_planning",
-		Model:   a.cfg.Model,
+	resp, err := a.chat(ctx, llm.ChatRequest{
+		Purpose:    "morning_planning",
+		Model:      a.cfg.Model,
+		ToolChoice: llm.ToolChoiceNone,
 		Messages: []llm.Message{
 			{
 				Role:    "system",
 				Content: "你是数字分身晨间计划器。输出简洁中文纯文本，不要代码块。",
 			},
 			{
-				Role: "user",
-				Content: strings.TrimSpace(
-					"请基于以下信息输出今日计划，必须包含：\n" +
-						"1) 任务进度回顾（昨天完成/未完成）\n" +
-						"2) 今日 Top 3 任务（按优先级）\n" +
-						"3) 学习与能力提升 1 条\n\n" +
-						"历史摘要：\n" + safeOrEmpty(summary) + "\n\n" +
-						"最近对话：\n" + renderConversation(lastN(messages, 20)),
-				),
+				Role:    "user",
+				Content: a.morningPlanUserPrompt(summary, renderConversation(lastN(messages, lookbackOrDefault(a.cfg.MorningPlanLookback)))),
 			},
 		},
-		Temperature: 0.2,
+		Temperature: temperatureOrDefault(a.cfg.MorningPlanTemperature, 0.2),
 	})
 	if err != nil {
 		return "", err
@@ -677,7 +1442,57 @@ func (a *Agent) generateMorningPlan(ctx context.Context, summary string, message
 	return strings.TrimSpace(resp.Content), nil
 }
 
-func isValidEvolvedPrompt(systemPrompt, compressionPrompt string) bool {
+func temperatureOrDefault(configured *float64, def float64) float64 {
+	if configured == nil {
+		return def
+	}
+	return *configured
+}
+
+// defaultLookback is how many recent messages reflection and planning read.
+const defaultLookback = 20
+
+func lookbackOrDefault(n int) int {
+	if n <= 0 {
+		return defaultLookback
+	}
+	return n
+}
+
+// personaInvariants are the traits an evolved system prompt must keep.
+type personaInvariants struct {
+	Name        string
+	ForbidEmoji bool
+}
+
+var personaNamePattern = regexp.MustCompile(`名字(?:叫|是)\s*[“"「']?([^”"」'，,。\s]{1,20})`)
+
+func (a *Agent) personaInvariantsLocked() personaInvariants {
+	name := strings.TrimSpace(a.cfg.PersonaName)
+	if name == "" {
+		systemPrompt, _ := a.resolvePromptsLocked()
+		if match := personaNamePattern.FindStringSubmatch(systemPrompt); len(match) == 2 {
+			name = match[1]
+		}
+	}
+	return personaInvariants{Name: name, ForbidEmoji: a.cfg.ForbidEmoji}
+}
+
+func (p personaInvariants) constraintText() string {
+	parts := make([]string, 0, 2)
+	if p.Name != "" {
+		parts = append(parts, "保持名字“"+p.Name+"”")
+	}
+	if p.ForbidEmoji {
+		parts = append(parts, "保留不使用表情符号的规则")
+	}
+	if len(parts) == 0 {
+		return "保持当前人格设定不变。"
+	}
+	return "必须" + strings.Join(parts, "、") + "，并保持当前人格设定不变。"
+}
+
+func isValidEvolvedPrompt(systemPrompt, compressionPrompt string, persona personaInvariants) bool {
 	systemPrompt = strings.TrimSpace(systemPrompt)
 	compressionPrompt = strings.TrimSpace(compressionPrompt)
 	if len(systemPrompt) < 100 || len(compressionPrompt) < 60 {
@@ -686,17 +1501,43 @@ func isValidEvolvedPrompt(systemPrompt, compressionPrompt string) bool {
 	if len(systemPrompt) > 16000 || len(compressionPrompt) > 8000 {
 		return false
 	}
-	if !strings.Contains(systemPrompt, "傻毛") {
+	if persona.Name != "" && !strings.Contains(systemPrompt, persona.Name) {
 		return false
 	}
-	if !strings.Contains(systemPrompt, "不使用表情符号") {
-		return false
+	if persona.ForbidEmoji {
+		lower := strings.ToLower(systemPrompt)
+		if !strings.Contains(lower, "表情") && !strings.Contains(lower, "emoji") {
+			return false
+		}
+		if containsEmoji(systemPrompt) || containsEmoji(compressionPrompt) {
+			return false
+		}
 	}
 	return true
 }
 
+func containsEmoji(text string) bool {
+	for _, r := range text {
+		if (r >= 0x1F300 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractJSONObject returns the first valid JSON object in a model reply,
+// looking inside markdown code fences first and then in the raw text. When
+// none parses, the naive first-"{" to last-"}" span is returned so the caller
+// still gets a meaningful decode error.
 func extractJSONObject(content string) string {
 	text := strings.TrimSpace(content)
+	candidates := append(fencedBlocks(text), text)
+	for _, candidate := range candidates {
+		if obj, ok := firstJSONObject(candidate); ok {
+			return obj
+		}
+	}
+
 	start := strings.Index(text, "{")
 	end := strings.LastIndex(text, "}")
 	if start >= 0 && end > start {
@@ -705,6 +1546,70 @@ func extractJSONObject(content string) string {
 	return text
 }
 
+// fencedBlocks returns the bodies of ``` code fences, dropping the language
+// tag line. An unterminated fence runs to the end of the text.
+func fencedBlocks(text string) []string {
+	var blocks []string
+	for {
+		open := strings.Index(text, "```")
+		if open < 0 {
+			return blocks
+		}
+		body := text[open+3:]
+		if nl := strings.IndexByte(body, '\n'); nl >= 0 && !strings.Contains(body[:nl], "{") {
+			body = body[nl+1:]
+		}
+		end := strings.Index(body, "```")
+		if end < 0 {
+			return append(blocks, body)
+		}
+		blocks = append(blocks, body[:end])
+		text = body[end+3:]
+	}
+}
+
+// firstJSONObject scans for balanced top-level {...} spans, skipping braces
+// inside JSON strings, and returns the first one that is valid JSON.
+func firstJSONObject(text string) (string, bool) {
+	for start := strings.IndexByte(text, '{'); start >= 0; {
+		depth, inString, escaped := 0, false, false
+		end := -1
+	scan:
+		for i := start; i < len(text); i++ {
+			c := text[i]
+			switch {
+			case escaped:
+				escaped = false
+			case inString:
+				if c == '\\' {
+					escaped = true
+				} else if c == '"' {
+					inString = false
+				}
+			case c == '"':
+				inString = true
+			case c == '{':
+				depth++
+			case c == '}':
+				depth--
+				if depth == 0 {
+					end = i
+					break scan
+				}
+			}
+		}
+		if end >= 0 && json.Valid([]byte(text[start:end+1])) {
+			return text[start : end+1], true
+		}
+		next := strings.IndexByte(text[start+1:], '{')
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return "", false
+}
+
 type linuxBashRequest struct {
 	Command    string
 	WorkDir    string
@@ -726,7 +1631,7 @@ func linuxBashToolDefinition() llm.ToolDefinition {
 					},
 					"working_dir": map[string]any{
 						"type":        "string",
-						"description": "Optional working directory.",
+						"description": "Optional working directory; may be restricted to a sandbox root.",
 					},
 					"timeout_sec": map[string]any{
 						"type":        "integer",
@@ -748,11 +1653,11 @@ func parseLinuxBashArguments(raw string) (linuxBashRequest, error) {
 
 	commandRaw, ok := args["command"]
 	if !ok {
-		return linuxBashRequest{}, fmt.Errorf("tool argument %q is required", "command")
+		return linuxBashRequest{}, fmt.Errorf("%w: tool argument %q is required", llm.ErrInvalidToolArgs, "command")
 	}
 	command, ok := commandRaw.(string)
 	if !ok || strings.TrimSpace(command) == "" {
-		return linuxBashRequest{}, fmt.Errorf("tool argument %q must be non-empty string", "command")
+		return linuxBashRequest{}, fmt.Errorf("%w: tool argument %q must be non-empty string", llm.ErrInvalidToolArgs, "command")
 	}
 
 	req := linuxBashRequest{
@@ -765,7 +1670,7 @@ func parseLinuxBashArguments(raw string) (linuxBashRequest, error) {
 	if rawTimeout, exists := args["timeout_sec"]; exists {
 		timeout, ok := parsePositiveInt(rawTimeout)
 		if !ok {
-			return linuxBashRequest{}, fmt.Errorf("tool argument %q must be positive integer", "timeout_sec")
+			return linuxBashRequest{}, fmt.Errorf("%w: tool argument %q must be positive integer", llm.ErrInvalidToolArgs, "timeout_sec")
 		}
 		req.TimeoutSec = timeout
 	}
@@ -778,22 +1683,61 @@ func parseLinuxBashArguments(raw string) (linuxBashRequest, error) {
 	return req, nil
 }
 
-func runLinuxBash(ctx context.Context, req linuxBashRequest) (string, error) {
+// bashOptions are the operator-level linux__bash settings; the model only
+// controls linuxBashRequest.
+type bashOptions struct {
+	JSONOutput     bool
+	MaxStdoutRunes int
+	MaxStderrRunes int
+	Shell          string
+	ShellArgs      []string
+	NoLogin        bool
+	WorkDirRoot    string
+}
+
+func (a *Agent) bashOptions() bashOptions {
+	opts := bashOptions{
+		JSONOutput:     a.cfg.BashJSONOutput,
+		MaxStdoutRunes: a.cfg.BashMaxStdoutRunes,
+		MaxStderrRunes: a.cfg.BashMaxStderrRunes,
+		Shell:          strings.TrimSpace(a.cfg.BashShell),
+		ShellArgs:      a.cfg.BashShellArgs,
+		NoLogin:        a.cfg.BashNoLogin,
+		WorkDirRoot:    strings.TrimSpace(a.cfg.BashWorkDirRoot),
+	}
+	if opts.MaxStdoutRunes <= 0 {
+		opts.MaxStdoutRunes = maxBashStdoutRunes
+	}
+	if opts.MaxStderrRunes <= 0 {
+		opts.MaxStderrRunes = maxBashStderrRunes
+	}
+	return opts
+}
+
+// bashResult is the JSON shape of a linux__bash result.
+type bashResult struct {
+	ExitCode int    `json:"exit_code"`
+	Shell    string `json:"shell"`
+	WorkDir  string `json:"working_dir,omitempty"`
+	TimedOut bool   `json:"timed_out"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+func runLinuxBash(ctx context.Context, req linuxBashRequest, opts bashOptions) (string, error) {
 	timeout := time.Duration(req.TimeoutSec) * time.Second
 	runCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	cmd, shellName, err := buildShellCommand(runCtx, req.Command)
+	workDir, err := resolveBashWorkDir(req.WorkDir, opts.WorkDirRoot)
 	if err != nil {
 		return "", err
 	}
-	if wd := strings.TrimSpace(req.WorkDir); wd != "" {
-		if abs, err := filepath.Abs(wd); err == nil {
-			cmd.Dir = abs
-		} else {
-			cmd.Dir = wd
-		}
+	cmd, shellName, err := buildShellCommand(runCtx, req.Command, opts)
+	if err != nil {
+		return "", err
 	}
+	cmd.Dir = workDir
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -817,8 +1761,23 @@ func runLinuxBash(ctx context.Context, req linuxBashRequest) (string, error) {
 		exitCode = 124
 	}
 
-	stdoutText := trimRunes(stdout.String(), maxBashStdoutRunes)
-	stderrText := trimRunes(stderr.String(), maxBashStderrRunes)
+	stdoutText := trimRunes(stdout.String(), opts.MaxStdoutRunes)
+	stderrText := trimRunes(stderr.String(), opts.MaxStderrRunes)
+
+	if opts.JSONOutput {
+		data, err := json.Marshal(bashResult{
+			ExitCode: exitCode,
+			Shell:    shellName,
+			WorkDir:  cmd.Dir,
+			TimedOut: timedOut,
+			Stdout:   stdoutText,
+			Stderr:   stderrText,
+		})
+		if err != nil {
+			return "", fmt.Errorf("encode bash result: %w", err)
+		}
+		return string(data), nil
+	}
 
 	var b strings.Builder
 	b.WriteString(fmt.Sprintf("exit_code: %d\n", exitCode))
@@ -837,9 +1796,66 @@ func runLinuxBash(ctx context.Context, req linuxBashRequest) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
-func buildShellCommand(ctx context.Context, command string) (*exec.Cmd, string, error) {
+// resolveBashWorkDir returns the directory to run in ("" for the process
+// default). With a root, the result must stay inside it.
+func resolveBashWorkDir(workDir, root string) (string, error) {
+	workDir = strings.TrimSpace(workDir)
+	if root == "" {
+		if workDir == "" {
+			return "", nil
+		}
+		if abs, err := filepath.Abs(workDir); err == nil {
+			return abs, nil
+		}
+		return workDir, nil
+	}
+
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("resolve bash workdir root: %w", err)
+	}
+	dir := rootAbs
+	if workDir != "" {
+		if filepath.IsAbs(workDir) {
+			dir = filepath.Clean(workDir)
+		} else {
+			dir = filepath.Join(rootAbs, workDir)
+		}
+	}
+	// Compare real paths so a symlink inside the root cannot lead out of it.
+	if real, err := filepath.EvalSymlinks(rootAbs); err == nil {
+		rootAbs = real
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	if rel, err := filepath.Rel(rootAbs, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("working_dir %q is outside the allowed root %q", workDir, rootAbs)
+	}
+	return dir, nil
+}
+
+func buildShellCommand(ctx context.Context, command string, opts bashOptions) (*exec.Cmd, string, error) {
+	if opts.Shell != "" {
+		if shellPath, err := exec.LookPath(opts.Shell); err == nil {
+			args := opts.ShellArgs
+			if len(args) == 0 {
+				args = []string{"-c"}
+				if !opts.NoLogin {
+					args = []string{"-lc"}
+				}
+			}
+			args = append(append([]string(nil), args...), command)
+			return exec.CommandContext(ctx, shellPath, args...), filepath.Base(shellPath), nil
+		}
+		// A missing configured shell falls back to the default lookup below.
+	}
 	if bashPath, err := exec.LookPath("bash"); err == nil {
-		return exec.CommandContext(ctx, bashPath, "-lc", command), "bash", nil
+		flag := "-lc"
+		if opts.NoLogin {
+			flag = "-c"
+		}
+		return exec.CommandContext(ctx, bashPath, flag, command), "bash", nil
 	}
 	if shPath, err := exec.LookPath("sh"); err == nil {
 		return exec.CommandContext(ctx, shPath, "-c", command), "sh", nil
@@ -850,14 +1866,14 @@ func buildShellCommand(ctx context.Context, command string) (*exec.Cmd, string,
 func readToolArguments(raw string) (map[string]any, error) {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
-		return nil, fmt.Errorf("tool arguments are required")
+		return nil, fmt.Errorf("%w: tool arguments are required", llm.ErrInvalidToolArgs)
 	}
 	var args map[string]any
 	if err := json.Unmarshal([]byte(trimmed), &args); err != nil {
-		return nil, fmt.Errorf("invalid tool arguments: %w", err)
+		return nil, fmt.Errorf("%w: %w", llm.ErrInvalidToolArgs, err)
 	}
 	if args == nil {
-		return nil, fmt.Errorf("tool arguments are required")
+		return nil, fmt.Errorf("%w: tool arguments are required", llm.ErrInvalidToolArgs)
 	}
 	return args, nil
 }
@@ -944,22 +1960,70 @@ func normalizeEvolvedSkills(raw []struct {
 	return out
 }
 
-func selectSkillPromptsForTurn(skillPrompts []string, summary string, messages []conversation.Message) []string {
+func selectSkillPromptsForTurn(skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) []string {
+	prompts, scores := scoreSkillPromptsForTurn(skillPrompts, summary, messages, limits)
+	return pickSkillPromptsWithinBudget(rankSkillPrompts(prompts, scores, limits), limits)
+}
+
+// scoreSkillPromptsForTurn normalizes skillPrompts and scores each against
+// the conversation focus, including the tag boost.
+func scoreSkillPromptsForTurn(skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) ([]string, []float64) {
 	if len(skillPrompts) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	focus := buildSkillFocus(summary, messages)
+	prompts := normalizeSkillPrompts(skillPrompts, limits.MaxSingleRunes)
+	scores := scoreSkillPrompts(prompts, focus)
+	if limits.TagsOf != nil {
+		categories := inferSkillCategories(focus)
+		for i, prompt := range prompts {
+			scores[i] += skillTagBoost(limits.TagsOf(prompt), categories, focus)
+		}
+	}
+	return prompts, scores
+}
+
+// rankSkillPrompts orders prompts by score, then priority (see PriorityOf),
+// then original position.
+func rankSkillPrompts(prompts []string, scores []float64, limits SkillInjectionLimits) []string {
 	type scoredPrompt struct {
-		Prompt string
-		Score  int
-		Index  int
+		Prompt   string
+		Score    float64
+		Priority int
+		Index    int
+	}
+	scored := make([]scoredPrompt, 0, len(prompts))
+	for i, prompt := range prompts {
+		item := scoredPrompt{Prompt: prompt, Score: scores[i], Index: i}
+		if limits.PriorityOf != nil {
+			item.Priority = limits.PriorityOf(prompt)
+		}
+		scored = append(scored, item)
 	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].Score != scored[j].Score {
+			return scored[i].Score > scored[j].Score
+		}
+		if scored[i].Priority != scored[j].Priority {
+			return scored[i].Priority > scored[j].Priority
+		}
+		return scored[i].Index < scored[j].Index
+	})
 
+	ranked := make([]string, 0, len(scored))
+	for _, item := range scored {
+		ranked = append(ranked, item.Prompt)
+	}
+	return ranked
+}
+
+// normalizeSkillPrompts trims each prompt to the single-skill cap and drops blanks and duplicates.
+func normalizeSkillPrompts(skillPrompts []string, maxSingleRunes int) []string {
 	seen := make(map[string]struct{}, len(skillPrompts))
-	scored := make([]scoredPrompt, 0, len(skillPrompts))
-	for i, raw := range skillPrompts {
-		prompt := trimRunes(strings.TrimSpace(raw), maxSingleSkillPromptRunes)
+	out := make([]string, 0, len(skillPrompts))
+	for _, raw := range skillPrompts {
+		prompt := trimRunes(strings.TrimSpace(raw), maxSingleRunes)
 		if prompt == "" {
 			continue
 		}
@@ -967,44 +2031,45 @@ func selectSkillPromptsForTurn(skillPrompts []string, summary string, messages [
 			continue
 		}
 		seen[prompt] = struct{}{}
-		scored = append(scored, scoredPrompt{
-			Prompt: prompt,
-			Score:  scoreSkillPrompt(prompt, focus),
-			Index:  i,
-		})
+		out = append(out, prompt)
 	}
-	if len(scored) == 0 {
+	return out
+}
+
+// pickSkillPromptsWithinBudget takes prompts in ranked order until the count or rune budget is used up.
+func pickSkillPromptsWithinBudget(ranked []string, limits SkillInjectionLimits) []string {
+	if len(ranked) == 0 {
 		return nil
 	}
-
-	sort.Slice(scored, func(i, j int) bool {
-		if scored[i].Score != scored[j].Score {
-			return scored[i].Score > scored[j].Score
-		}
-		return scored[i].Index < scored[j].Index
-	})
-
-	selected := make([]string, 0, min(maxInjectedSkillPrompts, len(scored)))
+	selected := make([]string, 0, min(limits.MaxPrompts, len(ranked)))
 	usedRunes := 0
-	for _, item := range scored {
-		if len(selected) >= maxInjectedSkillPrompts {
+	autoCount := 0
+	for _, prompt := range ranked {
+		if len(selected) >= limits.MaxPrompts {
 			break
 		}
-		promptLen := len([]rune(item.Prompt))
-		if promptLen > maxInjectedSkillPromptRunes {
+		isAuto := limits.MaxAutoPrompts > 0 && limits.IsAuto != nil && limits.IsAuto(prompt)
+		if isAuto && autoCount >= limits.MaxAutoPrompts {
 			continue
 		}
-		if usedRunes+promptLen > maxInjectedSkillPromptRunes {
+		promptLen := len([]rune(prompt))
+		if promptLen > limits.MaxTotalRunes {
 			continue
 		}
-		selected = append(selected, item.Prompt)
+		if usedRunes+promptLen > limits.MaxTotalRunes {
+			continue
+		}
+		selected = append(selected, prompt)
 		usedRunes += promptLen
+		if isAuto {
+			autoCount++
+		}
 	}
 	if len(selected) > 0 {
 		return selected
 	}
 
-	fallback := trimRunes(scored[0].Prompt, maxInjectedSkillPromptRunes)
+	fallback := trimRunes(ranked[0], limits.MaxTotalRunes)
 	if fallback == "" {
 		return nil
 	}
@@ -1029,42 +2094,156 @@ func buildSkillFocus(summary string, messages []conversation.Message) string {
 	return strings.ToLower(b.String())
 }
 
-func scoreSkillPrompt(prompt, focus string) int {
-	if strings.TrimSpace(prompt) == "" {
-		return 0
-	}
-	if strings.TrimSpace(focus) == "" {
-		return 1
+// scoreSkillPrompts ranks each prompt against the focus text. Single-token
+// overlaps are weighted by token length and down-weighted when the token shows
+// up in most skills (a crude IDF); consecutive token pairs that also appear
+// consecutively in the focus count as phrase matches and weigh more.
+func scoreSkillPrompts(prompts []string, focus string) []float64 {
+	scores := make([]float64, len(prompts))
+	focusTokens := skillTokens(focus)
+	focusSet := make(map[string]struct{}, len(focusTokens))
+	for _, token := range focusTokens {
+		focusSet[token] = struct{}{}
+	}
+	focusPairs := skillTokenPairs(focusTokens)
+
+	promptTokens := make([][]string, len(prompts))
+	docFreq := make(map[string]int)
+	for i, prompt := range prompts {
+		promptTokens[i] = skillTokens(prompt)
+		seen := make(map[string]struct{}, len(promptTokens[i]))
+		for _, token := range promptTokens[i] {
+			if _, exists := seen[token]; exists {
+				continue
+			}
+			seen[token] = struct{}{}
+			docFreq[token]++
+		}
 	}
 
-	score := 1
-	tokens := skillTokenPattern.FindAllString(strings.ToLower(prompt), -1)
-	seen := make(map[string]struct{}, len(tokens))
-	for _, token := range tokens {
-		token = strings.TrimSpace(token)
-		if token == "" {
+	for i, prompt := range prompts {
+		if strings.TrimSpace(prompt) == "" {
 			continue
 		}
-		if _, exists := seen[token]; exists {
+		score := 1.0
+		if strings.TrimSpace(focus) != "" {
+			seen := make(map[string]struct{}, len(promptTokens[i]))
+			for _, token := range promptTokens[i] {
+				if _, exists := seen[token]; exists {
+					continue
+				}
+				seen[token] = struct{}{}
+				if _, ok := focusSet[token]; !ok && !strings.Contains(focus, token) {
+					continue
+				}
+				score += skillTokenWeight(token) * skillTokenRarity(docFreq[token], len(prompts))
+			}
+			for pair := range skillTokenPairs(promptTokens[i]) {
+				if _, ok := focusPairs[pair]; ok {
+					score += 4
+				}
+			}
+		}
+		if strings.Contains(prompt, "必须") || strings.Contains(prompt, "默认") || strings.Contains(prompt, "优先") {
+			score++
+		}
+		scores[i] = score
+	}
+	return scores
+}
+
+// skillCategoryKeywords drives inferSkillCategories; a category is active when
+// any of its keywords appears in the (lowercased) focus text.
+var skillCategoryKeywords = map[string][]string{
+	"coding":   {"代码", "编程", "函数", "编译", "报错", "接口", "重构", "单测", "code", "bug", "debug", "refactor", "compile", "function", "golang", "python", "sql"},
+	"planning": {"计划", "规划", "安排", "目标", "优先级", "待办", "日程", "里程碑", "plan", "todo", "roadmap", "schedule", "milestone"},
+	"writing":  {"写作", "文章", "润色", "文案", "翻译", "邮件", "write", "draft", "essay", "translate", "email"},
+	"research": {"调研", "搜索", "资料", "论文", "对比", "research", "search", "paper", "compare"},
+	"ops":      {"部署", "发布", "上线", "服务器", "日志", "故障", "回滚", "监控", "deploy", "release", "docker", "kubernetes", "incident", "rollback"},
+	"learning": {"学习", "复习", "课程", "练习", "learn", "study", "course", "practice"},
+}
+
+// inferSkillCategories returns the task categories mentioned in focus, sorted.
+func inferSkillCategories(focus string) []string {
+	focus = strings.ToLower(focus)
+	out := make([]string, 0, 2)
+	for category, keywords := range skillCategoryKeywords {
+		for _, keyword := range keywords {
+			if strings.Contains(focus, keyword) {
+				out = append(out, category)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// skillTagBoost rewards tags that match an inferred category or appear in the
+// focus verbatim. Untagged skills get no boost and no penalty.
+func skillTagBoost(tags, categories []string, focus string) float64 {
+	boost := 0.0
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
 			continue
 		}
-		seen[token] = struct{}{}
-		if strings.Contains(focus, token) {
-			runes := len([]rune(token))
-			switch {
-			case runes >= 6:
-				score += 3
-			case runes >= 3:
-				score += 2
-			default:
-				score++
+		matched := false
+		for _, category := range categories {
+			if tag == category {
+				matched = true
+				break
 			}
 		}
+		// Short latin tags like "go" would match inside unrelated words.
+		verbatim := (len(tag) >= 3 || !isASCII(tag)) && strings.Contains(focus, tag)
+		if matched || verbatim {
+			boost += 5
+		}
+	}
+	return boost
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func skillTokens(text string) []string {
+	return skillTokenPattern.FindAllString(strings.ToLower(text), -1)
+}
+
+func skillTokenPairs(tokens []string) map[string]struct{} {
+	pairs := make(map[string]struct{}, len(tokens))
+	for i := 0; i+1 < len(tokens); i++ {
+		pairs[tokens[i]+" "+tokens[i+1]] = struct{}{}
+	}
+	return pairs
+}
+
+func skillTokenWeight(token string) float64 {
+	runes := len([]rune(token))
+	switch {
+	case runes >= 6:
+		return 3
+	case runes >= 3:
+		return 2
+	default:
+		return 1
 	}
-	if strings.Contains(prompt, "必须") || strings.Contains(prompt, "默认") || strings.Contains(prompt, "优先") {
-		score++
+}
+
+// skillTokenRarity is 1 for tokens unique to one skill and shrinks toward
+// 0.25 as a token appears in every skill.
+func skillTokenRarity(docFreq, totalSkills int) float64 {
+	if totalSkills <= 2 || docFreq <= 1 {
+		return 1
 	}
-	return score
+	return 1 - 0.75*float64(docFreq-1)/float64(totalSkills-1)
 }
 
 func trimRunes(input string, max int) string {
@@ -2,15 +2,23 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"laughing-barnacle/internal/conversation"
 	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/redact"
+	"laughing-barnacle/internal/skills"
 )
 
 type mockLLM struct {
@@ -54,19 +62,35 @@ type mockTools struct {
 	listed   []llm.ToolDefinition
 	calls    []llm.ToolCall
 	response map[string]string
+	errs     map[string]error
 }
 
 type mockSkills struct {
-	prompts    []string
-	indexLines []string
-	promptByID map[string]string
-	upserts    []evolvedSkill
+	prompts     []string
+	autoPrompts []string
+	tags        map[string][]string
+	priorities  map[string]int
+	indexLines  []string
+	promptByID  map[string]string
+	upserts     []evolvedSkill
 }
 
 func (m *mockSkills) ListEnabledSkillPrompts() []string {
 	return m.prompts
 }
 
+func (m *mockSkills) ListEnabledAutoSkillPrompts() []string {
+	return m.autoPrompts
+}
+
+func (m *mockSkills) ListEnabledSkillTags() map[string][]string {
+	return m.tags
+}
+
+func (m *mockSkills) ListEnabledSkillPriorities() map[string]int {
+	return m.priorities
+}
+
 func (m *mockSkills) ListEnabledSkillIndex() []string {
 	if len(m.indexLines) > 0 {
 		return m.indexLines
@@ -166,6 +190,9 @@ func (m *mockTools) CallTool(_ context.Context, call llm.ToolCall) (string, erro
 
 	m.calls = append(m.calls, call)
 	key := call.Function.Name + ":" + call.Function.Arguments
+	if err, ok := m.errs[key]; ok {
+		return "", err
+	}
 	if out, ok := m.response[key]; ok {
 		return out, nil
 	}
@@ -222,11 +249,54 @@ func TestHandleUserMessage_WithAutoCompression(t *testing.T) {
 	if fakeLLM.calls[0].Purpose != "compress_context" {
 		t.Fatalf("first call purpose mismatch: %s", fakeLLM.calls[0].Purpose)
 	}
+	if fakeLLM.calls[0].ToolChoice != llm.ToolChoiceNone {
+		t.Fatalf("expected compression to forbid tool calls, got %q", fakeLLM.calls[0].ToolChoice)
+	}
 	if fakeLLM.calls[1].Purpose != "chat_reply" {
 		t.Fatalf("second call purpose mismatch: %s", fakeLLM.calls[1].Purpose)
 	}
 }
 
+func TestHandleUserMessage_PurposeOverridesModelAndTemperature(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "old question")
+	store.Append("assistant", "old answer")
+
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"compress_context": {"summary-v1"},
+		"chat_reply":       {"final-answer"},
+	}}
+	compressionTemperature := 0.3
+	agentSvc := New(Config{
+		Model:                      "strong-model",
+		Temperature:                0.7,
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 3,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		Purposes: map[string]PurposeConfig{
+			"compress_context": {Model: "cheap-model", Temperature: &compressionTemperature},
+			"morning_planning": {Model: "planner-model"},
+		},
+	}, store, fakeLLM, nil)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "new input"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected compression + reply calls, got %d", len(fakeLLM.calls))
+	}
+	if call := fakeLLM.calls[0]; call.Purpose != "compress_context" || call.Model != "cheap-model" || call.Temperature != 0.3 {
+		t.Fatalf("unexpected compression request: model=%s temperature=%v", call.Model, call.Temperature)
+	}
+	if call := fakeLLM.calls[1]; call.Purpose != "chat_reply" || call.Model != "strong-model" || call.Temperature != 0.7 {
+		t.Fatalf("unexpected chat request: model=%s temperature=%v", call.Model, call.Temperature)
+	}
+}
+
 func TestHandleUserMessage_WithoutCompression(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{responses: map[string][]string{
@@ -257,6 +327,177 @@ func TestHandleUserMessage_WithoutCompression(t *testing.T) {
 	}
 }
 
+func TestEstimateTokens_WeightsCJKHeavierThanASCII(t *testing.T) {
+	ascii := strings.Repeat("word ", 80)
+	cjk := strings.Repeat("压缩上下文", 20)
+
+	asciiTokens := estimateTokens(ascii)
+	cjkTokens := estimateTokens(cjk)
+	if asciiTokens != 100 {
+		t.Fatalf("expected ~4 ascii chars per token, got %d for %d chars", asciiTokens, len(ascii))
+	}
+	if cjkTokens != 100 {
+		t.Fatalf("expected one token per CJK rune, got %d", cjkTokens)
+	}
+	if estimateTokens(strings.Repeat("压", 50)) <= estimateTokens(strings.Repeat("a", 50)) {
+		t.Fatal("expected CJK text to cost more tokens than ASCII of the same rune count")
+	}
+	if estimateTokens("") != 0 {
+		t.Fatal("expected empty text to cost nothing")
+	}
+}
+
+func TestHandleUserMessage_TokenBudgetForcesCompression(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", strings.Repeat("这是一段很长的旧问题", 6))
+	store.Append("assistant", strings.Repeat("这是一段很长的旧回答", 6))
+
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"compress_context": {"summary-v1"},
+		"chat_reply":       {"ok"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 2,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+		MaxContextTokens:           125,
+		ContextTokenRatio:          0.8,
+	}, store, fakeLLM, nil)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "new input"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if len(fakeLLM.calls) != 2 || fakeLLM.calls[0].Purpose != "compress_context" || fakeLLM.calls[1].Purpose != "chat_reply" {
+		t.Fatalf("expected one compression before reply, got %+v", fakeLLM.calls)
+	}
+	if summary, _ := store.Snapshot(); summary != "summary-v1" {
+		t.Fatalf("summary not updated, got %q", summary)
+	}
+}
+
+func TestHandleUserMessage_CompressionInputIncludesToolCalls(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "今天天气怎么样")
+	if err := store.SetLatestUserToolCalls([]conversation.ToolCall{{
+		Name:      "weather__query",
+		Arguments: `{"city":"上海"}`,
+		Result:    "18度 " + strings.Repeat("多云", 200),
+	}}); err != nil {
+		t.Fatalf("SetLatestUserToolCalls error: %v", err)
+	}
+	store.Append("assistant", "18度，多云")
+
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"compress_context": {"summary-v1"},
+		"chat_reply":       {"ok"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 3,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "new input"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if len(fakeLLM.calls) == 0 || fakeLLM.calls[0].Purpose != "compress_context" {
+		t.Fatalf("expected compression call first, got %+v", fakeLLM.calls)
+	}
+	input := fakeLLM.calls[0].Messages[len(fakeLLM.calls[0].Messages)-1].Content
+	if !strings.Contains(input, "weather__query") || !strings.Contains(input, "18度") {
+		t.Fatalf("expected tool call in compression input, got %q", input)
+	}
+	if strings.Count(input, "多云") > maxRenderedToolTextRunes/2 {
+		t.Fatalf("expected tool result to be truncated, got %q", input)
+	}
+}
+
+func TestHandleUserMessage_MessageTimestampsPrefixRelativeAge(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		store := conversation.NewStore()
+		store.Append("user", "old question")
+		store.Append("assistant", "old answer")
+
+		fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+		agentSvc := New(Config{
+			Model:                      "test-model",
+			MaxRecentMessages:          10,
+			CompressionTriggerMessages: 99,
+			CompressionTriggerChars:    99999,
+			KeepRecentAfterCompression: 1,
+			MaxCompressionLoopsPerTurn: 1,
+			MaxToolCallRounds:          4,
+			SystemPrompt:               "system",
+			CompressionSystemPrompt:    "compressor",
+			MessageTimestamps:          enabled,
+		}, store, fakeLLM, nil)
+		fixedNow := time.Now().Add(3*time.Hour + 5*time.Minute)
+		agentSvc.nowFn = func() time.Time { return fixedNow }
+
+		if _, err := agentSvc.HandleUserMessage(context.Background(), "new input"); err != nil {
+			t.Fatalf("HandleUserMessage error: %v", err)
+		}
+		var first string
+		for _, msg := range fakeLLM.calls[0].Messages {
+			if msg.Role == "user" {
+				first = msg.Content
+				break
+			}
+		}
+		want := "old question"
+		if enabled {
+			want = "[3小时前] old question"
+		}
+		if first != want {
+			t.Fatalf("enabled=%v: expected %q, got %q", enabled, want, first)
+		}
+	}
+}
+
+func TestHandleUserMessage_SurfacesPersistFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := conversation.NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("NewStoreWithFile error: %v", err)
+	}
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
+
+	_, err = agentSvc.HandleUserMessage(context.Background(), "hello")
+	if !errors.Is(err, conversation.ErrPersist) {
+		t.Fatalf("expected ErrPersist, got %v", err)
+	}
+	if len(fakeLLM.calls) != 0 {
+		t.Fatalf("expected no LLM call when the user message cannot be saved")
+	}
+}
+
 func TestHandleUserMessage_WithToolCalls(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{
@@ -338,11 +579,14 @@ func TestHandleUserMessage_WithToolCalls(t *testing.T) {
 	if len(messages) != 2 {
 		t.Fatalf("expected user + assistant messages, got %d", len(messages))
 	}
-	if len(messages[0].ToolCalls) != 1 {
-		t.Fatalf("expected tool calls attached to user message, got %d", len(messages[0].ToolCalls))
+	if len(messages[0].ToolCalls) != 0 {
+		t.Fatalf("expected no tool calls on user message, got %+v", messages[0].ToolCalls)
+	}
+	if messages[1].Role != "assistant" || len(messages[1].ToolCalls) != 1 {
+		t.Fatalf("expected tool calls attached to assistant reply, got %+v", messages[1])
 	}
-	if messages[0].ToolCalls[0].Name != "weather__query" {
-		t.Fatalf("unexpected attached tool name: %s", messages[0].ToolCalls[0].Name)
+	if messages[1].ToolCalls[0].Name != "weather__query" {
+		t.Fatalf("unexpected attached tool name: %s", messages[1].ToolCalls[0].Name)
 	}
 }
 
@@ -433,6 +677,61 @@ func TestHandleUserMessage_UsesOnlyBuiltinLinuxBashTool(t *testing.T) {
 	}
 }
 
+func TestHandleUserMessage_DisabledBashToolIsHiddenAndRejected(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", "done"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{{ID: "call_bash_1", Type: "function", Function: llm.ToolFunctionCall{Name: builtinLinuxBashToolName, Arguments: `{"command":"echo should-not-run"}`}}},
+				nil,
+			},
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, store, fakeLLM, &mockTools{listed: []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "weather__query"}}}})
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "run something"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+
+	if tools := fakeLLM.calls[0].Tools; len(tools) != 1 || tools[0].Function.Name != "weather__query" {
+		t.Fatalf("expected only the external tool with bash disabled, got %+v", tools)
+	}
+	for _, msg := range fakeLLM.calls[0].Messages {
+		if strings.Contains(msg.Content, "内置工具仅有 linux__bash") {
+			t.Fatalf("builtin tools notice should be dropped, got %q", msg.Content)
+		}
+	}
+	var toolResult string
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" {
+			toolResult = msg.Content
+		}
+	}
+	if !strings.Contains(toolResult, "disabled") || strings.Contains(toolResult, "should-not-run") {
+		t.Fatalf("expected a disabled-tool error as the tool result, got %q", toolResult)
+	}
+
+	agentSvc.cfg.DisabledBuiltinTools = []string{builtinSkillCatalogToolName}
+	call := llm.ToolCall{ID: "call_catalog", Type: "function", Function: llm.ToolFunctionCall{Name: builtinSkillCatalogToolName, Arguments: `{"query":"git"}`}}
+	if _, err, handled := agentSvc.callBuiltinTool(context.Background(), call); !handled || !errors.Is(err, llm.ErrToolUnavailable) {
+		t.Fatalf("expected the disabled catalog tool to be rejected, got handled=%v err=%v", handled, err)
+	}
+}
+
 func TestHandleUserMessage_LinuxBashToolCall(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{
@@ -495,21 +794,33 @@ func TestHandleUserMessage_LinuxBashToolCall(t *testing.T) {
 	if len(messages) != 2 {
 		t.Fatalf("expected user + assistant messages, got %d", len(messages))
 	}
-	if len(messages[0].ToolCalls) != 1 {
-		t.Fatalf("expected one tool call recorded, got %d", len(messages[0].ToolCalls))
+	if len(messages[1].ToolCalls) != 1 {
+		t.Fatalf("expected one tool call recorded on the reply, got %d", len(messages[1].ToolCalls))
 	}
-	if messages[0].ToolCalls[0].Name != builtinLinuxBashToolName {
-		t.Fatalf("unexpected tool call name: %s", messages[0].ToolCalls[0].Name)
+	if messages[1].ToolCalls[0].Name != builtinLinuxBashToolName {
+		t.Fatalf("unexpected tool call name: %s", messages[1].ToolCalls[0].Name)
 	}
 }
 
-func TestHandleUserMessage_SkillPromptInjectionIsCapped(t *testing.T) {
-	store := conversation.NewStore()
-	fakeLLM := &mockLLM{responses: map[string][]string{
-		"chat_reply": {"ok"},
-	}}
-
-	longPrompt := strings.Repeat("这个超长技能用于测试提示词裁剪能力。", 40)
+func TestHandleUserMessage_RedactsSecretsInBashResultBeforePersisting(t *testing.T) {
+	const apiKey = "sk-test-0123456789"
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := conversation.NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("NewStoreWithFile error: %v", err)
+	}
+	t.Setenv("LEAKY_API_KEY", apiKey)
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", "done"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{{ID: "call_env", Type: "function", Function: llm.ToolFunctionCall{Name: builtinLinuxBashToolName, Arguments: `{"command":"echo key=$LEAKY_API_KEY"}`}}},
+				nil,
+			},
+		},
+	}
 	agentSvc := New(Config{
 		Model:                      "test-model",
 		MaxRecentMessages:          10,
@@ -517,66 +828,59 @@ func TestHandleUserMessage_SkillPromptInjectionIsCapped(t *testing.T) {
 		CompressionTriggerChars:    99999,
 		KeepRecentAfterCompression: 1,
 		MaxCompressionLoopsPerTurn: 1,
-		MaxToolCallRounds:          2,
+		MaxToolCallRounds:          3,
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
+		BashNoLogin:                true,
+		Redactor:                   redact.Static(apiKey),
 	}, store, fakeLLM, nil)
-	agentSvc.SetSkillProvider(&mockSkills{
-		prompts: []string{
-			"代码变更前先明确验收标准，再拆分实现步骤。",
-			"线上故障处理先止血，再定位根因，再补监控与预案。",
-			"学习计划采用每天 30 分钟持续练习并复盘。",
-			"回答技术方案时给出风险、回滚与验证步骤。",
-			"写 SQL 前先确认索引与数据规模。",
-			"接口设计优先保证幂等性和可观测性。",
-			"发布前执行最小回归用例并记录结果。",
-			longPrompt,
-		},
-	})
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "今天要做代码评审并准备上线")
-	if err != nil {
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "print the key"); err != nil {
 		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if reply != "ok" {
-		t.Fatalf("unexpected reply: %s", reply)
-	}
-
-	if len(fakeLLM.calls) != 1 {
-		t.Fatalf("expected one llm call, got %d", len(fakeLLM.calls))
-	}
-	msgs := fakeLLM.calls[0].Messages
-	if len(msgs) < 2 {
-		t.Fatalf("expected skill system message")
-	}
 
-	content := ""
-	for _, msg := range msgs {
-		if msg.Role == "system" && strings.Contains(msg.Content, "已启用技能") {
-			content = msg.Content
-			break
+	var toolResult string
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" {
+			toolResult = msg.Content
 		}
 	}
-	if strings.TrimSpace(content) == "" {
-		t.Fatalf("expected injected skill message")
-	}
-	if strings.Contains(content, longPrompt) {
-		t.Fatalf("expected long prompt to be trimmed out from injected skills")
+	if !strings.Contains(toolResult, "key="+redact.Mask) || strings.Contains(toolResult, apiKey) {
+		t.Fatalf("expected the key masked in the tool result sent back, got %q", toolResult)
 	}
-	if strings.Count(content, "\n") > maxInjectedSkillPrompts+4 {
-		t.Fatalf("expected injected skill list to be capped, got: %q", content)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read conversation file: %v", err)
 	}
-	if !strings.Contains(content, "控制上下文长度") {
-		t.Fatalf("expected truncation note, got %q", content)
+	if strings.Contains(string(data), apiKey) || !strings.Contains(string(data), "key="+redact.Mask) {
+		t.Fatalf("expected the persisted tool result to be redacted, got %s", data)
 	}
 }
 
-func TestHandleUserMessage_UsesPromptProviderSystemPrompt(t *testing.T) {
-	store := conversation.NewStore()
-	fakeLLM := &mockLLM{responses: map[string][]string{
-		"chat_reply": {"ok"},
-	}}
+func TestHandleUserMessage_BoundsAccumulatedToolResults(t *testing.T) {
+	const rounds = 5
+	big := strings.Repeat("页", 1000)
+	replies := make([]string, 0, rounds+1)
+	calls := make([][]llm.ToolCall, 0, rounds+1)
+	response := make(map[string]string, rounds)
+	for i := 0; i < rounds; i++ {
+		args := fmt.Sprintf(`{"page":%d}`, i)
+		replies = append(replies, "")
+		calls = append(calls, []llm.ToolCall{{ID: fmt.Sprintf("call_%d", i), Type: "function", Function: llm.ToolFunctionCall{Name: "fetch", Arguments: args}}})
+		response["fetch:"+args] = big
+	}
+	replies = append(replies, "done")
+	calls = append(calls, nil)
 
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": replies},
+		toolCalls: map[string][][]llm.ToolCall{"chat_reply": calls},
+	}
+	tools := &mockTools{
+		listed:   []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "fetch"}}},
+		response: response,
+	}
+	store := conversation.NewStore()
 	agentSvc := New(Config{
 		Model:                      "test-model",
 		MaxRecentMessages:          10,
@@ -584,32 +888,288 @@ func TestHandleUserMessage_UsesPromptProviderSystemPrompt(t *testing.T) {
 		CompressionTriggerChars:    99999,
 		KeepRecentAfterCompression: 1,
 		MaxCompressionLoopsPerTurn: 1,
-		MaxToolCallRounds:          2,
-		SystemPrompt:               "default-system",
-		CompressionSystemPrompt:    "default-compressor",
-	}, store, fakeLLM, nil)
-	agentSvc.SetPromptProvider(&mockPromptProvider{
-		systemPrompt:            "override-system",
-		compressionSystemPrompt: "override-compressor",
-	})
+		MaxToolCallRounds:          rounds + 1,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		MaxToolResultsRunes:        2500,
+	}, store, fakeLLM, tools)
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "hello")
-	if err != nil {
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "read everything"); err != nil {
 		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if reply != "ok" {
-		t.Fatalf("unexpected reply: %s", reply)
+
+	if len(fakeLLM.calls) != rounds+1 {
+		t.Fatalf("expected %d chat calls, got %d", rounds+1, len(fakeLLM.calls))
+	}
+	for i, req := range fakeLLM.calls {
+		toolRunes, toolMsgs, whole := 0, 0, 0
+		for j, msg := range req.Messages {
+			if msg.Role != "tool" {
+				continue
+			}
+			toolMsgs++
+			toolRunes += utf8.RuneCountInString(msg.Content)
+			if msg.Content == big {
+				whole++
+			}
+			if prev := req.Messages[j-1]; prev.Role != "tool" && len(prev.ToolCalls) == 0 {
+				t.Fatalf("request %d: tool result at %d does not follow its tool call", i, j)
+			}
+		}
+		if toolMsgs != i {
+			t.Fatalf("request %d: expected %d tool results, got %d", i, i, toolMsgs)
+		}
+		if toolRunes > 2500 {
+			t.Fatalf("request %d: tool results total %d runes, want <= 2500", i, toolRunes)
+		}
+		// The bound counts runes, not bytes: two 1000-rune results fit.
+		if i == 2 && whole != 2 {
+			t.Fatalf("request 2: expected both tool results whole, got %d", whole)
+		}
 	}
-	if len(fakeLLM.calls) != 1 {
-		t.Fatalf("expected one llm call, got %d", len(fakeLLM.calls))
+	last := fakeLLM.calls[rounds].Messages
+	if got := last[len(last)-1].Content; got != big {
+		t.Fatalf("expected the latest tool result to be sent whole, got %d runes", utf8.RuneCountInString(got))
 	}
-	if got := fakeLLM.calls[0].Messages[0].Content; got != "override-system" {
-		t.Fatalf("expected provider system prompt, got %q", got)
+
+	_, messages := store.Snapshot()
+	persisted := messages[len(messages)-1].ToolCalls
+	if len(persisted) != rounds {
+		t.Fatalf("expected %d persisted tool calls, got %d", rounds, len(persisted))
+	}
+	for _, call := range persisted {
+		if call.Result != big {
+			t.Fatalf("expected persisted tool results to stay complete, got %d chars", len(call.Result))
+		}
 	}
 }
 
-func TestHandleUserMessage_UsesPromptProviderCompressionPrompt(t *testing.T) {
-	store := conversation.NewStore()
+func TestRunLinuxBash_JSONOutputCapsEachField(t *testing.T) {
+	agentSvc := New(Config{BashJSONOutput: true, BashMaxStdoutRunes: 10, BashMaxStderrRunes: 5}, conversation.NewStore(), &mockLLM{}, nil)
+
+	out, err := runLinuxBash(context.Background(), linuxBashRequest{
+		Command:    "printf 'stderr: not a label 0123456789'; printf 'oops-oops-oops' >&2; exit 3",
+		TimeoutSec: 5,
+	}, agentSvc.bashOptions())
+	if err != nil {
+		t.Fatalf("runLinuxBash error: %v", err)
+	}
+
+	var result bashResult
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("expected JSON result, got %q: %v", out, err)
+	}
+	if result.ExitCode != 3 || result.TimedOut {
+		t.Fatalf("unexpected exit status: %+v", result)
+	}
+	if result.Stdout != "stderr:..." {
+		t.Fatalf("expected stdout capped to 10 runes, got %q", result.Stdout)
+	}
+	// Login shells may add profile noise to stderr, so only check the cap.
+	if len([]rune(result.Stderr)) != 5 || !strings.HasSuffix(result.Stderr, "...") {
+		t.Fatalf("expected stderr capped to 5 runes, got %q", result.Stderr)
+	}
+}
+
+func TestBuildShellCommand_UsesConfiguredShellAndFlags(t *testing.T) {
+	cmd, name, err := buildShellCommand(context.Background(), "echo hi", bashOptions{Shell: "sh", ShellArgs: []string{"-e", "-c"}})
+	if err != nil {
+		t.Fatalf("buildShellCommand error: %v", err)
+	}
+	if name != "sh" || strings.Join(cmd.Args[1:], " ") != "-e -c echo hi" {
+		t.Fatalf("unexpected command: %s %v", name, cmd.Args)
+	}
+
+	cmd, _, err = buildShellCommand(context.Background(), "echo hi", bashOptions{Shell: "sh", NoLogin: true})
+	if err != nil {
+		t.Fatalf("buildShellCommand error: %v", err)
+	}
+	if strings.Join(cmd.Args[1:], " ") != "-c echo hi" {
+		t.Fatalf("expected non-login flag, got %v", cmd.Args)
+	}
+
+	cmd, name, err = buildShellCommand(context.Background(), "echo hi", bashOptions{Shell: "no-such-shell-xyz"})
+	if err != nil {
+		t.Fatalf("expected fallback for a missing shell, got %v", err)
+	}
+	if name != "bash" && name != "sh" {
+		t.Fatalf("expected default shell fallback, got %s %v", name, cmd.Args)
+	}
+}
+
+func TestRunLinuxBash_WorkDirRootConfinesWorkingDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "project"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	opts := bashOptions{JSONOutput: true, MaxStdoutRunes: 200, MaxStderrRunes: 200, WorkDirRoot: root, NoLogin: true}
+	realRoot, _ := filepath.EvalSymlinks(root)
+
+	run := func(workDir string) (bashResult, error) {
+		out, err := runLinuxBash(context.Background(), linuxBashRequest{Command: "pwd", WorkDir: workDir, TimeoutSec: 5}, opts)
+		if err != nil {
+			return bashResult{}, err
+		}
+		var result bashResult
+		if err := json.Unmarshal([]byte(out), &result); err != nil {
+			t.Fatalf("decode result %q: %v", out, err)
+		}
+		return result, nil
+	}
+
+	result, err := run("")
+	if err != nil || result.Stdout != realRoot {
+		t.Fatalf("expected default working dir %q, got %+v (%v)", realRoot, result, err)
+	}
+	result, err = run("project")
+	if err != nil || result.Stdout != filepath.Join(realRoot, "project") {
+		t.Fatalf("expected allowed subdir, got %+v (%v)", result, err)
+	}
+	if _, err := run("project/../.."); err == nil || !strings.Contains(err.Error(), "outside the allowed root") {
+		t.Fatalf("expected parent traversal rejected, got %v", err)
+	}
+	if _, err := run("/etc"); err == nil {
+		t.Fatalf("expected absolute path outside root rejected")
+	}
+}
+
+func TestHandleUserMessage_SkillPromptInjectionIsCapped(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"chat_reply": {"ok"},
+	}}
+
+	longPrompt := strings.Repeat("这个超长技能用于测试提示词裁剪能力。", 40)
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
+	agentSvc.SetSkillProvider(&mockSkills{
+		prompts: []string{
+			"代码变更前先明确验收标准，再拆分实现步骤。",
+			"线上故障处理先止血，再定位根因，再补监控与预案。",
+			"学习计划采用每天 30 分钟持续练习并复盘。",
+			"回答技术方案时给出风险、回滚与验证步骤。",
+			"写 SQL 前先确认索引与数据规模。",
+			"接口设计优先保证幂等性和可观测性。",
+			"发布前执行最小回归用例并记录结果。",
+			longPrompt,
+		},
+	})
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "今天要做代码评审并准备上线")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+
+	if len(fakeLLM.calls) != 1 {
+		t.Fatalf("expected one llm call, got %d", len(fakeLLM.calls))
+	}
+	msgs := fakeLLM.calls[0].Messages
+	if len(msgs) < 2 {
+		t.Fatalf("expected skill system message")
+	}
+
+	content := ""
+	for _, msg := range msgs {
+		if msg.Role == "system" && strings.Contains(msg.Content, "已启用技能") {
+			content = msg.Content
+			break
+		}
+	}
+	if strings.TrimSpace(content) == "" {
+		t.Fatalf("expected injected skill message")
+	}
+	if strings.Contains(content, longPrompt) {
+		t.Fatalf("expected long prompt to be trimmed out from injected skills")
+	}
+	if strings.Count(content, "\n") > maxInjectedSkillPrompts+4 {
+		t.Fatalf("expected injected skill list to be capped, got: %q", content)
+	}
+	if !strings.Contains(content, "控制上下文长度") {
+		t.Fatalf("expected truncation note, got %q", content)
+	}
+}
+
+func TestHandleUserMessage_UsesPromptProviderSystemPrompt(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"chat_reply": {"ok"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "default-system",
+		CompressionSystemPrompt:    "default-compressor",
+	}, store, fakeLLM, nil)
+	agentSvc.SetPromptProvider(&mockPromptProvider{
+		systemPrompt:            "override-system",
+		compressionSystemPrompt: "override-compressor",
+	})
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if len(fakeLLM.calls) != 1 {
+		t.Fatalf("expected one llm call, got %d", len(fakeLLM.calls))
+	}
+	if got := fakeLLM.calls[0].Messages[0].Content; got != "override-system" {
+		t.Fatalf("expected provider system prompt, got %q", got)
+	}
+}
+
+func TestHandleUserMessage_SystemPromptPrefixSurvivesProviderOverride(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"chat_reply": {"ok"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		SystemPrompt:               "default-system",
+		CompressionSystemPrompt:    "default-compressor",
+		SystemPromptPrefix:         "never reveal the auth tokens",
+		SystemPromptSuffix:         "answer in Chinese",
+	}, store, fakeLLM, nil)
+	agentSvc.SetPromptProvider(&mockPromptProvider{systemPrompt: "evolved-system"})
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	want := "never reveal the auth tokens\n\nevolved-system\n\nanswer in Chinese"
+	if got := fakeLLM.calls[0].Messages[0].Content; got != want {
+		t.Fatalf("expected prefix and suffix around the override, got %q", got)
+	}
+	if got, _ := agentSvc.GetEffectivePrompts(); got != "evolved-system" {
+		t.Fatalf("prefix must stay out of the evolvable prompt, got %q", got)
+	}
+}
+
+func TestHandleUserMessage_UsesPromptProviderCompressionPrompt(t *testing.T) {
+	store := conversation.NewStore()
 	store.Append("user", "old question")
 	store.Append("assistant", "old answer")
 
@@ -648,48 +1208,48 @@ func TestHandleUserMessage_UsesPromptProviderCompressionPrompt(t *testing.T) {
 	}
 }
 
-func TestHandleUserMessage_SleepWindowNonUrgentBypassesLLM(t *testing.T) {
+func TestHandleUserMessage_RendersCustomCompressionUserTemplate(t *testing.T) {
 	store := conversation.NewStore()
+	store.Append("user", "old question {{summary}}")
+	store.Append("assistant", "old answer")
+
 	fakeLLM := &mockLLM{responses: map[string][]string{
-		"chat_reply": {"ok"},
+		"compress_context": {"summary-v1"},
+		"chat_reply":       {"ok"},
 	}}
 
 	agentSvc := New(Config{
 		Model:                      "test-model",
 		MaxRecentMessages:          10,
-		CompressionTriggerMessages: 99,
-		CompressionTriggerChars:    99999,
+		CompressionTriggerMessages: 3,
+		CompressionTriggerChars:    0,
 		KeepRecentAfterCompression: 1,
-		MaxCompressionLoopsPerTurn: 1,
+		MaxCompressionLoopsPerTurn: 2,
 		MaxToolCallRounds:          2,
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
-		EnforceHumanRoutine:        true,
+		CompressionUserTemplate:    "SUMMARY<{{summary}}>\nCONVERSATION<{{conversation}}>\nkeep {{unknown}}",
 	}, store, fakeLLM, nil)
-	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
-	}
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我整理下周学习计划")
-	if err != nil {
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "new input"); err != nil {
 		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if !strings.Contains(reply, "休息时段") {
-		t.Fatalf("expected sleep-window reply, got %q", reply)
+	if fakeLLM.calls[0].Purpose != "compress_context" {
+		t.Fatalf("first call purpose mismatch: %s", fakeLLM.calls[0].Purpose)
 	}
-	if len(fakeLLM.calls) != 0 {
-		t.Fatalf("expected no llm calls in sleep-window non-urgent path, got %d", len(fakeLLM.calls))
+	got := fakeLLM.calls[0].Messages[1].Content
+	if !strings.HasPrefix(got, "SUMMARY<(无)>\nCONVERSATION<") || !strings.HasSuffix(got, ">\nkeep {{unknown}}") {
+		t.Fatalf("unexpected rendered template: %q", got)
 	}
-	_, messages := store.Snapshot()
-	if len(messages) != 2 || messages[1].Role != "assistant" {
-		t.Fatalf("expected user + assistant messages, got %+v", messages)
+	if !strings.Contains(got, "old question {{summary}}") || !strings.Contains(got, "old answer") {
+		t.Fatalf("expected conversation to be substituted verbatim, got %q", got)
 	}
 }
 
-func TestHandleUserMessage_SleepWindowUrgentStillCallsLLM(t *testing.T) {
+func TestHandleUserMessage_SleepWindowNonUrgentBypassesLLM(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{responses: map[string][]string{
-		"chat_reply": {"紧急止损方案"},
+		"chat_reply": {"ok"},
 	}}
 
 	agentSvc := New(Config{
@@ -708,22 +1268,26 @@ func TestHandleUserMessage_SleepWindowUrgentStillCallsLLM(t *testing.T) {
 		return time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
 	}
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "紧急：生产环境宕机，马上给我止损方案")
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我整理下周学习计划")
 	if err != nil {
 		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if reply != "紧急止损方案" {
-		t.Fatalf("unexpected reply: %q", reply)
+	if !strings.Contains(reply, "休息时段") {
+		t.Fatalf("expected sleep-window reply, got %q", reply)
 	}
-	if len(fakeLLM.calls) != 1 {
-		t.Fatalf("expected llm to be called for urgent message, got %d", len(fakeLLM.calls))
+	if len(fakeLLM.calls) != 0 {
+		t.Fatalf("expected no llm calls in sleep-window non-urgent path, got %d", len(fakeLLM.calls))
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 2 || messages[1].Role != "assistant" {
+		t.Fatalf("expected user + assistant messages, got %+v", messages)
 	}
 }
 
-func TestHandleUserMessage_SleepWindowRunsReflectionAndPromptEvolution(t *testing.T) {
+func TestRunScheduledHumanRoutine_AnswersDeferredMessagesAfterWake(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{responses: map[string][]string{
-		"night_reflection_evolution": {`{"reflection":"生活：按时休息。工作：推进核心任务。学习：补齐短板。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，回答务实、可执行、可复盘，并持续优化工作和学习策略。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格、事实、任务进度、学习进展与待办，输出简洁纯文本。","skills":[{"name":"故障复盘模板","prompt":"先写事实时间线，再写根因、影响、修复与预防项。"},{"name":"学习闭环","prompt":"每天结束前记录一个短板与一个可执行练习。"}]}`},
+		"chat_reply": {"学习计划已整理", "早上好"},
 	}}
 
 	agentSvc := New(Config{
@@ -737,48 +1301,60 @@ func TestHandleUserMessage_SleepWindowRunsReflectionAndPromptEvolution(t *testin
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
 		EnforceHumanRoutine:        true,
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
 	}, store, fakeLLM, nil)
-	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 2, 10, 0, 0, time.Local)
+	now := time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
+	agentSvc.nowFn = func() time.Time { return now }
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我整理下周学习计划")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if !strings.Contains(reply, "共 1 条") {
+		t.Fatalf("expected sleep reply with queue length, got %q", reply)
+	}
+	if store.DeferredCount() != 1 {
+		t.Fatalf("expected one deferred message, got %d", store.DeferredCount())
 	}
-	updater := &mockPromptUpdater{}
-	habits := &mockHabits{}
-	skills := &mockSkills{}
-	agentSvc.SetPromptUpdater(updater)
-	agentSvc.SetHabitProvider(habits)
-	agentSvc.SetSkillProvider(skills)
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我明天继续优化服务")
+	now = time.Date(2026, 2, 14, 9, 0, 0, 0, time.Local)
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
+	}
+	reply, err = agentSvc.HandleUserMessage(context.Background(), "早")
 	if err != nil {
 		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if !strings.Contains(reply, "夜间复盘") {
-		t.Fatalf("expected reflection section in sleep reply, got %q", reply)
+	if reply != "早上好" {
+		t.Fatalf("unexpected reply: %q", reply)
 	}
-	if updater.calls != 1 {
-		t.Fatalf("expected one prompt evolution update, got %d", updater.calls)
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected one call for the deferred message and one for the new one, got %d", len(fakeLLM.calls))
 	}
-	if habits.lastSleepReviewDate != "2026-02-14" {
-		t.Fatalf("expected sleep review date recorded, got %q", habits.lastSleepReviewDate)
+	if first := fakeLLM.calls[0].Messages; first[len(first)-1].Content != "帮我整理下周学习计划" {
+		t.Fatalf("expected the deferred message to be answered first, got %+v", first)
 	}
-	if habits.lastPromptEvolutionDate != "2026-02-14" {
-		t.Fatalf("expected prompt evolution date recorded, got %q", habits.lastPromptEvolutionDate)
+	if store.DeferredCount() != 0 {
+		t.Fatalf("expected deferred queue to be drained, got %d", store.DeferredCount())
 	}
-	if len(skills.upserts) != 2 {
-		t.Fatalf("expected 2 evolved skills, got %d", len(skills.upserts))
+	_, messages := store.Snapshot()
+	if len(messages) != 5 {
+		t.Fatalf("expected user, sleep reply, deferred reply, user, reply; got %+v", messages)
 	}
-	if skills.upserts[0].Name != "故障复盘模板" {
-		t.Fatalf("unexpected first evolved skill: %+v", skills.upserts[0])
+	if !strings.Contains(messages[2].Content, "【延后处理】") || !strings.Contains(messages[2].Content, "学习计划已整理") {
+		t.Fatalf("unexpected deferred reply: %q", messages[2].Content)
+	}
+	if messages[3].Content != "早" || messages[4].Content != "早上好" {
+		t.Fatalf("expected the new message after the deferred reply, got %+v", messages[3:])
 	}
 }
 
-func TestHandleUserMessage_MorningPlanningPrependsReplyAndTracksDate(t *testing.T) {
+func TestRunScheduledHumanRoutine_FailedDeferredReplyStaysQueued(t *testing.T) {
 	store := conversation.NewStore()
-	fakeLLM := &mockLLM{responses: map[string][]string{
-		"morning_planning": {"回顾：昨天完成 2 项，1 项待推进。\n今日 Top3：A/B/C。\n能力提升：复盘一个线上问题。"},
-		"chat_reply":       {"好的，我先从任务 A 开始。"},
-	}}
-
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": {"学习计划已整理"}},
+		errors:    map[string][]error{"chat_reply": {errors.New("upstream down")}},
+	}
 	agentSvc := New(Config{
 		Model:                      "test-model",
 		MaxRecentMessages:          10,
@@ -790,35 +1366,41 @@ func TestHandleUserMessage_MorningPlanningPrependsReplyAndTracksDate(t *testing.
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
 		EnforceHumanRoutine:        true,
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
 	}, store, fakeLLM, nil)
-	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 9, 5, 0, 0, time.Local)
+	now := time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
+	agentSvc.nowFn = func() time.Time { return now }
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "帮我整理下周学习计划"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	habits := &mockHabits{}
-	agentSvc.SetHabitProvider(habits)
 
-	reply, err := agentSvc.HandleUserMessage(context.Background(), "今天我应该先做什么")
-	if err != nil {
-		t.Fatalf("HandleUserMessage error: %v", err)
+	now = time.Date(2026, 2, 14, 9, 0, 0, 0, time.Local)
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
 	}
-	if !strings.Contains(reply, "晨间规划") {
-		t.Fatalf("expected morning planning prefix in reply, got %q", reply)
+	if store.DeferredCount() != 1 {
+		t.Fatalf("expected the failed message to stay queued, got %d", store.DeferredCount())
 	}
-	if habits.lastWakePlanDate != "2026-02-14" {
-		t.Fatalf("expected wake plan date recorded, got %q", habits.lastWakePlanDate)
+	if _, messages := store.Snapshot(); len(messages) != 2 {
+		t.Fatalf("expected no reply for the failed attempt, got %+v", messages)
 	}
-	if len(fakeLLM.calls) != 2 {
-		t.Fatalf("expected two llm calls (planning + reply), got %d", len(fakeLLM.calls))
+
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
 	}
-	if fakeLLM.calls[0].Purpose != "morning_planning" {
-		t.Fatalf("expected first call is morning planning, got %s", fakeLLM.calls[0].Purpose)
+	if store.DeferredCount() != 0 {
+		t.Fatalf("expected the retry to drain the queue, got %d", store.DeferredCount())
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 3 || !strings.Contains(messages[2].Content, "学习计划已整理") {
+		t.Fatalf("expected the deferred reply after the retry, got %+v", messages)
 	}
 }
 
-func TestRunScheduledHumanRoutine_NightReviewAppendsOncePerDay(t *testing.T) {
+func TestHandleUserMessage_SleepWindowUrgentStillCallsLLM(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{responses: map[string][]string{
-		"night_reflection_evolution": {`{"reflection":"生活：收束。工作：复盘。学习：迭代。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，并保持务实稳定。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格事实与进度，输出纯文本。"}`},
+		"chat_reply": {"紧急止损方案"},
 	}}
 
 	agentSvc := New(Config{
@@ -834,40 +1416,77 @@ func TestRunScheduledHumanRoutine_NightReviewAppendsOncePerDay(t *testing.T) {
 		EnforceHumanRoutine:        true,
 	}, store, fakeLLM, nil)
 	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 2, 30, 0, 0, time.Local)
+		return time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
+	}
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "紧急：生产环境宕机，马上给我止损方案")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "紧急止损方案" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if len(fakeLLM.calls) != 1 {
+		t.Fatalf("expected llm to be called for urgent message, got %d", len(fakeLLM.calls))
+	}
+}
+
+func TestHandleUserMessage_SleepWindowRunsReflectionAndPromptEvolution(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"night_reflection_evolution": {`{"reflection":"生活：按时休息。工作：推进核心任务。学习：补齐短板。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，回答务实、可执行、可复盘，并持续优化工作和学习策略。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格、事实、任务进度、学习进展与待办，输出简洁纯文本。","skills":[{"name":"故障复盘模板","prompt":"先写事实时间线，再写根因、影响、修复与预防项。"},{"name":"学习闭环","prompt":"每天结束前记录一个短板与一个可执行练习。"}]}`},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 2, 10, 0, 0, time.Local)
 	}
 	updater := &mockPromptUpdater{}
 	habits := &mockHabits{}
+	skills := &mockSkills{}
 	agentSvc.SetPromptUpdater(updater)
 	agentSvc.SetHabitProvider(habits)
+	agentSvc.SetSkillProvider(skills)
 
-	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
-		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
-	}
-	_, messages := store.Snapshot()
-	if len(messages) != 1 {
-		t.Fatalf("expected one auto message, got %d", len(messages))
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我明天继续优化服务")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
 	}
-	if !strings.Contains(messages[0].Content, "夜间复盘（自动）") {
-		t.Fatalf("unexpected auto message: %q", messages[0].Content)
+	if !strings.Contains(reply, "夜间复盘") {
+		t.Fatalf("expected reflection section in sleep reply, got %q", reply)
 	}
 	if updater.calls != 1 {
-		t.Fatalf("expected one prompt update, got %d", updater.calls)
+		t.Fatalf("expected one prompt evolution update, got %d", updater.calls)
 	}
-
-	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
-		t.Fatalf("RunScheduledHumanRoutine second call error: %v", err)
+	if habits.lastSleepReviewDate != "2026-02-14" {
+		t.Fatalf("expected sleep review date recorded, got %q", habits.lastSleepReviewDate)
 	}
-	_, messages = store.Snapshot()
-	if len(messages) != 1 {
-		t.Fatalf("expected no duplicate nightly message, got %d", len(messages))
+	if habits.lastPromptEvolutionDate != "2026-02-14" {
+		t.Fatalf("expected prompt evolution date recorded, got %q", habits.lastPromptEvolutionDate)
+	}
+	if len(skills.upserts) != 2 {
+		t.Fatalf("expected 2 evolved skills, got %d", len(skills.upserts))
+	}
+	if skills.upserts[0].Name != "故障复盘模板" {
+		t.Fatalf("unexpected first evolved skill: %+v", skills.upserts[0])
 	}
 }
 
-func TestRunScheduledHumanRoutine_MorningPlanAppendsOncePerDay(t *testing.T) {
+func TestRunPromptEvolutionNow_DedupedPerDayUnlessForced(t *testing.T) {
 	store := conversation.NewStore()
 	fakeLLM := &mockLLM{responses: map[string][]string{
-		"morning_planning": {"回顾：昨日 2/3 完成。\n今日 Top3：A/B/C。\n能力提升：复盘线上问题。"},
+		"night_reflection_evolution": {`{"reflection":"工作：推进核心任务。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，回答务实、可执行、可复盘。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格、事实、任务进度与待办，输出简洁纯文本。","skills":[]}`, `{"reflection":"工作：推进核心任务。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，回答务实、可执行、可复盘。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格、事实、任务进度与待办，输出简洁纯文本。","skills":[]}`},
 	}}
 
 	agentSvc := New(Config{
@@ -880,44 +1499,51 @@ func TestRunScheduledHumanRoutine_MorningPlanAppendsOncePerDay(t *testing.T) {
 		MaxToolCallRounds:          2,
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
-		EnforceHumanRoutine:        true,
 	}, store, fakeLLM, nil)
 	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 9, 0, 0, 0, time.Local)
+		return time.Date(2026, 2, 14, 15, 0, 0, 0, time.Local)
 	}
+	updater := &mockPromptUpdater{}
 	habits := &mockHabits{}
+	agentSvc.SetPromptUpdater(updater)
 	agentSvc.SetHabitProvider(habits)
 
-	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
-		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
+	result, err := agentSvc.RunPromptEvolutionNow(context.Background(), false)
+	if err != nil {
+		t.Fatalf("RunPromptEvolutionNow error: %v", err)
 	}
-	_, messages := store.Snapshot()
-	if len(messages) != 1 {
-		t.Fatalf("expected one auto message, got %d", len(messages))
+	if result.Skipped || !result.PromptsUpdated || !strings.Contains(result.Reflection, "核心任务") {
+		t.Fatalf("unexpected first result: %+v", result)
 	}
-	if !strings.Contains(messages[0].Content, "晨间规划（自动）") {
-		t.Fatalf("unexpected auto message: %q", messages[0].Content)
+	if habits.lastPromptEvolutionDate != "2026-02-14" {
+		t.Fatalf("expected evolution date recorded, got %q", habits.lastPromptEvolutionDate)
 	}
 
-	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
-		t.Fatalf("RunScheduledHumanRoutine second call error: %v", err)
+	result, err = agentSvc.RunPromptEvolutionNow(context.Background(), false)
+	if err != nil {
+		t.Fatalf("second RunPromptEvolutionNow error: %v", err)
 	}
-	_, messages = store.Snapshot()
-	if len(messages) != 1 {
-		t.Fatalf("expected no duplicate morning message, got %d", len(messages))
+	if !result.Skipped || updater.calls != 1 {
+		t.Fatalf("expected second run to be deduped, got %+v with %d updates", result, updater.calls)
+	}
+
+	result, err = agentSvc.RunPromptEvolutionNow(context.Background(), true)
+	if err != nil {
+		t.Fatalf("forced RunPromptEvolutionNow error: %v", err)
+	}
+	if result.Skipped || updater.calls != 2 {
+		t.Fatalf("expected forced run to evolve again, got %+v with %d updates", result, updater.calls)
 	}
 }
 
-func TestRetryLastUserMessage_ReusesPendingUserMessage(t *testing.T) {
+func TestRecompressNow_UpdatesSummaryWithoutTriggers(t *testing.T) {
 	store := conversation.NewStore()
-	fakeLLM := &mockLLM{
-		responses: map[string][]string{
-			"chat_reply": {"retry-ok"},
-		},
-		errors: map[string][]error{
-			"chat_reply": {errors.New("llm unavailable"), nil},
-		},
-	}
+	store.Append("user", "帮我记一下周五发版")
+	store.Append("assistant", "已记录")
+	store.Append("user", "顺便提醒回归测试")
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"compress_context": {"新摘要：周五发版，需回归测试"},
+	}}
 
 	agentSvc := New(Config{
 		Model:                      "test-model",
@@ -931,73 +1557,197 @@ func TestRetryLastUserMessage_ReusesPendingUserMessage(t *testing.T) {
 		CompressionSystemPrompt:    "compressor",
 		EnforceHumanRoutine:        true,
 	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 2, 0, 0, 0, time.Local)
+	}
 
-	if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err == nil {
-		t.Fatalf("expected first chat to fail")
+	if _, err := agentSvc.RecompressNow(context.Background(), false); !errors.Is(err, ErrSleepWindow) {
+		t.Fatalf("expected ErrSleepWindow, got %v", err)
+	}
+	if len(fakeLLM.calls) != 0 {
+		t.Fatalf("expected no LLM call in sleep window, got %d", len(fakeLLM.calls))
+	}
+
+	summary, err := agentSvc.RecompressNow(context.Background(), true)
+	if err != nil {
+		t.Fatalf("RecompressNow error: %v", err)
+	}
+	if summary != "新摘要：周五发版，需回归测试" {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+	storedSummary, messages := store.Snapshot()
+	if storedSummary != summary {
+		t.Fatalf("expected stored summary %q, got %q", summary, storedSummary)
 	}
+	if len(messages) != 1 || messages[0].Content != "顺便提醒回归测试" {
+		t.Fatalf("expected trim to keep the latest message, got %+v", messages)
+	}
+	if !strings.Contains(fakeLLM.calls[0].Messages[1].Content, "帮我记一下周五发版") {
+		t.Fatalf("expected compression over the whole snapshot, got %q", fakeLLM.calls[0].Messages[1].Content)
+	}
+}
+
+func TestRecompressNow_KeepRecentTurnsTrimsOnTurnBoundaries(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "q1")
+	store.Append("assistant", "a1")
+	store.Append("user", "q2")
+	store.Append("assistant", "a2-part1")
+	store.Append("assistant", "a2-part2")
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"compress_context": {"summary"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		KeepRecentAfterCompression: 2,
+		KeepRecentTurns:            1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
 
+	if _, err := agentSvc.RecompressNow(context.Background(), false); err != nil {
+		t.Fatalf("RecompressNow error: %v", err)
+	}
 	_, messages := store.Snapshot()
-	if len(messages) != 1 || messages[0].Role != "user" {
-		t.Fatalf("expected only pending user message, got %+v", messages)
+	if len(messages) != 3 || messages[0].Content != "q2" {
+		t.Fatalf("expected the last turn kept from its user message, got %+v", messages)
 	}
+}
 
-	reply, err := agentSvc.RetryLastUserMessage(context.Background())
+func TestRunPromptEvolutionNow_RequestsJSONResponseFormat(t *testing.T) {
+	store := conversation.NewStore()
+	// Providers that ignore response_format may still wrap the JSON in prose.
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"night_reflection_evolution": {"好的，结果如下：\n```json\n{\"reflection\":\"复盘完成\",\"skills\":[]}\n```"},
+	}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
+	agentSvc.SetPromptUpdater(&mockPromptUpdater{})
+
+	result, err := agentSvc.RunPromptEvolutionNow(context.Background(), true)
 	if err != nil {
-		t.Fatalf("RetryLastUserMessage error: %v", err)
+		t.Fatalf("RunPromptEvolutionNow error: %v", err)
 	}
-	if reply != "retry-ok" {
-		t.Fatalf("unexpected retry reply: %s", reply)
+	if result.Reflection != "复盘完成" {
+		t.Fatalf("expected reflection parsed from wrapped JSON, got %q", result.Reflection)
+	}
+	if len(fakeLLM.calls) != 1 {
+		t.Fatalf("expected one llm call, got %d", len(fakeLLM.calls))
+	}
+	format := fakeLLM.calls[0].ResponseFormat
+	if format == nil || format.Type != "json_object" {
+		t.Fatalf("expected json_object response format, got %+v", format)
 	}
+}
 
-	_, messages = store.Snapshot()
-	if len(messages) != 2 {
-		t.Fatalf("expected 2 messages after retry, got %d", len(messages))
+func TestReflectionAndPlanning_UseConfiguredLookback(t *testing.T) {
+	store := conversation.NewStore()
+	for i := 0; i < 10; i++ {
+		store.Append("user", fmt.Sprintf("msg-%d", i))
 	}
-	if messages[0].Role != "user" || messages[1].Role != "assistant" {
-		t.Fatalf("unexpected roles after retry: %+v", messages)
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"night_reflection_evolution": {`{"reflection":"ok","skills":[]}`},
+		"morning_planning":           {"plan"},
+	}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		NightReflectionLookback:    3,
+		MorningPlanLookback:        5,
+	}, store, fakeLLM, nil)
+	agentSvc.SetPromptUpdater(&mockPromptUpdater{})
+
+	if _, err := agentSvc.RunPromptEvolutionNow(context.Background(), true); err != nil {
+		t.Fatalf("RunPromptEvolutionNow error: %v", err)
 	}
-	if len(fakeLLM.calls) != 2 {
-		t.Fatalf("expected 2 llm calls, got %d", len(fakeLLM.calls))
+	summary, messages := store.Snapshot()
+	if _, err := agentSvc.generateMorningPlan(context.Background(), summary, messages); err != nil {
+		t.Fatalf("generateMorningPlan error: %v", err)
+	}
+
+	for i, want := range []int{3, 5} {
+		prompt := fakeLLM.calls[i].Messages[1].Content
+		first := 10 - want
+		if !strings.Contains(prompt, fmt.Sprintf("msg-%d", first)) || strings.Contains(prompt, fmt.Sprintf("msg-%d", first-1)) {
+			t.Fatalf("%s prompt should include exactly the last %d messages, got %q", fakeLLM.calls[i].Purpose, want, prompt)
+		}
 	}
 }
 
-func TestRetryLastUserMessage_SleepWindowNonUrgentBypassesLLM(t *testing.T) {
+func TestCompressionReflectionAndPlanning_UseConfiguredTemperatures(t *testing.T) {
 	store := conversation.NewStore()
-	store.Append("user", "帮我规划一下明天任务")
-	fakeLLM := &mockLLM{}
-
+	store.Append("user", "old question")
+	store.Append("assistant", "old answer")
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"night_reflection_evolution": {`{"reflection":"ok","skills":[]}`},
+		"morning_planning":           {"plan"},
+		"compress_context":           {"summary"},
+	}}
+	compression, planning, reflection := 0.4, 0.9, 0.6
 	agentSvc := New(Config{
 		Model:                      "test-model",
+		Temperature:                0.7,
 		MaxRecentMessages:          10,
 		CompressionTriggerMessages: 99,
-		CompressionTriggerChars:    99999,
-		KeepRecentAfterCompression: 1,
 		MaxCompressionLoopsPerTurn: 1,
 		MaxToolCallRounds:          2,
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
-		EnforceHumanRoutine:        true,
+		CompressionTemperature:     &compression,
+		MorningPlanTemperature:     &planning,
+		NightReflectionTemperature: &reflection,
 	}, store, fakeLLM, nil)
-	agentSvc.nowFn = func() time.Time {
-		return time.Date(2026, 2, 14, 3, 0, 0, 0, time.Local)
+	agentSvc.SetPromptUpdater(&mockPromptUpdater{})
+
+	if _, err := agentSvc.RunPromptEvolutionNow(context.Background(), true); err != nil {
+		t.Fatalf("RunPromptEvolutionNow error: %v", err)
+	}
+	summary, messages := store.Snapshot()
+	if _, err := agentSvc.generateMorningPlan(context.Background(), summary, messages); err != nil {
+		t.Fatalf("generateMorningPlan error: %v", err)
+	}
+	if _, err := agentSvc.compressContext(context.Background(), summary, messages); err != nil {
+		t.Fatalf("compressContext error: %v", err)
 	}
 
-	reply, err := agentSvc.RetryLastUserMessage(context.Background())
-	if err != nil {
-		t.Fatalf("RetryLastUserMessage error: %v", err)
+	want := map[string]float64{
+		"night_reflection_evolution": reflection,
+		"morning_planning":           planning,
+		"compress_context":           compression,
 	}
-	if !strings.Contains(reply, "休息时段") {
-		t.Fatalf("expected sleep-window reply, got %q", reply)
+	if len(fakeLLM.calls) != len(want) {
+		t.Fatalf("expected %d llm calls, got %d", len(want), len(fakeLLM.calls))
 	}
-	if len(fakeLLM.calls) != 0 {
-		t.Fatalf("expected no llm calls, got %d", len(fakeLLM.calls))
+	for _, call := range fakeLLM.calls {
+		if call.Temperature != want[call.Purpose] {
+			t.Fatalf("%s temperature = %v, want %v", call.Purpose, call.Temperature, want[call.Purpose])
+		}
 	}
 }
 
-func TestRetryLastUserMessage_NoPendingUser(t *testing.T) {
+func TestHandleUserMessage_MorningPlanningPrependsReplyAndTracksDate(t *testing.T) {
 	store := conversation.NewStore()
-	store.Append("assistant", "ready")
-	fakeLLM := &mockLLM{}
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"morning_planning": {"回顾：昨天完成 2 项，1 项待推进。\n今日 Top3：A/B/C。\n能力提升：复盘一个线上问题。"},
+		"chat_reply":       {"好的，我先从任务 A 开始。"},
+	}}
 
 	agentSvc := New(Config{
 		Model:                      "test-model",
@@ -1009,9 +1759,1885 @@ func TestRetryLastUserMessage_NoPendingUser(t *testing.T) {
 		MaxToolCallRounds:          2,
 		SystemPrompt:               "system",
 		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
 	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 9, 5, 0, 0, time.Local)
+	}
+	habits := &mockHabits{}
+	agentSvc.SetHabitProvider(habits)
 
-	if _, err := agentSvc.RetryLastUserMessage(context.Background()); err == nil {
-		t.Fatalf("expected retry to fail when no pending user message")
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "今天我应该先做什么")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if !strings.Contains(reply, "晨间规划") {
+		t.Fatalf("expected morning planning prefix in reply, got %q", reply)
+	}
+	if habits.lastWakePlanDate != "2026-02-14" {
+		t.Fatalf("expected wake plan date recorded, got %q", habits.lastWakePlanDate)
+	}
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected two llm calls (planning + reply), got %d", len(fakeLLM.calls))
+	}
+	if fakeLLM.calls[0].Purpose != "morning_planning" {
+		t.Fatalf("expected first call is morning planning, got %s", fakeLLM.calls[0].Purpose)
+	}
+}
+
+func TestRunScheduledHumanRoutine_NightReviewAppendsOncePerDay(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"night_reflection_evolution": {`{"reflection":"生活：收束。工作：复盘。学习：迭代。","system_prompt":"你是用户的 AI 数字分身，名字叫“傻毛”，女性，8 年全栈开发经验。你始终不使用表情符号，并保持务实稳定。","compression_system_prompt":"你是“傻毛”数字分身的上下文压缩器，保留人格事实与进度，输出纯文本。"}`},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 2, 30, 0, 0, time.Local)
+	}
+	updater := &mockPromptUpdater{}
+	habits := &mockHabits{}
+	agentSvc.SetPromptUpdater(updater)
+	agentSvc.SetHabitProvider(habits)
+
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 1 {
+		t.Fatalf("expected one auto message, got %d", len(messages))
+	}
+	if !strings.Contains(messages[0].Content, "夜间复盘（自动）") {
+		t.Fatalf("unexpected auto message: %q", messages[0].Content)
+	}
+	if updater.calls != 1 {
+		t.Fatalf("expected one prompt update, got %d", updater.calls)
+	}
+
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine second call error: %v", err)
+	}
+	_, messages = store.Snapshot()
+	if len(messages) != 1 {
+		t.Fatalf("expected no duplicate nightly message, got %d", len(messages))
+	}
+}
+
+func TestRunScheduledHumanRoutine_MorningPlanAppendsOncePerDay(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"morning_planning": {"回顾：昨日 2/3 完成。\n今日 Top3：A/B/C。\n能力提升：复盘线上问题。"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 9, 0, 0, 0, time.Local)
+	}
+	habits := &mockHabits{}
+	agentSvc.SetHabitProvider(habits)
+
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 1 {
+		t.Fatalf("expected one auto message, got %d", len(messages))
+	}
+	if !strings.Contains(messages[0].Content, "晨间规划（自动）") {
+		t.Fatalf("unexpected auto message: %q", messages[0].Content)
+	}
+
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine second call error: %v", err)
+	}
+	_, messages = store.Snapshot()
+	if len(messages) != 1 {
+		t.Fatalf("expected no duplicate morning message, got %d", len(messages))
+	}
+}
+
+func TestRetryLastUserMessage_ReusesPendingUserMessage(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"retry-ok"},
+		},
+		errors: map[string][]error{
+			"chat_reply": {errors.New("llm unavailable"), nil},
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+	}, store, fakeLLM, nil)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err == nil {
+		t.Fatalf("expected first chat to fail")
+	}
+
+	_, messages := store.Snapshot()
+	if len(messages) != 1 || messages[0].Role != "user" {
+		t.Fatalf("expected only pending user message, got %+v", messages)
+	}
+
+	reply, err := agentSvc.RetryLastUserMessage(context.Background())
+	if err != nil {
+		t.Fatalf("RetryLastUserMessage error: %v", err)
+	}
+	if reply != "retry-ok" {
+		t.Fatalf("unexpected retry reply: %s", reply)
+	}
+
+	_, messages = store.Snapshot()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages after retry, got %d", len(messages))
+	}
+	if messages[0].Role != "user" || messages[1].Role != "assistant" {
+		t.Fatalf("unexpected roles after retry: %+v", messages)
+	}
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected 2 llm calls, got %d", len(fakeLLM.calls))
+	}
+}
+
+func TestHandleUserMessage_MidLoopFailureKeepsToolResultsOnPendingMessage(t *testing.T) {
+	store := conversation.NewStore()
+	lookupCall := func(id, args string) []llm.ToolCall {
+		return []llm.ToolCall{{ID: id, Type: "function", Function: llm.ToolFunctionCall{Name: "search__lookup", Arguments: args}}}
+	}
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", ""},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				lookupCall("call_1", `{"q":"first"}`),
+				lookupCall("call_2", `{"q":"second"}`),
+			},
+		},
+		errors: map[string][]error{
+			"chat_reply": {nil, nil, errors.New("llm unavailable")},
+		},
+	}
+	tools := &mockTools{
+		listed: []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "search__lookup"}}},
+		response: map[string]string{
+			`search__lookup:{"q":"first"}`:  "result one",
+			`search__lookup:{"q":"second"}`: "result two",
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, tools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "查两次"); err == nil {
+		t.Fatalf("expected the third LLM round to fail")
+	}
+
+	_, messages := store.Snapshot()
+	if len(messages) != 1 || messages[0].Role != "user" {
+		t.Fatalf("expected only the pending user message, got %+v", messages)
+	}
+	calls := messages[0].ToolCalls
+	if len(calls) != 2 {
+		t.Fatalf("expected both executed tool calls on the pending message, got %+v", calls)
+	}
+	if calls[0].ID != "call_1" || calls[0].Result != "result one" || calls[1].ID != "call_2" || calls[1].Result != "result two" {
+		t.Fatalf("unexpected recorded tool calls: %+v", calls)
+	}
+}
+
+func TestRetryLastUserMessage_ReplaysToolsCompletedBeforeFailure(t *testing.T) {
+	store := conversation.NewStore()
+	sendCall := func(id, args string) []llm.ToolCall {
+		return []llm.ToolCall{{ID: id, Type: "function", Function: llm.ToolFunctionCall{Name: "notify__send", Arguments: args}}}
+	}
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", "", "已发送"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				sendCall("call_a", `{"to":"alice","text":"hi"}`),
+				// The retry issues the same call under a new id with reordered keys.
+				sendCall("call_b", `{"text":"hi", "to":"alice"}`),
+			},
+		},
+		errors: map[string][]error{
+			"chat_reply": {nil, errors.New("llm unavailable"), nil, nil},
+		},
+	}
+	tools := &mockTools{
+		listed:   []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "notify__send"}}},
+		response: map[string]string{`notify__send:{"to":"alice","text":"hi"}`: `{"sent":true}`},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, tools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "给 alice 发 hi"); err == nil {
+		t.Fatalf("expected first attempt to fail")
+	}
+	if len(tools.calls) != 1 {
+		t.Fatalf("expected the tool to run once before the failure, got %d", len(tools.calls))
+	}
+
+	reply, err := agentSvc.RetryLastUserMessage(context.Background())
+	if err != nil {
+		t.Fatalf("RetryLastUserMessage error: %v", err)
+	}
+	if reply != "已发送" {
+		t.Fatalf("unexpected retry reply: %q", reply)
+	}
+	if len(tools.calls) != 1 {
+		t.Fatalf("expected retry to replay instead of re-running the tool, got %d executions", len(tools.calls))
+	}
+
+	lastRequest := fakeLLM.calls[len(fakeLLM.calls)-1]
+	toolMsg := lastRequest.Messages[len(lastRequest.Messages)-1]
+	if toolMsg.Role != "tool" || toolMsg.ToolCallID != "call_b" || toolMsg.Content != `{"sent":true}` {
+		t.Fatalf("expected recorded result replayed under the new call id, got %+v", toolMsg)
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 2 || len(messages[1].ToolCalls) != 1 || messages[1].ToolCalls[0].ID != "call_b" {
+		t.Fatalf("expected replayed call recorded on the reply, got %+v", messages)
+	}
+}
+
+func TestRetryLastUserMessage_SleepWindowNonUrgentBypassesLLM(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "帮我规划一下明天任务")
+	fakeLLM := &mockLLM{}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 3, 0, 0, 0, time.Local)
+	}
+
+	reply, err := agentSvc.RetryLastUserMessage(context.Background())
+	if err != nil {
+		t.Fatalf("RetryLastUserMessage error: %v", err)
+	}
+	if !strings.Contains(reply, "休息时段") {
+		t.Fatalf("expected sleep-window reply, got %q", reply)
+	}
+	if len(fakeLLM.calls) != 0 {
+		t.Fatalf("expected no llm calls, got %d", len(fakeLLM.calls))
+	}
+}
+
+func TestRetryLastUserMessage_NoPendingUser(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("assistant", "ready")
+	fakeLLM := &mockLLM{}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, nil)
+
+	if _, err := agentSvc.RetryLastUserMessage(context.Background()); err == nil {
+		t.Fatalf("expected retry to fail when no pending user message")
+	}
+}
+
+type slowLLM struct {
+	mu        sync.Mutex
+	calls     int
+	firstCall []llm.ToolCall
+}
+
+func (m *slowLLM) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	m.mu.Lock()
+	m.calls++
+	call := m.calls
+	m.mu.Unlock()
+
+	if call == 1 {
+		return llm.ChatResponse{ToolCalls: m.firstCall}, nil
+	}
+	select {
+	case <-ctx.Done():
+		return llm.ChatResponse{}, ctx.Err()
+	case <-time.After(5 * time.Second):
+		return llm.ChatResponse{Content: "too late"}, nil
+	}
+}
+
+func TestHandleUserMessage_MaxTurnDurationAbortsToolLoop(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &slowLLM{
+		firstCall: []llm.ToolCall{
+			{
+				ID:   "call_1",
+				Type: "function",
+				Function: llm.ToolFunctionCall{
+					Name:      "weather__query",
+					Arguments: `{"city":"beijing"}`,
+				},
+			},
+		},
+	}
+	fakeTools := &mockTools{
+		listed: []llm.ToolDefinition{
+			{Type: "function", Function: llm.ToolFunctionDefinition{Name: "weather__query"}},
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		MaxTurnDuration:            150 * time.Millisecond,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, fakeTools)
+
+	start := time.Now()
+	_, err := agentSvc.HandleUserMessage(context.Background(), "今天北京天气")
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatalf("expected turn deadline error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "1 completed tool calls") {
+		t.Fatalf("expected partial progress in error, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("expected turn to abort near deadline, took %s", elapsed)
+	}
+
+	_, messages := store.Snapshot()
+	if len(messages) != 1 || messages[0].Role != "user" {
+		t.Fatalf("expected only pending user message, got %+v", messages)
+	}
+	if len(messages[0].ToolCalls) != 1 || messages[0].ToolCalls[0].Name != "weather__query" {
+		t.Fatalf("expected completed tool call persisted, got %+v", messages[0].ToolCalls)
+	}
+}
+
+type blockingLLM struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingLLM) Chat(ctx context.Context, _ llm.ChatRequest) (llm.ChatResponse, error) {
+	m.started <- struct{}{}
+	select {
+	case <-m.release:
+		return llm.ChatResponse{Content: "done"}, nil
+	case <-ctx.Done():
+		return llm.ChatResponse{}, ctx.Err()
+	}
+}
+
+func TestHandleUserMessage_BoundsTurnsWaitingBehindRunningTurn(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &blockingLLM{started: make(chan struct{}, 4), release: make(chan struct{})}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+		MaxPendingTurns:            1,
+	}, store, fakeLLM, nil)
+
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := agentSvc.HandleUserMessage(context.Background(), "first")
+		firstDone <- err
+	}()
+	<-fakeLLM.started
+
+	waitCtx, cancelWait := context.WithCancel(context.Background())
+	secondDone := make(chan error, 1)
+	go func() {
+		_, err := agentSvc.HandleUserMessage(waitCtx, "second")
+		secondDone <- err
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for agentSvc.gate.waiting.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("second turn never started waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "third"); !errors.Is(err, ErrAgentBusy) {
+		t.Fatalf("expected ErrAgentBusy for the turn beyond the cap, got %v", err)
+	}
+
+	cancelWait()
+	if err := <-secondDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected waiting turn to give up with its context, got %v", err)
+	}
+
+	close(fakeLLM.release)
+	if err := <-firstDone; err != nil {
+		t.Fatalf("first turn error: %v", err)
+	}
+	_, messages := store.Snapshot()
+	if len(messages) != 2 || messages[0].Content != "first" || messages[1].Content != "done" {
+		t.Fatalf("rejected turns must not be persisted, got %+v", messages)
+	}
+}
+
+func TestRunningTurn_DoesNotBlockAccessorsAndRoutineWaitsAtGate(t *testing.T) {
+	fakeLLM := &blockingLLM{started: make(chan struct{}, 4), release: make(chan struct{})}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+
+	turnDone := make(chan error, 1)
+	go func() {
+		_, err := agentSvc.HandleUserMessage(context.Background(), "slow")
+		turnDone <- err
+	}()
+	<-fakeLLM.started
+
+	prompts := make(chan string, 1)
+	go func() {
+		systemPrompt, _ := agentSvc.GetEffectivePrompts()
+		prompts <- systemPrompt
+	}()
+	select {
+	case got := <-prompts:
+		if got != "system" {
+			t.Fatalf("unexpected system prompt %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("GetEffectivePrompts blocked behind the running turn")
+	}
+
+	routineCtx, cancelRoutine := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelRoutine()
+	if err := agentSvc.RunScheduledHumanRoutine(routineCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the routine to give up waiting for the turn, got %v", err)
+	}
+
+	close(fakeLLM.release)
+	if err := <-turnDone; err != nil {
+		t.Fatalf("turn error: %v", err)
+	}
+}
+
+func TestExtractJSONObject(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "plain", content: `{"a":1}`, want: `{"a":1}`},
+		{name: "fenced with commentary", content: "结果如下：\n```json\n{\"a\":{\"b\":2}}\n```\n以上 {仅供参考}", want: `{"a":{"b":2}}`},
+		{name: "prose with braces first", content: `先说明一下 {这里不是 JSON}，然后：{"a":"x}y"}`, want: `{"a":"x}y"}`},
+		{name: "trailing garbage", content: `{"a":[1,2]} 后面还有 } 和 {`, want: `{"a":[1,2]}`},
+		{name: "first valid of several", content: `{bad} {"a":1} {"b":2}`, want: `{"a":1}`},
+		{name: "escaped quote", content: `{"a":"he said \"{\""}`, want: `{"a":"he said \"{\""}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extractJSONObject(tc.content); got != tc.want {
+				t.Fatalf("extractJSONObject(%q) = %q, want %q", tc.content, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClassifyToolError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "invalid json", err: fmt.Errorf("%w: %w", llm.ErrInvalidToolArgs, errors.New("unexpected end of JSON input")), want: toolErrorInvalidArgs},
+		{name: "missing arg", err: fmt.Errorf("%w: tool argument %q is required", llm.ErrInvalidToolArgs, "command"), want: toolErrorInvalidArgs},
+		{name: "unknown tool", err: fmt.Errorf("%w: unknown tool %q", llm.ErrToolUnavailable, "nope__tool"), want: toolErrorToolUnavailable},
+		{name: "disabled service", err: fmt.Errorf("%w: mcp service %q is disabled", llm.ErrToolUnavailable, "search"), want: toolErrorToolUnavailable},
+		{name: "server down", err: fmt.Errorf("call tool: %w", llm.ErrToolUnavailable), want: toolErrorToolUnavailable},
+		{name: "deadline", err: fmt.Errorf("call tool: %w", context.DeadlineExceeded), want: toolErrorTimeout},
+		{name: "tool reported error", err: errors.New("file not readable: permission denied"), want: toolErrorExecution},
+		{name: "tool reported not found", err: errors.New("file not found"), want: toolErrorExecution},
+		{name: "tool reported timeout text", err: errors.New("upstream timeout setting is disabled"), want: toolErrorExecution},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyToolError(tc.err); got != tc.want {
+				t.Fatalf("classifyToolError(%v) = %s, want %s", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleUserMessage_ToolErrorsAreCategorized(t *testing.T) {
+	toolCall := func(id, name, args string) llm.ToolCall {
+		return llm.ToolCall{ID: id, Type: "function", Function: llm.ToolFunctionCall{Name: name, Arguments: args}}
+	}
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", "done"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					toolCall("call_args", builtinLinuxBashToolName, `{"working_dir":"/tmp"}`),
+					toolCall("call_missing", "ghost__tool", `{}`),
+					toolCall("call_slow", "slow__tool", `{}`),
+					toolCall("call_fail", "flaky__tool", `{}`),
+				},
+				nil,
+			},
+		},
+	}
+	fakeTools := &mockTools{
+		listed: []llm.ToolDefinition{
+			{Type: "function", Function: llm.ToolFunctionDefinition{Name: "slow__tool"}},
+			{Type: "function", Function: llm.ToolFunctionDefinition{Name: "flaky__tool"}},
+		},
+		errs: map[string]error{
+			"ghost__tool:{}": fmt.Errorf("%w: unknown tool %q", llm.ErrToolUnavailable, "ghost__tool"),
+			"slow__tool:{}":  fmt.Errorf("send rpc request: %w", context.DeadlineExceeded),
+			"flaky__tool:{}": errors.New("upstream returned: quota exhausted"),
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, fakeTools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "run tools"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected 2 llm calls, got %d", len(fakeLLM.calls))
+	}
+
+	results := make(map[string]string)
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" {
+			results[msg.ToolCallID] = msg.Content
+		}
+	}
+	want := map[string]string{
+		"call_args":    toolErrorInvalidArgs,
+		"call_missing": toolErrorToolUnavailable,
+		"call_slow":    toolErrorTimeout,
+		"call_fail":    toolErrorExecution,
+	}
+	for id, prefix := range want {
+		if !strings.HasPrefix(results[id], prefix+":") {
+			t.Fatalf("expected %s result to start with %s, got %q", id, prefix, results[id])
+		}
+	}
+}
+
+func TestHandleUserMessage_UrgentFirstMorningMessageSkipsPlanning(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{
+		"morning_planning": {"回顾：昨天完成 2 项。\n今日 Top3：A/B/C。"},
+		"chat_reply":       {"先回滚最近一次发布。", "好的。"},
+	}}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		EnforceHumanRoutine:        true,
+		SkipMorningPlanForUrgent:   true,
+	}, store, fakeLLM, nil)
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 14, 8, 35, 0, 0, time.Local)
+	}
+	habits := &mockHabits{}
+	agentSvc.SetHabitProvider(habits)
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "紧急：线上故障，接口全部 500")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "先回滚最近一次发布。" {
+		t.Fatalf("expected direct answer without planning preamble, got %q", reply)
+	}
+	if habits.lastWakePlanDate != "2026-02-14" {
+		t.Fatalf("expected wake plan date still recorded, got %q", habits.lastWakePlanDate)
+	}
+	for _, call := range fakeLLM.calls {
+		if call.Purpose == "morning_planning" {
+			t.Fatalf("expected no morning planning call for urgent message")
+		}
+	}
+
+	reply, err = agentSvc.HandleUserMessage(context.Background(), "恢复了，今天接下来做什么")
+	if err != nil {
+		t.Fatalf("HandleUserMessage second error: %v", err)
+	}
+	if strings.Contains(reply, "晨间规划") {
+		t.Fatalf("expected no planning on later message the same day, got %q", reply)
+	}
+}
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []string
+	done   chan struct{}
+}
+
+func (s *recordingSink) record(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *recordingSink) OnCompression(messageCount int) {
+	s.record(fmt.Sprintf("compression:%d", messageCount))
+}
+
+func (s *recordingSink) OnRound(round int) {
+	s.record(fmt.Sprintf("round:%d", round))
+}
+
+func (s *recordingSink) OnToolCall(call conversation.ToolCall) {
+	s.record("tool:" + call.Name)
+}
+
+func (s *recordingSink) OnReply(reply string) {
+	s.record("reply:" + reply)
+	close(s.done)
+}
+
+func TestHandleUserMessage_EmitsEventSequence(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "old question")
+	store.Append("assistant", "old answer")
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"compress_context": {"summary-v1"},
+			"chat_reply":       {"", "weather ready"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					{
+						ID:       "call_1",
+						Type:     "function",
+						Function: llm.ToolFunctionCall{Name: "weather__query", Arguments: `{"city":"beijing"}`},
+					},
+				},
+				nil,
+			},
+		},
+	}
+	fakeTools := &mockTools{
+		listed: []llm.ToolDefinition{
+			{Type: "function", Function: llm.ToolFunctionDefinition{Name: "weather__query"}},
+		},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 3,
+		CompressionTriggerChars:    0,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, fakeTools)
+	sink := &recordingSink{done: make(chan struct{})}
+	agentSvc.SetEventSink(sink)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "今天北京天气"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+
+	select {
+	case <-sink.done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for reply event")
+	}
+	sink.mu.Lock()
+	got := strings.Join(sink.events, ",")
+	sink.mu.Unlock()
+	want := "compression:3,round:1,tool:weather__query,round:2,reply:weather ready"
+	if got != want {
+		t.Fatalf("unexpected event sequence:\n got %s\nwant %s", got, want)
+	}
+}
+
+type stubEmbeddings struct {
+	mu     sync.Mutex
+	inputs [][]string
+}
+
+// Embed maps text onto two axes: "deploy" related and "sql" related.
+func (s *stubEmbeddings) Embed(_ context.Context, req llm.EmbeddingRequest) ([][]float64, error) {
+	s.mu.Lock()
+	s.inputs = append(s.inputs, append([]string(nil), req.Input...))
+	s.mu.Unlock()
+
+	out := make([][]float64, 0, len(req.Input))
+	for _, text := range req.Input {
+		vec := []float64{0.1, 0.1}
+		if strings.Contains(text, "上线") || strings.Contains(text, "发布") {
+			vec[0] = 1
+		}
+		if strings.Contains(text, "SQL") || strings.Contains(text, "索引") {
+			vec[1] = 1
+		}
+		out = append(out, vec)
+	}
+	return out, nil
+}
+
+func TestPreviewSkillInjection_DoesNotWaitForRunningTurn(t *testing.T) {
+	fakeLLM := &blockingLLM{started: make(chan struct{}, 4), release: make(chan struct{})}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetSkillProvider(&mockSkills{prompts: []string{"Go 并发排查：先看 goroutine dump。"}})
+
+	turnDone := make(chan error, 1)
+	go func() {
+		_, err := agentSvc.HandleUserMessage(context.Background(), "slow")
+		turnDone <- err
+	}()
+	<-fakeLLM.started
+
+	previewDone := make(chan []SkillInjectionPreview, 1)
+	go func() {
+		preview, _ := agentSvc.PreviewSkillInjection(context.Background(), "goroutine 泄漏怎么查")
+		previewDone <- preview
+	}()
+	select {
+	case preview := <-previewDone:
+		if len(preview) != 1 {
+			t.Fatalf("expected the skill in the preview, got %+v", preview)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("PreviewSkillInjection blocked behind the running turn")
+	}
+
+	close(fakeLLM.release)
+	if err := <-turnDone; err != nil {
+		t.Fatalf("turn error: %v", err)
+	}
+}
+
+func TestPreviewSkillInjection_MatchesRealTurn(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "昨天的 SQL 慢查询看完了")
+	store.Append("assistant", "好的")
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		MaxInjectedSkillPrompts:    2,
+	}, store, fakeLLM, nil)
+	agentSvc.SetSkillProvider(&mockSkills{prompts: []string{
+		"代码变更前先明确验收标准。",
+		"线上故障先止血再定位根因。",
+		"写 SQL 前先确认索引。",
+		"发布前执行最小回归用例。",
+	}})
+
+	preview, err := agentSvc.PreviewSkillInjection(context.Background(), "今晚准备发布新版本")
+	if err != nil {
+		t.Fatalf("PreviewSkillInjection error: %v", err)
+	}
+	if _, messages := store.Snapshot(); len(messages) != 2 || len(fakeLLM.calls) != 0 {
+		t.Fatalf("preview must not touch the conversation or call the LLM: %d messages, %d calls", len(messages), len(fakeLLM.calls))
+	}
+	if len(preview) != 2 || preview[0].Score < preview[1].Score {
+		t.Fatalf("expected two skills in descending score order, got %+v", preview)
+	}
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "今晚准备发布新版本"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	injected := agentSvc.TurnTraces()[0].Skills
+	if len(injected) != len(preview) {
+		t.Fatalf("preview %+v does not match injected %v", preview, injected)
+	}
+	for i := range preview {
+		if preview[i].Prompt != injected[i] {
+			t.Fatalf("preview %+v does not match injected %v", preview, injected)
+		}
+	}
+}
+
+func TestEmbeddingSkillSelector_PicksMostSimilarSkill(t *testing.T) {
+	embeddings := &stubEmbeddings{}
+	selector := NewEmbeddingSkillSelector(embeddings, "embed-model")
+	prompts := []string{
+		"写 SQL 前先确认索引与数据规模。",
+		"发布前执行最小回归用例并记录结果。",
+	}
+	messages := []conversation.Message{{Role: "user", Content: "今晚要上线新版本"}}
+
+	selected := selector.SelectSkillPrompts(context.Background(), prompts, "", messages, defaultSkillInjectionLimits())
+	if len(selected) != 2 {
+		t.Fatalf("expected both skills within budget, got %v", selected)
+	}
+	if selected[0] != prompts[1] {
+		t.Fatalf("expected release skill ranked first, got %v", selected)
+	}
+
+	if _, _, err := selector.embed(context.Background(), normalizeSkillPrompts(prompts, maxSingleSkillPromptRunes), "再看一下 SQL"); err != nil {
+		t.Fatalf("embed error: %v", err)
+	}
+	embeddings.mu.Lock()
+	defer embeddings.mu.Unlock()
+	if len(embeddings.inputs) != 2 || len(embeddings.inputs[1]) != 1 {
+		t.Fatalf("expected cached skill embeddings on second call, got %v", embeddings.inputs)
+	}
+}
+
+func TestHandleUserMessage_SkillInjectionCapIsConfigurable(t *testing.T) {
+	skillPrompts := []string{
+		"代码变更前先明确验收标准。",
+		"线上故障先止血再定位根因。",
+		"回答技术方案时给出回滚步骤。",
+		"写 SQL 前先确认索引。",
+		"发布前执行最小回归用例。",
+	}
+	injected := func(t *testing.T, maxPrompts int) string {
+		t.Helper()
+		fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+		agentSvc := New(Config{
+			Model:                      "test-model",
+			MaxRecentMessages:          10,
+			CompressionTriggerMessages: 99,
+			CompressionTriggerChars:    99999,
+			KeepRecentAfterCompression: 1,
+			MaxCompressionLoopsPerTurn: 1,
+			MaxToolCallRounds:          2,
+			SystemPrompt:               "system",
+			CompressionSystemPrompt:    "compressor",
+			MaxInjectedSkillPrompts:    maxPrompts,
+		}, conversation.NewStore(), fakeLLM, nil)
+		agentSvc.SetSkillProvider(&mockSkills{prompts: skillPrompts})
+		if _, err := agentSvc.HandleUserMessage(context.Background(), "准备发布"); err != nil {
+			t.Fatalf("HandleUserMessage error: %v", err)
+		}
+		for _, msg := range fakeLLM.calls[0].Messages {
+			if msg.Role == "system" && strings.Contains(msg.Content, "已启用技能") {
+				return msg.Content
+			}
+		}
+		t.Fatalf("expected injected skill message")
+		return ""
+	}
+
+	low := injected(t, 2)
+	if !strings.Contains(low, "2. ") || strings.Contains(low, "3. ") {
+		t.Fatalf("expected exactly 2 injected skills, got %q", low)
+	}
+	if !strings.Contains(low, "(共 5 条启用技能，本轮注入 2 条") {
+		t.Fatalf("expected accurate truncation note, got %q", low)
+	}
+
+	high := injected(t, 10)
+	if !strings.Contains(high, "5. ") {
+		t.Fatalf("expected all 5 skills injected, got %q", high)
+	}
+	if strings.Contains(high, "控制上下文长度") {
+		t.Fatalf("expected no truncation note when everything fits, got %q", high)
+	}
+}
+
+func TestHandleUserMessage_ToolRoutingExposesOnlyRelevantTools(t *testing.T) {
+	toolDef := func(name, description string) llm.ToolDefinition {
+		return llm.ToolDefinition{Type: "function", Function: llm.ToolFunctionDefinition{Name: name, Description: description}}
+	}
+	tools := &mockTools{listed: []llm.ToolDefinition{
+		toolDef("weather__query", "查询城市天气预报"),
+		toolDef("github__search_issues", "搜索 GitHub issues"),
+		toolDef("calendar__list_events", "列出日程安排"),
+	}}
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok", "ok"}}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		ToolRouting:                true,
+	}, conversation.NewStore(), fakeLLM, tools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "明天北京天气预报怎么样？"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	var names []string
+	for _, def := range fakeLLM.calls[0].Tools {
+		names = append(names, def.Function.Name)
+	}
+	if got := strings.Join(names, ","); got != "linux__bash,weather__query" {
+		t.Fatalf("expected only builtin and weather tools, got %q", got)
+	}
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "随便聊聊"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if got := len(fakeLLM.calls[1].Tools); got != 4 {
+		t.Fatalf("expected all tools when nothing matches, got %d", got)
+	}
+}
+
+func TestScoreSkillPrompts_PhraseMatchOutranksIncidentalTokens(t *testing.T) {
+	prompts := []string{
+		"when reviewing code always check error handling, logging, naming and tests",
+		"before a database migration write the rollback plan",
+		"always keep replies short",
+	}
+	focus := buildSkillFocus("", []conversation.Message{
+		{Role: "user", Content: "we need a database migration for orders; also check the tests and naming later"},
+	})
+
+	scores := scoreSkillPrompts(prompts, focus)
+	if scores[1] <= scores[0] {
+		t.Fatalf("expected phrase match to outrank incidental overlaps, got %v", scores)
+	}
+
+	ranked := selectSkillPromptsForTurn(prompts, "", []conversation.Message{
+		{Role: "user", Content: "we need a database migration for orders; also check the tests and naming later"},
+	}, SkillInjectionLimits{MaxPrompts: 1, MaxTotalRunes: 1200, MaxSingleRunes: 280})
+	if len(ranked) != 1 || ranked[0] != prompts[1] {
+		t.Fatalf("expected migration skill to be picked first, got %v", ranked)
+	}
+}
+
+func TestScoreSkillPrompts_DownWeightsTokensCommonToAllSkills(t *testing.T) {
+	prompts := []string{
+		"always answer in chinese",
+		"always cite sources",
+		"always confirm deploy steps",
+	}
+	scores := scoreSkillPrompts(prompts, "please always confirm")
+	common := scoreSkillPrompts(prompts[:1], "please always confirm")[0]
+	if scores[0] >= common {
+		t.Fatalf("expected token shared by every skill to be down-weighted, got %v vs %v", scores[0], common)
+	}
+	if scores[2] <= scores[0] {
+		t.Fatalf("expected distinctive token match to rank higher, got %v", scores)
+	}
+}
+
+func TestHandleUserMessage_BuiltinToolsNotice(t *testing.T) {
+	hasNotice := func(req llm.ChatRequest) bool {
+		for _, msg := range req.Messages {
+			if msg.Role == "system" && strings.Contains(msg.Content, "内置工具仅有 linux__bash") {
+				return true
+			}
+		}
+		return false
+	}
+	run := func(t *testing.T, disableBash, suppress bool) llm.ChatRequest {
+		t.Helper()
+		var disabled []string
+		if disableBash {
+			disabled = []string{builtinLinuxBashToolName}
+		}
+		fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+		agentSvc := New(Config{
+			Model:                      "test-model",
+			MaxRecentMessages:          10,
+			CompressionTriggerMessages: 99,
+			CompressionTriggerChars:    99999,
+			KeepRecentAfterCompression: 1,
+			MaxCompressionLoopsPerTurn: 1,
+			MaxToolCallRounds:          2,
+			SystemPrompt:               "system",
+			CompressionSystemPrompt:    "compressor",
+			DisabledBuiltinTools:       disabled,
+			SuppressBuiltinToolsNotice: suppress,
+		}, conversation.NewStore(), fakeLLM, nil)
+		if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err != nil {
+			t.Fatalf("HandleUserMessage error: %v", err)
+		}
+		return fakeLLM.calls[0]
+	}
+
+	if req := run(t, false, false); !hasNotice(req) {
+		t.Fatalf("expected builtin tools notice by default")
+	}
+	if req := run(t, false, true); hasNotice(req) {
+		t.Fatalf("expected notice to be suppressed by config")
+	}
+	req := run(t, true, false)
+	if hasNotice(req) {
+		t.Fatalf("expected notice to be absent when bash is disabled")
+	}
+	if len(req.Tools) != 0 {
+		t.Fatalf("expected no tools when bash is disabled and no MCP tools, got %d", len(req.Tools))
+	}
+
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetSkillProvider(&mockSkills{prompts: []string{"p"}, indexLines: []string{"- demo: demo skill"}})
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	var notice string
+	for _, msg := range fakeLLM.calls[0].Messages {
+		if msg.Role == "system" && strings.HasPrefix(msg.Content, "内置工具仅有") {
+			notice = msg.Content
+		}
+	}
+	if !strings.Contains(notice, builtinSkillReadToolName) || strings.Contains(notice, builtinLinuxBashToolName) {
+		t.Fatalf("expected the notice to list exactly the builtin tools sent, got %q", notice)
+	}
+}
+
+type mockPromptTemplates struct {
+	index []string
+	refs  []string
+	args  []map[string]string
+}
+
+func (m *mockPromptTemplates) ListPromptTemplates(_ context.Context) []string {
+	return m.index
+}
+
+func (m *mockPromptTemplates) GetPromptTemplate(_ context.Context, ref string, args map[string]string) (string, error) {
+	m.refs = append(m.refs, ref)
+	m.args = append(m.args, args)
+	if ref != "review/code_review" {
+		return "", fmt.Errorf("prompt %q not found", ref)
+	}
+	return "[user] Please review: " + args["diff"], nil
+}
+
+func TestHandleUserMessage_UsesMCPPromptTemplateTool(t *testing.T) {
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": {"", "reviewed"}},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					{
+						ID:   "call_prompt",
+						Type: "function",
+						Function: llm.ToolFunctionCall{
+							Name:      builtinMCPPromptToolName,
+							Arguments: `{"name":"review/code_review","arguments":{"diff":"+x"}}`,
+						},
+					},
+				},
+			},
+		},
+	}
+	templates := &mockPromptTemplates{index: []string{"review/code_review: Review a diff (args: diff*)"}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetPromptTemplateProvider(templates)
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我 review 这个 diff")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "reviewed" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	var promptTool *llm.ToolDefinition
+	for i, def := range fakeLLM.calls[0].Tools {
+		if def.Function.Name == builtinMCPPromptToolName {
+			promptTool = &fakeLLM.calls[0].Tools[i]
+		}
+	}
+	if promptTool == nil || !strings.Contains(promptTool.Function.Description, "review/code_review") {
+		t.Fatalf("expected prompt template tool listing available templates, got %+v", fakeLLM.calls[0].Tools)
+	}
+	if len(templates.refs) != 1 || templates.args[0]["diff"] != "+x" {
+		t.Fatalf("unexpected template calls: %v %v", templates.refs, templates.args)
+	}
+	found := false
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" && strings.Contains(msg.Content, "Please review: +x") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected template content to be fed back as tool result")
+	}
+}
+
+type mockSkillFiles struct {
+	mockSkills
+	files map[string]map[string]string
+}
+
+func (m *mockSkillFiles) ListSkillFiles(id string) ([]string, error) {
+	files, ok := m.files[id]
+	if !ok {
+		return nil, fmt.Errorf("skill %q not found", id)
+	}
+	out := make([]string, 0, len(files))
+	for path := range files {
+		out = append(out, path)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *mockSkillFiles) ReadSkillFile(id, relPath string) (string, error) {
+	content, ok := m.files[id][relPath]
+	if !ok {
+		return "", fmt.Errorf("skill file %q not found", relPath)
+	}
+	return content, nil
+}
+
+func TestHandleUserMessage_SkillReadFileToolReturnsBundledFile(t *testing.T) {
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": {"", "deployed"}},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					{
+						ID:   "call_skill_file",
+						Type: "function",
+						Function: llm.ToolFunctionCall{
+							Name:      builtinSkillReadFileToolName,
+							Arguments: `{"skill_id":"deploy","path":"scripts/deploy.sh"}`,
+						},
+					},
+				},
+			},
+		},
+	}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetSkillProvider(&mockSkillFiles{
+		mockSkills: mockSkills{indexLines: []string{"skill_id=deploy | name=deploy | brief=run scripts/deploy.sh"}},
+		files: map[string]map[string]string{
+			"deploy": {"SKILL.md": "run scripts/deploy.sh", "scripts/deploy.sh": "echo deploying"},
+		},
+	})
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "部署一下")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "deployed" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	var fileTool *llm.ToolDefinition
+	for i, def := range fakeLLM.calls[0].Tools {
+		if def.Function.Name == builtinSkillReadFileToolName {
+			fileTool = &fakeLLM.calls[0].Tools[i]
+		}
+	}
+	if fileTool == nil {
+		t.Fatalf("expected skill file tool, got %+v", fakeLLM.calls[0].Tools)
+	}
+	found := false
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" && strings.Contains(msg.Content, "echo deploying") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected bundled file content to be fed back as tool result")
+	}
+}
+
+func TestHandleUserMessage_InjectsSkillIndexAndReadsFullSkill(t *testing.T) {
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": {"", "reviewed"}},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					{
+						ID:   "call_skill_read",
+						Type: "function",
+						Function: llm.ToolFunctionCall{
+							Name:      builtinSkillReadToolName,
+							Arguments: `{"skill_id":"code-review"}`,
+						},
+					},
+				},
+			},
+		},
+	}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+	fullSkill := "---\nname: code-review\n---\n\n1. 先看测试\n2. 再看边界条件\n3. 最后看命名"
+	agentSvc.SetSkillProvider(&mockSkills{
+		prompts:    []string{"评审代码时按清单逐项检查"},
+		indexLines: []string{"skill_id=code-review | name=code-review | brief=评审代码时按清单逐项检查"},
+		promptByID: map[string]string{"code-review": fullSkill},
+	})
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "帮我评审这段代码")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "reviewed" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+
+	indexed := false
+	for _, msg := range fakeLLM.calls[0].Messages {
+		if msg.Role == "system" && strings.Contains(msg.Content, "skill_id=code-review") {
+			indexed = true
+		}
+	}
+	if !indexed {
+		t.Fatalf("expected skill index in system messages, got %+v", fakeLLM.calls[0].Messages)
+	}
+	hasReadTool := false
+	for _, def := range fakeLLM.calls[0].Tools {
+		if def.Function.Name == builtinSkillReadToolName {
+			hasReadTool = true
+		}
+	}
+	if !hasReadTool {
+		t.Fatalf("expected %s tool, got %+v", builtinSkillReadToolName, fakeLLM.calls[0].Tools)
+	}
+	found := false
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" && strings.Contains(msg.Content, "3. 最后看命名") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected full SKILL.md to be fed back as tool result")
+	}
+}
+
+type mockCatalog struct {
+	queries []string
+	limits  []int
+	results []skills.CatalogSkill
+}
+
+func (m *mockCatalog) SearchSkillsCatalog(_ context.Context, query string, limit int) ([]skills.CatalogSkill, error) {
+	m.queries = append(m.queries, query)
+	m.limits = append(m.limits, limit)
+	return m.results, nil
+}
+
+func TestHandleUserMessage_SkillCatalogToolReturnsSearchResults(t *testing.T) {
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{"chat_reply": {"", "found"}},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{
+					{
+						ID:   "call_catalog",
+						Type: "function",
+						Function: llm.ToolFunctionCall{
+							Name:      builtinSkillCatalogToolName,
+							Arguments: `{"query":"react","limit":3}`,
+						},
+					},
+				},
+			},
+		},
+	}
+	catalog := &mockCatalog{results: []skills.CatalogSkill{{
+		Source:  "vercel-labs/agent-skills",
+		SkillID: "react-best-practices",
+		Name:    "React Best Practices",
+		URL:     "https://skills.sh/vercel-labs/agent-skills/react-best-practices",
+	}}}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetSkillCatalog(catalog)
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "找一个 react 相关的 skill")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "found" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if len(catalog.queries) != 1 || catalog.queries[0] != "react" || catalog.limits[0] != 3 {
+		t.Fatalf("unexpected catalog searches: %v %v", catalog.queries, catalog.limits)
+	}
+
+	var result struct {
+		Query   string                `json:"query"`
+		Results []skills.CatalogSkill `json:"results"`
+	}
+	for _, msg := range fakeLLM.calls[1].Messages {
+		if msg.Role == "tool" {
+			if err := json.Unmarshal([]byte(msg.Content), &result); err != nil {
+				t.Fatalf("tool result is not JSON: %v: %q", err, msg.Content)
+			}
+		}
+	}
+	if result.Query != "react" || len(result.Results) != 1 || result.Results[0].SkillID != "react-best-practices" {
+		t.Fatalf("unexpected catalog tool result: %+v", result)
+	}
+}
+
+func TestHandleUserMessage_NoToolsPrefixSendsNoTools(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"纯聊天回复"}}}
+	fakeTools := &mockTools{
+		listed: []llm.ToolDefinition{
+			{Type: "function", Function: llm.ToolFunctionDefinition{Name: "weather__query"}},
+		},
+	}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		NoToolsPrefix:              "chat:",
+	}, store, fakeLLM, fakeTools)
+	agentSvc.SetSkillCatalog(&mockCatalog{})
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "CHAT: 今天适合跑步吗")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "纯聊天回复" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if len(fakeLLM.calls) != 1 || len(fakeLLM.calls[0].Tools) != 0 {
+		t.Fatalf("expected one call without tools, got %+v", fakeLLM.calls)
+	}
+	for _, msg := range fakeLLM.calls[0].Messages {
+		if strings.Contains(msg.Content, "linux__bash") {
+			t.Fatalf("expected no builtin tools notice, got %q", msg.Content)
+		}
+	}
+	_, messages := store.Snapshot()
+	if messages[0].Content != "今天适合跑步吗" || !messages[0].NoTools {
+		t.Fatalf("expected prefix stripped and message marked, got %+v", messages[0])
+	}
+}
+
+func TestHandleUserMessage_AutoSkillQuotaReservesManualSlots(t *testing.T) {
+	autoPrompts := []string{
+		"发布 上线 回滚 检查清单 auto one",
+		"发布 上线 回滚 检查清单 auto two",
+		"发布 上线 回滚 检查清单 auto three",
+	}
+	manualPrompts := []string{
+		"manual: keep replies short",
+		"manual: cite sources",
+	}
+	skills := &mockSkills{
+		prompts:     append(append([]string{}, autoPrompts...), manualPrompts...),
+		autoPrompts: autoPrompts,
+	}
+	fakeLLM := &mockLLM{responses: map[string][]string{"chat_reply": {"ok"}}}
+	agentSvc := New(Config{
+		Model:                       "test-model",
+		MaxRecentMessages:           10,
+		CompressionTriggerMessages:  99,
+		CompressionTriggerChars:     99999,
+		KeepRecentAfterCompression:  1,
+		MaxCompressionLoopsPerTurn:  1,
+		MaxToolCallRounds:           2,
+		SystemPrompt:                "system",
+		CompressionSystemPrompt:     "compressor",
+		MaxInjectedSkillPrompts:     3,
+		MaxInjectedAutoSkillPrompts: 1,
+	}, conversation.NewStore(), fakeLLM, nil)
+	agentSvc.SetSkillProvider(skills)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "今晚发布上线，回滚检查清单准备好了吗"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	var injected string
+	for _, msg := range fakeLLM.calls[0].Messages {
+		if msg.Role == "system" && strings.Contains(msg.Content, "已启用技能") {
+			injected = msg.Content
+		}
+	}
+	if got := strings.Count(injected, "auto "); got != 1 {
+		t.Fatalf("expected exactly 1 auto skill despite higher relevance, got %d in %q", got, injected)
+	}
+	if got := strings.Count(injected, "manual:"); got != 2 {
+		t.Fatalf("expected manual skills to fill the reserved slots, got %d in %q", got, injected)
+	}
+}
+
+func TestSelectSkillPromptsForTurn_BoostsSkillsTaggedWithInferredCategory(t *testing.T) {
+	planning := "每天早上先列出三件最重要的事"
+	coding := "先复现问题再动手修改"
+	untagged := "回答保持简洁"
+	prompts := []string{untagged, planning, coding}
+	tags := map[string][]string{
+		planning: {"planning"},
+		coding:   {"coding"},
+	}
+	messages := []conversation.Message{{Role: "user", Content: "这个函数一直报错，帮我 debug 一下"}}
+
+	if got := inferSkillCategories(buildSkillFocus("", messages)); strings.Join(got, ",") != "coding" {
+		t.Fatalf("expected coding category, got %v", got)
+	}
+
+	limits := SkillInjectionLimits{MaxPrompts: 1, MaxTotalRunes: 1200, MaxSingleRunes: 280}
+	if got := selectSkillPromptsForTurn(prompts, "", messages, limits); len(got) != 1 || got[0] != untagged {
+		t.Fatalf("expected plain ordering without tags, got %v", got)
+	}
+	got := selectSkillPromptsForTurn(prompts, "", messages, limits.withSkillTags(tags))
+	if len(got) != 1 || got[0] != coding {
+		t.Fatalf("expected coding-tagged skill to be boosted, got %v", got)
+	}
+
+	all := selectSkillPromptsForTurn(prompts, "", messages, SkillInjectionLimits{MaxPrompts: 3, MaxTotalRunes: 1200, MaxSingleRunes: 280}.withSkillTags(tags))
+	if len(all) != 3 {
+		t.Fatalf("expected untagged skills to stay eligible, got %v", all)
+	}
+}
+
+func TestSelectSkillPromptsForTurn_PriorityBreaksScoreTies(t *testing.T) {
+	low := "回答保持简洁"
+	high := "涉及金额时先复核数字"
+	prompts := []string{low, high}
+	messages := []conversation.Message{{Role: "user", Content: "今天天气怎么样"}}
+	limits := SkillInjectionLimits{MaxPrompts: 1, MaxTotalRunes: 1200, MaxSingleRunes: 280}
+
+	if got := selectSkillPromptsForTurn(prompts, "", messages, limits); len(got) != 1 || got[0] != low {
+		t.Fatalf("expected slice order to decide ties without priorities, got %v", got)
+	}
+	got := selectSkillPromptsForTurn(prompts, "", messages, limits.withSkillPriorities(map[string]int{high: 10}))
+	if len(got) != 1 || got[0] != high {
+		t.Fatalf("expected higher-priority skill to win the tie, got %v", got)
+	}
+}
+
+func TestIsValidEvolvedPrompt_UsesConfiguredPersona(t *testing.T) {
+	compression := "你是“小满”数字分身的上下文压缩器，保留人格、事实、任务进度与待办，输出简洁纯文本，不要遗漏关键约束。"
+	custom := "你是用户的 AI 数字分身，名字叫“小满”，男性，10 年后端开发经验。你始终不使用表情符号，回答务实、可执行、可复盘，并持续优化工作和学习策略。"
+	persona := personaInvariants{Name: "小满", ForbidEmoji: true}
+
+	if !isValidEvolvedPrompt(custom, compression, persona) {
+		t.Fatalf("expected custom persona name to pass validation")
+	}
+	dropped := strings.ReplaceAll(custom, "小满", "助手")
+	if isValidEvolvedPrompt(dropped, compression, persona) {
+		t.Fatalf("expected evolution dropping the persona name to be rejected")
+	}
+	if isValidEvolvedPrompt(custom+" 😀", compression, persona) {
+		t.Fatalf("expected emoji in evolved prompt to be rejected")
+	}
+}
+
+func TestPersonaInvariants_DerivedFromCurrentSystemPrompt(t *testing.T) {
+	agentSvc := New(Config{SystemPrompt: "你是用户的 AI 数字分身，名字叫“阿青”，女性。", ForbidEmoji: true}, conversation.NewStore(), &mockLLM{}, nil)
+	persona := agentSvc.personaInvariantsLocked()
+	if persona.Name != "阿青" || !persona.ForbidEmoji {
+		t.Fatalf("unexpected derived persona: %+v", persona)
+	}
+
+	agentSvc = New(Config{SystemPrompt: "名字叫“阿青”", PersonaName: "小满"}, conversation.NewStore(), &mockLLM{}, nil)
+	if persona := agentSvc.personaInvariantsLocked(); persona.Name != "小满" {
+		t.Fatalf("expected configured persona name to win, got %+v", persona)
+	}
+}
+
+func TestLocalNow_UsesConfiguredTimezoneForWindowAndDate(t *testing.T) {
+	agentSvc := New(Config{Timezone: "Asia/Shanghai"}, conversation.NewStore(), &mockLLM{}, nil)
+	// 17:10 UTC on Feb 13 is 01:10 on Feb 14 in Shanghai.
+	agentSvc.nowFn = func() time.Time {
+		return time.Date(2026, 2, 13, 17, 10, 0, 0, time.UTC)
+	}
+
+	now := agentSvc.localNow()
+	if !isSleepWindow(now) {
+		t.Fatalf("expected Shanghai wall clock %s to be inside the sleep window", now.Format("15:04"))
+	}
+	if got := now.Format("2006-01-02"); got != "2026-02-14" {
+		t.Fatalf("expected date key from Shanghai wall clock, got %q", got)
+	}
+
+	agentSvc.cfg.EnforceHumanRoutine = true
+	habits := &mockHabits{}
+	agentSvc.SetHabitProvider(habits)
+	if err := agentSvc.RunScheduledHumanRoutine(context.Background()); err != nil {
+		t.Fatalf("RunScheduledHumanRoutine error: %v", err)
+	}
+	if habits.lastSleepReviewDate != "2026-02-14" || habits.lastWakePlanDate != "" {
+		t.Fatalf("expected night review keyed by Shanghai date, got %+v", habits)
+	}
+
+	utcAgent := New(Config{Timezone: "UTC"}, conversation.NewStore(), &mockLLM{}, nil)
+	utcAgent.nowFn = agentSvc.nowFn
+	if isSleepWindow(utcAgent.localNow()) {
+		t.Fatalf("expected 17:10 UTC to be outside the sleep window")
+	}
+}
+
+type modelFailingLLM struct {
+	mu       sync.Mutex
+	failFor  string
+	failWith error
+	calls    []llm.ChatRequest
+}
+
+func (m *modelFailingLLM) Chat(_ context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, req)
+	if req.Model == m.failFor {
+		return llm.ChatResponse{}, m.failWith
+	}
+	return llm.ChatResponse{Content: "reply from " + req.Model}, nil
+}
+
+func TestHandleUserMessage_RetriesOnFallbackModelForRetryableErrors(t *testing.T) {
+	fakeLLM := &modelFailingLLM{
+		failFor:  "primary",
+		failWith: fmt.Errorf("cerber %w", &llm.StatusError{StatusCode: 429, Body: "rate limited"}),
+	}
+	agentSvc := New(Config{
+		Model:                      "primary",
+		FallbackModel:              "backup",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		DisabledBuiltinTools:       []string{builtinLinuxBashToolName},
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, conversation.NewStore(), fakeLLM, nil)
+
+	reply, err := agentSvc.HandleUserMessage(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+	if reply != "reply from backup" {
+		t.Fatalf("expected fallback reply, got %q", reply)
+	}
+	if len(fakeLLM.calls) != 2 {
+		t.Fatalf("expected primary + fallback calls, got %d", len(fakeLLM.calls))
+	}
+	if fakeLLM.calls[0].Purpose != "chat_reply" || fakeLLM.calls[1].Purpose != "chat_reply_fallback" || fakeLLM.calls[1].Model != "backup" {
+		t.Fatalf("unexpected calls: %+v / %+v", fakeLLM.calls[0], fakeLLM.calls[1])
+	}
+
+	fakeLLM.calls = nil
+	fakeLLM.failWith = fmt.Errorf("cerber %w", &llm.StatusError{StatusCode: 400, Body: "bad request"})
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "again"); err == nil {
+		t.Fatalf("expected non-retryable error to surface")
+	}
+	if len(fakeLLM.calls) != 1 {
+		t.Fatalf("expected no fallback for non-retryable errors, got %d calls", len(fakeLLM.calls))
+	}
+}
+
+func TestHandleUserMessage_RecordsTurnTraceWithToolCallsAndRounds(t *testing.T) {
+	store := conversation.NewStore()
+	fakeLLM := &mockLLM{
+		responses: map[string][]string{
+			"chat_reply": {"", "查到了"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{{ID: "call_1", Type: "function", Function: llm.ToolFunctionCall{Name: "search__lookup", Arguments: `{"q":"go"}`}}},
+			},
+		},
+	}
+	tools := &mockTools{
+		listed:   []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "search__lookup"}}},
+		response: map[string]string{`search__lookup:{"q":"go"}`: "result"},
+	}
+
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          4,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, tools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "查一下"); err != nil {
+		t.Fatalf("HandleUserMessage returned error: %v", err)
+	}
+
+	traces := agentSvc.TurnTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected one trace, got %d", len(traces))
+	}
+	trace, ok := agentSvc.TurnTrace(traces[0].ID)
+	if !ok {
+		t.Fatalf("expected trace %q to be retrievable by id", traces[0].ID)
+	}
+	if trace.Input != "查一下" || trace.Reply != "查到了" || trace.Error != "" {
+		t.Fatalf("unexpected trace outcome: %+v", trace)
+	}
+	if trace.Rounds != 2 {
+		t.Fatalf("expected 2 rounds, got %d", trace.Rounds)
+	}
+	if len(trace.ToolCalls) != 1 || trace.ToolCalls[0].Name != "search__lookup" {
+		t.Fatalf("expected the search__lookup call in the trace, got %+v", trace.ToolCalls)
+	}
+	phases := make([]string, 0, len(trace.Phases))
+	for _, phase := range trace.Phases {
+		phases = append(phases, phase.Name)
+	}
+	if strings.Join(phases, ",") != "morning_plan,compression,reply" {
+		t.Fatalf("unexpected phases: %v", phases)
+	}
+}
+
+// loggingLLM records each request in an llmlog.Store the way the real
+// clients do, so tests can inspect what the log page would show.
+type loggingLLM struct {
+	*mockLLM
+	logs *llmlog.Store
+}
+
+func (l *loggingLLM) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	resp, err := l.mockLLM.Chat(ctx, req)
+	_ = l.logs.Add(llmlog.Entry{Purpose: req.Purpose, TurnID: req.TurnID, Model: req.Model})
+	return resp, err
+}
+
+func TestHandleUserMessage_AllLLMCallsInTurnShareTurnID(t *testing.T) {
+	store := conversation.NewStore()
+	store.Append("user", "old question")
+	store.Append("assistant", "old answer")
+
+	logs := llmlog.NewStore(100)
+	fakeLLM := &loggingLLM{logs: logs, mockLLM: &mockLLM{
+		responses: map[string][]string{
+			"compress_context": {"summary-v1"},
+			"chat_reply":       {"", "weather ready", "second reply"},
+		},
+		toolCalls: map[string][][]llm.ToolCall{
+			"chat_reply": {
+				{{ID: "call_1", Type: "function", Function: llm.ToolFunctionCall{Name: "weather__query", Arguments: `{"city":"beijing"}`}}},
+				nil,
+				nil,
+			},
+		},
+	}}
+	fakeTools := &mockTools{
+		listed:   []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "weather__query"}}},
+		response: map[string]string{`weather__query:{"city":"beijing"}`: `{"temp":18}`},
+	}
+	agentSvc := New(Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 3,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, fakeLLM, fakeTools)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "今天北京天气"); err != nil {
+		t.Fatalf("first turn error: %v", err)
+	}
+	traces := agentSvc.TurnTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected one trace, got %d", len(traces))
+	}
+	turnID := traces[0].ID
+
+	first := logs.Filter(llmlog.FilterOptions{TurnID: turnID})
+	if len(first) != 3 {
+		t.Fatalf("expected compression + two reply rounds under turn %s, got %+v", turnID, first)
+	}
+	purposes := map[string]int{}
+	for _, entry := range first {
+		purposes[entry.Purpose]++
+	}
+	if purposes["compress_context"] != 1 || purposes["chat_reply"] != 2 {
+		t.Fatalf("unexpected purposes for turn: %+v", purposes)
+	}
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "谢谢"); err != nil {
+		t.Fatalf("second turn error: %v", err)
+	}
+	secondID := agentSvc.TurnTraces()[0].ID
+	if secondID == turnID {
+		t.Fatalf("second turn reused turn ID %s", turnID)
+	}
+	for _, entry := range logs.List() {
+		if entry.TurnID != turnID && entry.TurnID != secondID {
+			t.Fatalf("entry #%d (%s) has unexpected turn ID %q", entry.ID, entry.Purpose, entry.TurnID)
+		}
+	}
+	if second := logs.Filter(llmlog.FilterOptions{TurnID: secondID}); len(second) == 0 {
+		t.Fatal("expected calls logged under the second turn")
 	}
 }
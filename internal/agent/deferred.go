@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"laughing-barnacle/internal/conversation"
+)
+
+const maxDeferredQuoteRunes = 40
+
+// answerDeferredLocked replies, oldest first, to the messages deferred during
+// the sleep window, appending each reply as its own assistant message. Each
+// message gets its own MaxTurnDuration. It is a no-op while the sleep window
+// lasts; a message is only marked answered once its reply succeeded, so the
+// one that failed and those left when ctx ends stay queued for the next run.
+func (a *Agent) answerDeferredLocked(ctx context.Context, now time.Time) {
+	if !a.cfg.EnforceHumanRoutine || isSleepWindow(now) || a.store.DeferredCount() == 0 {
+		return
+	}
+
+	phaseStart := time.Now()
+	for ctx.Err() == nil {
+		msg, ok := a.store.OldestDeferred()
+		if !ok {
+			break
+		}
+		if err := a.answerDeferredMessageLocked(ctx, msg); err != nil {
+			a.logger.Warn("answer deferred message failed; left queued", "error", err)
+			break
+		}
+	}
+	a.trace.phase("deferred", phaseStart)
+}
+
+func (a *Agent) answerDeferredMessageLocked(ctx context.Context, msg conversation.Message) error {
+	ctx, cancel := a.withTurnDeadline(ctx)
+	defer cancel()
+
+	_, messages := a.store.Snapshot()
+	// Re-ask the deferred request as the latest user message so the
+	// reply addresses it rather than whatever came after it.
+	messages = append(messages, conversation.Message{Role: "user", Content: msg.Content, CreatedAt: msg.CreatedAt, NoTools: msg.NoTools})
+	reply, toolCalls, err := a.generateReply(ctx, messages, nil)
+	if err != nil {
+		return err
+	}
+	a.warnIfErr("clear deferred marker", a.store.ClearDeferred(msg))
+	header := fmt.Sprintf("【延后处理】关于你在 %s 的消息「%s」：", msg.CreatedAt.In(a.loc).Format("01-02 15:04"), trimRunes(msg.Content, maxDeferredQuoteRunes))
+	_, err = a.appendReply(header+"\n"+strings.TrimSpace(reply), toolCalls)
+	a.warnIfErr("persist deferred reply", err)
+	return nil
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llm"
+)
+
+// EventSink observes agent activity during a turn. Callbacks run on a
+// dedicated goroutine in emission order; a slow sink drops events instead of
+// stalling the turn.
+type EventSink interface {
+	OnCompression(messageCount int)
+	OnRound(round int)
+	OnToolCall(call conversation.ToolCall)
+	OnReply(reply string)
+}
+
+// ToolProgressSink is implemented by sinks that also want the progress
+// updates long-running tools report while a call is still in flight.
+type ToolProgressSink interface {
+	OnToolProgress(tool string, progress llm.ToolProgress)
+}
+
+const eventBufferSize = 128
+
+type eventDispatcher struct {
+	ch chan func(EventSink)
+}
+
+func newEventDispatcher(sink EventSink) *eventDispatcher {
+	d := &eventDispatcher{ch: make(chan func(EventSink), eventBufferSize)}
+	go func() {
+		for fn := range d.ch {
+			fn(sink)
+		}
+	}()
+	return d
+}
+
+func (d *eventDispatcher) emit(fn func(EventSink)) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.ch <- fn:
+	default:
+	}
+}
+
+func (d *eventDispatcher) close() {
+	if d == nil {
+		return
+	}
+	close(d.ch)
+}
+
+func (a *Agent) SetEventSink(sink EventSink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events.close()
+	a.events = nil
+	if sink != nil {
+		a.events = newEventDispatcher(sink)
+	}
+}
+
+func (a *Agent) emitCompression(messageCount int) {
+	a.events.emit(func(s EventSink) { s.OnCompression(messageCount) })
+}
+
+func (a *Agent) emitRound(round int) {
+	a.events.emit(func(s EventSink) { s.OnRound(round) })
+}
+
+func (a *Agent) emitToolCall(call conversation.ToolCall) {
+	a.events.emit(func(s EventSink) { s.OnToolCall(call) })
+}
+
+func (a *Agent) emitReply(reply string) {
+	a.events.emit(func(s EventSink) { s.OnReply(reply) })
+}
+
+func (a *Agent) emitToolProgress(tool string, progress llm.ToolProgress) {
+	a.events.emit(func(s EventSink) {
+		if ps, ok := s.(ToolProgressSink); ok {
+			ps.OnToolProgress(tool, progress)
+		}
+	})
+}
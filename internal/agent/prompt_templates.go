@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"laughing-barnacle/internal/llm"
+)
+
+const (
+	builtinMCPPromptToolName  = "mcp__get_prompt"
+	maxListedPromptTemplates  = 30
+	maxPromptTemplateIndexLen = 2000
+)
+
+// PromptTemplateProvider exposes prompt templates advertised by MCP servers,
+// addressed as "service/name".
+type PromptTemplateProvider interface {
+	ListPromptTemplates(ctx context.Context) []string
+	GetPromptTemplate(ctx context.Context, ref string, args map[string]string) (string, error)
+}
+
+func (a *Agent) SetPromptTemplateProvider(provider PromptTemplateProvider) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.templates = provider
+}
+
+// promptTemplateToolDefinition returns the builtin tool for fetching server
+// prompt templates, or false when no provider or no template is available.
+func (a *Agent) promptTemplateToolDefinition(ctx context.Context) (llm.ToolDefinition, bool) {
+	if a.templates == nil {
+		return llm.ToolDefinition{}, false
+	}
+	index := a.templates.ListPromptTemplates(ctx)
+	if len(index) == 0 {
+		return llm.ToolDefinition{}, false
+	}
+	if len(index) > maxListedPromptTemplates {
+		index = index[:maxListedPromptTemplates]
+	}
+
+	description := "Use a server-provided MCP prompt template: fetch it by name and follow the returned instructions. Available templates (* = required argument):\n" +
+		trimRunes(strings.Join(index, "\n"), maxPromptTemplateIndexLen)
+	return llm.ToolDefinition{
+		Type: "function",
+		Function: llm.ToolFunctionDefinition{
+			Name:        builtinMCPPromptToolName,
+			Description: description,
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"name": map[string]any{
+						"type":        "string",
+						"description": "Template reference in service/name form.",
+					},
+					"arguments": map[string]any{
+						"type":                 "object",
+						"description":          "Optional template arguments.",
+						"additionalProperties": map[string]any{"type": "string"},
+					},
+				},
+				"required":             []string{"name"},
+				"additionalProperties": false,
+			},
+		},
+	}, true
+}
+
+func (a *Agent) callPromptTemplateTool(ctx context.Context, raw string) (string, error) {
+	if a.templates == nil {
+		return "", fmt.Errorf("prompt templates are not available")
+	}
+	args, err := readToolArguments(raw)
+	if err != nil {
+		return "", err
+	}
+	ref, ok := readOptionalStringArgument(args, "name")
+	if !ok {
+		return "", fmt.Errorf("%w: name is required", llm.ErrInvalidToolArgs)
+	}
+
+	templateArgs := make(map[string]string)
+	if rawArgs, exists := args["arguments"]; exists && rawArgs != nil {
+		values, ok := rawArgs.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("%w: arguments must be an object", llm.ErrInvalidToolArgs)
+		}
+		for key, value := range values {
+			templateArgs[key] = fmt.Sprint(value)
+		}
+	}
+	return a.templates.GetPromptTemplate(ctx, ref, templateArgs)
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/skills"
+)
+
+const (
+	builtinSkillCatalogToolName = "skills__catalog_search"
+	defaultCatalogSearchLimit   = 8
+)
+
+// SkillCatalog searches the skills.sh catalog for installable skills.
+type SkillCatalog interface {
+	SearchSkillsCatalog(ctx context.Context, query string, limit int) ([]skills.CatalogSkill, error)
+}
+
+func (a *Agent) SetSkillCatalog(catalog SkillCatalog) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.catalog = catalog
+}
+
+func skillCatalogToolDefinition() llm.ToolDefinition {
+	return llm.ToolDefinition{
+		Type: "function",
+		Function: llm.ToolFunctionDefinition{
+			Name:        builtinSkillCatalogToolName,
+			Description: "Search the skills.sh catalog for installable skills matching a need. Returns candidates with their skills.sh URL; installing still requires explicit user confirmation.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{
+						"type":        "string",
+						"description": "Keywords describing the needed capability.",
+					},
+					"limit": map[string]any{
+						"type":        "integer",
+						"description": "Maximum number of results (1-30, default 8).",
+					},
+				},
+				"required":             []string{"query"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+func (a *Agent) callSkillCatalogTool(ctx context.Context, raw string) (string, error) {
+	if a.catalog == nil {
+		return "", fmt.Errorf("skill catalog is not available")
+	}
+	args, err := readToolArguments(raw)
+	if err != nil {
+		return "", err
+	}
+	query, ok := readOptionalStringArgument(args, "query")
+	if !ok {
+		return "", fmt.Errorf("%w: query is required", llm.ErrInvalidToolArgs)
+	}
+	limit := defaultCatalogSearchLimit
+	if rawLimit, exists := args["limit"]; exists {
+		parsed, ok := parsePositiveInt(rawLimit)
+		if !ok {
+			return "", fmt.Errorf("%w: limit must be a positive integer", llm.ErrInvalidToolArgs)
+		}
+		limit = parsed
+	}
+
+	results, err := a.catalog.SearchSkillsCatalog(ctx, query, limit)
+	if err != nil {
+		return "", err
+	}
+	if results == nil {
+		results = []skills.CatalogSkill{}
+	}
+	data, err := json.Marshal(map[string]any{
+		"query":   query,
+		"results": results,
+	})
+	if err != nil {
+		return "", fmt.Errorf("encode catalog results: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"laughing-barnacle/internal/llm"
+)
+
+const (
+	builtinSkillReadToolName     = "skill__read"
+	builtinSkillReadFileToolName = "skill__read_file"
+	maxSkillIndexRunes           = 2000
+	maxSkillFileResultRunes      = 12000
+)
+
+// SkillFileReader is implemented by skill providers that can serve the files
+// bundled next to a skill's SKILL.md (scripts, templates, references).
+type SkillFileReader interface {
+	ListSkillFiles(id string) ([]string, error)
+	ReadSkillFile(id, relPath string) (string, error)
+}
+
+// skillIndexMessage lists the enabled skills for the read tools, or returns
+// "" when no skill is enabled.
+func (a *Agent) skillIndexMessage() string {
+	if a.skills == nil {
+		return ""
+	}
+	index := a.skills.ListEnabledSkillIndex()
+	if len(index) == 0 {
+		return ""
+	}
+	return "技能索引（需要完整指令时用 skill__read 按 skill_id 读取 SKILL.md）：\n" +
+		trimRunes(strings.Join(index, "\n"), maxSkillIndexRunes)
+}
+
+func skillReadToolDefinition() llm.ToolDefinition {
+	return llm.ToolDefinition{
+		Type: "function",
+		Function: llm.ToolFunctionDefinition{
+			Name:        builtinSkillReadToolName,
+			Description: "Read the full SKILL.md of an enabled skill listed in the skill index, when the injected brief is not enough.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"skill_id": map[string]any{
+						"type":        "string",
+						"description": "Skill ID from the skill index (the skill name also works when unique).",
+					},
+				},
+				"required":             []string{"skill_id"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+func (a *Agent) callSkillReadTool(raw string) (string, error) {
+	if a.skills == nil {
+		return "", fmt.Errorf("skills are not available")
+	}
+	args, err := readToolArguments(raw)
+	if err != nil {
+		return "", err
+	}
+	skillID, ok := readOptionalStringArgument(args, "skill_id")
+	if !ok {
+		return "", fmt.Errorf("%w: skill_id is required", llm.ErrInvalidToolArgs)
+	}
+	prompt, ok := a.skills.ReadEnabledSkillPrompt(skillID)
+	if !ok {
+		return "", fmt.Errorf("skill %q is not enabled or does not exist", skillID)
+	}
+	return trimRunes(prompt, maxSkillFileResultRunes), nil
+}
+
+// skillFileToolDefinition returns the builtin tool for reading skill assets,
+// or false when the provider cannot serve files.
+func (a *Agent) skillFileToolDefinition() (llm.ToolDefinition, bool) {
+	if _, ok := a.skills.(SkillFileReader); !ok {
+		return llm.ToolDefinition{}, false
+	}
+	return llm.ToolDefinition{
+		Type: "function",
+		Function: llm.ToolFunctionDefinition{
+			Name:        builtinSkillReadFileToolName,
+			Description: "Read a file bundled with a skill from the skill index, such as a script or template its instructions refer to. Omit path to list the skill's files.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"skill_id": map[string]any{
+						"type":        "string",
+						"description": "Skill ID from the skill index.",
+					},
+					"path": map[string]any{
+						"type":        "string",
+						"description": "File path relative to the skill directory, e.g. scripts/run.sh.",
+					},
+				},
+				"required":             []string{"skill_id"},
+				"additionalProperties": false,
+			},
+		},
+	}, true
+}
+
+func (a *Agent) callSkillFileTool(raw string) (string, error) {
+	reader, ok := a.skills.(SkillFileReader)
+	if !ok {
+		return "", fmt.Errorf("skill files are not available")
+	}
+	args, err := readToolArguments(raw)
+	if err != nil {
+		return "", err
+	}
+	skillID, ok := readOptionalStringArgument(args, "skill_id")
+	if !ok {
+		return "", fmt.Errorf("%w: skill_id is required", llm.ErrInvalidToolArgs)
+	}
+	path, ok := readOptionalStringArgument(args, "path")
+	if !ok {
+		files, err := reader.ListSkillFiles(skillID)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(files, "\n"), nil
+	}
+	content, err := reader.ReadSkillFile(skillID, path)
+	if err != nil {
+		return "", err
+	}
+	return trimRunes(content, maxSkillFileResultRunes), nil
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llm"
+)
+
+// SkillSelector picks which enabled skill prompts are injected into a turn.
+type SkillSelector interface {
+	SelectSkillPrompts(ctx context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) []string
+}
+
+// SkillScorer is implemented by selectors that can report the relevance score
+// behind their ranking. prompts are the normalized candidates and scores
+// parallels it; scores are only comparable within one call.
+type SkillScorer interface {
+	ScoreSkillPrompts(ctx context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) (prompts []string, scores []float64)
+}
+
+// TokenSkillSelector ranks skills by token overlap with the recent conversation.
+type TokenSkillSelector struct{}
+
+func (TokenSkillSelector) SelectSkillPrompts(_ context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) []string {
+	return selectSkillPromptsForTurn(skillPrompts, summary, messages, limits)
+}
+
+func (TokenSkillSelector) ScoreSkillPrompts(_ context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) ([]string, []float64) {
+	return scoreSkillPromptsForTurn(skillPrompts, summary, messages, limits)
+}
+
+func (a *Agent) SetSkillSelector(selector SkillSelector) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.skillSel = selector
+}
+
+func (a *Agent) skillSelector() SkillSelector {
+	if a.skillSel == nil {
+		return TokenSkillSelector{}
+	}
+	return a.skillSel
+}
+
+// SkillInjectionPreview is one skill prompt a turn would inject and the
+// selector's relevance score for it (0 when the selector reports none).
+type SkillInjectionPreview struct {
+	Prompt string  `json:"prompt"`
+	Score  float64 `json:"score"`
+}
+
+// PreviewSkillInjection reports which skill prompts the next turn would
+// inject if input were sent now, in injection order. It runs the configured
+// selector on the current conversation plus input without changing any
+// state; an empty input previews the conversation as it stands. It does not
+// wait for a running turn.
+func (a *Agent) PreviewSkillInjection(ctx context.Context, input string) ([]SkillInjectionPreview, error) {
+	text, _ := a.stripNoToolsPrefix(strings.TrimSpace(input))
+
+	a.mu.RLock()
+	skills, selector := a.skills, a.skillSelector()
+	a.mu.RUnlock()
+
+	if skills == nil {
+		return []SkillInjectionPreview{}, nil
+	}
+	summary, messages := a.store.Snapshot()
+	if text != "" {
+		messages = append(messages, conversation.Message{Role: "user", Content: text})
+	}
+	allSkillPrompts, limits := a.enabledSkillPrompts(skills)
+
+	scoreOf := make(map[string]float64)
+	var selected []string
+	if scorer, ok := selector.(SkillScorer); ok {
+		prompts, scores := scorer.ScoreSkillPrompts(ctx, allSkillPrompts, summary, messages, limits)
+		for i, prompt := range prompts {
+			scoreOf[prompt] = scores[i]
+		}
+		selected = pickSkillPromptsWithinBudget(rankSkillPrompts(prompts, scores, limits), limits)
+	} else {
+		selected = selector.SelectSkillPrompts(ctx, allSkillPrompts, summary, messages, limits)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]SkillInjectionPreview, 0, len(selected))
+	for _, prompt := range selected {
+		out = append(out, SkillInjectionPreview{Prompt: prompt, Score: scoreOf[prompt]})
+	}
+	return out, nil
+}
+
+const maxCachedSkillEmbeddings = 512
+
+// EmbeddingSkillSelector ranks skills by cosine similarity between skill prompt
+// embeddings (cached per prompt text) and the current conversation focus.
+// Any embedding failure falls back to token-based selection.
+type EmbeddingSkillSelector struct {
+	client   llm.EmbeddingClient
+	model    string
+	fallback TokenSkillSelector
+
+	mu    sync.Mutex
+	cache map[string][]float64
+}
+
+func NewEmbeddingSkillSelector(client llm.EmbeddingClient, model string) *EmbeddingSkillSelector {
+	return &EmbeddingSkillSelector{
+		client:   client,
+		model:    strings.TrimSpace(model),
+		fallback: TokenSkillSelector{},
+		cache:    make(map[string][]float64),
+	}
+}
+
+func (s *EmbeddingSkillSelector) SelectSkillPrompts(ctx context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) []string {
+	prompts, scores := s.ScoreSkillPrompts(ctx, skillPrompts, summary, messages, limits)
+	return pickSkillPromptsWithinBudget(rankSkillPrompts(prompts, scores, limits), limits)
+}
+
+func (s *EmbeddingSkillSelector) ScoreSkillPrompts(ctx context.Context, skillPrompts []string, summary string, messages []conversation.Message, limits SkillInjectionLimits) ([]string, []float64) {
+	prompts := normalizeSkillPrompts(skillPrompts, limits.MaxSingleRunes)
+	if len(prompts) == 0 {
+		return nil, nil
+	}
+	focus := strings.TrimSpace(buildSkillFocus(summary, messages))
+	if focus == "" || s.client == nil || s.model == "" {
+		return s.fallback.ScoreSkillPrompts(ctx, skillPrompts, summary, messages, limits)
+	}
+
+	vectors, focusVector, err := s.embed(ctx, prompts, focus)
+	if err != nil {
+		return s.fallback.ScoreSkillPrompts(ctx, skillPrompts, summary, messages, limits)
+	}
+
+	scores := make([]float64, len(prompts))
+	for i := range prompts {
+		scores[i] = cosineSimilarity(vectors[i], focusVector)
+	}
+	return prompts, scores
+}
+
+func (s *EmbeddingSkillSelector) embed(ctx context.Context, prompts []string, focus string) ([][]float64, []float64, error) {
+	s.mu.Lock()
+	missing := make([]string, 0, len(prompts))
+	for _, prompt := range prompts {
+		if _, ok := s.cache[prompt]; !ok {
+			missing = append(missing, prompt)
+		}
+	}
+	s.mu.Unlock()
+
+	input := make([]string, 0, len(missing)+1)
+	input = append(input, missing...)
+	input = append(input, focus)
+	out, err := s.client.Embed(ctx, llm.EmbeddingRequest{
+		Purpose: "skill_embedding",
+		Model:   s.model,
+		Input:   input,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(out) != len(input) {
+		return nil, nil, fmt.Errorf("expected %d embeddings, got %d", len(input), len(out))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := make(map[string][]float64, len(missing))
+	for i, prompt := range missing {
+		fresh[prompt] = out[i]
+	}
+	vectors := make([][]float64, len(prompts))
+	for i, prompt := range prompts {
+		if v, ok := fresh[prompt]; ok {
+			vectors[i] = v
+			continue
+		}
+		vectors[i] = s.cache[prompt]
+	}
+	if len(s.cache)+len(fresh) > maxCachedSkillEmbeddings {
+		s.cache = make(map[string][]float64)
+	}
+	for prompt, v := range fresh {
+		s.cache[prompt] = v
+	}
+	return vectors, out[len(out)-1], nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"laughing-barnacle/internal/conversation"
+)
+
+const (
+	defaultContextTokenRatio = 0.8
+	perMessageTokenOverhead  = 4
+)
+
+// estimateTokens approximates the token count of text without a tokenizer.
+// CJK characters usually map to about one token each, while other text
+// averages roughly four characters per token.
+func estimateTokens(text string) int {
+	cjk := 0
+	other := 0
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			cjk++
+		default:
+			other++
+		}
+	}
+	return cjk + (other+3)/4
+}
+
+func estimateMessageTokens(messages []conversation.Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += perMessageTokenOverhead + estimateTokens(msg.Content)
+		for _, call := range msg.ToolCalls {
+			total += estimateTokens(call.Name) + estimateTokens(call.Arguments) + estimateTokens(call.Result)
+		}
+	}
+	return total
+}
+
+// contextTokenBudget is the estimated prompt size that forces compression,
+// or 0 when the token guard is disabled.
+func (a *Agent) contextTokenBudget() int {
+	if a.cfg.MaxContextTokens <= 0 {
+		return 0
+	}
+	ratio := a.cfg.ContextTokenRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = defaultContextTokenRatio
+	}
+	return int(float64(a.cfg.MaxContextTokens) * ratio)
+}
+
+// promptOverheadTokens estimates the parts of a reply request that do not
+// shrink with compression: system prompt, injected skills and tool schemas.
+func (a *Agent) promptOverheadTokens(ctx context.Context) int {
+	total := estimateTokens(a.replySystemPromptLocked())
+
+	if a.skills != nil {
+		limits := a.skillInjectionLimits()
+		total += estimateTokens(trimRunes(strings.Join(a.skills.ListEnabledSkillPrompts(), "\n"), limits.MaxTotalRunes))
+		total += estimateTokens(a.skillIndexMessage())
+	}
+
+	defs := make([]any, 0, 8)
+	if a.builtinToolEnabled(builtinLinuxBashToolName) {
+		defs = append(defs, linuxBashToolDefinition())
+	}
+	if a.tools != nil {
+		if external, err := a.tools.ListTools(ctx); err == nil {
+			for _, def := range external {
+				defs = append(defs, def)
+			}
+		}
+	}
+	if len(defs) > 0 {
+		if data, err := json.Marshal(defs); err == nil {
+			total += estimateTokens(string(data))
+		}
+	}
+	return total
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+
+	"laughing-barnacle/internal/conversation"
+)
+
+// toolReplay holds the tool calls a failed attempt of the pending turn
+// already completed. A retry takes results from here instead of executing
+// the same call (same tool, same arguments) again, so side effects such as
+// sending a message or writing a file do not happen twice. Failed calls are
+// not kept; they run again.
+type toolReplay struct {
+	pending []conversation.ToolCall
+}
+
+func newToolReplay(calls []conversation.ToolCall) *toolReplay {
+	r := &toolReplay{}
+	for _, call := range calls {
+		if call.Error == "" {
+			r.pending = append(r.pending, call)
+		}
+	}
+	return r
+}
+
+// take removes and returns the recorded call matching name and args. Each
+// record is replayed at most once, so a turn that legitimately repeats a
+// call still executes the extra ones.
+func (r *toolReplay) take(name, args string) (conversation.ToolCall, bool) {
+	if r == nil {
+		return conversation.ToolCall{}, false
+	}
+	key := toolCallKey(name, args)
+	for i, call := range r.pending {
+		if toolCallKey(call.Name, call.Arguments) == key {
+			r.pending = append(r.pending[:i:i], r.pending[i+1:]...)
+			return call, true
+		}
+	}
+	return conversation.ToolCall{}, false
+}
+
+// remaining returns the recorded calls this attempt did not reach; they are
+// kept on the pending message in case this attempt fails too.
+func (r *toolReplay) remaining() []conversation.ToolCall {
+	if r == nil {
+		return nil
+	}
+	return r.pending
+}
+
+// toolCallKey identifies a call by tool name and arguments. Model-issued call
+// IDs differ between attempts, and JSON arguments are re-encoded so key order
+// and whitespace do not matter.
+func toolCallKey(name, args string) string {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		args = "{}"
+	}
+	var decoded any
+	if err := json.Unmarshal([]byte(args), &decoded); err == nil {
+		if normalized, err := json.Marshal(decoded); err == nil {
+			args = string(normalized)
+		}
+	}
+	return strings.TrimSpace(name) + "\x00" + args
+}
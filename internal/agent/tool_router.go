@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llm"
+)
+
+// ToolCategory groups external tools by their MCP service prefix
+// (the part of the tool name before "__").
+type ToolCategory struct {
+	Name  string
+	Tools []llm.ToolDefinition
+}
+
+// ToolClassifier decides which tool categories are relevant to a user message.
+// Returning an empty slice means no category clearly matched.
+type ToolClassifier interface {
+	ClassifyToolCategories(ctx context.Context, userInput string, categories []ToolCategory) ([]string, error)
+}
+
+// KeywordToolClassifier matches category names, tool names and descriptions
+// against the user message. Chinese text is compared by character bigrams
+// since it has no word boundaries.
+type KeywordToolClassifier struct{}
+
+func (KeywordToolClassifier) ClassifyToolCategories(_ context.Context, userInput string, categories []ToolCategory) ([]string, error) {
+	input := strings.ToLower(strings.TrimSpace(userInput))
+	if input == "" {
+		return nil, nil
+	}
+	inputKeywords := routingKeywords(input)
+
+	out := make([]string, 0, len(categories))
+	for _, category := range categories {
+		for keyword := range routingKeywords(strings.ToLower(toolCategoryText(category))) {
+			if _, ok := inputKeywords[keyword]; ok {
+				out = append(out, category.Name)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// LLMToolClassifier asks the model for relevant categories with a cheap
+// tool-less call and falls back to keyword matching on any failure.
+type LLMToolClassifier struct {
+	client   llm.Client
+	model    string
+	fallback ToolClassifier
+}
+
+func NewLLMToolClassifier(client llm.Client, model string) *LLMToolClassifier {
+	return &LLMToolClassifier{
+		client:   client,
+		model:    strings.TrimSpace(model),
+		fallback: KeywordToolClassifier{},
+	}
+}
+
+func (c *LLMToolClassifier) ClassifyToolCategories(ctx context.Context, userInput string, categories []ToolCategory) ([]string, error) {
+	if c.client == nil || len(categories) == 0 {
+		return c.fallback.ClassifyToolCategories(ctx, userInput, categories)
+	}
+
+	var b strings.Builder
+	for _, category := range categories {
+		names := make([]string, 0, len(category.Tools))
+		for _, def := range category.Tools {
+			names = append(names, def.Function.Name)
+		}
+		b.WriteString(fmt.Sprintf("- %s: %s\n", category.Name, strings.Join(names, ", ")))
+	}
+	resp, err := c.client.Chat(ctx, llm.ChatRequest{
+		Purpose: "tool_routing",
+		Model:   c.model,
+		Messages: []llm.Message{
+			{Role: "system", Content: "你是工具路由器。根据用户消息判断需要哪些工具类别，只输出 JSON：{\"categories\":[\"类别名\"]}；都不需要时输出空数组。"},
+			{Role: "user", Content: "工具类别：\n" + b.String() + "\n用户消息：\n" + userInput},
+		},
+		Temperature: 0,
+	})
+	if err != nil {
+		return c.fallback.ClassifyToolCategories(ctx, userInput, categories)
+	}
+	var payload struct {
+		Categories []string `json:"categories"`
+	}
+	if err := json.Unmarshal([]byte(extractJSONObject(resp.Content)), &payload); err != nil {
+		return c.fallback.ClassifyToolCategories(ctx, userInput, categories)
+	}
+	return payload.Categories, nil
+}
+
+func (a *Agent) SetToolClassifier(classifier ToolClassifier) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.toolClass = classifier
+}
+
+func (a *Agent) toolClassifier() ToolClassifier {
+	if a.toolClass == nil {
+		return KeywordToolClassifier{}
+	}
+	return a.toolClass
+}
+
+// routeExternalTools narrows external tools to the categories relevant to the
+// latest user message. When nothing matches, all tools stay exposed so the
+// model is never left without an option it may need.
+func (a *Agent) routeExternalTools(ctx context.Context, userInput string, defs []llm.ToolDefinition) []llm.ToolDefinition {
+	if !a.cfg.ToolRouting || len(defs) == 0 {
+		return defs
+	}
+	categories := groupToolCategories(defs)
+	if len(categories) <= 1 {
+		return defs
+	}
+	names, err := a.toolClassifier().ClassifyToolCategories(ctx, userInput, categories)
+	if err != nil || len(names) == 0 {
+		return defs
+	}
+	relevant := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		relevant[strings.TrimSpace(name)] = struct{}{}
+	}
+	out := make([]llm.ToolDefinition, 0, len(defs))
+	for _, def := range defs {
+		if _, ok := relevant[toolCategoryName(def.Function.Name)]; ok {
+			out = append(out, def)
+		}
+	}
+	if len(out) == 0 {
+		return defs
+	}
+	return out
+}
+
+func groupToolCategories(defs []llm.ToolDefinition) []ToolCategory {
+	byName := make(map[string]*ToolCategory)
+	for _, def := range defs {
+		name := toolCategoryName(def.Function.Name)
+		category, ok := byName[name]
+		if !ok {
+			category = &ToolCategory{Name: name}
+			byName[name] = category
+		}
+		category.Tools = append(category.Tools, def)
+	}
+	out := make([]ToolCategory, 0, len(byName))
+	for _, category := range byName {
+		out = append(out, *category)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func toolCategoryName(toolName string) string {
+	if idx := strings.Index(toolName, "__"); idx > 0 {
+		return toolName[:idx]
+	}
+	return toolName
+}
+
+func toolCategoryText(category ToolCategory) string {
+	var b strings.Builder
+	b.WriteString(category.Name)
+	for _, def := range category.Tools {
+		b.WriteString(" ")
+		b.WriteString(strings.ReplaceAll(def.Function.Name, "__", " "))
+		b.WriteString(" ")
+		b.WriteString(def.Function.Description)
+	}
+	return b.String()
+}
+
+func routingKeywords(text string) map[string]struct{} {
+	out := make(map[string]struct{})
+	for _, token := range skillTokenPattern.FindAllString(text, -1) {
+		runes := []rune(token)
+		if !unicode.Is(unicode.Han, runes[0]) {
+			out[token] = struct{}{}
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			out[string(runes[i:i+2])] = struct{}{}
+		}
+	}
+	return out
+}
+
+func lastUserInput(messages []conversation.Message) string {
+	return latestUserMessage(messages).Content
+}
+
+func latestUserMessage(messages []conversation.Message) conversation.Message {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i]
+		}
+	}
+	return conversation.Message{}
+}
+
+// stripNoToolsPrefix removes the configured no-tools prefix from text and
+// reports whether it was present.
+func (a *Agent) stripNoToolsPrefix(text string) (string, bool) {
+	prefix := strings.TrimSpace(a.cfg.NoToolsPrefix)
+	if prefix == "" || len(text) < len(prefix) || !strings.EqualFold(text[:len(prefix)], prefix) {
+		return text, false
+	}
+	return strings.TrimSpace(text[len(prefix):]), true
+}
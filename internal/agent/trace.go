@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"laughing-barnacle/internal/conversation"
+)
+
+const (
+	defaultTurnTraceLimit = 50
+	maxTracedSkillRunes   = 120
+)
+
+// TurnTrace is the decision record of one user turn: what was injected, how
+// the context was compressed, which tools ran and how long each phase took.
+type TurnTrace struct {
+	ID           string                  `json:"id"`
+	Input        string                  `json:"input"`
+	Retry        bool                    `json:"retry,omitempty"`
+	StartedAt    time.Time               `json:"started_at"`
+	DurationMS   int64                   `json:"duration_ms"`
+	Skills       []string                `json:"skills,omitempty"`
+	Compressions int                     `json:"compressions"`
+	Rounds       int                     `json:"rounds"`
+	ToolCalls    []conversation.ToolCall `json:"tool_calls,omitempty"`
+	Reply        string                  `json:"reply,omitempty"`
+	Error        string                  `json:"error,omitempty"`
+	Phases       []TracePhase            `json:"phases"`
+}
+
+// TracePhase times one step of a turn, in execution order.
+type TracePhase struct {
+	Name       string `json:"name"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// The recording helpers are no-ops on a nil trace, so code shared with
+// non-turn paths (manual recompression) records unconditionally.
+
+func (t *TurnTrace) phase(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.Phases = append(t.Phases, TracePhase{Name: name, DurationMS: time.Since(start).Milliseconds()})
+}
+
+func (t *TurnTrace) setSkills(prompts []string) {
+	if t == nil {
+		return
+	}
+	t.Skills = make([]string, 0, len(prompts))
+	for _, prompt := range prompts {
+		t.Skills = append(t.Skills, trimRunes(prompt, maxTracedSkillRunes))
+	}
+}
+
+func (t *TurnTrace) noteCompression() {
+	if t != nil {
+		t.Compressions++
+	}
+}
+
+func (t *TurnTrace) noteRound(round int) {
+	if t != nil {
+		t.Rounds = round
+	}
+}
+
+func (t *TurnTrace) noteToolCall(call conversation.ToolCall) {
+	if t != nil {
+		t.ToolCalls = append(t.ToolCalls, call)
+	}
+}
+
+// traceStore keeps the most recent traces, newest first. It has its own lock
+// so traces stay readable while a turn holds the agent mutex.
+type traceStore struct {
+	mu     sync.RWMutex
+	limit  int
+	traces []TurnTrace
+}
+
+func newTraceStore(limit int) *traceStore {
+	if limit <= 0 {
+		limit = defaultTurnTraceLimit
+	}
+	return &traceStore{limit: limit}
+}
+
+func (s *traceStore) add(trace TurnTrace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traces = append([]TurnTrace{trace}, s.traces...)
+	if len(s.traces) > s.limit {
+		s.traces = s.traces[:s.limit]
+	}
+}
+
+func newTurnID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// beginTrace starts the trace for the turn holding a.mu.
+func (a *Agent) beginTrace(input string, retry bool) {
+	a.trace = &TurnTrace{
+		ID:        newTurnID(),
+		Input:     input,
+		Retry:     retry,
+		StartedAt: time.Now(),
+		Phases:    []TracePhase{},
+	}
+}
+
+// endTrace stores the current trace with the turn's outcome.
+func (a *Agent) endTrace(reply string, err error) {
+	trace := a.trace
+	a.trace = nil
+	if trace == nil {
+		return
+	}
+	trace.DurationMS = time.Since(trace.StartedAt).Milliseconds()
+	trace.Reply = reply
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	a.traces.add(*trace)
+}
+
+// TurnTraces returns the retained traces, newest first.
+func (a *Agent) TurnTraces() []TurnTrace {
+	a.traces.mu.RLock()
+	defer a.traces.mu.RUnlock()
+	return append([]TurnTrace(nil), a.traces.traces...)
+}
+
+// TurnTrace returns the retained trace with the given ID.
+func (a *Agent) TurnTrace(id string) (TurnTrace, bool) {
+	a.traces.mu.RLock()
+	defer a.traces.mu.RUnlock()
+	for _, trace := range a.traces.traces {
+		if trace.ID == id {
+			return trace, true
+		}
+	}
+	return TurnTrace{}, false
+}
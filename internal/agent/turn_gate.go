@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrAgentBusy is returned when MaxPendingTurns turns are already waiting for
+// the conversation; the rejected input is not persisted.
+var ErrAgentBusy = errors.New("agent busy: too many pending turns")
+
+// turnGate admits one turn at a time to the single shared conversation.
+// Waiting for it is bounded and honours the caller's context, so requests
+// behind a slow turn fail fast instead of hanging until their HTTP timeout.
+type turnGate struct {
+	slot    chan struct{}
+	waiting atomic.Int32
+	limit   int32 // max waiters; 0 means unbounded
+}
+
+func newTurnGate(maxPending int) *turnGate {
+	return &turnGate{
+		slot:  make(chan struct{}, 1),
+		limit: int32(max(maxPending, 0)),
+	}
+}
+
+func (g *turnGate) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case g.slot <- struct{}{}:
+		return g.release, nil
+	default:
+	}
+	if n := g.waiting.Add(1); g.limit > 0 && n > g.limit {
+		g.waiting.Add(-1)
+		return nil, ErrAgentBusy
+	}
+	defer g.waiting.Add(-1)
+	select {
+	case g.slot <- struct{}{}:
+		return g.release, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for the running turn: %w", ctx.Err())
+	}
+}
+
+func (g *turnGate) release() {
+	<-g.slot
+}
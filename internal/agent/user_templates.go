@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"strings"
+
+	"laughing-barnacle/internal/agentprompt"
+)
+
+// renderUserTemplate fills the {{name}} placeholders of tmpl, or of fallback
+// when tmpl is blank. Values are substituted in one pass, so placeholder text
+// inside a value (e.g. quoted in the conversation) is left alone.
+func renderUserTemplate(tmpl, fallback string, values map[string]string) string {
+	if strings.TrimSpace(tmpl) == "" {
+		tmpl = fallback
+	}
+	pairs := make([]string, 0, 2*len(values))
+	for name, value := range values {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+func (a *Agent) compressionUserPrompt(summary, conversation string) string {
+	return renderUserTemplate(a.cfg.CompressionUserTemplate, agentprompt.DefaultCompressionUserTemplate, map[string]string{
+		"summary":      safeOrEmpty(summary),
+		"conversation": conversation,
+	})
+}
+
+func (a *Agent) morningPlanUserPrompt(summary, conversation string) string {
+	return strings.TrimSpace(renderUserTemplate(a.cfg.MorningPlanUserTemplate, agentprompt.DefaultMorningPlanUserTemplate, map[string]string{
+		"summary":      safeOrEmpty(summary),
+		"conversation": conversation,
+	}))
+}
+
+func (a *Agent) nightReflectionUserPrompt(constraints, summary, systemPrompt, compressionPrompt, conversation string) string {
+	return strings.TrimSpace(renderUserTemplate(a.cfg.NightReflectionUserTemplate, agentprompt.DefaultNightReflectionUserTemplate, map[string]string{
+		"constraints":        constraints,
+		"summary":            safeOrEmpty(summary),
+		"system_prompt":      systemPrompt,
+		"compression_prompt": compressionPrompt,
+		"conversation":       conversation,
+	}))
+}
@@ -40,3 +40,53 @@ const DefaultCompressionSystemPrompt = `你是“傻毛”数字分身的上下
 - 删除重复、寒暄与无效信息。
 - 保留时间点、截止日期、可执行动作。
 - 输出纯文本，不使用 markdown 代码块。`
+
+// User-prompt templates for the background LLM calls. Placeholders are
+// written as {{name}} and replaced verbatim; unknown ones are left as is.
+
+// DefaultCompressionUserTemplate supports {{summary}} and {{conversation}}.
+const DefaultCompressionUserTemplate = `当前历史摘要：
+{{summary}}
+
+最近对话：
+{{conversation}}
+
+请输出新的合并摘要，包含：事实、约束、待办、用户偏好。`
+
+// DefaultMorningPlanUserTemplate supports {{summary}} and {{conversation}}.
+const DefaultMorningPlanUserTemplate = `请基于以下信息输出今日计划，必须包含：
+1) 任务进度回顾（昨天完成/未完成）
+2) 今日 Top 3 任务（按优先级）
+3) 学习与能力提升 1 条
+
+历史摘要：
+{{summary}}
+
+最近对话：
+{{conversation}}`
+
+// DefaultNightReflectionUserTemplate supports {{constraints}}, {{summary}},
+// {{system_prompt}}, {{compression_prompt}} and {{conversation}}. A custom
+// template must keep asking for the JSON fields below, otherwise the
+// reflection falls back to its canned text. The summary covers everything
+// older than the lookback, so it stays ahead of the long prompt texts.
+const DefaultNightReflectionUserTemplate = `请基于以下信息执行两件事：
+1) 生成夜间复盘（生活/工作/学习三段，各 1-2 行）
+2) 生成升级后的系统提示词与压缩提示词
+3) 提炼 0-3 条可复用能力 Skill（用于后续自动注入，不要冗长）
+
+约束：{{constraints}}
+输出 JSON 字段：reflection, system_prompt, compression_system_prompt, skills。
+skills 为数组；每项字段：name, prompt。name 2-20字，prompt 1 行且不超过 120 字。
+
+历史摘要：
+{{summary}}
+
+当前系统提示词：
+{{system_prompt}}
+
+当前压缩提示词：
+{{compression_prompt}}
+
+最近对话：
+{{conversation}}`
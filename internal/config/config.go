@@ -2,8 +2,12 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"laughing-barnacle/internal/agentprompt"
@@ -11,77 +15,343 @@ import (
 
 type Config struct {
 	Addr                       string
+	LogLevel                   string
+	AuthToken                  string
+	AuthUsername               string
+	AuthPassword               string
+	DataDir                    string
 	SettingsFile               string
 	SkillsDir                  string
 	SkillsStateFile            string
 	ConversationFile           string
+	ConversationAppendLog      bool
+	MaxStoredMessages          int
 	LLMLogFile                 string
+	LLMProvider                string
+	OllamaBaseURL              string
+	OllamaModel                string
+	OllamaFallbackModel        string
 	CerberBaseURL              string
 	CerberAPIKey               string
+	RequireAPIKey              bool
 	CerberModel                string
+	CerberFallbackModel        string
+	Model                      string
+	FallbackModel              string
+	ChatModel                  string
+	CompressionModel           string
+	PlanningModel              string
+	ReflectionModel            string
 	RequestTimeout             time.Duration
 	MCPRequestTimeout          time.Duration
 	MCPProtocolVersion         string
 	MCPToolCacheTTL            time.Duration
+	MCPSSEIdleTimeout          time.Duration
+	OutboundProxyURL           string
+	MCPCAFile                  string
+	MCPInsecureSkipVerify      bool
+	MCPFollowRedirects         bool
+	LLMCAFile                  string
+	LLMInsecureSkipVerify      bool
 	Temperature                float64
+	CompressionTemperature     float64
+	PlanningTemperature        float64
+	ReflectionTemperature      float64
 	MaxRecentMessages          int
 	CompressionTriggerMessages int
 	CompressionTriggerChars    int
 	KeepRecentAfterCompression int
+	KeepRecentTurns            int
 	MaxCompressionLoopsPerTurn int
 	MaxToolCallRounds          int
+	MaxToolResultsRunes        int
+	MaxTurnDuration            time.Duration
+	MaxPendingTurns            int
+	MaxContextTokens           int
+	ContextTokenRatio          float64
+	SkipMorningPlanForUrgent   bool
+	PersonaName                string
+	ForbidEmoji                bool
+	SystemPromptPrefix         string
+	SystemPromptSuffix         string
+	CompressionUserPrompt      string
+	MorningPlanUserPrompt      string
+	ReflectionUserPrompt       string
+	Timezone                   string
+	SkillSelector              string
+	EmbeddingModel             string
+	MaxInjectedSkills          int
+	MaxInjectedSkillRunes      int
+	MaxSingleSkillRunes        int
+	MaxInjectedAutoSkills      int
+	MaxSkillCandidates         int
+	SkillMaxNameRunes          int
+	SkillMaxDescriptionRunes   int
+	SkillMaxPromptRunes        int
+	SkillsCloneTimeout         time.Duration
+	SkillsMaxRepoBytes         int
+	ToolRouting                string
+	NoToolsPrefix              string
+	BuiltinToolsNotice         bool
+	DisabledBuiltinTools       []string
+	MessageTimestamps          bool
+	BashJSONOutput             bool
+	BashMaxStdoutRunes         int
+	BashMaxStderrRunes         int
+	BashShell                  string
+	BashShellArgs              []string
+	BashLogin                  bool
+	BashWorkDirRoot            string
+	NightReflectionLookback    int
+	MorningPlanLookback        int
 	LLMLogLimit                int
+	LLMLogMaxFieldBytes        int
+	LLMLogMaxAge               time.Duration
+	LLMLogRotateBytes          int
+	TurnTraceLimit             int
+	RateLimitPerMinute         int
+	ReadyzCheckLLM             bool
 	AgentSystemPrompt          string
 	CompressionSystemPrompt    string
 }
 
 func Load() (Config, error) {
+	dataDir := envOrDefault("APP_DATA_DIR", "./data")
 	cfg := Config{
 		Addr:                       envOrDefault("APP_ADDR", ":8080"),
-		SettingsFile:               envOrDefault("APP_SETTINGS_FILE", "./data/settings.json"),
-		SkillsDir:                  envOrDefault("APP_SKILLS_DIR", "./data/skills"),
-		SkillsStateFile:            envOrDefault("APP_SKILLS_STATE_FILE", "./data/skills_state.json"),
-		ConversationFile:           envOrDefault("APP_CONVERSATION_FILE", "./data/conversation.json"),
-		LLMLogFile:                 envOrDefault("APP_LLM_LOG_FILE", "./data/llm_logs.json"),
+		LogLevel:                   envOrDefault("APP_LOG_LEVEL", "info"),
+		AuthToken:                  os.Getenv("APP_AUTH_TOKEN"),
+		AuthUsername:               os.Getenv("APP_AUTH_USERNAME"),
+		AuthPassword:               os.Getenv("APP_AUTH_PASSWORD"),
+		DataDir:                    dataDir,
+		SettingsFile:               envOrDefault("APP_SETTINGS_FILE", filepath.Join(dataDir, "settings.json")),
+		SkillsDir:                  envOrDefault("APP_SKILLS_DIR", filepath.Join(dataDir, "skills")),
+		SkillsStateFile:            envOrDefault("APP_SKILLS_STATE_FILE", filepath.Join(dataDir, "skills_state.json")),
+		ConversationFile:           envOrDefault("APP_CONVERSATION_FILE", filepath.Join(dataDir, "conversation.json")),
+		ConversationAppendLog:      envBool("APP_CONVERSATION_APPEND_LOG", false),
+		MaxStoredMessages:          envInt("APP_MAX_STORED_MESSAGES", 500),
+		LLMLogFile:                 envOrDefault("APP_LLM_LOG_FILE", filepath.Join(dataDir, "llm_logs.json")),
+		LLMProvider:                envOrDefault("LLM_PROVIDER", "cerber"),
+		OllamaBaseURL:              envOrDefault("OLLAMA_BASE_URL", "http://localhost:11434"),
+		OllamaModel:                envOrDefault("OLLAMA_MODEL", "qwen2.5"),
+		OllamaFallbackModel:        envOrDefault("OLLAMA_FALLBACK_MODEL", ""),
 		CerberBaseURL:              envOrDefault("CERBER_BASE_URL", "https://api.cerber.ai"),
 		CerberAPIKey:               os.Getenv("CERBER_API_KEY"),
+		RequireAPIKey:              envBool("CERBER_REQUIRE_API_KEY", false),
 		CerberModel:                envOrDefault("CERBER_MODEL", "gpt-4o-mini"),
+		CerberFallbackModel:        envOrDefault("CERBER_FALLBACK_MODEL", ""),
+		ChatModel:                  envOrDefault("AGENT_CHAT_MODEL", ""),
+		CompressionModel:           envOrDefault("AGENT_COMPRESSION_MODEL", ""),
+		PlanningModel:              envOrDefault("AGENT_PLANNING_MODEL", ""),
+		ReflectionModel:            envOrDefault("AGENT_REFLECTION_MODEL", ""),
 		Temperature:                envFloat("CERBER_TEMPERATURE", 0.2),
+		CompressionTemperature:     envFloat("AGENT_COMPRESSION_TEMPERATURE", 0),
+		PlanningTemperature:        envFloat("AGENT_PLANNING_TEMPERATURE", 0.2),
+		ReflectionTemperature:      envFloat("AGENT_REFLECTION_TEMPERATURE", 0.1),
 		RequestTimeout:             envDuration("CERBER_TIMEOUT", 45*time.Second),
 		MCPRequestTimeout:          envDuration("MCP_HTTP_TIMEOUT", 20*time.Second),
 		MCPProtocolVersion:         envOrDefault("MCP_PROTOCOL_VERSION", "2025-06-18"),
 		MCPToolCacheTTL:            envDuration("MCP_TOOL_CACHE_TTL", 30*time.Second),
+		MCPSSEIdleTimeout:          envDuration("MCP_SSE_IDLE_TIMEOUT", 0),
+		OutboundProxyURL:           envOrDefault("OUTBOUND_PROXY_URL", ""),
+		MCPCAFile:                  envOrDefault("MCP_CA_FILE", ""),
+		MCPInsecureSkipVerify:      envBool("MCP_TLS_INSECURE_SKIP_VERIFY", false),
+		MCPFollowRedirects:         envBool("MCP_FOLLOW_REDIRECTS", true),
+		LLMCAFile:                  envOrDefault("LLM_CA_FILE", ""),
+		LLMInsecureSkipVerify:      envBool("LLM_TLS_INSECURE_SKIP_VERIFY", false),
 		MaxRecentMessages:          envInt("AGENT_MAX_RECENT_MESSAGES", 14),
 		CompressionTriggerMessages: envInt("AGENT_COMPRESSION_TRIGGER_MESSAGES", 20),
 		CompressionTriggerChars:    envInt("AGENT_COMPRESSION_TRIGGER_CHARS", 14000),
 		KeepRecentAfterCompression: envInt("AGENT_KEEP_RECENT_AFTER_COMPRESSION", 8),
+		KeepRecentTurns:            envInt("AGENT_KEEP_RECENT_TURNS_AFTER_COMPRESSION", 0),
 		MaxCompressionLoopsPerTurn: envInt("AGENT_MAX_COMPRESSION_LOOPS", 3),
 		MaxToolCallRounds:          envInt("AGENT_MAX_TOOL_CALL_ROUNDS", 6),
+		MaxToolResultsRunes:        envInt("AGENT_MAX_TOOL_RESULTS_RUNES", 60000),
+		MaxTurnDuration:            envDuration("AGENT_MAX_TURN_DURATION", 90*time.Second),
+		MaxPendingTurns:            envInt("AGENT_MAX_PENDING_TURNS", 4),
+		MaxContextTokens:           envInt("AGENT_MAX_CONTEXT_TOKENS", 0),
+		ContextTokenRatio:          envFloat("AGENT_CONTEXT_TOKEN_RATIO", 0.8),
+		SkipMorningPlanForUrgent:   envBool("AGENT_SKIP_MORNING_PLAN_FOR_URGENT", true),
+		PersonaName:                envOrDefault("AGENT_PERSONA_NAME", ""),
+		ForbidEmoji:                envBool("AGENT_FORBID_EMOJI", true),
+		SystemPromptPrefix:         envOrDefault("AGENT_SYSTEM_PROMPT_PREFIX", ""),
+		SystemPromptSuffix:         envOrDefault("AGENT_SYSTEM_PROMPT_SUFFIX", ""),
+		CompressionUserPrompt:      envOrDefault("AGENT_COMPRESSION_USER_TEMPLATE", ""),
+		MorningPlanUserPrompt:      envOrDefault("AGENT_MORNING_PLAN_USER_TEMPLATE", ""),
+		ReflectionUserPrompt:       envOrDefault("AGENT_NIGHT_REFLECTION_USER_TEMPLATE", ""),
+		Timezone:                   envOrDefault("AGENT_TIMEZONE", ""),
+		SkillSelector:              envOrDefault("AGENT_SKILL_SELECTOR", "token"),
+		EmbeddingModel:             envOrDefault("AGENT_EMBEDDING_MODEL", "text-embedding-3-small"),
+		MaxInjectedSkills:          envInt("AGENT_MAX_INJECTED_SKILLS", 6),
+		MaxInjectedSkillRunes:      envInt("AGENT_MAX_INJECTED_SKILL_RUNES", 1200),
+		MaxSingleSkillRunes:        envInt("AGENT_MAX_SINGLE_SKILL_RUNES", 280),
+		MaxInjectedAutoSkills:      envInt("AGENT_MAX_INJECTED_AUTO_SKILLS", 0),
+		MaxSkillCandidates:         envInt("AGENT_MAX_SKILL_CANDIDATES", 0),
+		SkillMaxNameRunes:          envInt("SKILLS_MAX_NAME_RUNES", 64),
+		SkillMaxDescriptionRunes:   envInt("SKILLS_MAX_DESCRIPTION_RUNES", 140),
+		SkillMaxPromptRunes:        envInt("SKILLS_MAX_PROMPT_RUNES", 4000),
+		SkillsCloneTimeout:         envDuration("SKILLS_CLONE_TIMEOUT", 60*time.Second),
+		SkillsMaxRepoBytes:         envInt("SKILLS_MAX_REPO_BYTES", 50<<20),
+		ToolRouting:                envOrDefault("AGENT_TOOL_ROUTING", "off"),
+		NoToolsPrefix:              envOrDefault("AGENT_NO_TOOLS_PREFIX", "chat:"),
+		BuiltinToolsNotice:         envBool("AGENT_BUILTIN_TOOLS_NOTICE", true),
+		DisabledBuiltinTools:       envList("AGENT_DISABLED_BUILTIN_TOOLS"),
+		MessageTimestamps:          envBool("AGENT_MESSAGE_TIMESTAMPS", false),
+		BashJSONOutput:             envBool("AGENT_BASH_JSON_OUTPUT", false),
+		BashMaxStdoutRunes:         envInt("AGENT_BASH_MAX_STDOUT_RUNES", 4000),
+		BashMaxStderrRunes:         envInt("AGENT_BASH_MAX_STDERR_RUNES", 2000),
+		BashShell:                  envOrDefault("AGENT_BASH_SHELL", ""),
+		BashShellArgs:              strings.Fields(os.Getenv("AGENT_BASH_SHELL_ARGS")),
+		BashLogin:                  envBool("AGENT_BASH_LOGIN", true),
+		BashWorkDirRoot:            envOrDefault("AGENT_BASH_WORKDIR_ROOT", ""),
+		NightReflectionLookback:    envInt("AGENT_NIGHT_REFLECTION_LOOKBACK", 20),
+		MorningPlanLookback:        envInt("AGENT_MORNING_PLAN_LOOKBACK", 20),
 		LLMLogLimit:                envInt("APP_LLM_LOG_LIMIT", 500),
+		LLMLogMaxFieldBytes:        envInt("APP_LLM_LOG_MAX_FIELD_BYTES", 16*1024),
+		LLMLogMaxAge:               envDuration("APP_LLM_LOG_MAX_AGE", 0),
+		LLMLogRotateBytes:          envInt("APP_LLM_LOG_ROTATE_BYTES", 0),
+		TurnTraceLimit:             envInt("APP_TURN_TRACE_LIMIT", 50),
+		RateLimitPerMinute:         envInt("APP_RATE_LIMIT_PER_MINUTE", 20),
+		ReadyzCheckLLM:             envBool("APP_READYZ_CHECK_LLM", false),
 		AgentSystemPrompt: envOrDefault("AGENT_SYSTEM_PROMPT",
 			agentprompt.DefaultSystemPrompt),
 		CompressionSystemPrompt: envOrDefault("AGENT_COMPRESSION_SYSTEM_PROMPT",
 			agentprompt.DefaultCompressionSystemPrompt),
 	}
+	if !envBool("AGENT_ENABLE_BASH_TOOL", true) && !slices.Contains(cfg.DisabledBuiltinTools, "linux__bash") {
+		cfg.DisabledBuiltinTools = append(cfg.DisabledBuiltinTools, "linux__bash")
+	}
 
-	if cfg.CerberAPIKey == "" {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return Config{}, fmt.Errorf("APP_LOG_LEVEL must be debug, info, warn or error")
+	}
+	if cfg.LLMProvider != "cerber" && cfg.LLMProvider != "ollama" {
+		return Config{}, fmt.Errorf("LLM_PROVIDER must be cerber or ollama")
+	}
+	cfg.Model, cfg.FallbackModel = cfg.CerberModel, cfg.CerberFallbackModel
+	if cfg.LLMProvider == "ollama" {
+		cfg.Model, cfg.FallbackModel = cfg.OllamaModel, cfg.OllamaFallbackModel
+		if os.Getenv("AGENT_EMBEDDING_MODEL") == "" {
+			cfg.EmbeddingModel = "nomic-embed-text"
+		}
+	}
+	if cfg.RequireAPIKey && cfg.LLMProvider == "cerber" && cfg.CerberAPIKey == "" {
 		return Config{}, fmt.Errorf("CERBER_API_KEY is required")
 	}
+	if (cfg.AuthUsername == "") != (cfg.AuthPassword == "") {
+		return Config{}, fmt.Errorf("APP_AUTH_USERNAME and APP_AUTH_PASSWORD must be set together")
+	}
 	if cfg.MaxRecentMessages <= 0 {
 		return Config{}, fmt.Errorf("AGENT_MAX_RECENT_MESSAGES must be > 0")
 	}
 	if cfg.KeepRecentAfterCompression < 0 {
 		return Config{}, fmt.Errorf("AGENT_KEEP_RECENT_AFTER_COMPRESSION must be >= 0")
 	}
+	if cfg.KeepRecentTurns < 0 {
+		return Config{}, fmt.Errorf("AGENT_KEEP_RECENT_TURNS_AFTER_COMPRESSION must be >= 0")
+	}
+	if cfg.NightReflectionLookback <= 0 {
+		return Config{}, fmt.Errorf("AGENT_NIGHT_REFLECTION_LOOKBACK must be > 0")
+	}
+	if cfg.MorningPlanLookback <= 0 {
+		return Config{}, fmt.Errorf("AGENT_MORNING_PLAN_LOOKBACK must be > 0")
+	}
+	if cfg.BashMaxStdoutRunes <= 0 || cfg.BashMaxStderrRunes <= 0 {
+		return Config{}, fmt.Errorf("AGENT_BASH_MAX_STDOUT_RUNES and AGENT_BASH_MAX_STDERR_RUNES must be > 0")
+	}
 	if cfg.MaxCompressionLoopsPerTurn <= 0 {
 		return Config{}, fmt.Errorf("AGENT_MAX_COMPRESSION_LOOPS must be > 0")
 	}
 	if cfg.MaxToolCallRounds <= 0 {
 		return Config{}, fmt.Errorf("AGENT_MAX_TOOL_CALL_ROUNDS must be > 0")
 	}
+	if cfg.MaxToolResultsRunes < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_TOOL_RESULTS_RUNES must be >= 0")
+	}
+	if cfg.MCPSSEIdleTimeout < 0 {
+		return Config{}, fmt.Errorf("MCP_SSE_IDLE_TIMEOUT must be >= 0")
+	}
+	if cfg.MaxTurnDuration < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_TURN_DURATION must be >= 0")
+	}
+	if cfg.MaxPendingTurns < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_PENDING_TURNS must be >= 0")
+	}
+	if cfg.MaxContextTokens < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_CONTEXT_TOKENS must be >= 0")
+	}
+	for name, temperature := range map[string]float64{
+		"AGENT_COMPRESSION_TEMPERATURE": cfg.CompressionTemperature,
+		"AGENT_PLANNING_TEMPERATURE":    cfg.PlanningTemperature,
+		"AGENT_REFLECTION_TEMPERATURE":  cfg.ReflectionTemperature,
+	} {
+		if temperature < 0 || temperature > 2 {
+			return Config{}, fmt.Errorf("%s must be in [0, 2]", name)
+		}
+	}
+	if cfg.ContextTokenRatio <= 0 || cfg.ContextTokenRatio > 1 {
+		return Config{}, fmt.Errorf("AGENT_CONTEXT_TOKEN_RATIO must be in (0, 1]")
+	}
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			return Config{}, fmt.Errorf("AGENT_TIMEZONE is invalid: %w", err)
+		}
+	}
+	if cfg.SkillSelector != "token" && cfg.SkillSelector != "embedding" {
+		return Config{}, fmt.Errorf("AGENT_SKILL_SELECTOR must be token or embedding")
+	}
+	if cfg.MaxInjectedSkills <= 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_INJECTED_SKILLS must be > 0")
+	}
+	if cfg.MaxInjectedSkillRunes <= 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_INJECTED_SKILL_RUNES must be > 0")
+	}
+	if cfg.MaxSingleSkillRunes <= 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_SINGLE_SKILL_RUNES must be > 0")
+	}
+	if cfg.MaxInjectedAutoSkills < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_INJECTED_AUTO_SKILLS must be >= 0")
+	}
+	if cfg.MaxSkillCandidates < 0 {
+		return Config{}, fmt.Errorf("AGENT_MAX_SKILL_CANDIDATES must be >= 0")
+	}
+	if cfg.SkillMaxNameRunes <= 0 {
+		return Config{}, fmt.Errorf("SKILLS_MAX_NAME_RUNES must be > 0")
+	}
+	if cfg.SkillMaxDescriptionRunes <= 0 {
+		return Config{}, fmt.Errorf("SKILLS_MAX_DESCRIPTION_RUNES must be > 0")
+	}
+	if cfg.SkillMaxPromptRunes <= 0 {
+		return Config{}, fmt.Errorf("SKILLS_MAX_PROMPT_RUNES must be > 0")
+	}
+	if cfg.SkillsCloneTimeout <= 0 {
+		return Config{}, fmt.Errorf("SKILLS_CLONE_TIMEOUT must be > 0")
+	}
+	if cfg.SkillsMaxRepoBytes <= 0 {
+		return Config{}, fmt.Errorf("SKILLS_MAX_REPO_BYTES must be > 0")
+	}
+	if cfg.ToolRouting != "off" && cfg.ToolRouting != "keyword" && cfg.ToolRouting != "llm" {
+		return Config{}, fmt.Errorf("AGENT_TOOL_ROUTING must be off, keyword or llm")
+	}
 	if cfg.LLMLogLimit <= 0 {
 		return Config{}, fmt.Errorf("APP_LLM_LOG_LIMIT must be > 0")
 	}
+	if cfg.LLMLogMaxAge < 0 {
+		return Config{}, fmt.Errorf("APP_LLM_LOG_MAX_AGE must be >= 0")
+	}
+	if cfg.LLMLogRotateBytes < 0 {
+		return Config{}, fmt.Errorf("APP_LLM_LOG_ROTATE_BYTES must be >= 0")
+	}
+	if cfg.TurnTraceLimit <= 0 {
+		return Config{}, fmt.Errorf("APP_TURN_TRACE_LIMIT must be > 0")
+	}
+	if cfg.MaxStoredMessages < 0 {
+		return Config{}, fmt.Errorf("APP_MAX_STORED_MESSAGES must be >= 0")
+	}
+	if cfg.RateLimitPerMinute < 0 {
+		return Config{}, fmt.Errorf("APP_RATE_LIMIT_PER_MINUTE must be >= 0")
+	}
 	if cfg.LLMLogFile == "" {
 		return Config{}, fmt.Errorf("APP_LLM_LOG_FILE is required")
 	}
@@ -98,6 +368,46 @@ func Load() (Config, error) {
 	return cfg, nil
 }
 
+// CheckDataPaths creates the directories the configured data files and skills
+// live in and verifies each accepts writes, so a read-only volume fails at
+// startup instead of on the first save. APP_DATA_DIR is only touched through
+// the paths that still default into it.
+func (c Config) CheckDataPaths() error {
+	dirs := []struct {
+		env string
+		dir string
+	}{
+		{env: "APP_SETTINGS_FILE", dir: filepath.Dir(c.SettingsFile)},
+		{env: "APP_SKILLS_DIR", dir: c.SkillsDir},
+		{env: "APP_SKILLS_STATE_FILE", dir: filepath.Dir(c.SkillsStateFile)},
+		{env: "APP_CONVERSATION_FILE", dir: filepath.Dir(c.ConversationFile)},
+		{env: "APP_LLM_LOG_FILE", dir: filepath.Dir(c.LLMLogFile)},
+	}
+	checked := make(map[string]struct{}, len(dirs))
+	for _, d := range dirs {
+		if _, ok := checked[d.dir]; ok {
+			continue
+		}
+		checked[d.dir] = struct{}{}
+		if err := checkWritableDir(d.dir); err != nil {
+			return fmt.Errorf("%s: %w", d.env, err)
+		}
+	}
+	return nil
+}
+
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create directory %q: %w", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return fmt.Errorf("directory %q is not writable: %w", dir, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
 func envOrDefault(key, fallback string) string {
 	v := os.Getenv(key)
 	if v == "" {
@@ -118,6 +428,29 @@ func envInt(key string, fallback int) int {
 	return n
 }
 
+// envList splits a comma-separated value, dropping empty items.
+func envList(key string) []string {
+	var out []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
 func envFloat(key string, fallback float64) float64 {
 	v := os.Getenv(key)
 	if v == "" {
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -43,3 +45,110 @@ func TestLoad_PromptEnvOverrideWorks(t *testing.T) {
 		t.Fatalf("expected custom compression prompt, got %q", cfg.CompressionSystemPrompt)
 	}
 }
+
+func TestLoad_DataDirRelocatesDefaultPaths(t *testing.T) {
+	t.Setenv("CERBER_API_KEY", "test-key")
+	dataDir := filepath.Join(t.TempDir(), "data")
+	elsewhere := filepath.Join(t.TempDir(), "elsewhere")
+	t.Setenv("APP_DATA_DIR", dataDir)
+	t.Setenv("APP_CONVERSATION_FILE", filepath.Join(elsewhere, "conversation.json"))
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+
+	want := map[string]string{
+		"settings":     filepath.Join(dataDir, "settings.json"),
+		"skills dir":   filepath.Join(dataDir, "skills"),
+		"skills state": filepath.Join(dataDir, "skills_state.json"),
+		"llm log":      filepath.Join(dataDir, "llm_logs.json"),
+		"conversation": filepath.Join(elsewhere, "conversation.json"),
+	}
+	got := map[string]string{
+		"settings":     cfg.SettingsFile,
+		"skills dir":   cfg.SkillsDir,
+		"skills state": cfg.SkillsStateFile,
+		"llm log":      cfg.LLMLogFile,
+		"conversation": cfg.ConversationFile,
+	}
+	for name, path := range want {
+		if got[name] != path {
+			t.Fatalf("%s path = %q, want %q", name, got[name], path)
+		}
+	}
+	if err := cfg.CheckDataPaths(); err != nil {
+		t.Fatalf("CheckDataPaths error: %v", err)
+	}
+	for _, dir := range []string{dataDir, filepath.Join(dataDir, "skills"), elsewhere} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Fatalf("expected %s to be created, got %v", dir, err)
+		}
+	}
+}
+
+func TestCheckDataPaths_DoesNotCreateUnusedDataDir(t *testing.T) {
+	t.Setenv("CERBER_API_KEY", "test-key")
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "unused")
+	t.Setenv("APP_DATA_DIR", dataDir)
+	t.Setenv("APP_SETTINGS_FILE", filepath.Join(root, "state", "settings.json"))
+	t.Setenv("APP_SKILLS_DIR", filepath.Join(root, "state", "skills"))
+	t.Setenv("APP_SKILLS_STATE_FILE", filepath.Join(root, "state", "skills_state.json"))
+	t.Setenv("APP_CONVERSATION_FILE", filepath.Join(root, "state", "conversation.json"))
+	t.Setenv("APP_LLM_LOG_FILE", filepath.Join(root, "logs", "llm_logs.json"))
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if err := cfg.CheckDataPaths(); err != nil {
+		t.Fatalf("CheckDataPaths error: %v", err)
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("expected APP_DATA_DIR to stay uncreated, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "logs")); err != nil {
+		t.Fatalf("expected llm log directory to be created: %v", err)
+	}
+}
+
+func TestLoad_DisabledBuiltinTools(t *testing.T) {
+	t.Setenv("CERBER_API_KEY", "test-key")
+	t.Setenv("AGENT_DISABLED_BUILTIN_TOOLS", " skills__catalog_search, ,mcp__get_prompt ")
+	t.Setenv("AGENT_ENABLE_BASH_TOOL", "false")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	want := []string{"skills__catalog_search", "mcp__get_prompt", "linux__bash"}
+	if strings.Join(cfg.DisabledBuiltinTools, ",") != strings.Join(want, ",") {
+		t.Fatalf("DisabledBuiltinTools = %v, want %v", cfg.DisabledBuiltinTools, want)
+	}
+}
+
+func TestLoad_OllamaUsesItsOwnModelDefaults(t *testing.T) {
+	t.Setenv("LLM_PROVIDER", "ollama")
+	t.Setenv("CERBER_MODEL", "gpt-4o-mini")
+	t.Setenv("AGENT_EMBEDDING_MODEL", "")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if cfg.Model != "qwen2.5" || cfg.EmbeddingModel != "nomic-embed-text" {
+		t.Fatalf("expected ollama defaults, got model=%q embedding=%q", cfg.Model, cfg.EmbeddingModel)
+	}
+
+	t.Setenv("OLLAMA_MODEL", "llama3.1")
+	t.Setenv("OLLAMA_FALLBACK_MODEL", "llama3.2")
+	t.Setenv("AGENT_EMBEDDING_MODEL", "bge-m3")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if cfg.Model != "llama3.1" || cfg.FallbackModel != "llama3.2" || cfg.EmbeddingModel != "bge-m3" {
+		t.Fatalf("expected configured ollama models, got %q %q %q", cfg.Model, cfg.FallbackModel, cfg.EmbeddingModel)
+	}
+}
@@ -0,0 +1,108 @@
+package conversation
+
+import (
+	"fmt"
+	"strings"
+)
+
+const markdownTimeLayout = "2006-01-02 15:04:05 MST"
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ExportMarkdown renders the summary and messages as a readable transcript.
+// Message text is escaped so it cannot break the surrounding structure; tool
+// arguments and results go into fenced blocks inside collapsible sections.
+func (s *Store) ExportMarkdown() string {
+	summary, messages := s.Snapshot()
+
+	var b strings.Builder
+	b.WriteString("# 对话记录\n\n")
+	if strings.TrimSpace(summary) != "" {
+		b.WriteString("## 历史摘要\n\n")
+		b.WriteString(escapeMarkdownText(summary))
+		b.WriteString("\n\n")
+	}
+	if len(messages) == 0 {
+		b.WriteString("_（暂无消息）_\n")
+		return b.String()
+	}
+	for _, msg := range messages {
+		b.WriteString("## ")
+		b.WriteString(markdownRoleLabel(msg.Role))
+		if !msg.CreatedAt.IsZero() {
+			b.WriteString(" · ")
+			b.WriteString(msg.CreatedAt.Format(markdownTimeLayout))
+		}
+		b.WriteString("\n\n")
+		b.WriteString(escapeMarkdownText(msg.Content))
+		b.WriteString("\n\n")
+		for _, call := range msg.ToolCalls {
+			writeMarkdownToolCall(&b, call)
+		}
+	}
+	return b.String()
+}
+
+func markdownRoleLabel(role string) string {
+	switch role {
+	case "user":
+		return "用户"
+	case "assistant":
+		return "助手"
+	default:
+		return escapeMarkdownText(role)
+	}
+}
+
+func writeMarkdownToolCall(b *strings.Builder, call ToolCall) {
+	status := ""
+	if call.Error != "" {
+		status = "（失败）"
+	}
+	fmt.Fprintf(b, "<details>\n<summary>工具调用：%s%s</summary>\n\n", htmlEscaper.Replace(call.Name), status)
+	b.WriteString("参数：\n\n")
+	writeMarkdownFence(b, call.Arguments)
+	b.WriteString("结果：\n\n")
+	writeMarkdownFence(b, call.Result)
+	if call.Error != "" {
+		b.WriteString("错误：\n\n")
+		writeMarkdownFence(b, call.Error)
+	}
+	b.WriteString("</details>\n\n")
+}
+
+// writeMarkdownFence wraps text in a code fence longer than any backtick run
+// it contains, so the text cannot close the block early.
+func writeMarkdownFence(b *strings.Builder, text string) {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	b.WriteString(fence)
+	b.WriteString("\n")
+	b.WriteString(strings.TrimRight(text, "\n"))
+	b.WriteString("\n")
+	b.WriteString(fence)
+	b.WriteString("\n\n")
+}
+
+// escapeMarkdownText keeps inline formatting but neutralizes raw HTML and
+// lines that would start a heading, rule or fence of their own.
+func escapeMarkdownText(text string) string {
+	lines := strings.Split(strings.TrimSpace(htmlEscaper.Replace(text)), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "#"),
+			strings.HasPrefix(trimmed, "```"),
+			strings.HasPrefix(trimmed, "~~~"),
+			strings.Trim(trimmed, "-= ") == "",
+			strings.Trim(trimmed, "* ") == "":
+			lines[i] = `\` + trimmed
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,7 +2,9 @@ package conversation
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -25,6 +27,31 @@ type Message struct {
 	Content   string     `json:"content"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 	CreatedAt time.Time  `json:"created_at"`
+	// Deferred marks a user message received during the sleep window that
+	// still waits to be answered on wake.
+	Deferred bool `json:"deferred,omitempty"`
+	// NoTools marks a user message that must be answered without any tools.
+	NoTools bool `json:"no_tools,omitempty"`
+}
+
+// ErrPersist marks failures to write the conversation file. The in-memory
+// state has already changed when it is returned.
+var ErrPersist = errors.New("persist conversation")
+
+// ErrInvalidRole is returned when appending a message whose role the chat
+// APIs would reject.
+var ErrInvalidRole = errors.New("invalid message role")
+
+var validRoles = map[string]bool{"user": true, "assistant": true, "system": true, "tool": true}
+
+// normalizeRole trims and lower-cases role and checks it against the roles
+// accepted by the chat APIs.
+func normalizeRole(role string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(role))
+	if !validRoles[normalized] {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+	return normalized, nil
 }
 
 // Store holds one global conversation (no session concept).
@@ -33,6 +60,27 @@ type Store struct {
 	path     string
 	summary  string
 	messages []Message
+	logger   *slog.Logger
+
+	// Append-log mode (see wal.go).
+	appendLog  bool
+	seq        int64
+	walRecords int
+
+	maxStored int
+	fold      FoldFunc
+}
+
+// FoldFunc merges messages dropped by the storage cap into the summary and
+// returns the new summary. It runs under the store lock, so keep it cheap.
+type FoldFunc func(summary string, dropped []Message) string
+
+// Options tunes file persistence.
+type Options struct {
+	// AppendLog writes Append/SetLatest*ToolCalls as JSON lines to
+	// "<path>.wal" instead of rewriting the whole file; the log is compacted
+	// into the main file on trim/edit/delete and every few hundred records.
+	AppendLog bool
 }
 
 func NewStore() *Store {
@@ -40,27 +88,109 @@ func NewStore() *Store {
 }
 
 func NewStoreWithFile(path string) (*Store, error) {
+	return NewStoreWithOptions(path, Options{})
+}
+
+func NewStoreWithOptions(path string, opts Options) (*Store, error) {
 	path = strings.TrimSpace(path)
 	if path == "" {
 		return nil, fmt.Errorf("conversation file path is required")
 	}
-	s := &Store{path: path}
+	s := &Store{path: path, appendLog: opts.AppendLog}
 	if err := s.loadFromFile(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-func (s *Store) Append(role, content string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.messages = append(s.messages, Message{
+func (s *Store) Append(role, content string) error {
+	return s.appendMessage(Message{
 		Role:      role,
 		Content:   content,
 		CreatedAt: time.Now(),
 	})
-	_ = s.persistLocked()
+}
+
+// AppendMessage appends msg as is, for messages carrying markers such as
+// Deferred or NoTools. A zero CreatedAt is set to now.
+func (s *Store) AppendMessage(msg Message) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	return s.appendMessage(msg)
+}
+
+func (s *Store) appendMessage(msg Message) error {
+	role, err := normalizeRole(msg.Role)
+	if err != nil {
+		return err
+	}
+	msg.Role = role
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	if s.maxStored > 0 && len(s.messages) > s.maxStored {
+		s.enforceCapLocked()
+		return s.persistCheckedLocked()
+	}
+	return s.persistRecordLocked(walRecord{Op: walOpAppend, Message: &msg})
+}
+
+// SetMaxStoredMessages caps the stored history regardless of the agent's
+// compression. When exceeded, the oldest messages are dropped down to three
+// quarters of the cap (so the fold does not run on every append), passing
+// them to fold first when it is non-nil. Deferred messages are never dropped.
+// max <= 0 disables the cap.
+func (s *Store) SetMaxStoredMessages(max int, fold FoldFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxStored = max
+	s.fold = fold
+	if max > 0 && len(s.messages) > max {
+		s.enforceCapLocked()
+		_ = s.persistCheckedLocked() // already logged; a loaded history is still usable
+	}
+}
+
+func (s *Store) enforceCapLocked() {
+	keep := s.maxStored - s.maxStored/4
+	if keep < 1 {
+		keep = 1
+	}
+	drop := len(s.messages) - keep
+	if drop <= 0 {
+		return
+	}
+	// Deferred messages still wait for an answer, so they are kept even when
+	// that leaves the history above the cap.
+	var dropped []Message
+	kept := make([]Message, 0, len(s.messages)-drop)
+	for _, msg := range s.messages[:drop] {
+		if msg.Deferred {
+			kept = append(kept, msg)
+		} else {
+			dropped = append(dropped, msg)
+		}
+	}
+	s.messages = append(kept, s.messages[drop:]...)
+	if s.fold != nil && len(dropped) > 0 {
+		s.summary = s.fold(s.summary, cloneMessages(dropped))
+	}
+}
+
+// SetLatestToolCalls attaches toolCalls to the most recent message of any
+// role, e.g. the assistant reply whose turn executed them.
+func (s *Store) SetLatestToolCalls(toolCalls []ToolCall) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.messages) == 0 {
+		return fmt.Errorf("no message to attach tool calls to")
+	}
+	s.messages[len(s.messages)-1].ToolCalls = normalizeToolCalls(toolCalls)
+	return s.persistRecordLocked(walRecord{Op: walOpToolCalls, ToolCalls: s.messages[len(s.messages)-1].ToolCalls})
 }
 
 func (s *Store) SetLatestUserToolCalls(toolCalls []ToolCall) error {
@@ -71,8 +201,99 @@ func (s *Store) SetLatestUserToolCalls(toolCalls []ToolCall) error {
 		return fmt.Errorf("no pending user message")
 	}
 	s.messages[len(s.messages)-1].ToolCalls = normalizeToolCalls(toolCalls)
-	_ = s.persistLocked()
-	return nil
+	return s.persistRecordLocked(walRecord{Op: walOpToolCalls, ToolCalls: s.messages[len(s.messages)-1].ToolCalls})
+}
+
+// EditMessage replaces the content of the message at index. Tool calls
+// recorded for the old content are dropped since they no longer match it.
+func (s *Store) EditMessage(index int, content string) error {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return fmt.Errorf("message content is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.messages) {
+		return fmt.Errorf("message index %d out of range", index)
+	}
+	s.messages[index].Content = content
+	s.messages[index].ToolCalls = nil
+	return s.persistCheckedLocked()
+}
+
+// DeleteMessage removes the message at index; later messages shift down.
+// The summary is left untouched because it only covers trimmed history.
+func (s *Store) DeleteMessage(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.messages) {
+		return fmt.Errorf("message index %d out of range", index)
+	}
+	s.messages = append(s.messages[:index:index], s.messages[index+1:]...)
+	if len(s.messages) == 0 {
+		s.messages = nil
+	}
+	return s.persistCheckedLocked()
+}
+
+// DeferLatestUserMessage marks the pending user message as deferred.
+func (s *Store) DeferLatestUserMessage() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.messages) == 0 || s.messages[len(s.messages)-1].Role != "user" {
+		return fmt.Errorf("no pending user message")
+	}
+	s.messages[len(s.messages)-1].Deferred = true
+	return s.persistCheckedLocked()
+}
+
+// DeferredCount reports how many stored messages still wait to be answered.
+func (s *Store) DeferredCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, msg := range s.messages {
+		if msg.Deferred {
+			count++
+		}
+	}
+	return count
+}
+
+// OldestDeferred returns the oldest message still waiting to be answered.
+func (s *Store) OldestDeferred() (Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := range s.messages {
+		if s.messages[i].Deferred {
+			return cloneMessages(s.messages[i : i+1])[0], true
+		}
+	}
+	return Message{}, false
+}
+
+// ClearDeferred clears the deferred marker on the waiting message matching
+// msg (same content and creation time), once it has been answered. The
+// marker stays cleared in memory even when persisting fails, so a message is
+// answered at most once.
+func (s *Store) ClearDeferred(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.messages {
+		stored := s.messages[i]
+		if stored.Deferred && stored.Content == msg.Content && stored.CreatedAt.Equal(msg.CreatedAt) {
+			s.messages[i].Deferred = false
+			return s.persistCheckedLocked()
+		}
+	}
+	return fmt.Errorf("deferred message not found")
 }
 
 func (s *Store) Snapshot() (string, []Message) {
@@ -82,7 +303,7 @@ func (s *Store) Snapshot() (string, []Message) {
 	return s.summary, cloneMessages(s.messages)
 }
 
-func (s *Store) SetSummaryAndTrim(summary string, keepRecent int) {
+func (s *Store) SetSummaryAndTrim(summary string, keepRecent int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -90,12 +311,68 @@ func (s *Store) SetSummaryAndTrim(summary string, keepRecent int) {
 	if keepRecent < 0 {
 		keepRecent = 0
 	}
-	if len(s.messages) <= keepRecent {
-		_ = s.persistLocked()
-		return
+	if len(s.messages) > keepRecent {
+		s.messages = append([]Message(nil), s.messages[len(s.messages)-keepRecent:]...)
+	}
+	return s.persistCheckedLocked()
+}
+
+// SetSummaryAndTrimTurns is SetSummaryAndTrim keeping the last keepTurns
+// complete turns instead of a raw message count. A turn starts at a user
+// message and runs through the replies and tool output that follow it, so the
+// cut never separates a reply from the message it answered.
+func (s *Store) SetSummaryAndTrimTurns(summary string, keepTurns int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.summary = summary
+	start := len(s.messages)
+	if keepTurns > 0 {
+		start = turnStart(s.messages, keepTurns)
+	}
+	if start > 0 {
+		s.messages = append([]Message(nil), s.messages[start:]...)
+	}
+	return s.persistCheckedLocked()
+}
+
+// turnStart returns the index of the user message opening the keepTurns-th
+// most recent turn, or 0 when there are fewer turns than that.
+func turnStart(messages []Message, keepTurns int) int {
+	turns := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		turns++
+		if turns == keepTurns {
+			return i
+		}
 	}
-	s.messages = append([]Message(nil), s.messages[len(s.messages)-keepRecent:]...)
-	_ = s.persistLocked()
+	return 0
+}
+
+// SetLogger sets where persistence failures are reported; nil restores
+// slog.Default().
+func (s *Store) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+// persistCheckedLocked writes the file, logging and returning failures
+// wrapped in ErrPersist.
+func (s *Store) persistCheckedLocked() error {
+	err := s.persistLocked()
+	if err == nil {
+		return nil
+	}
+	logger := s.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("persist conversation failed", "path", s.path, "error", err)
+	return fmt.Errorf("%w: %w", ErrPersist, err)
 }
 
 func (s *Store) loadFromFile() error {
@@ -111,6 +388,9 @@ func (s *Store) loadFromFile() error {
 		if os.IsNotExist(err) {
 			s.summary = ""
 			s.messages = nil
+			if err := s.replayWALLocked(); err != nil {
+				return err
+			}
 			return s.persistLocked()
 		}
 		return fmt.Errorf("read conversation file: %w", err)
@@ -120,19 +400,23 @@ func (s *Store) loadFromFile() error {
 	if trimmed == "" {
 		s.summary = ""
 		s.messages = nil
-		return nil
+		if err := s.replayWALLocked(); err != nil {
+			return err
+		}
+		return s.persistLocked()
 	}
 
-	var payload struct {
-		Summary  string    `json:"summary"`
-		Messages []Message `json:"messages"`
-	}
+	var payload filePayload
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return fmt.Errorf("decode conversation file: %w", err)
 	}
 
 	s.summary = payload.Summary
 	s.messages = cloneMessages(payload.Messages)
+	s.seq = payload.LastSeq
+	if err := s.replayWALLocked(); err != nil {
+		return err
+	}
 	return s.persistLocked()
 }
 
@@ -141,12 +425,10 @@ func (s *Store) persistLocked() error {
 		return nil
 	}
 
-	payload := struct {
-		Summary  string    `json:"summary"`
-		Messages []Message `json:"messages"`
-	}{
+	payload := filePayload{
 		Summary:  s.summary,
 		Messages: s.messages,
+		LastSeq:  s.seq,
 	}
 	data, err := json.MarshalIndent(payload, "", "  ")
 	if err != nil {
@@ -164,9 +446,20 @@ func (s *Store) persistLocked() error {
 	if err := os.Rename(tempPath, s.path); err != nil {
 		return fmt.Errorf("rename conversation file: %w", err)
 	}
+	// The snapshot now covers every logged record (seq <= LastSeq).
+	if err := os.Remove(s.walPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove conversation log: %w", err)
+	}
+	s.walRecords = 0
 	return nil
 }
 
+type filePayload struct {
+	Summary  string    `json:"summary"`
+	Messages []Message `json:"messages"`
+	LastSeq  int64     `json:"last_seq,omitempty"`
+}
+
 func cloneMessages(in []Message) []Message {
 	if len(in) == 0 {
 		return nil
@@ -1,7 +1,14 @@
 package conversation
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -49,6 +56,47 @@ func TestStoreWithFile_PersistsSummaryMessagesAndToolCalls(t *testing.T) {
 	}
 }
 
+func TestSetSummaryAndTrimTurns_KeepsCompleteTurns(t *testing.T) {
+	store := NewStore()
+	store.Append("user", "q1")
+	store.Append("assistant", "a1")
+	store.Append("user", "q2")
+	store.Append("tool", "tool output")
+	store.Append("assistant", "a2")
+	store.Append("user", "q3")
+	store.Append("assistant", "a3")
+
+	// A raw count of 4 would keep a2 without the q2 it answered.
+	if err := store.SetSummaryAndTrimTurns("summary", 2); err != nil {
+		t.Fatalf("SetSummaryAndTrimTurns error: %v", err)
+	}
+	summary, messages := store.Snapshot()
+	if summary != "summary" {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+	var got []string
+	for _, msg := range messages {
+		got = append(got, msg.Content)
+	}
+	if strings.Join(got, ",") != "q2,tool output,a2,q3,a3" {
+		t.Fatalf("unexpected kept messages: %v", got)
+	}
+
+	if err := store.SetSummaryAndTrimTurns("summary", 5); err != nil {
+		t.Fatalf("SetSummaryAndTrimTurns error: %v", err)
+	}
+	if _, messages := store.Snapshot(); len(messages) != 5 {
+		t.Fatalf("expected all messages kept when fewer turns exist, got %d", len(messages))
+	}
+
+	if err := store.SetSummaryAndTrimTurns("summary", 0); err != nil {
+		t.Fatalf("SetSummaryAndTrimTurns error: %v", err)
+	}
+	if _, messages := store.Snapshot(); len(messages) != 0 {
+		t.Fatalf("expected no messages kept for zero turns, got %d", len(messages))
+	}
+}
+
 func TestSetLatestUserToolCalls_RequiresPendingUserMessage(t *testing.T) {
 	store := NewStore()
 	store.Append("assistant", "ready")
@@ -57,3 +105,370 @@ func TestSetLatestUserToolCalls_RequiresPendingUserMessage(t *testing.T) {
 		t.Fatalf("expected error without pending user message")
 	}
 }
+
+func TestSetLatestToolCalls_AttachesToAssistantMessage(t *testing.T) {
+	for _, appendLog := range []bool{false, true} {
+		t.Run(fmt.Sprintf("appendLog=%v", appendLog), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conversation.json")
+			store, err := NewStoreWithOptions(path, Options{AppendLog: appendLog})
+			if err != nil {
+				t.Fatalf("NewStoreWithOptions error: %v", err)
+			}
+
+			store.Append("user", "今天北京天气")
+			store.Append("assistant", "18 度")
+			if err := store.SetLatestToolCalls([]ToolCall{{ID: "call_1", Name: "weather__query", Result: `{"temp":18}`}}); err != nil {
+				t.Fatalf("SetLatestToolCalls error: %v", err)
+			}
+
+			reloaded, err := NewStoreWithOptions(path, Options{AppendLog: appendLog})
+			if err != nil {
+				t.Fatalf("reload store error: %v", err)
+			}
+			_, messages := reloaded.Snapshot()
+			if len(messages) != 2 {
+				t.Fatalf("expected 2 messages, got %d", len(messages))
+			}
+			if len(messages[0].ToolCalls) != 0 {
+				t.Fatalf("expected user message untouched, got %+v", messages[0].ToolCalls)
+			}
+			if len(messages[1].ToolCalls) != 1 || messages[1].ToolCalls[0].Name != "weather__query" {
+				t.Fatalf("expected tool call on assistant message, got %+v", messages[1].ToolCalls)
+			}
+			if messages[1].ToolCalls[0].Arguments != "{}" {
+				t.Fatalf("expected normalized arguments, got %q", messages[1].ToolCalls[0].Arguments)
+			}
+		})
+	}
+}
+
+func TestSetLatestToolCalls_RequiresMessage(t *testing.T) {
+	if err := NewStore().SetLatestToolCalls([]ToolCall{{Name: "any"}}); err == nil {
+		t.Fatalf("expected error on empty conversation")
+	}
+}
+
+func TestEditMessage_UpdatesContentAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("NewStoreWithFile error: %v", err)
+	}
+	store.Append("user", "今天北京天汽")
+	if err := store.SetLatestUserToolCalls([]ToolCall{{Name: "weather__query"}}); err != nil {
+		t.Fatalf("SetLatestUserToolCalls error: %v", err)
+	}
+
+	if err := store.EditMessage(0, "  今天北京天气  "); err != nil {
+		t.Fatalf("EditMessage error: %v", err)
+	}
+	if err := store.EditMessage(0, "   "); err == nil {
+		t.Fatalf("expected error for empty content")
+	}
+
+	reloaded, err := NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("reload store error: %v", err)
+	}
+	_, messages := reloaded.Snapshot()
+	if len(messages) != 1 || messages[0].Content != "今天北京天气" {
+		t.Fatalf("unexpected messages after edit: %+v", messages)
+	}
+	if len(messages[0].ToolCalls) != 0 {
+		t.Fatalf("expected stale tool calls to be dropped, got %+v", messages[0].ToolCalls)
+	}
+}
+
+func TestEditAndDeleteMessage_RejectOutOfRangeIndex(t *testing.T) {
+	store := NewStore()
+	store.Append("user", "hello")
+
+	for _, index := range []int{-1, 1} {
+		if err := store.EditMessage(index, "hi"); err == nil {
+			t.Fatalf("expected edit error for index %d", index)
+		}
+		if err := store.DeleteMessage(index); err == nil {
+			t.Fatalf("expected delete error for index %d", index)
+		}
+	}
+	if _, messages := store.Snapshot(); len(messages) != 1 || messages[0].Content != "hello" {
+		t.Fatalf("store changed after rejected operations: %+v", messages)
+	}
+}
+
+func TestDeleteMessage_ReindexesRemainingMessages(t *testing.T) {
+	store := NewStore()
+	store.Append("user", "first")
+	store.Append("assistant", "bad answer")
+	store.Append("user", "second")
+	store.SetSummaryAndTrim("summary", 10)
+
+	if err := store.DeleteMessage(1); err != nil {
+		t.Fatalf("DeleteMessage error: %v", err)
+	}
+	summary, messages := store.Snapshot()
+	if summary != "summary" {
+		t.Fatalf("summary changed: %q", summary)
+	}
+	if len(messages) != 2 || messages[0].Content != "first" || messages[1].Content != "second" {
+		t.Fatalf("unexpected messages after delete: %+v", messages)
+	}
+
+	if err := store.EditMessage(1, "second, edited"); err != nil {
+		t.Fatalf("EditMessage error: %v", err)
+	}
+	if _, messages := store.Snapshot(); messages[1].Content != "second, edited" {
+		t.Fatalf("expected index 1 to address the shifted message, got %+v", messages)
+	}
+}
+
+func TestAppend_ReturnsAndLogsPersistFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("NewStoreWithFile error: %v", err)
+	}
+	var logs bytes.Buffer
+	store.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// A directory at the temp path makes the atomic write fail.
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := store.Append("user", "hello"); !errors.Is(err, ErrPersist) {
+		t.Fatalf("expected ErrPersist, got %v", err)
+	}
+	if err := store.SetSummaryAndTrim("summary", 1); !errors.Is(err, ErrPersist) {
+		t.Fatalf("expected ErrPersist from SetSummaryAndTrim, got %v", err)
+	}
+
+	if _, messages := store.Snapshot(); len(messages) != 1 {
+		t.Fatalf("expected message to stay in memory, got %+v", messages)
+	}
+	if out := logs.String(); !strings.Contains(out, "level=WARN") || !strings.Contains(out, "persist conversation failed") {
+		t.Fatalf("expected persist warning, got %q", out)
+	}
+}
+
+func TestAppend_RejectsInvalidRoleAndNormalizesCase(t *testing.T) {
+	store := NewStore()
+	if err := store.Append("moderator", "hello"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("expected ErrInvalidRole, got %v", err)
+	}
+	if err := store.AppendMessage(Message{Content: "no role"}); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("expected ErrInvalidRole for an empty role, got %v", err)
+	}
+	if err := store.Append(" User ", "hi"); err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+
+	_, messages := store.Snapshot()
+	if len(messages) != 1 || messages[0].Role != "user" {
+		t.Fatalf("expected only the normalized user message, got %+v", messages)
+	}
+}
+
+func TestAppendLog_ReplaysOnReloadAndCompactsOnTrim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := NewStoreWithOptions(path, Options{AppendLog: true})
+	if err != nil {
+		t.Fatalf("NewStoreWithOptions error: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+
+	store.Append("user", "今天北京天气")
+	if err := store.SetLatestUserToolCalls([]ToolCall{{Name: "weather__query", Result: "18"}}); err != nil {
+		t.Fatalf("SetLatestUserToolCalls error: %v", err)
+	}
+	store.Append("assistant", "18 度")
+
+	after, _ := os.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Fatalf("expected appends to leave the main file untouched")
+	}
+	if _, err := os.Stat(path + ".wal"); err != nil {
+		t.Fatalf("expected append log to exist: %v", err)
+	}
+
+	reloaded, err := NewStoreWithOptions(path, Options{AppendLog: true})
+	if err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	_, messages := reloaded.Snapshot()
+	if len(messages) != 2 || messages[0].ToolCalls[0].Name != "weather__query" || messages[1].Content != "18 度" {
+		t.Fatalf("unexpected replayed messages: %+v", messages)
+	}
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected load to fold the log into the main file, stat err=%v", err)
+	}
+
+	reloaded.Append("user", "明天呢")
+	if err := reloaded.SetSummaryAndTrim("问过天气", 1); err != nil {
+		t.Fatalf("SetSummaryAndTrim error: %v", err)
+	}
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected trim to compact the log, stat err=%v", err)
+	}
+
+	// A log left behind by an interrupted compaction must not be replayed twice.
+	stale, _ := json.Marshal(walRecord{Seq: 1, Op: walOpAppend, Message: &Message{Role: "user", Content: "stale"}})
+	if err := os.WriteFile(path+".wal", append(stale, '\n'), 0o600); err != nil {
+		t.Fatalf("write stale log: %v", err)
+	}
+	final, err := NewStoreWithFile(path)
+	if err != nil {
+		t.Fatalf("final reload error: %v", err)
+	}
+	summary, messages := final.Snapshot()
+	if summary != "问过天气" || len(messages) != 1 || messages[0].Content != "明天呢" {
+		t.Fatalf("unexpected state after stale log: %q %+v", summary, messages)
+	}
+}
+
+func TestAppendLog_AppendCostIndependentOfHistorySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	store, err := NewStoreWithOptions(path, Options{AppendLog: true})
+	if err != nil {
+		t.Fatalf("NewStoreWithOptions error: %v", err)
+	}
+
+	appendBytes := func() int64 {
+		before := fileSize(path + ".wal")
+		store.Append("user", "same sized message")
+		return fileSize(path+".wal") - before
+	}
+
+	early := appendBytes()
+	for i := 0; i < maxWALRecords-10; i++ {
+		store.Append("assistant", "filler")
+	}
+	late := appendBytes()
+	if early <= 0 || late-early > 16 || early-late > 16 {
+		t.Fatalf("expected constant bytes written per append, got %d then %d", early, late)
+	}
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, appendLog := range []bool{false, true} {
+		for _, history := range []int{100, 2000} {
+			name := fmt.Sprintf("appendLog=%v/history=%d", appendLog, history)
+			b.Run(name, func(b *testing.B) {
+				path := filepath.Join(b.TempDir(), "conversation.json")
+				store, err := NewStoreWithOptions(path, Options{AppendLog: appendLog})
+				if err != nil {
+					b.Fatalf("NewStoreWithOptions error: %v", err)
+				}
+				for i := 0; i < history; i++ {
+					store.messages = append(store.messages, Message{Role: "user", Content: "history message"})
+				}
+				_ = store.persistLocked()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					store.Append("user", "benchmark message")
+				}
+			})
+		}
+	}
+}
+
+func TestMaxStoredMessages_DropsOldestAndFoldsIntoSummary(t *testing.T) {
+	store := NewStore()
+	var folded []string
+	store.SetMaxStoredMessages(8, func(summary string, dropped []Message) string {
+		for _, msg := range dropped {
+			folded = append(folded, msg.Content)
+		}
+		return strings.TrimSpace(summary + fmt.Sprintf("\n已移除 %d 条", len(dropped)))
+	})
+
+	for i := 1; i <= 9; i++ {
+		store.Append("user", fmt.Sprintf("m%d", i))
+	}
+
+	summary, messages := store.Snapshot()
+	if len(messages) != 6 || messages[0].Content != "m4" || messages[5].Content != "m9" {
+		t.Fatalf("expected oldest messages trimmed to 3/4 of the cap, got %+v", messages)
+	}
+	if strings.Join(folded, ",") != "m1,m2,m3" || summary != "已移除 3 条" {
+		t.Fatalf("unexpected fold: dropped=%v summary=%q", folded, summary)
+	}
+
+	store.Append("user", "m10")
+	if _, messages := store.Snapshot(); len(messages) != 7 {
+		t.Fatalf("expected no trim below the cap, got %d messages", len(messages))
+	}
+}
+
+func TestMaxStoredMessages_KeepsDeferredMessages(t *testing.T) {
+	store := NewStore()
+	var folded []string
+	store.SetMaxStoredMessages(8, func(summary string, dropped []Message) string {
+		for _, msg := range dropped {
+			folded = append(folded, msg.Content)
+		}
+		return summary
+	})
+
+	store.Append("user", "m1")
+	if err := store.AppendMessage(Message{Role: "user", Content: "late night", Deferred: true}); err != nil {
+		t.Fatalf("AppendMessage error: %v", err)
+	}
+	for i := 3; i <= 9; i++ {
+		store.Append("user", fmt.Sprintf("m%d", i))
+	}
+
+	_, messages := store.Snapshot()
+	if len(messages) != 7 || messages[0].Content != "late night" || !messages[0].Deferred {
+		t.Fatalf("expected the deferred message to survive the trim, got %+v", messages)
+	}
+	if strings.Join(folded, ",") != "m1,m3" {
+		t.Fatalf("expected only non-deferred messages folded, got %v", folded)
+	}
+	if store.DeferredCount() != 1 {
+		t.Fatalf("expected the deferred message to stay queued")
+	}
+}
+
+func TestExportMarkdown_RendersToolCallsAndEscapesContent(t *testing.T) {
+	store := NewStore()
+	if err := store.Append("user", "# 不是标题 <b>"); err != nil {
+		t.Fatalf("Append user error: %v", err)
+	}
+	if err := store.Append("assistant", "查好了"); err != nil {
+		t.Fatalf("Append assistant error: %v", err)
+	}
+	if err := store.SetLatestToolCalls([]ToolCall{{
+		Name:      "search__lookup",
+		Arguments: `{"q":"go"}`,
+		Result:    "found ``` fence",
+	}}); err != nil {
+		t.Fatalf("SetLatestToolCalls error: %v", err)
+	}
+
+	out := store.ExportMarkdown()
+	for _, want := range []string{
+		"## 用户",
+		`\# 不是标题 &lt;b&gt;`,
+		"## 助手",
+		"<summary>工具调用：search__lookup</summary>",
+		"````\nfound ``` fence\n````",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected export to contain %q, got:\n%s", want, out)
+		}
+	}
+	if _, messages := store.Snapshot(); len(messages) != 2 {
+		t.Fatalf("export must not change state, got %d messages", len(messages))
+	}
+}
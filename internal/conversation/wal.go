@@ -0,0 +1,122 @@
+package conversation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	walOpAppend    = "append"
+	walOpToolCalls = "tool_calls"
+
+	// maxWALRecords bounds replay time; the log is folded into the main
+	// file once it holds this many records.
+	maxWALRecords = 256
+)
+
+// walRecord is one line of the append log. Seq increases monotonically and
+// the main file stores the last folded Seq, so replay skips records that a
+// compaction already covered even if the log removal did not happen.
+type walRecord struct {
+	Seq       int64      `json:"seq"`
+	Op        string     `json:"op"`
+	Message   *Message   `json:"message,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+func (s *Store) walPath() string {
+	return s.path + ".wal"
+}
+
+// persistRecordLocked persists one incremental change, appending to the log
+// in append-log mode and rewriting the full file otherwise.
+func (s *Store) persistRecordLocked(rec walRecord) error {
+	if strings.TrimSpace(s.path) == "" {
+		return nil
+	}
+	if !s.appendLog || s.walRecords >= maxWALRecords {
+		return s.persistCheckedLocked()
+	}
+
+	rec.Seq = s.seq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("%w: encode conversation log: %w", ErrPersist, err)
+	}
+	if err := appendLine(s.walPath(), line); err != nil {
+		logger := s.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("append conversation log failed", "path", s.walPath(), "error", err)
+		return fmt.Errorf("%w: %w", ErrPersist, err)
+	}
+	s.seq = rec.Seq
+	s.walRecords++
+	return nil
+}
+
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open conversation log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write conversation log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close conversation log: %w", err)
+	}
+	return nil
+}
+
+// replayWALLocked applies logged records newer than the loaded snapshot. A
+// torn trailing line from an interrupted write is dropped.
+func (s *Store) replayWALLocked() error {
+	data, err := os.ReadFile(s.walPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read conversation log: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			logger := s.logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Warn("skip unreadable conversation log tail", "path", s.walPath(), "error", err)
+			break
+		}
+		if rec.Seq <= s.seq {
+			continue
+		}
+		switch rec.Op {
+		case walOpAppend:
+			if rec.Message != nil {
+				s.messages = append(s.messages, *rec.Message)
+			}
+		case walOpToolCalls:
+			if n := len(s.messages); n > 0 {
+				s.messages[n-1].ToolCalls = cloneToolCalls(rec.ToolCalls)
+			}
+		}
+		s.seq = rec.Seq
+	}
+	return scanner.Err()
+}
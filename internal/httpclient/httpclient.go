@@ -0,0 +1,76 @@
+// Package httpclient builds the outbound *http.Client used for MCP and LLM
+// calls from proxy, CA bundle, TLS and redirect settings.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	Timeout time.Duration
+	// ProxyURL overrides HTTP_PROXY/HTTPS_PROXY/NO_PROXY, which are honored
+	// when it is empty.
+	ProxyURL string
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile             string
+	InsecureSkipVerify bool
+	NoRedirects        bool
+}
+
+// New returns a client with its own transport, cloned from
+// http.DefaultTransport so pooling and HTTP/2 defaults are kept.
+func New(opts Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if raw := strings.TrimSpace(opts.ProxyURL); raw != "" {
+		proxyURL, err := url.Parse(raw)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q", raw)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if opts.CAFile != "" || opts.InsecureSkipVerify {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.CAFile != "" {
+			pool, err := loadCertPool(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		tlsConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{Timeout: opts.Timeout, Transport: transport}
+	if opts.NoRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("ca file contains no PEM certificates")
+	}
+	return pool, nil
+}
@@ -0,0 +1,68 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew_RoutesThroughProxyURL(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	client, err := New(Options{Timeout: 3 * time.Second, ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	resp, err := client.Get("http://mcp.internal.example/tools")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "via proxy" || proxied != "http://mcp.internal.example/tools" {
+		t.Fatalf("expected request through proxy, got %q for %q", body, proxied)
+	}
+}
+
+func TestNew_NoRedirectsReturnsRedirectResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Redirect(w, r, "/end", http.StatusFound)
+			return
+		}
+		t.Fatalf("redirect should not be followed, got %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	client, err := New(Options{Timeout: 3 * time.Second, NoRedirects: true})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	resp, err := client.Get(ts.URL + "/start")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected 302, got %d", resp.StatusCode)
+	}
+}
+
+func TestNew_RejectsInvalidCAFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("write ca file: %v", err)
+	}
+	if _, err := New(Options{CAFile: path}); err == nil {
+		t.Fatalf("expected error for CA file without certificates")
+	}
+}
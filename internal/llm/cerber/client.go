@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,21 +13,35 @@ import (
 
 	"laughing-barnacle/internal/llm"
 	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/metrics"
+	"laughing-barnacle/internal/redact"
 )
 
+// ErrMissingAPIKey is returned instead of calling the API when no key is set.
+var ErrMissingAPIKey = errors.New("LLM 未配置 API Key，请设置 CERBER_API_KEY")
+
 type Config struct {
 	BaseURL    string
 	APIKey     string
 	Timeout    time.Duration
 	HTTPClient *http.Client
 	LogStore   *llmlog.Store
+	Metrics    *metrics.Metrics
+	// MaxLogFieldBytes truncates logged request/response bodies; 0 uses
+	// the 16KB default and a negative value disables truncation.
+	MaxLogFieldBytes int
+	// Redactor masks secrets in logged bodies and errors; nil logs them as is.
+	Redactor *redact.Redactor
 }
 
 type Client struct {
-	baseURL string
-	apiKey  string
-	http    *http.Client
-	logs    *llmlog.Store
+	baseURL        string
+	apiKey         string
+	http           *http.Client
+	logs           *llmlog.Store
+	metrics        *metrics.Metrics
+	maxLogFieldLen int
+	redactor       *redact.Redactor
 }
 
 func NewClient(cfg Config) *Client {
@@ -35,11 +50,19 @@ func NewClient(cfg Config) *Client {
 		httpClient = &http.Client{Timeout: cfg.Timeout}
 	}
 
+	maxLogFieldLen := cfg.MaxLogFieldBytes
+	if maxLogFieldLen == 0 {
+		maxLogFieldLen = llmlog.DefaultMaxFieldBytes
+	}
+
 	return &Client{
-		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
-		apiKey:  cfg.APIKey,
-		http:    httpClient,
-		logs:    cfg.LogStore,
+		baseURL:        strings.TrimRight(cfg.BaseURL, "/"),
+		apiKey:         cfg.APIKey,
+		http:           httpClient,
+		logs:           cfg.LogStore,
+		metrics:        cfg.Metrics,
+		maxLogFieldLen: maxLogFieldLen,
+		redactor:       cfg.Redactor,
 	}
 }
 
@@ -47,8 +70,12 @@ type chatRequestPayload struct {
 	Model       string               `json:"model"`
 	Messages    []llm.Message        `json:"messages"`
 	Tools       []llm.ToolDefinition `json:"tools,omitempty"`
+	ToolChoice  llm.ToolChoice       `json:"tool_choice,omitempty"`
 	Temperature float64              `json:"temperature,omitempty"`
 	Stream      bool                 `json:"stream"`
+	// ResponseFormat is sent as-is; OpenAI-style json_object mode requires
+	// the prompt itself to mention JSON.
+	ResponseFormat *llm.ResponseFormat `json:"response_format,omitempty"`
 }
 
 type chatResponsePayload struct {
@@ -58,9 +85,16 @@ type chatResponsePayload struct {
 			ToolCalls []llm.ToolCall `json:"tool_calls"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
 }
 
 func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	if strings.TrimSpace(c.apiKey) == "" {
+		return llm.ChatResponse{}, ErrMissingAPIKey
+	}
 	if req.Model == "" {
 		return llm.ChatResponse{}, fmt.Errorf("model is required")
 	}
@@ -75,6 +109,11 @@ func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatRespons
 		Temperature: req.Temperature,
 		Stream:      false,
 	}
+	payload.ResponseFormat = req.ResponseFormat
+	// OpenAI-style APIs reject tool_choice without tools.
+	if len(req.Tools) > 0 {
+		payload.ToolChoice = req.ToolChoice
+	}
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return llm.ChatResponse{}, fmt.Errorf("marshal request: %w", err)
@@ -96,31 +135,31 @@ func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatRespons
 	start := time.Now()
 	httpResp, err := c.http.Do(httpReq)
 	if err != nil {
-		c.appendLog(req, payloadBytes, nil, 0, time.Since(start), err)
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, nil, 0, time.Since(start), err)
 		return llm.ChatResponse{}, fmt.Errorf("request failed: %w", err)
 	}
 	defer httpResp.Body.Close()
 
 	respBody, err := io.ReadAll(httpResp.Body)
 	if err != nil {
-		c.appendLog(req, payloadBytes, nil, httpResp.StatusCode, time.Since(start), err)
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, nil, httpResp.StatusCode, time.Since(start), err)
 		return llm.ChatResponse{}, fmt.Errorf("read response: %w", err)
 	}
 
 	if httpResp.StatusCode >= http.StatusBadRequest {
-		err = fmt.Errorf("cerber status %d: %s", httpResp.StatusCode, strings.TrimSpace(string(respBody)))
-		c.appendLog(req, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		err = fmt.Errorf("cerber %w", &llm.StatusError{StatusCode: httpResp.StatusCode, Body: strings.TrimSpace(string(respBody))})
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
 		return llm.ChatResponse{}, err
 	}
 
 	var parsed chatResponsePayload
 	if err := json.Unmarshal(respBody, &parsed); err != nil {
-		c.appendLog(req, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
 		return llm.ChatResponse{}, fmt.Errorf("decode response: %w", err)
 	}
 	if len(parsed.Choices) == 0 {
 		err = fmt.Errorf("empty choices in response")
-		c.appendLog(req, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
 		return llm.ChatResponse{}, err
 	}
 
@@ -128,11 +167,12 @@ func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatRespons
 	toolCalls := parsed.Choices[0].Message.ToolCalls
 	if strings.TrimSpace(content) == "" && len(toolCalls) == 0 {
 		err = fmt.Errorf("empty content and tool_calls in response")
-		c.appendLog(req, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
 		return llm.ChatResponse{}, err
 	}
 
-	c.appendLog(req, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), nil)
+	c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), nil)
+	c.metrics.AddLLMTokens(req.Purpose, parsed.Usage.PromptTokens, parsed.Usage.CompletionTokens)
 
 	return llm.ChatResponse{
 		Content:     content,
@@ -141,42 +181,114 @@ func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatRespons
 	}, nil
 }
 
+type embeddingResponsePayload struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed calls the OpenAI-compatible /v1/embeddings endpoint.
+func (c *Client) Embed(ctx context.Context, req llm.EmbeddingRequest) ([][]float64, error) {
+	if strings.TrimSpace(c.apiKey) == "" {
+		return nil, ErrMissingAPIKey
+	}
+	if req.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if len(req.Input) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+
+	payloadBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		c.baseURL+"/v1/embeddings",
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, nil, 0, time.Since(start), err)
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, nil, httpResp.StatusCode, time.Since(start), err)
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("cerber %w", &llm.StatusError{StatusCode: httpResp.StatusCode, Body: strings.TrimSpace(string(respBody))})
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		return nil, err
+	}
+
+	var parsed embeddingResponsePayload
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if len(parsed.Data) != len(req.Input) {
+		err = fmt.Errorf("expected %d embeddings, got %d", len(req.Input), len(parsed.Data))
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, httpResp.StatusCode, time.Since(start), err)
+		return nil, err
+	}
+
+	out := make([][]float64, len(req.Input))
+	for i, item := range parsed.Data {
+		idx := item.Index
+		if idx < 0 || idx >= len(out) {
+			idx = i
+		}
+		out[idx] = item.Embedding
+	}
+	// Vectors are large and unreadable; log only their shape.
+	summary := fmt.Sprintf(`{"embeddings":%d,"dimensions":%d}`, len(out), len(out[0]))
+	c.appendLog(req.Purpose, "", req.Model, payloadBytes, []byte(summary), httpResp.StatusCode, time.Since(start), nil)
+	return out, nil
+}
+
 func (c *Client) appendLog(
-	req llm.ChatRequest,
+	purpose string,
+	turnID string,
+	model string,
 	requestBody []byte,
 	responseBody []byte,
 	statusCode int,
 	duration time.Duration,
 	err error,
 ) {
+	c.metrics.ObserveLLMRequest(purpose, duration, err)
 	if c.logs == nil {
 		return
 	}
 
 	entry := llmlog.Entry{
-		Purpose:    req.Purpose,
-		Model:      req.Model,
+		Purpose:    purpose,
+		TurnID:     turnID,
+		Model:      model,
 		DurationMS: duration.Milliseconds(),
 		StatusCode: statusCode,
-		Request:    prettyJSONForLog(requestBody),
-		Response:   prettyJSONForLog(responseBody),
+		Request:    llmlog.FormatBody(requestBody, c.maxLogFieldLen, c.redactor),
+		Response:   llmlog.FormatBody(responseBody, c.maxLogFieldLen, c.redactor),
 	}
 	if err != nil {
-		entry.Error = err.Error()
-	}
-	c.logs.Add(entry)
-}
-
-func prettyJSONForLog(raw []byte) string {
-	trimmed := bytes.TrimSpace(raw)
-	if len(trimmed) == 0 {
-		return ""
-	}
-	var out bytes.Buffer
-	if err := json.Indent(&out, trimmed, "", "  "); err == nil {
-		return out.String()
+		entry.Error = c.redactor.Redact(err.Error())
 	}
-	return string(trimmed)
+	// Add already logs persistence failures; a lost log entry must not fail the call.
+	_ = c.logs.Add(entry)
 }
 
 func extractContent(value any) string {
@@ -3,14 +3,17 @@ package cerber
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"laughing-barnacle/internal/llm"
 	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/redact"
 )
 
 func TestClientChat(t *testing.T) {
@@ -79,3 +82,177 @@ func TestClientChat(t *testing.T) {
 		t.Fatalf("request/response logs should be pretty-printed JSON")
 	}
 }
+
+func TestClientChat_SendsToolChoice(t *testing.T) {
+	var captured []map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("decode request body: %v", err)
+		}
+		captured = append(captured, body)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(Config{BaseURL: ts.URL, APIKey: "test-key", Timeout: 3 * time.Second})
+	tools := []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "linux__bash"}}}
+	requests := []llm.ChatRequest{
+		{Tools: tools, ToolChoice: llm.ToolChoiceRequired},
+		{Tools: tools, ToolChoice: "linux__bash"},
+		{ToolChoice: llm.ToolChoiceNone},
+	}
+	for _, req := range requests {
+		req.Model = "mock-model"
+		req.Messages = []llm.Message{{Role: "user", Content: "ping"}}
+		if _, err := client.Chat(context.Background(), req); err != nil {
+			t.Fatalf("Chat failed: %v", err)
+		}
+	}
+
+	if captured[0]["tool_choice"] != "required" {
+		t.Fatalf("expected string tool_choice, got %#v", captured[0]["tool_choice"])
+	}
+	named, ok := captured[1]["tool_choice"].(map[string]any)
+	if !ok || named["type"] != "function" || named["function"].(map[string]any)["name"] != "linux__bash" {
+		t.Fatalf("expected named function tool_choice, got %#v", captured[1]["tool_choice"])
+	}
+	if _, ok := captured[2]["tool_choice"]; ok {
+		t.Fatalf("expected tool_choice omitted without tools, got %#v", captured[2]["tool_choice"])
+	}
+}
+
+func TestClientChat_SendsResponseFormat(t *testing.T) {
+	var captured map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Fatalf("decode request body: %v", err)
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"{}"}}]}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(Config{BaseURL: ts.URL, APIKey: "test-key", Timeout: 3 * time.Second})
+	if _, err := client.Chat(context.Background(), llm.ChatRequest{
+		Model:          "mock-model",
+		Messages:       []llm.Message{{Role: "user", Content: "reply in JSON"}},
+		ResponseFormat: llm.ResponseFormatJSON,
+	}); err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	format, ok := captured["response_format"].(map[string]any)
+	if !ok || format["type"] != "json_object" {
+		t.Fatalf("expected response_format json_object, got %#v", captured["response_format"])
+	}
+}
+
+func TestClientChat_MissingAPIKeyFailsWithoutRequest(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+
+	client := NewClient(Config{BaseURL: ts.URL, Timeout: time.Second})
+	_, err := client.Chat(context.Background(), llm.ChatRequest{
+		Model:    "gpt-4o-mini",
+		Messages: []llm.Message{{Role: "user", Content: "ping"}},
+	})
+	if !errors.Is(err, ErrMissingAPIKey) {
+		t.Fatalf("expected ErrMissingAPIKey, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "未配置 API Key") {
+		t.Fatalf("unexpected error message: %v", err)
+	}
+	if llm.IsRetryable(err) {
+		t.Fatalf("missing key must not trigger fallback retries")
+	}
+	if called {
+		t.Fatalf("expected no HTTP request without an API key")
+	}
+}
+
+func TestClientChat_TruncatesOversizedLogFields(t *testing.T) {
+	bigContent := strings.Repeat("长", 2000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{"message": map[string]any{"content": bigContent}}},
+		})
+	}))
+	defer ts.Close()
+
+	logStore := llmlog.NewStore(10)
+	client := NewClient(Config{
+		BaseURL:          ts.URL,
+		APIKey:           "test-key",
+		Timeout:          3 * time.Second,
+		LogStore:         logStore,
+		MaxLogFieldBytes: 1024,
+	})
+	resp, err := client.Chat(context.Background(), llm.ChatRequest{
+		Purpose:  "chat_reply",
+		Model:    "mock-model",
+		Messages: []llm.Message{{Role: "user", Content: "ping"}},
+	})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if resp.Content != bigContent {
+		t.Fatalf("truncation must only affect the log, got %d bytes", len(resp.Content))
+	}
+
+	entries := logStore.List()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	logged := entries[0].Response
+	if !strings.Contains(logged, "已截断") || len(logged) > 1024+64 {
+		t.Fatalf("expected truncated response log, got %d bytes", len(logged))
+	}
+	if !utf8.ValidString(logged) {
+		t.Fatalf("truncated log must stay valid UTF-8")
+	}
+	if entries[0].StatusCode != http.StatusOK || strings.Contains(entries[0].Request, "已截断") {
+		t.Fatalf("unexpected entry: status=%d request=%q", entries[0].StatusCode, entries[0].Request)
+	}
+}
+
+func TestClientChat_RedactsSecretsInLogs(t *testing.T) {
+	const apiKey = "sk-cerber-0123456789"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{"message": map[string]any{"content": "your key is " + apiKey}}},
+		})
+	}))
+	defer ts.Close()
+
+	logStore := llmlog.NewStore(10)
+	client := NewClient(Config{
+		BaseURL:  ts.URL,
+		APIKey:   apiKey,
+		Timeout:  3 * time.Second,
+		LogStore: logStore,
+		Redactor: redact.Static(apiKey),
+	})
+	resp, err := client.Chat(context.Background(), llm.ChatRequest{
+		Purpose:  "chat_reply",
+		Model:    "mock-model",
+		Messages: []llm.Message{{Role: "tool", Content: "CERBER_API_KEY=" + apiKey}},
+	})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if !strings.Contains(resp.Content, apiKey) {
+		t.Fatalf("redaction must only affect the log, got %q", resp.Content)
+	}
+
+	entry := logStore.List()[0]
+	if strings.Contains(entry.Request, apiKey) || strings.Contains(entry.Response, apiKey) {
+		t.Fatalf("expected the key masked in the log, got request=%q response=%q", entry.Request, entry.Response)
+	}
+	if !strings.Contains(entry.Request, "CERBER_API_KEY="+redact.Mask) {
+		t.Fatalf("expected masked value in logged request, got %q", entry.Request)
+	}
+}
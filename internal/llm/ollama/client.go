@@ -0,0 +1,312 @@
+// Package ollama implements llm.Client against Ollama's native /api/chat and
+// /api/embed endpoints.
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/metrics"
+	"laughing-barnacle/internal/redact"
+)
+
+type Config struct {
+	BaseURL    string
+	Timeout    time.Duration
+	HTTPClient *http.Client
+	LogStore   *llmlog.Store
+	Metrics    *metrics.Metrics
+	// MaxLogFieldBytes truncates logged request/response bodies; 0 uses
+	// the 16KB default and a negative value disables truncation.
+	MaxLogFieldBytes int
+	// Redactor masks secrets in logged bodies and errors; nil logs them as is.
+	Redactor *redact.Redactor
+}
+
+type Client struct {
+	baseURL        string
+	http           *http.Client
+	logs           *llmlog.Store
+	metrics        *metrics.Metrics
+	maxLogFieldLen int
+	redactor       *redact.Redactor
+}
+
+func NewClient(cfg Config) *Client {
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	maxLogFieldLen := cfg.MaxLogFieldBytes
+	if maxLogFieldLen == 0 {
+		maxLogFieldLen = llmlog.DefaultMaxFieldBytes
+	}
+
+	return &Client{
+		baseURL:        strings.TrimRight(cfg.BaseURL, "/"),
+		http:           httpClient,
+		logs:           cfg.LogStore,
+		metrics:        cfg.Metrics,
+		maxLogFieldLen: maxLogFieldLen,
+		redactor:       cfg.Redactor,
+	}
+}
+
+type chatMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	ToolName  string     `json:"tool_name,omitempty"`
+}
+
+// toolCall differs from the OpenAI shape: arguments are a JSON object rather
+// than an encoded string, and ids are optional.
+type toolCall struct {
+	ID       string `json:"id,omitempty"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type chatRequestPayload struct {
+	Model    string               `json:"model"`
+	Messages []chatMessage        `json:"messages"`
+	Tools    []llm.ToolDefinition `json:"tools,omitempty"`
+	Options  map[string]any       `json:"options,omitempty"`
+	Format   string               `json:"format,omitempty"`
+	Stream   bool                 `json:"stream"`
+}
+
+type chatResponsePayload struct {
+	Message         chatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+}
+
+func (c *Client) Chat(ctx context.Context, req llm.ChatRequest) (llm.ChatResponse, error) {
+	if req.Model == "" {
+		return llm.ChatResponse{}, fmt.Errorf("model is required")
+	}
+	if len(req.Messages) == 0 {
+		return llm.ChatResponse{}, fmt.Errorf("messages are required")
+	}
+
+	payload := chatRequestPayload{
+		Model:    req.Model,
+		Messages: toChatMessages(req.Messages),
+		Tools:    req.Tools,
+		Stream:   false,
+	}
+	// Ollama has no tool_choice; "none" is honored by not offering tools.
+	if req.ToolChoice == llm.ToolChoiceNone {
+		payload.Tools = nil
+	}
+	if req.ResponseFormat != nil && req.ResponseFormat.Type == "json_object" {
+		payload.Format = "json"
+	}
+	if req.Temperature != 0 {
+		payload.Options = map[string]any{"temperature": req.Temperature}
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return llm.ChatResponse{}, fmt.Errorf("marshal request: %w", err)
+	}
+
+	start := time.Now()
+	respBody, statusCode, err := c.post(ctx, "/api/chat", payloadBytes)
+	if err != nil {
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return llm.ChatResponse{}, err
+	}
+
+	var parsed chatResponsePayload
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return llm.ChatResponse{}, fmt.Errorf("decode response: %w", err)
+	}
+	content := parsed.Message.Content
+	toolCalls := fromToolCalls(parsed.Message.ToolCalls)
+	if strings.TrimSpace(content) == "" && len(toolCalls) == 0 {
+		err = fmt.Errorf("empty content and tool_calls in response")
+		c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return llm.ChatResponse{}, err
+	}
+
+	c.appendLog(req.Purpose, req.TurnID, req.Model, payloadBytes, respBody, statusCode, time.Since(start), nil)
+	c.metrics.AddLLMTokens(req.Purpose, parsed.PromptEvalCount, parsed.EvalCount)
+
+	return llm.ChatResponse{
+		Content:     content,
+		ToolCalls:   toolCalls,
+		RawResponse: string(respBody),
+	}, nil
+}
+
+type embedResponsePayload struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+// Embed calls /api/embed.
+func (c *Client) Embed(ctx context.Context, req llm.EmbeddingRequest) ([][]float64, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if len(req.Input) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+
+	payloadBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	start := time.Now()
+	respBody, statusCode, err := c.post(ctx, "/api/embed", payloadBytes)
+	if err != nil {
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return nil, err
+	}
+
+	var parsed embedResponsePayload
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if len(parsed.Embeddings) != len(req.Input) {
+		err = fmt.Errorf("expected %d embeddings, got %d", len(req.Input), len(parsed.Embeddings))
+		c.appendLog(req.Purpose, "", req.Model, payloadBytes, respBody, statusCode, time.Since(start), err)
+		return nil, err
+	}
+
+	// Vectors are large and unreadable; log only their shape.
+	summary := fmt.Sprintf(`{"embeddings":%d,"dimensions":%d}`, len(parsed.Embeddings), len(parsed.Embeddings[0]))
+	c.appendLog(req.Purpose, "", req.Model, payloadBytes, []byte(summary), statusCode, time.Since(start), nil)
+	return parsed.Embeddings, nil
+}
+
+// post sends body to path and returns the response body and status. HTTP
+// error statuses are returned as *llm.StatusError so the agent's fallback
+// logic treats them like the other providers.
+func (c *Client) post(ctx context.Context, path string, body []byte) ([]byte, int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, httpResp.StatusCode, fmt.Errorf("read response: %w", err)
+	}
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		return respBody, httpResp.StatusCode, fmt.Errorf("ollama %w", &llm.StatusError{StatusCode: httpResp.StatusCode, Body: strings.TrimSpace(string(respBody))})
+	}
+	return respBody, httpResp.StatusCode, nil
+}
+
+// toChatMessages converts OpenAI-style messages. Tool results carry the
+// tool's name instead of the call id, so names are looked up from the
+// assistant messages that issued the calls.
+func toChatMessages(in []llm.Message) []chatMessage {
+	names := make(map[string]string)
+	out := make([]chatMessage, 0, len(in))
+	for _, msg := range in {
+		cm := chatMessage{Role: msg.Role, Content: msg.Content}
+		for _, call := range msg.ToolCalls {
+			names[call.ID] = call.Function.Name
+			cm.ToolCalls = append(cm.ToolCalls, toToolCall(call))
+		}
+		if msg.Role == "tool" {
+			cm.ToolName = names[msg.ToolCallID]
+			if cm.ToolName == "" {
+				cm.ToolName = msg.Name
+			}
+		}
+		out = append(out, cm)
+	}
+	return out
+}
+
+func toToolCall(call llm.ToolCall) toolCall {
+	var out toolCall
+	out.ID = call.ID
+	out.Function.Name = call.Function.Name
+	args := json.RawMessage(strings.TrimSpace(call.Function.Arguments))
+	if len(args) == 0 || !json.Valid(args) {
+		args = json.RawMessage("{}")
+	}
+	out.Function.Arguments = args
+	return out
+}
+
+func fromToolCalls(in []toolCall) []llm.ToolCall {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make([]llm.ToolCall, 0, len(in))
+	for i, call := range in {
+		id := call.ID
+		if id == "" {
+			// The agent pairs results with calls by id.
+			id = fmt.Sprintf("call_%d", i)
+		}
+		args := strings.TrimSpace(string(call.Function.Arguments))
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		out = append(out, llm.ToolCall{
+			ID:       id,
+			Type:     "function",
+			Function: llm.ToolFunctionCall{Name: call.Function.Name, Arguments: args},
+		})
+	}
+	return out
+}
+
+func (c *Client) appendLog(
+	purpose string,
+	turnID string,
+	model string,
+	requestBody []byte,
+	responseBody []byte,
+	statusCode int,
+	duration time.Duration,
+	err error,
+) {
+	c.metrics.ObserveLLMRequest(purpose, duration, err)
+	if c.logs == nil {
+		return
+	}
+
+	entry := llmlog.Entry{
+		Purpose:    purpose,
+		TurnID:     turnID,
+		Model:      model,
+		DurationMS: duration.Milliseconds(),
+		StatusCode: statusCode,
+		Request:    llmlog.FormatBody(requestBody, c.maxLogFieldLen, c.redactor),
+		Response:   llmlog.FormatBody(responseBody, c.maxLogFieldLen, c.redactor),
+	}
+	if err != nil {
+		entry.Error = c.redactor.Redact(err.Error())
+	}
+	// Add already logs persistence failures; a lost log entry must not fail the call.
+	_ = c.logs.Add(entry)
+}
@@ -0,0 +1,121 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/llmlog"
+)
+
+func TestClientChat_TranslatesToolCalls(t *testing.T) {
+	var captured struct {
+		Model    string `json:"model"`
+		Stream   bool   `json:"stream"`
+		Messages []struct {
+			Role      string `json:"role"`
+			Content   string `json:"content"`
+			ToolName  string `json:"tool_name"`
+			ToolCalls []struct {
+				Function struct {
+					Name      string         `json:"name"`
+					Arguments map[string]any `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"messages"`
+		Tools   []llm.ToolDefinition `json:"tools"`
+		Options map[string]any       `json:"options"`
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" || r.Method != http.MethodPost {
+			t.Fatalf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Fatalf("decode request body: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"model":"qwen3","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"linux__bash","arguments":{"command":"date"}}}]},"done":true}`))
+	}))
+	defer ts.Close()
+
+	logStore := llmlog.NewStore(10)
+	client := NewClient(Config{BaseURL: ts.URL, Timeout: 3 * time.Second, LogStore: logStore})
+
+	resp, err := client.Chat(context.Background(), llm.ChatRequest{
+		Purpose: "chat_reply",
+		Model:   "qwen3",
+		Messages: []llm.Message{
+			{Role: "user", Content: "现在几点"},
+			{Role: "assistant", ToolCalls: []llm.ToolCall{{
+				ID:       "call_a",
+				Type:     "function",
+				Function: llm.ToolFunctionCall{Name: "weather__query", Arguments: `{"city":"beijing"}`},
+			}}},
+			{Role: "tool", ToolCallID: "call_a", Content: `{"temp":18}`},
+		},
+		Tools:       []llm.ToolDefinition{{Type: "function", Function: llm.ToolFunctionDefinition{Name: "linux__bash"}}},
+		Temperature: 0.3,
+	})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+
+	if captured.Model != "qwen3" || captured.Stream {
+		t.Fatalf("unexpected model/stream: %q %v", captured.Model, captured.Stream)
+	}
+	if captured.Options["temperature"] != 0.3 {
+		t.Fatalf("expected temperature in options, got %v", captured.Options)
+	}
+	if len(captured.Tools) != 1 || captured.Tools[0].Function.Name != "linux__bash" {
+		t.Fatalf("unexpected tools: %+v", captured.Tools)
+	}
+	if len(captured.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(captured.Messages))
+	}
+	assistant := captured.Messages[1]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Function.Arguments["city"] != "beijing" {
+		t.Fatalf("expected tool call arguments sent as an object, got %+v", assistant.ToolCalls)
+	}
+	if captured.Messages[2].ToolName != "weather__query" {
+		t.Fatalf("expected tool result to carry tool_name, got %q", captured.Messages[2].ToolName)
+	}
+
+	if len(resp.ToolCalls) != 1 {
+		t.Fatalf("expected one tool call, got %d", len(resp.ToolCalls))
+	}
+	call := resp.ToolCalls[0]
+	if call.ID == "" || call.Type != "function" || call.Function.Name != "linux__bash" || call.Function.Arguments != `{"command":"date"}` {
+		t.Fatalf("unexpected tool call: %+v", call)
+	}
+
+	entries := logStore.List()
+	if len(entries) != 1 || entries[0].Purpose != "chat_reply" || entries[0].StatusCode != http.StatusOK {
+		t.Fatalf("unexpected log entries: %+v", entries)
+	}
+}
+
+func TestClientChat_ErrorStatusIsRetryable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"model is loading"}`, http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Config{BaseURL: ts.URL, Timeout: 3 * time.Second})
+	_, err := client.Chat(context.Background(), llm.ChatRequest{
+		Model:    "qwen3",
+		Messages: []llm.Message{{Role: "user", Content: "hi"}},
+	})
+	var statusErr *llm.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected StatusError 503, got %v", err)
+	}
+	if !llm.IsRetryable(err) {
+		t.Fatalf("expected 503 to be retryable")
+	}
+}
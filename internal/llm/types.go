@@ -1,6 +1,12 @@
 package llm
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
 
 // Message is a chat message compatible with OpenAI-style chat APIs.
 type Message struct {
@@ -33,13 +39,79 @@ type ToolFunctionCall struct {
 	Arguments string `json:"arguments"`
 }
 
+// ToolProgress is a progress update a tool reports while a call is running.
+// Total is 0 when the tool does not know it.
+type ToolProgress struct {
+	Progress float64
+	Total    float64
+	Message  string
+}
+
+// ErrInvalidToolArgs and ErrToolUnavailable are wrapped by tool providers so
+// the agent can tell a malformed call or an unreachable tool apart from a
+// tool that ran and failed.
+var (
+	ErrInvalidToolArgs = errors.New("invalid tool arguments")
+	ErrToolUnavailable = errors.New("tool unavailable")
+)
+
+type toolProgressKey struct{}
+
+// WithToolProgress returns a ctx whose tool calls report progress to fn.
+// Providers that cannot report progress ignore it.
+func WithToolProgress(ctx context.Context, fn func(ToolProgress)) context.Context {
+	return context.WithValue(ctx, toolProgressKey{}, fn)
+}
+
+// ToolProgressFunc returns the callback set by WithToolProgress, or nil.
+func ToolProgressFunc(ctx context.Context) func(ToolProgress) {
+	fn, _ := ctx.Value(toolProgressKey{}).(func(ToolProgress))
+	return fn
+}
+
+// ToolChoice controls tool use: "auto", "none", "required", or the name of
+// a single function the model must call. Empty leaves it to the provider.
+type ToolChoice string
+
+const (
+	ToolChoiceAuto     ToolChoice = "auto"
+	ToolChoiceNone     ToolChoice = "none"
+	ToolChoiceRequired ToolChoice = "required"
+)
+
+// MarshalJSON encodes the modes as strings and a function name as the
+// {"type":"function","function":{"name":...}} object.
+func (c ToolChoice) MarshalJSON() ([]byte, error) {
+	switch c {
+	case ToolChoiceAuto, ToolChoiceNone, ToolChoiceRequired:
+		return json.Marshal(string(c))
+	}
+	return json.Marshal(map[string]any{
+		"type":     "function",
+		"function": map[string]string{"name": string(c)},
+	})
+}
+
+// ResponseFormat asks the provider for structured output, e.g.
+// {"type":"json_object"}. Providers that do not support it ignore it.
+type ResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// ResponseFormatJSON requests a single JSON object as the reply.
+var ResponseFormatJSON = &ResponseFormat{Type: "json_object"}
+
 // ChatRequest represents one non-streaming completion request.
 type ChatRequest struct {
 	Purpose     string           `json:"-"`
+	TurnID      string           `json:"-"` // shared by every request of one user turn; logged, never sent
 	Model       string           `json:"model"`
 	Messages    []Message        `json:"messages"`
 	Tools       []ToolDefinition `json:"tools,omitempty"`
+	ToolChoice  ToolChoice       `json:"tool_choice,omitempty"`
 	Temperature float64          `json:"temperature,omitempty"`
+	// ResponseFormat is nil for free-form text.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
 }
 
 // ChatResponse is the normalized LLM reply.
@@ -53,3 +125,40 @@ type ChatResponse struct {
 type Client interface {
 	Chat(ctx context.Context, req ChatRequest) (ChatResponse, error)
 }
+
+// EmbeddingRequest asks the provider to embed each input string.
+type EmbeddingRequest struct {
+	Purpose string   `json:"-"`
+	Model   string   `json:"model"`
+	Input   []string `json:"input"`
+}
+
+// EmbeddingClient is implemented by providers exposing an embeddings endpoint.
+type EmbeddingClient interface {
+	Embed(ctx context.Context, req EmbeddingRequest) ([][]float64, error)
+}
+
+// StatusError is an HTTP error status returned by the upstream provider.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+// IsRetryable reports whether err is a transient upstream failure (rate
+// limit, 5xx or a transport error) worth retrying, possibly on another model.
+// Cancellations and deadline expiries are never retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == 429 || statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,49 @@
+package llmlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"laughing-barnacle/internal/redact"
+)
+
+// DefaultMaxFieldBytes caps each logged request/response body.
+const DefaultMaxFieldBytes = 16 * 1024
+
+// FormatBody masks the secrets redactor knows, indents a JSON body for the
+// log page and truncates it to max bytes; max <= 0 disables truncation.
+// Non-JSON bodies are kept verbatim. Secrets are masked before the cut so a
+// truncated body never keeps part of one. A nil redactor masks nothing.
+func FormatBody(raw []byte, max int, redactor *redact.Redactor) string {
+	if len(raw) > 0 {
+		raw = []byte(redactor.Redact(string(raw)))
+	}
+	return truncate(prettyJSON(raw), max)
+}
+
+func prettyJSON(raw []byte) string {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return ""
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, trimmed, "", "  "); err == nil {
+		return out.String()
+	}
+	return string(trimmed)
+}
+
+// truncate cuts text to at most max bytes on a rune boundary and appends a
+// marker with the original size.
+func truncate(text string, max int) string {
+	if max <= 0 || len(text) <= max {
+		return text
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + fmt.Sprintf("\n...(已截断，原始长度 %d 字节)", len(text))
+}
@@ -3,8 +3,10 @@ package llmlog
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,6 +18,7 @@ type Entry struct {
 	ID         int64
 	Time       time.Time
 	Purpose    string
+	TurnID     string
 	Model      string
 	Request    string
 	Response   string
@@ -30,7 +33,23 @@ type Store struct {
 	entries []Entry
 	limit   int
 	path    string
+	opts    Options
 	nextID  atomic.Int64
+	logger  *slog.Logger
+	// archivedThrough is the newest entry ID already moved to an archive
+	// file; the active file only holds newer entries.
+	archivedThrough int64
+}
+
+// Options configures retention of the persisted log; zero values disable
+// each policy.
+type Options struct {
+	// MaxAge drops entries older than this on load and on every Add.
+	MaxAge time.Duration
+	// RotateBytes moves the active file's entries to a timestamped archive
+	// next to it once the file would grow past this size. Archives older
+	// than MaxAge are removed on rotation.
+	RotateBytes int64
 }
 
 func NewStore(limit int) *Store {
@@ -41,6 +60,10 @@ func NewStore(limit int) *Store {
 }
 
 func NewStoreWithFile(limit int, path string) (*Store, error) {
+	return NewStoreWithOptions(limit, path, Options{})
+}
+
+func NewStoreWithOptions(limit int, path string, opts Options) (*Store, error) {
 	path = strings.TrimSpace(path)
 	if path == "" {
 		return nil, fmt.Errorf("llm log file path is required")
@@ -48,13 +71,16 @@ func NewStoreWithFile(limit int, path string) (*Store, error) {
 
 	s := NewStore(limit)
 	s.path = path
+	s.opts = opts
 	if err := s.loadFromFile(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-func (s *Store) Add(e Entry) {
+// Add records e. The entry is kept in memory even when persisting fails;
+// the write error is logged and returned.
+func (s *Store) Add(e Entry) error {
 	e.ID = s.nextID.Add(1)
 	if e.Time.IsZero() {
 		e.Time = time.Now()
@@ -67,7 +93,36 @@ func (s *Store) Add(e Entry) {
 	if len(s.entries) > s.limit {
 		s.entries = s.entries[:s.limit]
 	}
-	_ = s.persistLocked()
+	s.entries = s.pruneExpired(s.entries, time.Now())
+	if err := s.persistLocked(); err != nil {
+		logger := s.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("persist llm logs failed", "path", s.path, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Clear drops every entry, in memory and on disk, and restarts IDs at 1.
+// Archives written by rotation are left alone.
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make([]Entry, 0, s.limit)
+	s.nextID.Store(0)
+	s.archivedThrough = 0
+	return s.persistLocked()
+}
+
+// SetLogger sets where persistence failures are reported; nil restores
+// slog.Default().
+func (s *Store) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
 }
 
 func (s *Store) List() []Entry {
@@ -79,6 +134,64 @@ func (s *Store) List() []Entry {
 	return out
 }
 
+// FilterOptions narrows List results; zero values match everything.
+type FilterOptions struct {
+	Purpose    string
+	TurnID     string
+	ErrorsOnly bool
+	Since      time.Time
+	Limit      int
+}
+
+// Filter returns matching entries, newest first, capped at opts.Limit.
+func (s *Store) Filter(opts FilterOptions) []Entry {
+	purpose := strings.TrimSpace(opts.Purpose)
+	turnID := strings.TrimSpace(opts.TurnID)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		if purpose != "" && entry.Purpose != purpose {
+			continue
+		}
+		if turnID != "" && entry.TurnID != turnID {
+			continue
+		}
+		if opts.ErrorsOnly && entry.Error == "" {
+			continue
+		}
+		if !opts.Since.IsZero() && entry.Time.Before(opts.Since) {
+			continue
+		}
+		out = append(out, entry)
+		if opts.Limit > 0 && len(out) >= opts.Limit {
+			break
+		}
+	}
+	return out
+}
+
+// Purposes lists the distinct purposes present in the log, sorted.
+func (s *Store) Purposes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	for _, entry := range s.entries {
+		if entry.Purpose != "" {
+			seen[entry.Purpose] = struct{}{}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for purpose := range seen {
+		out = append(out, purpose)
+	}
+	sort.Strings(out)
+	return out
+}
+
 func (s *Store) loadFromFile() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -119,17 +232,39 @@ func (s *Store) loadFromFile() error {
 		}
 	}
 
-	s.entries = entries
+	s.entries = s.pruneExpired(entries, time.Now())
 	s.nextID.Store(maxID)
 	return s.persistLocked()
 }
 
+// pruneExpired drops entries older than opts.MaxAge.
+func (s *Store) pruneExpired(entries []Entry, now time.Time) []Entry {
+	if s.opts.MaxAge <= 0 {
+		return entries
+	}
+	cutoff := now.Add(-s.opts.MaxAge)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !entry.Time.Before(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
 func (s *Store) persistLocked() error {
 	if strings.TrimSpace(s.path) == "" {
 		return nil
 	}
 
-	data, err := json.MarshalIndent(s.entries, "", "  ")
+	active := s.entries
+	for i, entry := range active {
+		if entry.ID <= s.archivedThrough {
+			active = active[:i]
+			break
+		}
+	}
+	data, err := json.MarshalIndent(active, "", "  ")
 	if err != nil {
 		return fmt.Errorf("encode llm logs: %w", err)
 	}
@@ -138,6 +273,14 @@ func (s *Store) persistLocked() error {
 		return fmt.Errorf("create llm log dir: %w", err)
 	}
 
+	if s.opts.RotateBytes > 0 && int64(len(data)) > s.opts.RotateBytes && len(active) > 0 {
+		if err := s.rotateLocked(data); err != nil {
+			return err
+		}
+		s.archivedThrough = active[0].ID
+		data = []byte("[]")
+	}
+
 	tempPath := s.path + ".tmp"
 	if err := os.WriteFile(tempPath, data, 0o600); err != nil {
 		return fmt.Errorf("write temp llm logs: %w", err)
@@ -147,3 +290,28 @@ func (s *Store) persistLocked() error {
 	}
 	return nil
 }
+
+// rotateLocked writes data to a timestamped archive beside the active file
+// and removes archives older than opts.MaxAge.
+func (s *Store) rotateLocked(data []byte) error {
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	archivePath := base + "-" + time.Now().UTC().Format("20060102T150405.000Z") + ext
+	if err := os.WriteFile(archivePath, data, 0o600); err != nil {
+		return fmt.Errorf("write llm log archive: %w", err)
+	}
+	if s.opts.MaxAge <= 0 {
+		return nil
+	}
+	archives, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return nil
+	}
+	cutoff := time.Now().Add(-s.opts.MaxAge)
+	for _, path := range archives {
+		if info, err := os.Stat(path); err == nil && info.ModTime().Before(cutoff) {
+			_ = os.Remove(path)
+		}
+	}
+	return nil
+}
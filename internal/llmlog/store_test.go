@@ -1,8 +1,10 @@
 package llmlog
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestStoreWithFilePersistsEntries(t *testing.T) {
@@ -61,3 +63,143 @@ func TestStoreWithFileRespectsLimit(t *testing.T) {
 		t.Fatalf("unexpected entries after limit trim: %+v", entries)
 	}
 }
+
+func TestStoreFilter_ByPurposeErrorsAndSince(t *testing.T) {
+	store := NewStore(10)
+	base := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	store.Add(Entry{Purpose: "chat_reply", Time: base})
+	store.Add(Entry{Purpose: "compress_context", Time: base.Add(time.Minute)})
+	store.Add(Entry{Purpose: "chat_reply", Time: base.Add(2 * time.Minute), Error: "cerber status 500"})
+	store.Add(Entry{Purpose: "compress_context", Time: base.Add(3 * time.Minute), Error: "timeout"})
+
+	compress := store.Filter(FilterOptions{Purpose: "compress_context"})
+	if len(compress) != 2 || compress[0].Error != "timeout" {
+		t.Fatalf("unexpected purpose filter result: %+v", compress)
+	}
+
+	errorsOnly := store.Filter(FilterOptions{ErrorsOnly: true})
+	if len(errorsOnly) != 2 {
+		t.Fatalf("expected 2 error entries, got %+v", errorsOnly)
+	}
+	for _, entry := range errorsOnly {
+		if entry.Error == "" {
+			t.Fatalf("unexpected non-error entry: %+v", entry)
+		}
+	}
+
+	chatErrors := store.Filter(FilterOptions{Purpose: "chat_reply", ErrorsOnly: true})
+	if len(chatErrors) != 1 || chatErrors[0].Error != "cerber status 500" {
+		t.Fatalf("unexpected combined filter result: %+v", chatErrors)
+	}
+
+	recent := store.Filter(FilterOptions{Since: base.Add(90 * time.Second), Limit: 1})
+	if len(recent) != 1 || !recent[0].Time.Equal(base.Add(3*time.Minute)) {
+		t.Fatalf("expected newest entry within since+limit, got %+v", recent)
+	}
+
+	if got := store.Purposes(); len(got) != 2 || got[0] != "chat_reply" || got[1] != "compress_context" {
+		t.Fatalf("unexpected purposes: %v", got)
+	}
+}
+
+func TestStoreAdd_ReturnsPersistError(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "llm_logs.json")
+	store, err := NewStoreWithFile(5, logPath)
+	if err != nil {
+		t.Fatalf("new store failed: %v", err)
+	}
+	if err := os.Mkdir(logPath+".tmp", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	if err := store.Add(Entry{Purpose: "chat_reply"}); err == nil {
+		t.Fatalf("expected persist error for unwritable log file")
+	}
+	if got := len(store.List()); got != 1 {
+		t.Fatalf("expected entry to stay in memory, got %d", got)
+	}
+}
+
+func TestStoreWithOptions_PrunesEntriesOlderThanMaxAgeOnLoad(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "llm_logs.json")
+	store, err := NewStoreWithFile(10, logPath)
+	if err != nil {
+		t.Fatalf("new store failed: %v", err)
+	}
+	now := time.Now()
+	store.Add(Entry{Purpose: "old", Time: now.Add(-72 * time.Hour)})
+	store.Add(Entry{Purpose: "recent", Time: now.Add(-time.Hour)})
+
+	reloaded, err := NewStoreWithOptions(10, logPath, Options{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("reload store failed: %v", err)
+	}
+	entries := reloaded.List()
+	if len(entries) != 1 || entries[0].Purpose != "recent" {
+		t.Fatalf("expected only the recent entry, got %+v", entries)
+	}
+
+	again, err := NewStoreWithFile(10, logPath)
+	if err != nil {
+		t.Fatalf("second reload failed: %v", err)
+	}
+	if got := len(again.List()); got != 1 {
+		t.Fatalf("expected pruned file to be persisted, got %d entries", got)
+	}
+}
+
+func TestStoreWithOptions_RotatesActiveFileToArchive(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "llm_logs.json")
+	store, err := NewStoreWithOptions(10, logPath, Options{RotateBytes: 300})
+	if err != nil {
+		t.Fatalf("new store failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Add(Entry{Purpose: "chat_reply", Request: "request body long enough to cross the rotation threshold"})
+	}
+
+	archives, err := filepath.Glob(filepath.Join(dir, "llm_logs-*.json"))
+	if err != nil || len(archives) == 0 {
+		t.Fatalf("expected an archive file, got %v (%v)", archives, err)
+	}
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatalf("stat active file: %v", err)
+	}
+	if info.Size() > 300 {
+		t.Fatalf("expected active file under the rotation size, got %d bytes", info.Size())
+	}
+	if got := len(store.List()); got != 3 {
+		t.Fatalf("expected in-memory entries kept after rotation, got %d", got)
+	}
+}
+
+func TestStoreClear_EmptiesMemoryAndFile(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "llm_logs.json")
+	store, err := NewStoreWithFile(5, logPath)
+	if err != nil {
+		t.Fatalf("new store failed: %v", err)
+	}
+	store.Add(Entry{Purpose: "chat_reply"})
+	store.Add(Entry{Purpose: "compress_context"})
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear error: %v", err)
+	}
+	if got := len(store.List()); got != 0 {
+		t.Fatalf("expected empty store after clear, got %d entries", got)
+	}
+
+	reloaded, err := NewStoreWithFile(5, logPath)
+	if err != nil {
+		t.Fatalf("reload store failed: %v", err)
+	}
+	if got := len(reloaded.List()); got != 0 {
+		t.Fatalf("expected empty file after clear, got %d entries", got)
+	}
+	reloaded.Add(Entry{Purpose: "retry"})
+	if id := reloaded.List()[0].ID; id != 1 {
+		t.Fatalf("expected ids to restart at 1, got %d", id)
+	}
+}
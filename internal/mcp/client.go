@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,10 +15,24 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"laughing-barnacle/internal/llm"
 )
 
 const defaultProtocolVersion = "2025-06-18"
 
+// stdioStopGrace is how long a stdio server's process group gets to exit
+// after SIGTERM before it is killed.
+var stdioStopGrace = 2 * time.Second
+
+// sseEndpointWait bounds the wait for an sse stream's endpoint event before
+// falling back to POSTing to the stream URL itself.
+var sseEndpointWait = 2 * time.Second
+
+// ErrUnsupportedMethod is returned without a round trip when a service's
+// initialize response did not advertise the capability a method needs.
+var ErrUnsupportedMethod = errors.New("method not supported by mcp service")
+
 type Tool struct {
 	Name        string         `json:"name"`
 	Description string         `json:"description,omitempty"`
@@ -33,33 +48,105 @@ type ToolCallResult struct {
 type ToolContentPart struct {
 	Type string `json:"type,omitempty"`
 	Text string `json:"text,omitempty"`
+	// Data and MimeType carry base64 image/audio parts.
+	Data     string `json:"data,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	// URI, Name and Description describe resource_link parts.
+	URI         string            `json:"uri,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Resource    *EmbeddedResource `json:"resource,omitempty"`
+}
+
+// EmbeddedResource is the payload of a "resource" content part; exactly one
+// of Text and Blob (base64) is normally set.
+type EmbeddedResource struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+}
+
+// ServerCapabilities records what a service advertised in its initialize response.
+type ServerCapabilities struct {
+	ProtocolVersion string
+	Tools           bool
+	Resources       bool
+	Prompts         bool
+	Logging         bool
+}
+
+type Prompt struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Arguments   []PromptArgument `json:"arguments,omitempty"`
+}
+
+type PromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+type PromptResult struct {
+	Description string          `json:"description,omitempty"`
+	Messages    []PromptMessage `json:"messages,omitempty"`
+}
+
+type PromptMessage struct {
+	Role    string          `json:"role"`
+	Content ToolContentPart `json:"content"`
 }
 
 type HTTPClient struct {
 	http            *http.Client
 	protocolVersion string
+	sseIdleTimeout  time.Duration
 
 	reqID atomic.Int64
 
-	mu       sync.Mutex
-	sessions map[string]string
+	mu           sync.Mutex
+	sessions     map[string]string
+	capabilities map[string]ServerCapabilities
+	// streamPosts holds, per sse service, the stream URL found to take POSTs
+	// itself after no endpoint event arrived within sseEndpointWait.
+	streamPosts map[string]string
 }
 
 func NewHTTPClient(timeout time.Duration, protocolVersion string) *HTTPClient {
 	if timeout <= 0 {
 		timeout = 20 * time.Second
 	}
+	return NewHTTPClientWith(&http.Client{Timeout: timeout}, protocolVersion)
+}
+
+// NewHTTPClientWith uses httpClient for streamable_http and sse services, so
+// callers can supply proxy, TLS and redirect settings. Its Timeout also bounds
+// sse streams.
+func NewHTTPClientWith(httpClient *http.Client, protocolVersion string) *HTTPClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 20 * time.Second}
+	}
 	if strings.TrimSpace(protocolVersion) == "" {
 		protocolVersion = defaultProtocolVersion
 	}
 
 	return &HTTPClient{
-		http:            &http.Client{Timeout: timeout},
+		http:            httpClient,
 		protocolVersion: protocolVersion,
 		sessions:        make(map[string]string),
+		capabilities:    make(map[string]ServerCapabilities),
+		streamPosts:     make(map[string]string),
 	}
 }
 
+// SetSSEIdleTimeout makes sse calls fail once their event stream has been
+// silent (no event or heartbeat comment) for d, instead of waiting for the
+// HTTP client timeout. 0 disables the check. Call it before first use.
+func (c *HTTPClient) SetSSEIdleTimeout(d time.Duration) {
+	c.sseIdleTimeout = max(d, 0)
+}
+
 func (c *HTTPClient) ListTools(ctx context.Context, service Service) ([]Tool, error) {
 	raw, err := c.callRPC(ctx, service, "tools/list", map[string]any{})
 	if err != nil {
@@ -76,10 +163,12 @@ func (c *HTTPClient) ListTools(ctx context.Context, service Service) ([]Tool, er
 }
 
 func (c *HTTPClient) CallTool(ctx context.Context, service Service, toolName string, args map[string]any) (ToolCallResult, error) {
-	raw, err := c.callRPC(ctx, service, "tools/call", map[string]any{
+	params := map[string]any{
 		"name":      toolName,
 		"arguments": args,
-	})
+	}
+	ctx = c.withProgressToken(ctx, params)
+	raw, err := c.callRPC(ctx, service, "tools/call", params)
 	if err != nil {
 		return ToolCallResult{}, err
 	}
@@ -91,6 +180,38 @@ func (c *HTTPClient) CallTool(ctx context.Context, service Service, toolName str
 	return result, nil
 }
 
+func (c *HTTPClient) ListPrompts(ctx context.Context, service Service) ([]Prompt, error) {
+	raw, err := c.callRPC(ctx, service, "prompts/list", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Prompts []Prompt `json:"prompts"`
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, fmt.Errorf("decode prompts/list: %w", err)
+	}
+	return payload.Prompts, nil
+}
+
+func (c *HTTPClient) GetPrompt(ctx context.Context, service Service, name string, args map[string]string) (PromptResult, error) {
+	params := map[string]any{"name": name}
+	if len(args) > 0 {
+		params["arguments"] = args
+	}
+	raw, err := c.callRPC(ctx, service, "prompts/get", params)
+	if err != nil {
+		return PromptResult{}, err
+	}
+
+	var result PromptResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return PromptResult{}, fmt.Errorf("decode prompts/get: %w", err)
+	}
+	return result, nil
+}
+
 func (c *HTTPClient) callRPC(ctx context.Context, service Service, method string, params map[string]any) (json.RawMessage, error) {
 	if normalizeServiceTransport(service.Transport) == ServiceTransportStdio {
 		return c.callRPCStdio(ctx, service, method, params)
@@ -100,6 +221,9 @@ func (c *HTTPClient) callRPC(ctx context.Context, service Service, method string
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkCapability(service.ID, method); err != nil {
+		return nil, err
+	}
 
 	result, headers, err := c.postRPC(ctx, service, sessionID, rpcRequest{
 		JSONRPC: "2.0",
@@ -134,6 +258,43 @@ func (c *HTTPClient) callRPC(ctx context.Context, service Service, method string
 	return result, nil
 }
 
+// stopStdioProcess stops a stdio server together with everything it spawned:
+// SIGTERM to the process group, then SIGKILL once grace has passed.
+func stopStdioProcess(cmd *exec.Cmd, grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	_ = terminateProcessGroup(cmd)
+	select {
+	case <-done:
+	case <-time.After(grace):
+	}
+	// Reaps children that ignored SIGTERM or outlived the server itself.
+	_ = killProcessGroup(cmd)
+	<-done
+}
+
+// lockedBuffer collects a stdio server's stderr; exec copies into it from its
+// own goroutine while an error path may already be reading it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method string, params map[string]any) (json.RawMessage, error) {
 	command := strings.TrimSpace(service.Command)
 	if command == "" {
@@ -141,6 +302,24 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 	}
 
 	cmd := exec.CommandContext(ctx, command, service.Args...)
+	setProcessGroup(cmd)
+	// Read once: the stop goroutines below may outlive this call.
+	grace := stdioStopGrace
+	stopped := make(chan struct{})
+	// On cancellation the whole group gets SIGTERM, then SIGKILL if it is
+	// still around after the grace period; a child holding stdout open would
+	// otherwise keep the pending read blocked.
+	cmd.Cancel = func() error {
+		go func() {
+			select {
+			case <-stopped:
+			case <-time.After(grace):
+				_ = killProcessGroup(cmd)
+			}
+		}()
+		return terminateProcessGroup(cmd)
+	}
+	cmd.WaitDelay = grace
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("open stdio stdin: %w", err)
@@ -149,18 +328,16 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 	if err != nil {
 		return nil, fmt.Errorf("open stdio stdout: %w", err)
 	}
-	var stderr bytes.Buffer
+	var stderr lockedBuffer
 	cmd.Stderr = &stderr
 
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start stdio command: %w", err)
+		return nil, unavailable(fmt.Errorf("start stdio command: %w", err))
 	}
 	defer func() {
 		_ = stdin.Close()
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
-		}
-		_ = cmd.Wait()
+		stopStdioProcess(cmd, grace)
+		close(stopped)
 	}()
 
 	enc := json.NewEncoder(stdin)
@@ -184,7 +361,7 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 	}); err != nil {
 		return nil, fmt.Errorf("write initialize request: %w", err)
 	}
-	initResp, err := waitRPCResponseFromSTDIO(dec, initID)
+	initResp, err := waitRPCResponseFromSTDIO(dec, initID, nil)
 	if err != nil {
 		if tail := strings.TrimSpace(stderr.String()); tail != "" {
 			return nil, fmt.Errorf("read initialize response: %w; stderr: %s", err, tail)
@@ -192,7 +369,11 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 		return nil, fmt.Errorf("read initialize response: %w", err)
 	}
 	if initResp.Error != nil {
-		return nil, fmt.Errorf("rpc error %d: %s", initResp.Error.Code, initResp.Error.Message)
+		return nil, initResp.Error
+	}
+	c.setCapabilities(service.ID, parseServerCapabilities(initResp.Result))
+	if err := c.checkCapability(service.ID, method); err != nil {
+		return nil, err
 	}
 
 	if err := enc.Encode(rpcRequest{
@@ -213,7 +394,7 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 		return nil, fmt.Errorf("write rpc request: %w", err)
 	}
 
-	resp, err := waitRPCResponseFromSTDIO(dec, reqID)
+	resp, err := waitRPCResponseFromSTDIO(dec, reqID, progressNotifier(ctx))
 	if err != nil {
 		if tail := strings.TrimSpace(stderr.String()); tail != "" {
 			return nil, fmt.Errorf("read rpc response: %w; stderr: %s", err, tail)
@@ -221,7 +402,7 @@ func (c *HTTPClient) callRPCStdio(ctx context.Context, service Service, method s
 		return nil, fmt.Errorf("read rpc response: %w", err)
 	}
 	if resp.Error != nil {
-		return nil, fmt.Errorf("rpc error %d: %s", resp.Error.Code, resp.Error.Message)
+		return nil, resp.Error
 	}
 	return resp.Result, nil
 }
@@ -247,13 +428,10 @@ func (c *HTTPClient) ensureSession(ctx context.Context, service Service) (string
 		},
 	}, true)
 	if err != nil {
-		return "", fmt.Errorf("initialize mcp service %q failed: %w", service.ID, err)
+		return "", unavailable(fmt.Errorf("initialize mcp service %q failed: %w", service.ID, err))
 	}
 
-	var initPayload struct {
-		ProtocolVersion string `json:"protocolVersion"`
-	}
-	_ = json.Unmarshal(initResult, &initPayload)
+	c.setCapabilities(service.ID, parseServerCapabilities(initResult))
 
 	sessionID := strings.TrimSpace(headers.Get("Mcp-Session-Id"))
 	if sessionID != "" {
@@ -305,7 +483,7 @@ func (c *HTTPClient) postRPCStreamable(
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json, text/event-stream")
-	req.Header.Set("MCP-Protocol-Version", c.protocolVersion)
+	req.Header.Set("MCP-Protocol-Version", c.negotiatedVersion(service.ID))
 	if service.AuthToken != "" {
 		req.Header.Set("Authorization", "Bearer "+service.AuthToken)
 	}
@@ -315,28 +493,41 @@ func (c *HTTPClient) postRPCStreamable(
 
 	resp, err := c.http.Do(req)
 	if err != nil {
-		return nil, nil, fmt.Errorf("send rpc request: %w", err)
+		return nil, nil, unavailable(fmt.Errorf("send rpc request: %w", err))
 	}
 	defer resp.Body.Close()
 
+	// An event-stream reply is decoded as it arrives so progress
+	// notifications sent ahead of the result are delivered live.
+	if expectResponse && resp.StatusCode < http.StatusBadRequest && isEventStream(resp.Header.Get("Content-Type")) {
+		rpcResp, err := waitRPCResponseFromSSE(bufio.NewReader(resp.Body), nil, progressNotifier(ctx))
+		if err != nil {
+			return nil, resp.Header, err
+		}
+		if rpcResp.Error != nil {
+			return nil, resp.Header, rpcResp.Error
+		}
+		return rpcResp.Result, resp.Header, nil
+	}
+
 	respBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, resp.Header, fmt.Errorf("read rpc response: %w", err)
 	}
 
 	if resp.StatusCode >= http.StatusBadRequest {
-		return nil, resp.Header, fmt.Errorf("mcp status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+		return nil, resp.Header, statusError(resp.StatusCode, respBytes)
 	}
 	if !expectResponse {
 		return nil, resp.Header, nil
 	}
 
-	rpcResp, err := decodeRPCResponse(respBytes, resp.Header.Get("Content-Type"))
+	rpcResp, err := decodeRPCResponse(respBytes, resp.Header.Get("Content-Type"), payload.ID, nil)
 	if err != nil {
 		return nil, resp.Header, err
 	}
 	if rpcResp.Error != nil {
-		return nil, resp.Header, fmt.Errorf("rpc error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+		return nil, resp.Header, rpcResp.Error
 	}
 
 	return rpcResp.Result, resp.Header, nil
@@ -349,12 +540,14 @@ func (c *HTTPClient) postRPCSSE(
 	payload rpcRequest,
 	expectResponse bool,
 ) (json.RawMessage, http.Header, error) {
-	streamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, service.Endpoint, nil)
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	streamReq, err := http.NewRequestWithContext(streamCtx, http.MethodGet, service.Endpoint, nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("build sse request: %w", err)
 	}
 	streamReq.Header.Set("Accept", "text/event-stream")
-	streamReq.Header.Set("MCP-Protocol-Version", c.protocolVersion)
+	streamReq.Header.Set("MCP-Protocol-Version", c.negotiatedVersion(service.ID))
 	if service.AuthToken != "" {
 		streamReq.Header.Set("Authorization", "Bearer "+service.AuthToken)
 	}
@@ -364,22 +557,36 @@ func (c *HTTPClient) postRPCSSE(
 
 	streamResp, err := c.http.Do(streamReq)
 	if err != nil {
-		return nil, nil, fmt.Errorf("open sse stream: %w", err)
+		return nil, nil, unavailable(fmt.Errorf("open sse stream: %w", err))
 	}
 	defer streamResp.Body.Close()
 	if streamResp.StatusCode >= http.StatusBadRequest {
 		body, _ := io.ReadAll(streamResp.Body)
-		return nil, streamResp.Header, fmt.Errorf("mcp status %d: %s", streamResp.StatusCode, strings.TrimSpace(string(body)))
-	}
-
-	reader := bufio.NewReader(streamResp.Body)
+		return nil, streamResp.Header, statusError(streamResp.StatusCode, body)
+	}
+
+	// The stream is read in the background from here on: the response may
+	// arrive on it instead of in the POST body, and heartbeats sent while the
+	// POST runs must be consumed for the idle timeout to mean anything.
+	stream := newSSEStream(streamResp.Body, c.sseIdleTimeout, cancelStream)
+	defer stream.close()
+	// Some servers take POSTs on the stream URL and never announce an
+	// endpoint, so the announcement is only awaited for sseEndpointWait, and
+	// not at all once the service is known to be one of them.
+	endpointCtx, cancelEndpoint := context.WithTimeout(ctx, sseEndpointWait)
+	defer cancelEndpoint()
 	postEndpoint := service.Endpoint
-	for {
-		event, readErr := readSSEEvent(reader)
+	postsToStream := c.postsToStream(service)
+	for !postsToStream {
+		event, readErr := stream.next(endpointCtx)
 		if readErr == io.EOF {
 			break
 		}
 		if readErr != nil {
+			if endpointCtx.Err() != nil && ctx.Err() == nil {
+				c.setPostsToStream(service, true)
+				break
+			}
 			return nil, streamResp.Header, fmt.Errorf("read sse event: %w", readErr)
 		}
 		if strings.EqualFold(strings.TrimSpace(event.Name), "endpoint") {
@@ -403,7 +610,7 @@ func (c *HTTPClient) postRPCSSE(
 	}
 	postReq.Header.Set("Content-Type", "application/json")
 	postReq.Header.Set("Accept", "application/json, text/event-stream")
-	postReq.Header.Set("MCP-Protocol-Version", c.protocolVersion)
+	postReq.Header.Set("MCP-Protocol-Version", c.negotiatedVersion(service.ID))
 	if service.AuthToken != "" {
 		postReq.Header.Set("Authorization", "Bearer "+service.AuthToken)
 	}
@@ -413,7 +620,7 @@ func (c *HTTPClient) postRPCSSE(
 
 	postResp, err := c.http.Do(postReq)
 	if err != nil {
-		return nil, streamResp.Header, fmt.Errorf("send rpc request: %w", err)
+		return nil, streamResp.Header, unavailable(fmt.Errorf("send rpc request: %w", err))
 	}
 	defer postResp.Body.Close()
 	postBytes, err := io.ReadAll(postResp.Body)
@@ -421,58 +628,111 @@ func (c *HTTPClient) postRPCSSE(
 		return nil, mergeHeaders(postResp.Header, streamResp.Header), fmt.Errorf("read rpc response: %w", err)
 	}
 	if postResp.StatusCode >= http.StatusBadRequest {
-		return nil, mergeHeaders(postResp.Header, streamResp.Header), fmt.Errorf("mcp status %d: %s", postResp.StatusCode, strings.TrimSpace(string(postBytes)))
+		if postsToStream {
+			// Wait for an endpoint event again next time.
+			c.setPostsToStream(service, false)
+		}
+		return nil, mergeHeaders(postResp.Header, streamResp.Header), statusError(postResp.StatusCode, postBytes)
 	}
 	if !expectResponse {
 		return nil, mergeHeaders(postResp.Header, streamResp.Header), nil
 	}
 
 	if len(bytes.TrimSpace(postBytes)) > 0 {
-		rpcResp, decodeErr := decodeRPCResponse(postBytes, postResp.Header.Get("Content-Type"))
+		rpcResp, decodeErr := decodeRPCResponse(postBytes, postResp.Header.Get("Content-Type"), payload.ID, progressNotifier(ctx))
 		if decodeErr == nil {
 			if payload.ID == nil || sameRPCID(payload.ID, rpcResp.ID) {
 				if rpcResp.Error != nil {
-					return nil, mergeHeaders(postResp.Header, streamResp.Header), fmt.Errorf("rpc error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+					return nil, mergeHeaders(postResp.Header, streamResp.Header), rpcResp.Error
 				}
 				return rpcResp.Result, mergeHeaders(postResp.Header, streamResp.Header), nil
 			}
 		}
 	}
 
-	rpcResp, err := waitRPCResponseFromSSE(reader, payload.ID)
+	rpcResp, err := stream.waitResponse(ctx, payload.ID, progressNotifier(ctx))
 	if err != nil {
 		return nil, mergeHeaders(postResp.Header, streamResp.Header), err
 	}
 	if rpcResp.Error != nil {
-		return nil, mergeHeaders(postResp.Header, streamResp.Header), fmt.Errorf("rpc error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+		return nil, mergeHeaders(postResp.Header, streamResp.Header), rpcResp.Error
 	}
 	return rpcResp.Result, mergeHeaders(postResp.Header, streamResp.Header), nil
 }
 
-func decodeRPCResponse(respBytes []byte, contentType string) (rpcResponse, error) {
+// decodeRPCResponse decodes a POST reply: a single JSON-RPC message, a batch
+// array, or an event stream of either. In a batch the response to expectID is
+// picked.
+func decodeRPCResponse(respBytes []byte, contentType string, expectID any, notify notifyFunc) (rpcResponse, error) {
 	trimmed := bytes.TrimSpace(respBytes)
 	if len(trimmed) == 0 {
 		return rpcResponse{}, fmt.Errorf("decode rpc response: empty response")
 	}
-	if strings.Contains(strings.ToLower(contentType), "text/event-stream") ||
+	if isEventStream(contentType) ||
 		bytes.HasPrefix(trimmed, []byte("event:")) ||
 		bytes.HasPrefix(trimmed, []byte("data:")) {
-		return decodeRPCResponseFromSSE(trimmed, nil)
+		return decodeRPCResponseFromSSE(trimmed, expectID, notify)
 	}
 
-	var rpcResp rpcResponse
-	if err := json.Unmarshal(trimmed, &rpcResp); err != nil {
+	messages, err := decodeRPCMessages(trimmed)
+	if err != nil {
 		return rpcResponse{}, fmt.Errorf("decode rpc response: %w", err)
 	}
+	if len(messages) == 1 && messages[0].Method == "" {
+		// A lone response is taken as is, like before batches were understood.
+		return messages[0], nil
+	}
+	rpcResp, ok := pickRPCResponse(messages, expectID, notify)
+	if !ok {
+		return rpcResponse{}, fmt.Errorf("decode rpc response: no response with id %v in batch", expectID)
+	}
 	return rpcResp, nil
 }
 
-func decodeRPCResponseFromSSE(payload []byte, expectID any) (rpcResponse, error) {
+// decodeRPCMessages decodes one JSON-RPC message or a batch array of them.
+func decodeRPCMessages(data []byte) ([]rpcResponse, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var batch []rpcResponse
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, err
+		}
+		return batch, nil
+	}
+	var msg rpcResponse
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return []rpcResponse{msg}, nil
+}
+
+// pickRPCResponse returns the response to expectID (any response when nil)
+// among messages, handing the notifications it passes over to notify.
+func pickRPCResponse(messages []rpcResponse, expectID any, notify notifyFunc) (rpcResponse, bool) {
+	for _, msg := range messages {
+		if strings.TrimSpace(msg.Method) != "" {
+			if msg.ID == nil {
+				notify.call(msg.Method, msg.Params)
+			}
+			continue
+		}
+		if expectID != nil && !sameRPCID(expectID, msg.ID) {
+			continue
+		}
+		return msg, true
+	}
+	return rpcResponse{}, false
+}
+
+func isEventStream(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "text/event-stream")
+}
+
+func decodeRPCResponseFromSSE(payload []byte, expectID any, notify notifyFunc) (rpcResponse, error) {
 	reader := bufio.NewReader(bytes.NewReader(payload))
-	return waitRPCResponseFromSSE(reader, expectID)
+	return waitRPCResponseFromSSE(reader, expectID, notify)
 }
 
-func waitRPCResponseFromSSE(reader *bufio.Reader, expectID any) (rpcResponse, error) {
+func waitRPCResponseFromSSE(reader *bufio.Reader, expectID any, notify notifyFunc) (rpcResponse, error) {
 	for {
 		event, err := readSSEEvent(reader)
 		if err != nil {
@@ -482,23 +742,13 @@ func waitRPCResponseFromSSE(reader *bufio.Reader, expectID any) (rpcResponse, er
 			return rpcResponse{}, fmt.Errorf("decode rpc response: %w", err)
 		}
 
-		data := strings.TrimSpace(event.Data)
-		if data == "" {
-			continue
-		}
-
-		var rpcResp rpcResponse
-		if unmarshalErr := json.Unmarshal([]byte(data), &rpcResp); unmarshalErr != nil {
-			continue
-		}
-		if expectID != nil && !sameRPCID(expectID, rpcResp.ID) {
-			continue
+		if rpcResp, ok := matchRPCResponse(event, expectID, notify); ok {
+			return rpcResp, nil
 		}
-		return rpcResp, nil
 	}
 }
 
-func waitRPCResponseFromSTDIO(decoder *json.Decoder, expectID any) (rpcResponse, error) {
+func waitRPCResponseFromSTDIO(decoder *json.Decoder, expectID any, notify notifyFunc) (rpcResponse, error) {
 	for {
 		var envelope map[string]json.RawMessage
 		if err := decoder.Decode(&envelope); err != nil {
@@ -512,7 +762,11 @@ func waitRPCResponseFromSTDIO(decoder *json.Decoder, expectID any) (rpcResponse,
 		if hasMethod {
 			var method string
 			if err := json.Unmarshal(methodField, &method); err == nil && strings.TrimSpace(method) != "" {
-				// Server initiated request/notification; ignore for this lightweight client.
+				// Server initiated request/notification; only notifications
+				// are passed on, requests are ignored by this lightweight client.
+				if _, isRequest := envelope["id"]; !isRequest {
+					notify.call(method, envelope["params"])
+				}
 				continue
 			}
 		}
@@ -621,6 +875,69 @@ func (c *HTTPClient) updateSessionFromHeaders(serviceID string, headers http.Hea
 	c.setSession(serviceID, sid)
 }
 
+// Capabilities returns what the service advertised on its last initialize.
+func (c *HTTPClient) Capabilities(serviceID string) (ServerCapabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	caps, ok := c.capabilities[serviceID]
+	return caps, ok
+}
+
+// checkCapability rejects prompts/* and resources/* calls to services that
+// did not advertise them. Services not yet initialized are not checked.
+func (c *HTTPClient) checkCapability(serviceID, method string) error {
+	caps, ok := c.Capabilities(serviceID)
+	if !ok {
+		return nil
+	}
+	supported := true
+	switch {
+	case strings.HasPrefix(method, "prompts/"):
+		supported = caps.Prompts
+	case strings.HasPrefix(method, "resources/"):
+		supported = caps.Resources
+	}
+	if !supported {
+		return fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
+	}
+	return nil
+}
+
+// negotiatedVersion is the protocolVersion the service answered initialize
+// with, which may be older than the one offered; before the first initialize
+// it is the configured version.
+func (c *HTTPClient) negotiatedVersion(serviceID string) string {
+	if caps, ok := c.Capabilities(serviceID); ok && caps.ProtocolVersion != "" {
+		return caps.ProtocolVersion
+	}
+	return c.protocolVersion
+}
+
+func (c *HTTPClient) setCapabilities(serviceID string, caps ServerCapabilities) {
+	c.mu.Lock()
+	c.capabilities[serviceID] = caps
+	c.mu.Unlock()
+}
+
+func parseServerCapabilities(raw json.RawMessage) ServerCapabilities {
+	var payload struct {
+		ProtocolVersion string                     `json:"protocolVersion"`
+		Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	}
+	_ = json.Unmarshal(raw, &payload)
+	has := func(key string) bool {
+		v, ok := payload.Capabilities[key]
+		return ok && strings.TrimSpace(string(v)) != "null"
+	}
+	return ServerCapabilities{
+		ProtocolVersion: strings.TrimSpace(payload.ProtocolVersion),
+		Tools:           has("tools"),
+		Resources:       has("resources"),
+		Prompts:         has("prompts"),
+		Logging:         has("logging"),
+	}
+}
+
 func (c *HTTPClient) nextReqID() int64 {
 	return c.reqID.Add(1)
 }
@@ -637,6 +954,25 @@ func (c *HTTPClient) setSession(serviceID, sessionID string) {
 	c.sessions[serviceID] = sessionID
 }
 
+// postsToStream reports whether service's stream URL is known to take POSTs
+// without an endpoint event.
+func (c *HTTPClient) postsToStream(service Service) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpoint, ok := c.streamPosts[service.ID]
+	return ok && endpoint == service.Endpoint
+}
+
+func (c *HTTPClient) setPostsToStream(service Service, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.streamPosts[service.ID] = service.Endpoint
+	} else {
+		delete(c.streamPosts, service.ID)
+	}
+}
+
 func (c *HTTPClient) clearSession(serviceID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -655,9 +991,58 @@ type rpcResponse struct {
 	ID      any             `json:"id"`
 	Result  json.RawMessage `json:"result"`
 	Error   *rpcError       `json:"error,omitempty"`
+	// Method and Params are set when the message is a server notification
+	// or request rather than a response.
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
 }
 
 type rpcError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Unwrap maps the JSON-RPC invalid params and method not found codes to the
+// llm tool errors.
+func (e *rpcError) Unwrap() error {
+	switch e.Code {
+	case -32602:
+		return llm.ErrInvalidToolArgs
+	case -32601:
+		return llm.ErrToolUnavailable
+	default:
+		return nil
+	}
+}
+
+// unavailableError marks a failure to start or reach an mcp service. The
+// message is left as is; errors.Is matches llm.ErrToolUnavailable.
+type unavailableError struct {
+	err error
+}
+
+func unavailable(err error) error {
+	return &unavailableError{err: err}
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() []error {
+	return []error{e.err, llm.ErrToolUnavailable}
+}
+
+// statusError reports an HTTP error status from an mcp service; 5xx means
+// the service is unavailable.
+func statusError(code int, body []byte) error {
+	err := fmt.Errorf("mcp status %d: %s", code, strings.TrimSpace(string(body)))
+	if code >= http.StatusInternalServerError {
+		return unavailable(err)
+	}
+	return err
+}
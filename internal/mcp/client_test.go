@@ -3,12 +3,17 @@ package mcp
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"laughing-barnacle/internal/llm"
 )
 
 func TestHTTPClient_ListAndCallTool(t *testing.T) {
@@ -129,6 +134,108 @@ func TestHTTPClient_StreamableHTTPWithSSEResponse(t *testing.T) {
 	}
 }
 
+func TestHTTPClient_DecodesBatchArrayResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		id, _ := json.Marshal(req["id"])
+
+		switch req["method"] {
+		case "initialize":
+			_, _ = fmt.Fprintf(w, `[{"jsonrpc":"2.0","id":%s,"result":{"protocolVersion":"2025-06-18"}}]`, id)
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/call":
+			_, _ = fmt.Fprintf(w, `[{"jsonrpc":"2.0","id":%s,"result":{"content":[{"type":"text","text":"from batch"}]}}]`, id)
+		default:
+			t.Fatalf("unexpected method: %v", req["method"])
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "batch", Name: "Batch", Endpoint: ts.URL, Enabled: true}
+
+	result, err := client.CallTool(context.Background(), service, "echo", map[string]any{})
+	if err != nil {
+		t.Fatalf("CallTool error: %v", err)
+	}
+	if len(result.Content) != 1 || result.Content[0].Text != "from batch" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	batch := []byte(`[{"jsonrpc":"2.0","method":"notifications/message","params":{}},{"jsonrpc":"2.0","id":7,"result":{"n":7}},{"jsonrpc":"2.0","id":8,"result":{"n":8}}]`)
+	resp, err := decodeRPCResponse(batch, "application/json", int64(8), nil)
+	if err != nil {
+		t.Fatalf("decode batch: %v", err)
+	}
+	if string(resp.Result) != `{"n":8}` {
+		t.Fatalf("picked the wrong batch response: %s", resp.Result)
+	}
+	if _, err := decodeRPCResponse(batch, "application/json", int64(9), nil); err == nil {
+		t.Fatalf("expected an error when no batch response matches the id")
+	}
+}
+
+func TestHTTPClient_CallToolDeliversProgressBeforeResult(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+			Params struct {
+				Meta struct {
+					ProgressToken string `json:"progressToken"`
+				} `json:"_meta"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+
+		switch req.Method {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18"}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/call":
+			token := req.Params.Meta.ProgressToken
+			if token == "" {
+				t.Fatalf("expected a progress token on tools/call")
+			}
+			id, _ := json.Marshal(req.ID)
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progressToken\":%q,\"progress\":1,\"total\":2,\"message\":\"halfway\"}}\n\n", token)
+			_, _ = fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progressToken\":\"someone-else\",\"progress\":9}}\n\n")
+			_, _ = fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":%s,\"result\":{\"content\":[{\"type\":\"text\",\"text\":\"done\"}]}}\n\n", id)
+		default:
+			t.Fatalf("unexpected method: %s", req.Method)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "slow", Name: "Slow", Endpoint: ts.URL, Enabled: true}
+
+	var updates []llm.ToolProgress
+	ctx := llm.WithToolProgress(context.Background(), func(p llm.ToolProgress) {
+		updates = append(updates, p)
+	})
+	result, err := client.CallTool(ctx, service, "crunch", map[string]any{})
+	if err != nil {
+		t.Fatalf("CallTool error: %v", err)
+	}
+	if len(result.Content) != 1 || result.Content[0].Text != "done" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	want := []llm.ToolProgress{{Progress: 1, Total: 2, Message: "halfway"}}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("progress updates = %+v, want %+v", updates, want)
+	}
+
+}
+
 func TestHTTPClient_StdioListAndCallTool(t *testing.T) {
 	script := filepath.Join(t.TempDir(), "fake-mcp.sh")
 	err := os.WriteFile(script, []byte(`#!/bin/sh
@@ -140,7 +247,7 @@ while IFS= read -r line; do
     *\"method\":\"initialize\"*)
       id=$(extract_id "$line")
       if [ -z "$id" ]; then id=1; fi
-      echo "{\"jsonrpc\":\"2.0\",\"id\":$id,\"result\":{\"protocolVersion\":\"2025-06-18\"}}"
+      echo "{\"jsonrpc\":\"2.0\",\"id\":$id,\"result\":{\"protocolVersion\":\"2025-06-18\",\"capabilities\":{\"tools\":{},\"prompts\":{}}}}"
       ;;
     *\"method\":\"tools/list\"*)
       id=$(extract_id "$line")
@@ -183,4 +290,219 @@ done
 	if len(result.Content) != 1 || result.Content[0].Text != "ok" {
 		t.Fatalf("unexpected result: %+v", result)
 	}
+	caps, ok := client.Capabilities("stdio_demo")
+	if !ok || !caps.Tools || !caps.Prompts || caps.Resources {
+		t.Fatalf("unexpected stdio capabilities: %+v", caps)
+	}
+}
+
+func TestHTTPClient_RecordsServerCapabilities(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch method, _ := req["method"].(string); method {
+		case "initialize":
+			w.Header().Set("Mcp-Session-Id", "session-caps")
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-03-26","capabilities":{"tools":{"listChanged":true},"resources":{"subscribe":true},"logging":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[]}}`))
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "caps", Name: "Caps", Endpoint: ts.URL, Enabled: true}
+	if _, ok := client.Capabilities("caps"); ok {
+		t.Fatalf("expected no capabilities before initialize")
+	}
+	if _, err := client.ListTools(context.Background(), service); err != nil {
+		t.Fatalf("ListTools error: %v", err)
+	}
+
+	caps, ok := client.Capabilities("caps")
+	if !ok {
+		t.Fatalf("expected capabilities to be recorded")
+	}
+	want := ServerCapabilities{ProtocolVersion: "2025-03-26", Tools: true, Resources: true, Logging: true}
+	if caps != want {
+		t.Fatalf("expected %+v, got %+v", want, caps)
+	}
+}
+
+func TestHTTPClient_ListAndGetPrompts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch method, _ := req["method"].(string); method {
+		case "initialize":
+			w.Header().Set("Mcp-Session-Id", "session-prompts")
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18","capabilities":{"prompts":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "prompts/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"prompts":[{"name":"code_review","description":"Review a diff","arguments":[{"name":"diff","required":true}]}]}}`))
+		case "prompts/get":
+			params, _ := req["params"].(map[string]any)
+			args, _ := params["arguments"].(map[string]any)
+			if params["name"] != "code_review" || args["diff"] != "+x" {
+				t.Fatalf("unexpected prompts/get params: %v", params)
+			}
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":3,"result":{"description":"Code review","messages":[{"role":"user","content":{"type":"text","text":"Please review: +x"}}]}}`))
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "review", Name: "Review", Endpoint: ts.URL, Enabled: true}
+
+	prompts, err := client.ListPrompts(context.Background(), service)
+	if err != nil {
+		t.Fatalf("ListPrompts error: %v", err)
+	}
+	if len(prompts) != 1 || prompts[0].Name != "code_review" || len(prompts[0].Arguments) != 1 || !prompts[0].Arguments[0].Required {
+		t.Fatalf("unexpected prompts: %+v", prompts)
+	}
+
+	result, err := client.GetPrompt(context.Background(), service, "code_review", map[string]string{"diff": "+x"})
+	if err != nil {
+		t.Fatalf("GetPrompt error: %v", err)
+	}
+	if got := renderPromptResult(result); got != "Code review\n\n[user] Please review: +x" {
+		t.Fatalf("unexpected rendered prompt: %q", got)
+	}
+}
+
+type recordingTransport struct {
+	base    http.RoundTripper
+	methods []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.methods = append(t.methods, req.Method+" "+req.URL.Path)
+	return t.base.RoundTrip(req)
+}
+
+func TestHTTPClient_CallToolErrorsWrapToolSentinels(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch method, _ := req["method"].(string); method {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18","capabilities":{"tools":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/call":
+			params, _ := req["params"].(map[string]any)
+			switch params["name"] {
+			case "bad_args":
+				_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%v,"error":{"code":-32602,"message":"missing query"}}`, req["id"])
+			case "down":
+				http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+			default:
+				_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%v,"error":{"code":-32000,"message":"file not found"}}`, req["id"])
+			}
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "svc", Endpoint: ts.URL, Enabled: true}
+
+	_, err := client.CallTool(context.Background(), service, "bad_args", map[string]any{})
+	if !errors.Is(err, llm.ErrInvalidToolArgs) {
+		t.Fatalf("expected ErrInvalidToolArgs for -32602, got %v", err)
+	}
+	_, err = client.CallTool(context.Background(), service, "down", map[string]any{})
+	if !errors.Is(err, llm.ErrToolUnavailable) {
+		t.Fatalf("expected ErrToolUnavailable for status 503, got %v", err)
+	}
+	_, err = client.CallTool(context.Background(), service, "missing_file", map[string]any{})
+	if err == nil || errors.Is(err, llm.ErrToolUnavailable) || errors.Is(err, llm.ErrInvalidToolArgs) {
+		t.Fatalf("expected a plain tool error, got %v", err)
+	}
+}
+
+func TestHTTPClient_UsesInjectedHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch method, _ := req["method"].(string); method {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18","capabilities":{"tools":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"ping"}]}}`))
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	transport := &recordingTransport{base: http.DefaultTransport}
+	client := NewHTTPClientWith(&http.Client{Transport: transport, Timeout: 3 * time.Second}, "")
+	tools, err := client.ListTools(context.Background(), Service{ID: "svc", Endpoint: ts.URL + "/mcp", Enabled: true})
+	if err != nil {
+		t.Fatalf("ListTools error: %v", err)
+	}
+	if len(tools) != 1 || tools[0].Name != "ping" {
+		t.Fatalf("unexpected tools: %+v", tools)
+	}
+	if len(transport.methods) != 3 || transport.methods[0] != "POST /mcp" {
+		t.Fatalf("expected all requests through the injected transport, got %v", transport.methods)
+	}
+}
+
+func TestHTTPClient_AdoptsProtocolVersionReturnedByServer(t *testing.T) {
+	versions := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		method, _ := req["method"].(string)
+		versions[method] = r.Header.Get("MCP-Protocol-Version")
+		switch method {
+		case "initialize":
+			w.Header().Set("Mcp-Session-Id", "session-old")
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2024-11-05","capabilities":{"tools":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[]}}`))
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(3*time.Second, "2025-06-18")
+	service := Service{ID: "old", Endpoint: ts.URL, Enabled: true}
+	if _, err := client.ListTools(context.Background(), service); err != nil {
+		t.Fatalf("ListTools error: %v", err)
+	}
+	if versions["initialize"] != "2025-06-18" {
+		t.Fatalf("expected initialize to offer the configured version, got %q", versions["initialize"])
+	}
+	for _, method := range []string{"notifications/initialized", "tools/list"} {
+		if versions[method] != "2024-11-05" {
+			t.Fatalf("expected %s to use the negotiated version, got %q", method, versions[method])
+		}
+	}
 }
@@ -0,0 +1,65 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"laughing-barnacle/internal/llm"
+)
+
+const progressMethod = "notifications/progress"
+
+// notifyFunc receives the server notifications read while waiting for a
+// response. A nil notifyFunc drops them.
+type notifyFunc func(method string, params json.RawMessage)
+
+func (f notifyFunc) call(method string, params json.RawMessage) {
+	if f != nil {
+		f(method, params)
+	}
+}
+
+type progressWatch struct {
+	token string
+	fn    func(llm.ToolProgress)
+}
+
+type progressKey struct{}
+
+// withProgressToken asks the server for progress on the request made with
+// the returned ctx when the caller set llm.WithToolProgress; otherwise params
+// and ctx are left alone.
+func (c *HTTPClient) withProgressToken(ctx context.Context, params map[string]any) context.Context {
+	fn := llm.ToolProgressFunc(ctx)
+	if fn == nil {
+		return ctx
+	}
+	token := fmt.Sprintf("progress-%d", c.nextReqID())
+	params["_meta"] = map[string]any{"progressToken": token}
+	return context.WithValue(ctx, progressKey{}, progressWatch{token: token, fn: fn})
+}
+
+// progressNotifier forwards the notifications/progress messages carrying the
+// token of ctx's request; everything else is ignored.
+func progressNotifier(ctx context.Context) notifyFunc {
+	watch, ok := ctx.Value(progressKey{}).(progressWatch)
+	if !ok {
+		return nil
+	}
+	return func(method string, params json.RawMessage) {
+		if method != progressMethod {
+			return
+		}
+		var payload struct {
+			ProgressToken any     `json:"progressToken"`
+			Progress      float64 `json:"progress"`
+			Total         float64 `json:"total"`
+			Message       string  `json:"message"`
+		}
+		if err := json.Unmarshal(params, &payload); err != nil || !sameRPCID(watch.token, payload.ProgressToken) {
+			return
+		}
+		watch.fn(llm.ToolProgress{Progress: payload.Progress, Total: payload.Total, Message: payload.Message})
+	}
+}
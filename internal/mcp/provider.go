@@ -10,14 +10,16 @@ import (
 	"time"
 
 	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/metrics"
 )
 
 type ServiceStatus struct {
-	Service   Service
-	Connected bool
-	ToolCount int
-	Tools     []ServiceToolStatus
-	Error     string
+	Service      Service
+	Connected    bool
+	ToolCount    int
+	Tools        []ServiceToolStatus
+	Capabilities ServerCapabilities
+	Error        string
 }
 
 type ServiceToolStatus struct {
@@ -32,10 +34,23 @@ type ToolProvider struct {
 
 	cacheTTL time.Duration
 
-	mu         sync.Mutex
-	cacheUntil time.Time
-	tools      []llm.ToolDefinition
-	bindings   map[string]toolBinding
+	mu           sync.Mutex
+	cacheUntil   time.Time
+	tools        []llm.ToolDefinition
+	bindings     map[string]toolBinding
+	promptsUntil time.Time
+	prompts      []ServicePrompt
+
+	metrics *metrics.Metrics
+
+	statsMu sync.Mutex
+	stats   map[string]*ToolStat
+}
+
+// ServicePrompt is a prompt template advertised by one MCP service.
+type ServicePrompt struct {
+	ServiceID string
+	Prompt    Prompt
 }
 
 type toolBinding struct {
@@ -55,6 +70,13 @@ func NewToolProvider(store *Store, client *HTTPClient, cacheTTL time.Duration) *
 	}
 }
 
+// SetMetrics reports each enabled service as up or down after every refresh.
+func (p *ToolProvider) SetMetrics(m *metrics.Metrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics = m
+}
+
 func (p *ToolProvider) ListTools(ctx context.Context) ([]llm.ToolDefinition, error) {
 	p.mu.Lock()
 	if time.Now().Before(p.cacheUntil) && len(p.tools) > 0 {
@@ -67,16 +89,49 @@ func (p *ToolProvider) ListTools(ctx context.Context) ([]llm.ToolDefinition, err
 	return p.RefreshTools(ctx)
 }
 
+// ServiceRefresh reports what one enabled service returned on a refresh.
+type ServiceRefresh struct {
+	ServiceID string `json:"service_id"`
+	ToolCount int    `json:"tool_count"`
+	Error     string `json:"error,omitempty"`
+}
+
 func (p *ToolProvider) RefreshTools(ctx context.Context) ([]llm.ToolDefinition, error) {
+	defs, _ := p.refreshTools(ctx)
+	return defs, nil
+}
+
+// RefreshToolsReport re-lists every enabled service, bypassing the cache, and
+// reports the enabled tool count or the listing error per service.
+func (p *ToolProvider) RefreshToolsReport(ctx context.Context) []ServiceRefresh {
+	_, report := p.refreshTools(ctx)
+	return report
+}
+
+func (p *ToolProvider) refreshTools(ctx context.Context) ([]llm.ToolDefinition, []ServiceRefresh) {
 	services := p.store.ListEnabledServices()
 	defs := make([]llm.ToolDefinition, 0)
 	bindings := make(map[string]toolBinding)
 
+	// Colliding names are numbered in service ID / tool name order, so a tool
+	// keeps its exposed name no matter in which order services were added or
+	// enabled.
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+	up := make(map[string]bool, len(services))
+	report := make([]ServiceRefresh, 0, len(services))
 	for _, svc := range services {
 		tools, err := p.client.ListTools(ctx, svc)
+		up[svc.ID] = err == nil
 		if err != nil {
+			report = append(report, ServiceRefresh{ServiceID: svc.ID, Error: err.Error()})
 			continue
 		}
+		count := 0
+		sort.SliceStable(tools, func(i, j int) bool {
+			return tools[i].Name < tools[j].Name
+		})
 		for _, tool := range tools {
 			if !p.store.IsServiceToolEnabled(svc.ID, tool.Name) {
 				continue
@@ -89,7 +144,9 @@ func (p *ToolProvider) RefreshTools(ctx context.Context) ([]llm.ToolDefinition,
 			def.Function.Name = name
 			bindings[name] = binding
 			defs = append(defs, def)
+			count++
 		}
+		report = append(report, ServiceRefresh{ServiceID: svc.ID, ToolCount: count})
 	}
 
 	sort.Slice(defs, func(i, j int) bool {
@@ -101,37 +158,46 @@ func (p *ToolProvider) RefreshTools(ctx context.Context) ([]llm.ToolDefinition,
 	p.bindings = bindings
 	p.cacheUntil = time.Now().Add(p.cacheTTL)
 	cached := cloneToolDefs(defs)
+	m := p.metrics
 	p.mu.Unlock()
+	m.SetMCPServicesUp(up)
 
-	return cached, nil
+	return cached, report
 }
 
 func (p *ToolProvider) CallTool(ctx context.Context, call llm.ToolCall) (string, error) {
+	start := time.Now()
+	out, err := p.callTool(ctx, call)
+	p.RecordToolCall(call.Function.Name, time.Since(start), err)
+	return out, err
+}
+
+func (p *ToolProvider) callTool(ctx context.Context, call llm.ToolCall) (string, error) {
 	binding, ok := p.lookupBinding(call.Function.Name)
 	if !ok {
 		if _, err := p.RefreshTools(ctx); err != nil {
-			return "", fmt.Errorf("refresh tools: %w", err)
+			return "", fmt.Errorf("refresh tools: %w", unavailable(err))
 		}
 		binding, ok = p.lookupBinding(call.Function.Name)
 		if !ok {
-			return "", fmt.Errorf("unknown tool %q", call.Function.Name)
+			return "", fmt.Errorf("%w: unknown tool %q", llm.ErrToolUnavailable, call.Function.Name)
 		}
 	}
 
 	service, exists := p.store.GetService(binding.ServiceID)
 	if !exists {
-		return "", fmt.Errorf("mcp service %q not found", binding.ServiceID)
+		return "", fmt.Errorf("%w: mcp service %q not found", llm.ErrToolUnavailable, binding.ServiceID)
 	}
 	if !service.Enabled {
-		return "", fmt.Errorf("mcp service %q is disabled", binding.ServiceID)
+		return "", fmt.Errorf("%w: mcp service %q is disabled", llm.ErrToolUnavailable, binding.ServiceID)
 	}
 	if !p.store.IsServiceToolEnabled(binding.ServiceID, binding.ToolName) {
-		return "", fmt.Errorf("mcp service %q tool %q is disabled", binding.ServiceID, binding.ToolName)
+		return "", fmt.Errorf("%w: mcp service %q tool %q is disabled", llm.ErrToolUnavailable, binding.ServiceID, binding.ToolName)
 	}
 
 	args, err := parseToolArguments(call.Function.Arguments)
 	if err != nil {
-		return "", fmt.Errorf("invalid tool arguments for %q: %w", call.Function.Name, err)
+		return "", fmt.Errorf("%w for %q: %w", llm.ErrInvalidToolArgs, call.Function.Name, err)
 	}
 
 	result, err := p.client.CallTool(ctx, service, binding.ToolName, args)
@@ -189,11 +255,13 @@ func (p *ToolProvider) ListServiceStatuses(ctx context.Context) []ServiceStatus
 			return toolStatuses[i].Name < toolStatuses[j].Name
 		})
 
+		caps, _ := p.client.Capabilities(svc.ID)
 		statuses = append(statuses, ServiceStatus{
-			Service:   svc,
-			Connected: true,
-			ToolCount: enabledCount,
-			Tools:     toolStatuses,
+			Service:      svc,
+			Connected:    true,
+			ToolCount:    enabledCount,
+			Tools:        toolStatuses,
+			Capabilities: caps,
 		})
 	}
 
@@ -207,6 +275,96 @@ func (p *ToolProvider) InvalidateCache() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.cacheUntil = time.Time{}
+	p.promptsUntil = time.Time{}
+}
+
+// ListPrompts returns prompt templates from enabled services. Services whose
+// initialize response did not advertise prompts are skipped.
+func (p *ToolProvider) ListPrompts(ctx context.Context) []ServicePrompt {
+	p.mu.Lock()
+	if time.Now().Before(p.promptsUntil) {
+		cached := append([]ServicePrompt(nil), p.prompts...)
+		p.mu.Unlock()
+		return cached
+	}
+	p.mu.Unlock()
+
+	out := make([]ServicePrompt, 0)
+	for _, svc := range p.store.ListEnabledServices() {
+		if caps, ok := p.client.Capabilities(svc.ID); ok && !caps.Prompts {
+			continue
+		}
+		// The client also skips the request once initialize shows prompts
+		// are unsupported, so the first listing costs no extra round trip.
+		prompts, err := p.client.ListPrompts(ctx, svc)
+		if err != nil {
+			continue
+		}
+		for _, prompt := range prompts {
+			if strings.TrimSpace(prompt.Name) == "" {
+				continue
+			}
+			out = append(out, ServicePrompt{ServiceID: svc.ID, Prompt: prompt})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ServiceID != out[j].ServiceID {
+			return out[i].ServiceID < out[j].ServiceID
+		}
+		return out[i].Prompt.Name < out[j].Prompt.Name
+	})
+
+	p.mu.Lock()
+	p.prompts = out
+	p.promptsUntil = time.Now().Add(p.cacheTTL)
+	p.mu.Unlock()
+	return append([]ServicePrompt(nil), out...)
+}
+
+// ListPromptTemplates renders ListPrompts as "service/name" index lines for the agent.
+func (p *ToolProvider) ListPromptTemplates(ctx context.Context) []string {
+	prompts := p.ListPrompts(ctx)
+	out := make([]string, 0, len(prompts))
+	for _, item := range prompts {
+		line := item.ServiceID + "/" + item.Prompt.Name
+		if desc := strings.TrimSpace(item.Prompt.Description); desc != "" {
+			line += ": " + desc
+		}
+		if len(item.Prompt.Arguments) > 0 {
+			args := make([]string, 0, len(item.Prompt.Arguments))
+			for _, arg := range item.Prompt.Arguments {
+				name := arg.Name
+				if arg.Required {
+					name += "*"
+				}
+				args = append(args, name)
+			}
+			line += " (args: " + strings.Join(args, ", ") + ")"
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// GetPromptTemplate fetches a prompt by "service/name" reference and renders its messages as text.
+func (p *ToolProvider) GetPromptTemplate(ctx context.Context, ref string, args map[string]string) (string, error) {
+	serviceID, name, ok := strings.Cut(strings.TrimSpace(ref), "/")
+	if !ok || strings.TrimSpace(serviceID) == "" || strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("prompt reference must be service/name")
+	}
+	service, exists := p.store.GetService(serviceID)
+	if !exists {
+		return "", fmt.Errorf("mcp service %q not found", serviceID)
+	}
+	if !service.Enabled {
+		return "", fmt.Errorf("mcp service %q is disabled", serviceID)
+	}
+
+	result, err := p.client.GetPrompt(ctx, service, name, args)
+	if err != nil {
+		return "", err
+	}
+	return renderPromptResult(result), nil
 }
 
 func (p *ToolProvider) lookupBinding(toolName string) (toolBinding, bool) {
@@ -293,8 +451,8 @@ func parseToolArguments(raw string) (map[string]any, error) {
 func renderToolResult(result ToolCallResult) string {
 	textParts := make([]string, 0, len(result.Content))
 	for _, item := range result.Content {
-		if strings.EqualFold(item.Type, "text") && strings.TrimSpace(item.Text) != "" {
-			textParts = append(textParts, item.Text)
+		if part := renderContentPart(item); part != "" {
+			textParts = append(textParts, part)
 		}
 	}
 	if len(textParts) > 0 {
@@ -315,6 +473,76 @@ func renderToolResult(result ToolCallResult) string {
 	return string(data)
 }
 
+// renderContentPart renders one content part for the model. Binary payloads
+// are never inlined; the model only learns what kind of content came back.
+func renderContentPart(item ToolContentPart) string {
+	switch strings.ToLower(item.Type) {
+	case "text":
+		if strings.TrimSpace(item.Text) == "" {
+			return ""
+		}
+		return item.Text
+	case "image", "audio":
+		return fmt.Sprintf("[%s: %s, %s]", strings.ToLower(item.Type), mimeTypeOrUnknown(item.MimeType), base64Size(item.Data))
+	case "resource":
+		if item.Resource == nil {
+			return ""
+		}
+		res := item.Resource
+		if strings.TrimSpace(res.Text) != "" {
+			return fmt.Sprintf("[resource: %s]\n%s", res.URI, res.Text)
+		}
+		return fmt.Sprintf("[resource: %s, %s, %s]", res.URI, mimeTypeOrUnknown(res.MimeType), base64Size(res.Blob))
+	case "resource_link":
+		line := "[resource link: " + item.URI
+		if name := strings.TrimSpace(item.Name); name != "" {
+			line += " (" + name + ")"
+		}
+		line += "]"
+		if desc := strings.TrimSpace(item.Description); desc != "" {
+			line += " " + desc
+		}
+		return line
+	default:
+		return ""
+	}
+}
+
+func mimeTypeOrUnknown(v string) string {
+	if v = strings.TrimSpace(v); v != "" {
+		return v
+	}
+	return "unknown type"
+}
+
+// base64Size describes the decoded size of a base64 payload.
+func base64Size(data string) string {
+	data = strings.TrimSpace(data)
+	n := len(data)*3/4 - (len(data) - len(strings.TrimRight(data, "=")))
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return fmt.Sprintf("%.1f KB", float64(n)/1024)
+}
+
+func renderPromptResult(result PromptResult) string {
+	var b strings.Builder
+	if desc := strings.TrimSpace(result.Description); desc != "" {
+		b.WriteString(desc)
+		b.WriteString("\n\n")
+	}
+	for _, msg := range result.Messages {
+		text := strings.TrimSpace(msg.Content.Text)
+		if text == "" {
+			continue
+		}
+		b.WriteString("[" + msg.Role + "] ")
+		b.WriteString(text)
+		b.WriteString("\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
 func bindingExists(bindings map[string]toolBinding, name string) bool {
 	_, ok := bindings[name]
 	return ok
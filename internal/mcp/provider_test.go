@@ -0,0 +1,208 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"laughing-barnacle/internal/llm"
+)
+
+func TestToolProviderRefreshTools_CollisionNamesStableAcrossServiceOrder(t *testing.T) {
+	// "a" + "x__y" and "a__x" + "y" both sanitize to a__x__y.
+	toolsByPath := map[string]string{
+		"/a":    `[{"name":"x__y"},{"name":"z"}]`,
+		"/a__x": `[{"name":"y"}]`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch req["method"] {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18"}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":2,"result":{"tools":%s}}`, toolsByPath[r.URL.Path])
+		default:
+			t.Fatalf("unexpected method: %v", req["method"])
+		}
+	}))
+	defer ts.Close()
+
+	exposedNames := func(order []string) map[string]string {
+		store, err := NewStore(filepath.Join(t.TempDir(), "settings.json"))
+		if err != nil {
+			t.Fatalf("NewStore error: %v", err)
+		}
+		for _, id := range order {
+			if err := store.UpsertService(Service{ID: id, Endpoint: ts.URL + "/" + id, Enabled: true}); err != nil {
+				t.Fatalf("UpsertService %s error: %v", id, err)
+			}
+		}
+		provider := NewToolProvider(store, NewHTTPClient(3*time.Second, ""), time.Minute)
+		if _, err := provider.RefreshTools(context.Background()); err != nil {
+			t.Fatalf("RefreshTools error: %v", err)
+		}
+		out := make(map[string]string)
+		for name, binding := range provider.bindings {
+			out[binding.ServiceID+"/"+binding.ToolName] = name
+		}
+		return out
+	}
+
+	first := exposedNames([]string{"a", "a__x"})
+	second := exposedNames([]string{"a__x", "a"})
+	if len(first) != 3 {
+		t.Fatalf("expected 3 exposed tools, got %+v", first)
+	}
+	for key, name := range first {
+		if second[key] != name {
+			t.Fatalf("tool %s exposed as %q then %q", key, name, second[key])
+		}
+	}
+	if first["a/x__y"] != "a__x__y" || first["a__x/y"] != "a__x__y_2" {
+		t.Fatalf("unexpected collision names: %+v", first)
+	}
+}
+
+func TestRenderToolResult_MixedContent(t *testing.T) {
+	var result ToolCallResult
+	raw := `{"content":[
+		{"type":"text","text":"chart ready"},
+		{"type":"image","data":"iVBORw0KGgo=","mimeType":"image/png"},
+		{"type":"resource","resource":{"uri":"file:///tmp/report.md","mimeType":"text/markdown","text":"# Report"}},
+		{"type":"resource","resource":{"uri":"file:///tmp/data.bin","blob":"AAAA"}},
+		{"type":"resource_link","uri":"https://example.com/doc","name":"doc","description":"full docs"},
+		{"type":"text","text":"done"}
+	]}`
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		t.Fatalf("decode result: %v", err)
+	}
+
+	want := "chart ready\n" +
+		"[image: image/png, 8 bytes]\n" +
+		"[resource: file:///tmp/report.md]\n# Report\n" +
+		"[resource: file:///tmp/data.bin, unknown type, 3 bytes]\n" +
+		"[resource link: https://example.com/doc (doc)] full docs\n" +
+		"done"
+	if got := renderToolResult(result); got != want {
+		t.Fatalf("unexpected render:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestToolProviderListPrompts_SkipsServiceWithoutPromptsCapability(t *testing.T) {
+	var methods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		method, _ := req["method"].(string)
+		methods = append(methods, method)
+		switch method {
+		case "initialize":
+			// No session id: every call re-initializes, as stateless servers do.
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18","capabilities":{"tools":{}}}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"search"}]}}`))
+		default:
+			t.Fatalf("unexpected method: %s", method)
+		}
+	}))
+	defer ts.Close()
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	service := Service{ID: "tools-only", Endpoint: ts.URL, Enabled: true}
+	if err := store.UpsertService(service); err != nil {
+		t.Fatalf("UpsertService error: %v", err)
+	}
+	client := NewHTTPClient(3*time.Second, "")
+	provider := NewToolProvider(store, client, time.Minute)
+
+	if prompts := provider.ListPrompts(context.Background()); len(prompts) != 0 {
+		t.Fatalf("expected no prompts, got %+v", prompts)
+	}
+	if _, err := client.ListPrompts(context.Background(), service); !errors.Is(err, ErrUnsupportedMethod) {
+		t.Fatalf("expected ErrUnsupportedMethod, got %v", err)
+	}
+	for _, method := range methods {
+		if method == "prompts/list" {
+			t.Fatalf("prompts/list should be skipped, got requests %v", methods)
+		}
+	}
+
+	statuses := provider.ListServiceStatuses(context.Background())
+	if len(statuses) != 1 || !statuses[0].Capabilities.Tools || statuses[0].Capabilities.Prompts {
+		t.Fatalf("unexpected statuses: %+v", statuses)
+	}
+}
+
+func TestToolProviderCallTool_RecordsPerToolStats(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		switch req["method"] {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18"}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"echo"}]}}`))
+		case "tools/call":
+			calls++
+			if calls == 2 {
+				_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":3,"result":{"isError":true,"content":[{"type":"text","text":"boom"}]}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":3,"result":{"content":[{"type":"text","text":"ok"}]}}`))
+		default:
+			t.Fatalf("unexpected method: %v", req["method"])
+		}
+	}))
+	defer ts.Close()
+
+	store, err := NewStore(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if err := store.UpsertService(Service{ID: "demo", Endpoint: ts.URL, Enabled: true}); err != nil {
+		t.Fatalf("UpsertService error: %v", err)
+	}
+	provider := NewToolProvider(store, NewHTTPClient(3*time.Second, ""), time.Minute)
+	call := llm.ToolCall{Function: llm.ToolFunctionCall{Name: "demo__echo", Arguments: `{}`}}
+	if _, err := provider.CallTool(context.Background(), call); err != nil {
+		t.Fatalf("first CallTool error: %v", err)
+	}
+	if _, err := provider.CallTool(context.Background(), call); err == nil {
+		t.Fatalf("expected second CallTool to fail")
+	}
+	provider.RecordToolCall("linux__bash", time.Second, nil)
+
+	stats := provider.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("expected stats for 2 tools, got %+v", stats)
+	}
+	if got := stats[0]; got.Name != "demo__echo" || got.Successes+got.Errors != 2 || got.Errors != 1 {
+		t.Fatalf("unexpected demo__echo stats: %+v", got)
+	}
+	if got := stats[1]; got.Name != "linux__bash" || got.Successes != 1 || got.TotalLatencyMS != 1000 {
+		t.Fatalf("unexpected linux__bash stats: %+v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sseStream reads events from an sse transport stream in the background, so
+// heartbeat comments keep being consumed while the POST is in flight. With an
+// idle timeout, a stream that delivers nothing (not even a heartbeat) for that
+// long is cancelled and reported as dead.
+type sseStream struct {
+	events      chan sseEvent
+	done        chan struct{}
+	stop        chan struct{}
+	err         error // valid once done is closed
+	idle        atomic.Bool
+	idleTimeout time.Duration
+	timer       *time.Timer
+}
+
+// newSSEStream starts reading body; cancel must abort the request that
+// produced body so an idle stream's pending read returns.
+func newSSEStream(body io.Reader, idleTimeout time.Duration, cancel context.CancelFunc) *sseStream {
+	s := &sseStream{
+		events:      make(chan sseEvent),
+		done:        make(chan struct{}),
+		stop:        make(chan struct{}),
+		idleTimeout: idleTimeout,
+	}
+	if idleTimeout > 0 {
+		s.timer = time.AfterFunc(idleTimeout, func() {
+			s.idle.Store(true)
+			cancel()
+		})
+		body = &idleResetReader{r: body, timer: s.timer, timeout: idleTimeout}
+	}
+	go s.run(bufio.NewReader(body))
+	return s
+}
+
+func (s *sseStream) run(reader *bufio.Reader) {
+	defer close(s.done)
+	if s.timer != nil {
+		defer s.timer.Stop()
+	}
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil {
+			s.err = err
+			return
+		}
+		// Nothing is read while the event waits for a consumer, so that wait
+		// must not count as server silence.
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		select {
+		case s.events <- event:
+		case <-s.stop:
+			return
+		}
+		if s.timer != nil {
+			s.timer.Reset(s.idleTimeout)
+		}
+	}
+}
+
+// close releases the reader goroutine; the caller still closes the body.
+func (s *sseStream) close() {
+	close(s.stop)
+}
+
+// next returns the next event, io.EOF when the server ended the stream, or
+// the read error (an idle error when the idle timeout fired).
+func (s *sseStream) next(ctx context.Context) (sseEvent, error) {
+	select {
+	case event := <-s.events:
+		return event, nil
+	case <-s.done:
+		if s.idle.Load() {
+			return sseEvent{}, fmt.Errorf("sse stream idle for %s: %w", s.idleTimeout, context.DeadlineExceeded)
+		}
+		return sseEvent{}, s.err
+	case <-ctx.Done():
+		return sseEvent{}, ctx.Err()
+	}
+}
+
+// waitResponse returns the rpc response with expectID delivered on the stream,
+// passing notifications read before it to notify.
+func (s *sseStream) waitResponse(ctx context.Context, expectID any, notify notifyFunc) (rpcResponse, error) {
+	for {
+		event, err := s.next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				return rpcResponse{}, fmt.Errorf("decode rpc response: no rpc message in sse stream")
+			}
+			return rpcResponse{}, fmt.Errorf("decode rpc response: %w", err)
+		}
+		if resp, ok := matchRPCResponse(event, expectID, notify); ok {
+			return resp, nil
+		}
+	}
+}
+
+// matchRPCResponse decodes event as the rpc response to expectID; other
+// messages (notifications, unrelated responses) do not match, and
+// notifications are handed to notify.
+func matchRPCResponse(event sseEvent, expectID any, notify notifyFunc) (rpcResponse, bool) {
+	data := strings.TrimSpace(event.Data)
+	if data == "" {
+		return rpcResponse{}, false
+	}
+	messages, err := decodeRPCMessages([]byte(data))
+	if err != nil {
+		return rpcResponse{}, false
+	}
+	return pickRPCResponse(messages, expectID, notify)
+}
+
+type idleResetReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleResetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
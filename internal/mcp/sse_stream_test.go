@@ -0,0 +1,186 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sseTestServer is an sse-transport MCP server: GET / opens a stream that
+// announces a per-stream POST endpoint, and every POST is answered with 202
+// while the JSON-RPC response is pushed onto that stream after delay.
+type sseTestServer struct {
+	delay      time.Duration
+	heartbeat  time.Duration // 0 sends no heartbeat comments
+	respond    bool          // false never delivers tools/call responses
+	noEndpoint bool          // true announces no endpoint; POSTs go to the stream URL
+
+	mu      sync.Mutex
+	streams map[string]chan string
+	next    int
+}
+
+func (s *sseTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.serveStream(w, r)
+		return
+	}
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	stream := s.streams[r.URL.Query().Get("stream")]
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("Accepted"))
+
+	var result string
+	switch req["method"] {
+	case "initialize":
+		result = `{"protocolVersion":"2025-06-18"}`
+	case "tools/call":
+		if !s.respond {
+			return
+		}
+		result = `{"content":[{"type":"text","text":"done on stream"}]}`
+	default:
+		return
+	}
+	id, _ := json.Marshal(req["id"])
+	go func() {
+		time.Sleep(s.delay)
+		stream <- fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%s}`, id, result)
+	}()
+}
+
+func (s *sseTestServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.next++
+	key := fmt.Sprint(s.next)
+	if s.noEndpoint {
+		key = ""
+	}
+	stream := make(chan string, 1)
+	s.streams[key] = stream
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher := w.(http.Flusher)
+	if s.noEndpoint {
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/message\",\"params\":{\"level\":\"info\",\"data\":\"ready\"}}\n\n")
+	} else {
+		fmt.Fprintf(w, "event: endpoint\ndata: /messages?stream=%s\n\n", key)
+	}
+	flusher.Flush()
+
+	var ticks <-chan time.Time
+	if s.heartbeat > 0 {
+		ticker := time.NewTicker(s.heartbeat)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case msg := <-stream:
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", msg)
+			flusher.Flush()
+		case <-ticks:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestHTTPClient_SSEResponseOnStreamSurvivesIdleTimeoutWithHeartbeats(t *testing.T) {
+	ts := httptest.NewServer(&sseTestServer{
+		delay:     300 * time.Millisecond,
+		heartbeat: 40 * time.Millisecond,
+		respond:   true,
+		streams:   make(map[string]chan string),
+	})
+	defer ts.Close()
+
+	client := NewHTTPClient(5*time.Second, "")
+	client.SetSSEIdleTimeout(150 * time.Millisecond)
+	service := Service{ID: "slow", Endpoint: ts.URL, Transport: "sse", Enabled: true}
+
+	result, err := client.CallTool(context.Background(), service, "slow_tool", map[string]any{})
+	if err != nil {
+		t.Fatalf("CallTool error: %v", err)
+	}
+	if len(result.Content) != 1 || result.Content[0].Text != "done on stream" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestHTTPClient_SSEIdleTimeoutDetectsDeadStream(t *testing.T) {
+	ts := httptest.NewServer(&sseTestServer{
+		delay:   10 * time.Millisecond,
+		respond: false,
+		streams: make(map[string]chan string),
+	})
+	defer ts.Close()
+
+	client := NewHTTPClient(5*time.Second, "")
+	client.SetSSEIdleTimeout(150 * time.Millisecond)
+	service := Service{ID: "dead", Endpoint: ts.URL, Transport: "sse", Enabled: true}
+
+	start := time.Now()
+	_, err := client.CallTool(context.Background(), service, "stuck_tool", map[string]any{})
+	if err == nil || !strings.Contains(err.Error(), "idle") {
+		t.Fatalf("expected an idle stream error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dead stream detected too late: %s", elapsed)
+	}
+}
+
+func TestHTTPClient_SSEWithoutEndpointEventPostsToStreamURL(t *testing.T) {
+	prev := sseEndpointWait
+	sseEndpointWait = 300 * time.Millisecond
+	defer func() { sseEndpointWait = prev }()
+
+	ts := httptest.NewServer(&sseTestServer{
+		delay:      10 * time.Millisecond,
+		respond:    true,
+		noEndpoint: true,
+		streams:    make(map[string]chan string),
+	})
+	defer ts.Close()
+
+	client := NewHTTPClient(5*time.Second, "")
+	service := Service{ID: "variant", Endpoint: ts.URL, Transport: "sse", Enabled: true}
+
+	start := time.Now()
+	result, err := client.CallTool(context.Background(), service, "tool", map[string]any{})
+	if err != nil {
+		t.Fatalf("CallTool error: %v", err)
+	}
+	if len(result.Content) != 1 || result.Content[0].Text != "done on stream" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("endpoint fallback took too long: %s", elapsed)
+	}
+
+	// The fallback is remembered: later calls do not wait for an endpoint.
+	for i := 0; i < 3; i++ {
+		start = time.Now()
+		if _, err := client.CallTool(context.Background(), service, "tool", map[string]any{}); err != nil {
+			t.Fatalf("CallTool %d error: %v", i, err)
+		}
+		if elapsed := time.Since(start); elapsed >= sseEndpointWait {
+			t.Fatalf("call %d waited for an endpoint event again: %s", i, elapsed)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package mcp
+
+import (
+	"sort"
+	"time"
+)
+
+// ToolStat is the usage of one tool, keyed by the name exposed to the model.
+type ToolStat struct {
+	Name           string    `json:"name"`
+	Successes      int       `json:"successes"`
+	Errors         int       `json:"errors"`
+	TotalLatencyMS int64     `json:"total_latency_ms"`
+	LastCalledAt   time.Time `json:"last_called_at"`
+}
+
+// RecordToolCall counts one call of the named tool. CallTool records MCP
+// tools itself; the agent reports its builtin tools here so one view covers
+// every tool the model uses.
+func (p *ToolProvider) RecordToolCall(name string, latency time.Duration, err error) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	if p.stats == nil {
+		p.stats = make(map[string]*ToolStat)
+	}
+	stat := p.stats[name]
+	if stat == nil {
+		stat = &ToolStat{Name: name}
+		p.stats[name] = stat
+	}
+	if err != nil {
+		stat.Errors++
+	} else {
+		stat.Successes++
+	}
+	stat.TotalLatencyMS += latency.Milliseconds()
+	stat.LastCalledAt = time.Now()
+}
+
+// Stats returns the per-tool usage since process start, sorted by name.
+func (p *ToolProvider) Stats() []ToolStat {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	out := make([]ToolStat, 0, len(p.stats))
+	for _, stat := range p.stats {
+		out = append(out, *stat)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
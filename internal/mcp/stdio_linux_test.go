@@ -0,0 +1,68 @@
+//go:build linux
+
+package mcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient_StdioCancelReapsChildProcesses(t *testing.T) {
+	prevGrace := stdioStopGrace
+	stdioStopGrace = 200 * time.Millisecond
+	defer func() { stdioStopGrace = prevGrace }()
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	script := filepath.Join(dir, "hung-mcp.sh")
+	// The child ignores SIGTERM and keeps stdout open; the server never
+	// answers initialize.
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+(trap '' TERM; exec sleep 60) &
+echo $! > "$1"
+sleep 60
+`), 0o755)
+	if err != nil {
+		t.Fatalf("write fake stdio script: %v", err)
+	}
+
+	client := NewHTTPClient(3*time.Second, "")
+	service := Service{ID: "hung", Transport: "stdio", Command: script, Args: []string{pidFile}, Enabled: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.ListTools(ctx, service); err == nil {
+		t.Fatalf("expected ListTools to fail on cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("ListTools returned after %s, want bounded by the stop grace", elapsed)
+	}
+
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("read child pid: %v", err)
+	}
+	pid := strings.TrimSpace(string(raw))
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %s survived cancellation", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// processAlive treats zombies as gone: the test may run without an init
+// that reaps re-parented children.
+func processAlive(pid string) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package mcp
+
+import "os/exec"
+
+// Without process groups only the server process itself can be stopped.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return killProcessGroup(cmd)
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -2,13 +2,13 @@ package mcp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,10 +22,6 @@ const (
 	ServiceTransportStreamableHTTP = "streamable_http"
 	ServiceTransportSSE            = "sse"
 	ServiceTransportStdio          = "stdio"
-	autoSkillIDPrefix              = "auto-skill-"
-	maxAutoSkillsRetained          = 24
-	maxAutoSkillNameRunes          = 24
-	maxAutoSkillPromptRunes        = 180
 )
 
 type Service struct {
@@ -36,9 +32,13 @@ type Service struct {
 	Args       []string           `json:"args,omitempty"`
 	Transport  string             `json:"transport,omitempty"`
 	AuthToken  string             `json:"auth_token,omitempty"`
+	Group      string             `json:"group,omitempty"`
 	Enabled    bool               `json:"enabled"`
 	ToolStates []ServiceToolState `json:"tool_states,omitempty"`
-	UpdatedAt  time.Time          `json:"updated_at"`
+	// ToolsDefaultDisabled makes tools without an explicit state disabled,
+	// so newly discovered tools need opt-in.
+	ToolsDefaultDisabled bool      `json:"tools_default_disabled,omitempty"`
+	UpdatedAt            time.Time `json:"updated_at"`
 }
 
 type ServiceToolState struct {
@@ -47,6 +47,8 @@ type ServiceToolState struct {
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 }
 
+// Skill is a skill stored in the settings file by older versions. Skills now
+// live in skills.Store; these are only read back for migration.
 type Skill struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
@@ -62,6 +64,16 @@ type AgentPromptConfig struct {
 	UpdatedAt               time.Time `json:"updated_at,omitempty"`
 }
 
+// AgentPromptVersion is one snapshot of the effective agent prompts, recorded
+// whenever they change so evolution runs can be compared and rolled back.
+type AgentPromptVersion struct {
+	Version                 int       `json:"version"`
+	SystemPrompt            string    `json:"system_prompt"`
+	CompressionSystemPrompt string    `json:"compression_system_prompt"`
+	Reason                  string    `json:"reason,omitempty"`
+	CreatedAt               time.Time `json:"created_at"`
+}
+
 type AgentHabitState struct {
 	LastSleepReviewDate     string    `json:"last_sleep_review_date,omitempty"`
 	LastWakePlanDate        string    `json:"last_wake_plan_date,omitempty"`
@@ -74,14 +86,17 @@ type fileConfig struct {
 		Services []Service `json:"services"`
 	} `json:"mcp"`
 	Skills struct {
-		Items []Skill `json:"items"`
+		Items []Skill `json:"items,omitempty"`
 	} `json:"skills"`
 	Agent struct {
-		Prompts AgentPromptConfig `json:"prompts"`
-		Habits  AgentHabitState   `json:"habits"`
+		Prompts       AgentPromptConfig    `json:"prompts"`
+		PromptHistory []AgentPromptVersion `json:"prompt_history,omitempty"`
+		Habits        AgentHabitState      `json:"habits"`
 	} `json:"agent"`
 }
 
+const maxAgentPromptHistory = 20
+
 type Store struct {
 	path string
 	mu   sync.RWMutex
@@ -146,7 +161,8 @@ func (s *Store) UpsertService(service Service) error {
 	service.Args = normalizeServiceArgs(service.Args)
 	service.Transport = normalizeServiceTransport(service.Transport)
 	service.AuthToken = strings.TrimSpace(service.AuthToken)
-	service.ToolStates = normalizeServiceToolStates(service.ToolStates)
+	service.Group = strings.TrimSpace(service.Group)
+	service.ToolStates = normalizeServiceToolStates(service.ToolStates, service.ToolsDefaultDisabled)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -173,7 +189,7 @@ func (s *Store) UpsertService(service Service) error {
 				service.AuthToken = s.cfg.MCP.Services[i].AuthToken
 			}
 			if len(service.ToolStates) == 0 {
-				service.ToolStates = cloneToolStates(s.cfg.MCP.Services[i].ToolStates)
+				service.ToolStates = normalizeServiceToolStates(s.cfg.MCP.Services[i].ToolStates, service.ToolsDefaultDisabled)
 			}
 			s.cfg.MCP.Services[i] = service
 			updated = true
@@ -231,6 +247,33 @@ func (s *Store) SetEnabled(id string, enabled bool) error {
 	return s.persistLocked()
 }
 
+// SetGroupEnabled enables or disables every service in group. It fails when
+// no service belongs to the group.
+func (s *Store) SetGroupEnabled(group string, enabled bool) error {
+	group = strings.TrimSpace(group)
+	if group == "" {
+		return fmt.Errorf("group is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	found := false
+	for i := range s.cfg.MCP.Services {
+		if s.cfg.MCP.Services[i].Group == group {
+			s.cfg.MCP.Services[i].Enabled = enabled
+			s.cfg.MCP.Services[i].UpdatedAt = now
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("group %q has no services", group)
+	}
+
+	return s.persistLocked()
+}
+
 func (s *Store) SetServiceToolEnabled(serviceID, toolName string, enabled bool) error {
 	serviceID = strings.TrimSpace(serviceID)
 	toolName = strings.TrimSpace(toolName)
@@ -259,24 +302,25 @@ func (s *Store) SetServiceToolEnabled(serviceID, toolName string, enabled bool)
 			}
 		}
 
-		if enabled {
+		defaultDisabled := s.cfg.MCP.Services[i].ToolsDefaultDisabled
+		if enabled != defaultDisabled {
 			if idx >= 0 {
 				states = append(states[:idx], states[idx+1:]...)
 			}
 		} else {
 			if idx >= 0 {
-				states[idx].Enabled = false
+				states[idx].Enabled = enabled
 				states[idx].UpdatedAt = now
 			} else {
 				states = append(states, ServiceToolState{
 					Name:      toolName,
-					Enabled:   false,
+					Enabled:   enabled,
 					UpdatedAt: now,
 				})
 			}
 		}
 
-		s.cfg.MCP.Services[i].ToolStates = normalizeServiceToolStates(states)
+		s.cfg.MCP.Services[i].ToolStates = normalizeServiceToolStates(states, defaultDisabled)
 		s.cfg.MCP.Services[i].UpdatedAt = now
 		return s.persistLocked()
 	}
@@ -302,280 +346,208 @@ func (s *Store) IsServiceToolEnabled(serviceID, toolName string) bool {
 	return false
 }
 
-func (s *Store) ListSkills() []Skill {
+// LegacySkills returns the skills older versions kept in the settings file.
+func (s *Store) LegacySkills() []Skill {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return slices.Clone(s.cfg.Skills.Items)
 }
 
-func (s *Store) ListEnabledSkillPrompts() []string {
-	skills := s.ListSkills()
-	out := make([]string, 0, len(skills))
-	for _, skill := range skills {
-		if !skill.Enabled {
-			continue
-		}
-		prompt := strings.TrimSpace(skill.Prompt)
-		if prompt == "" {
-			continue
-		}
-		out = append(out, prompt)
-	}
-	return out
-}
-
-func (s *Store) ListEnabledSkillIndex() []string {
-	skills := s.ListSkills()
-	out := make([]string, 0, len(skills))
-	for _, skill := range skills {
-		if !skill.Enabled {
-			continue
-		}
-		id := strings.TrimSpace(skill.ID)
-		name := strings.TrimSpace(skill.Name)
-		description := strings.TrimSpace(skill.Description)
-		prompt := strings.TrimSpace(skill.Prompt)
-		if id == "" || name == "" || prompt == "" {
-			continue
-		}
-		if description == "" {
-			description = normalizeSkillDescription("", name, prompt)
-		}
-		brief := trimSkillText(prompt, 72)
-		out = append(out, fmt.Sprintf(
-			"skill_id=%s | name=%s | description=%s | brief=%s | path=skill://%s/SKILL.md",
-			id,
-			name,
-			description,
-			brief,
-			id,
-		))
+// ClearLegacySkills drops the settings-file skills once they were migrated.
+func (s *Store) ClearLegacySkills() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cfg.Skills.Items) == 0 {
+		return nil
 	}
-	return out
+	s.cfg.Skills.Items = nil
+	return s.persistLocked()
 }
 
-func (s *Store) ReadEnabledSkillPrompt(skillID string) (string, bool) {
-	skillID = strings.TrimSpace(skillID)
-	if skillID == "" {
-		return "", false
-	}
-
+func (s *Store) GetAgentPromptConfig() AgentPromptConfig {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Prefer exact ID; fallback to unique name match for model robustness.
-	for _, skill := range s.cfg.Skills.Items {
-		if !skill.Enabled {
-			continue
-		}
-		if strings.TrimSpace(skill.ID) == skillID {
-			markdown := renderSkillMarkdown(skill)
-			return markdown, strings.TrimSpace(markdown) != ""
-		}
-	}
+	cfg := s.cfg.Agent.Prompts
+	cfg.SystemPrompt = strings.TrimSpace(cfg.SystemPrompt)
+	cfg.CompressionSystemPrompt = strings.TrimSpace(cfg.CompressionSystemPrompt)
+	return cfg
+}
 
-	matchedSkill := Skill{}
-	matched := false
-	for _, skill := range s.cfg.Skills.Items {
-		if !skill.Enabled {
-			continue
-		}
-		if !strings.EqualFold(strings.TrimSpace(skill.Name), skillID) {
-			continue
-		}
-		prompt := strings.TrimSpace(skill.Prompt)
-		if prompt == "" {
-			continue
-		}
-		if matched {
-			return "", false
-		}
-		matchedSkill = skill
-		matched = true
-	}
-	if !matched {
-		return "", false
-	}
-	markdown := renderSkillMarkdown(matchedSkill)
-	return markdown, strings.TrimSpace(markdown) != ""
+func (s *Store) GetSystemPrompt() string {
+	return s.GetAgentPromptConfig().SystemPrompt
 }
 
-func (s *Store) UpsertAutoSkill(name, prompt string) error {
-	name = trimSkillText(name, maxAutoSkillNameRunes)
-	prompt = trimSkillText(prompt, maxAutoSkillPromptRunes)
-	if name == "" {
-		return fmt.Errorf("auto skill name is required")
-	}
-	if prompt == "" {
-		return fmt.Errorf("auto skill prompt is required")
+func (s *Store) GetCompressionSystemPrompt() string {
+	return s.GetAgentPromptConfig().CompressionSystemPrompt
+}
+
+func (s *Store) UpsertAgentPromptConfig(cfg AgentPromptConfig) error {
+	cfg.SystemPrompt = strings.TrimSpace(cfg.SystemPrompt)
+	cfg.CompressionSystemPrompt = strings.TrimSpace(cfg.CompressionSystemPrompt)
+
+	if err := validateAgentPromptConfig(cfg); err != nil {
+		return err
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	id := s.findAutoSkillIDByNameLocked(name)
-	if id == "" {
-		id = s.generateAutoSkillIDLocked(name, prompt)
-	}
+	s.setAgentPromptsLocked(cfg, "manual")
+	return s.persistLocked()
+}
 
-	skill := Skill{
-		ID:          id,
-		Name:        name,
-		Description: normalizeSkillDescription("", name, prompt),
-		Prompt:      prompt,
-		Enabled:     true,
+func (s *Store) UpdateAgentPrompts(systemPrompt, compressionSystemPrompt string) error {
+	cfg := AgentPromptConfig{
+		SystemPrompt:            strings.TrimSpace(systemPrompt),
+		CompressionSystemPrompt: strings.TrimSpace(compressionSystemPrompt),
 	}
-	if err := validateSkill(skill); err != nil {
+	if err := validateAgentPromptConfig(cfg); err != nil {
 		return err
 	}
 
-	skill.UpdatedAt = time.Now()
-	updated := false
-	for i := range s.cfg.Skills.Items {
-		if s.cfg.Skills.Items[i].ID == skill.ID {
-			s.cfg.Skills.Items[i] = skill
-			updated = true
-			break
-		}
-	}
-	if !updated {
-		s.cfg.Skills.Items = append(s.cfg.Skills.Items, skill)
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.trimAutoSkillsLocked(maxAutoSkillsRetained)
+	s.setAgentPromptsLocked(cfg, "evolution")
 	return s.persistLocked()
 }
 
-func (s *Store) UpsertSkill(skill Skill) error {
-	skill.ID = strings.TrimSpace(skill.ID)
-	skill.Name = strings.TrimSpace(skill.Name)
-	skill.Description = normalizeSkillDescription(skill.Description, skill.Name, skill.Prompt)
-	skill.Prompt = strings.TrimSpace(skill.Prompt)
+func (s *Store) ResetAgentPromptConfig() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if skill.ID == "" {
-		skill.ID = s.findSkillIDForUpdateLocked(skill)
-	}
-	if skill.ID == "" {
-		skill.ID = generateUniqueSkillID(s.cfg.Skills.Items, skill.Name, skill.Prompt)
-	}
-	if skill.Name == "" {
-		skill.Name = skill.ID
-	}
-	skill.Description = normalizeSkillDescription(skill.Description, skill.Name, skill.Prompt)
-	if err := validateSkill(skill); err != nil {
-		return err
-	}
-
-	skill.UpdatedAt = time.Now()
-	updated := false
-	for i := range s.cfg.Skills.Items {
-		if s.cfg.Skills.Items[i].ID == skill.ID {
-			s.cfg.Skills.Items[i] = skill
-			updated = true
-			break
-		}
-	}
-	if !updated {
-		s.cfg.Skills.Items = append(s.cfg.Skills.Items, skill)
-	}
-
+	s.setAgentPromptsLocked(DefaultAgentPromptConfig(), "reset")
 	return s.persistLocked()
 }
 
-func (s *Store) DeleteSkill(id string) error {
-	id = strings.TrimSpace(id)
-	if id == "" {
-		return fmt.Errorf("skill id is required")
+// ListAgentPromptHistory returns recorded prompt versions, newest first.
+func (s *Store) ListAgentPromptHistory() []AgentPromptVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]AgentPromptVersion, 0, len(s.cfg.Agent.PromptHistory))
+	for i := len(s.cfg.Agent.PromptHistory) - 1; i >= 0; i-- {
+		out = append(out, s.cfg.Agent.PromptHistory[i])
 	}
+	return out
+}
 
+// RevertAgentPrompts restores a recorded version. The revert itself is
+// recorded as a new version so it can be undone the same way.
+func (s *Store) RevertAgentPrompts(version int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	next := make([]Skill, 0, len(s.cfg.Skills.Items))
-	for _, skill := range s.cfg.Skills.Items {
-		if skill.ID != id {
-			next = append(next, skill)
+	for _, item := range s.cfg.Agent.PromptHistory {
+		if item.Version != version {
+			continue
 		}
+		s.setAgentPromptsLocked(AgentPromptConfig{
+			SystemPrompt:            item.SystemPrompt,
+			CompressionSystemPrompt: item.CompressionSystemPrompt,
+		}, fmt.Sprintf("revert:v%d", version))
+		return s.persistLocked()
 	}
-	s.cfg.Skills.Items = next
-	return s.persistLocked()
+	return fmt.Errorf("prompt version %d not found", version)
 }
 
-func (s *Store) SetSkillEnabled(id string, enabled bool) error {
-	id = strings.TrimSpace(id)
-	if id == "" {
-		return fmt.Errorf("skill id is required")
-	}
+// ErrNoPreviousPrompts is returned by RollbackAgentPrompts when the history
+// holds nothing older than the current prompts.
+var ErrNoPreviousPrompts = errors.New("no previous prompt version to roll back to")
 
+// RollbackAgentPrompts restores the version that preceded the current one
+// (see PreviousAgentPromptVersion) and records it as "rollback:vN".
+func (s *Store) RollbackAgentPrompts() (AgentPromptVersion, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	found := false
-	for i := range s.cfg.Skills.Items {
-		if s.cfg.Skills.Items[i].ID == id {
-			s.cfg.Skills.Items[i].Enabled = enabled
-			s.cfg.Skills.Items[i].UpdatedAt = time.Now()
-			found = true
-			break
-		}
-	}
-	if !found {
-		return fmt.Errorf("skill %q not found", id)
+	item, ok := s.previousAgentPromptVersionLocked()
+	if !ok {
+		return AgentPromptVersion{}, ErrNoPreviousPrompts
 	}
-	return s.persistLocked()
+	s.setAgentPromptsLocked(AgentPromptConfig{
+		SystemPrompt:            item.SystemPrompt,
+		CompressionSystemPrompt: item.CompressionSystemPrompt,
+	}, fmt.Sprintf("rollback:v%d", item.Version))
+	return item, s.persistLocked()
 }
 
-func (s *Store) GetAgentPromptConfig() AgentPromptConfig {
+// PreviousAgentPromptVersion returns the version RollbackAgentPrompts would
+// restore.
+func (s *Store) PreviousAgentPromptVersion() (AgentPromptVersion, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-
-	cfg := s.cfg.Agent.Prompts
-	cfg.SystemPrompt = strings.TrimSpace(cfg.SystemPrompt)
-	cfg.CompressionSystemPrompt = strings.TrimSpace(cfg.CompressionSystemPrompt)
-	return cfg
-}
-
-func (s *Store) GetSystemPrompt() string {
-	return s.GetAgentPromptConfig().SystemPrompt
-}
-
-func (s *Store) GetCompressionSystemPrompt() string {
-	return s.GetAgentPromptConfig().CompressionSystemPrompt
+	return s.previousAgentPromptVersionLocked()
+}
+
+// previousAgentPromptVersionLocked finds the newest version older than the
+// current prompts with different content. Rollback entries are followed to
+// the version they restored, so repeated rollbacks keep stepping further
+// into the past instead of toggling between the last two versions.
+func (s *Store) previousAgentPromptVersionLocked() (AgentPromptVersion, bool) {
+	history := s.cfg.Agent.PromptHistory
+	current := s.cfg.Agent.Prompts
+	i := len(history) - 1
+	for i >= 0 {
+		var target int
+		if _, err := fmt.Sscanf(history[i].Reason, "rollback:v%d", &target); err != nil {
+			break
+		}
+		j := i - 1
+		for j >= 0 && history[j].Version != target {
+			j--
+		}
+		if j < 0 {
+			break // target trimmed from the history
+		}
+		i = j
+	}
+	for i--; i >= 0; i-- {
+		item := history[i]
+		if item.SystemPrompt != current.SystemPrompt || item.CompressionSystemPrompt != current.CompressionSystemPrompt {
+			return item, true
+		}
+	}
+	return AgentPromptVersion{}, false
 }
 
-func (s *Store) UpsertAgentPromptConfig(cfg AgentPromptConfig) error {
-	cfg.SystemPrompt = strings.TrimSpace(cfg.SystemPrompt)
-	cfg.CompressionSystemPrompt = strings.TrimSpace(cfg.CompressionSystemPrompt)
-
-	if err := validateAgentPromptConfig(cfg); err != nil {
-		return err
+// setAgentPromptsLocked applies cfg and appends it to the bounded history.
+// The first change seeds the history with the prompts it replaces, and
+// unchanged content does not create a new version.
+func (s *Store) setAgentPromptsLocked(cfg AgentPromptConfig, reason string) {
+	now := time.Now()
+	prev := s.cfg.Agent.Prompts
+	if len(s.cfg.Agent.PromptHistory) == 0 {
+		s.appendAgentPromptVersionLocked(prev, "initial", now)
 	}
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	cfg.UpdatedAt = time.Now()
+	cfg.UpdatedAt = now
 	s.cfg.Agent.Prompts = cfg
-	return s.persistLocked()
+	s.appendAgentPromptVersionLocked(cfg, reason, now)
 }
 
-func (s *Store) UpdateAgentPrompts(systemPrompt, compressionSystemPrompt string) error {
-	return s.UpsertAgentPromptConfig(AgentPromptConfig{
-		SystemPrompt:            strings.TrimSpace(systemPrompt),
-		CompressionSystemPrompt: strings.TrimSpace(compressionSystemPrompt),
+func (s *Store) appendAgentPromptVersionLocked(cfg AgentPromptConfig, reason string, now time.Time) {
+	history := s.cfg.Agent.PromptHistory
+	if n := len(history); n > 0 &&
+		history[n-1].SystemPrompt == cfg.SystemPrompt &&
+		history[n-1].CompressionSystemPrompt == cfg.CompressionSystemPrompt {
+		return
+	}
+	next := 1
+	if n := len(history); n > 0 {
+		next = history[n-1].Version + 1
+	}
+	history = append(history, AgentPromptVersion{
+		Version:                 next,
+		SystemPrompt:            cfg.SystemPrompt,
+		CompressionSystemPrompt: cfg.CompressionSystemPrompt,
+		Reason:                  reason,
+		CreatedAt:               now,
 	})
-}
-
-func (s *Store) ResetAgentPromptConfig() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	cfg := DefaultAgentPromptConfig()
-	cfg.UpdatedAt = time.Now()
-	s.cfg.Agent.Prompts = cfg
-	return s.persistLocked()
+	if len(history) > maxAgentPromptHistory {
+		history = append([]AgentPromptVersion(nil), history[len(history)-maxAgentPromptHistory:]...)
+	}
+	s.cfg.Agent.PromptHistory = history
 }
 
 func (s *Store) GetLastSleepReviewDate() string {
@@ -655,26 +627,12 @@ func (s *Store) load() error {
 		svc.Transport = normalizeServiceTransport(svc.Transport)
 		svc.Command = strings.TrimSpace(svc.Command)
 		svc.Args = normalizeServiceArgs(svc.Args)
-		svc.ToolStates = normalizeServiceToolStates(svc.ToolStates)
+		svc.ToolStates = normalizeServiceToolStates(svc.ToolStates, svc.ToolsDefaultDisabled)
 		if err := validateService(svc); err != nil {
 			return fmt.Errorf("invalid mcp service %q: %w", svc.ID, err)
 		}
 		cfg.MCP.Services[i] = svc
 	}
-	for i, skill := range cfg.Skills.Items {
-		skill.ID = strings.TrimSpace(skill.ID)
-		skill.Name = strings.TrimSpace(skill.Name)
-		skill.Prompt = strings.TrimSpace(skill.Prompt)
-		nextDescription := normalizeSkillDescription(skill.Description, skill.Name, skill.Prompt)
-		if strings.TrimSpace(skill.Description) != nextDescription {
-			skill.Description = nextDescription
-			needsPersist = true
-		}
-		if err := validateSkill(skill); err != nil {
-			return fmt.Errorf("invalid skill %q: %w", skill.ID, err)
-		}
-		cfg.Skills.Items[i] = skill
-	}
 	if err := validateAgentPromptConfig(cfg.Agent.Prompts); err != nil {
 		return fmt.Errorf("invalid agent prompts: %w", err)
 	}
@@ -694,6 +652,29 @@ func (s *Store) load() error {
 	return nil
 }
 
+// CheckHealth reports whether the settings file still decodes and its
+// directory still accepts writes, without changing either.
+func (s *Store) CheckHealth() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read settings file: %w", err)
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("decode settings file: %w", err)
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(s.path), ".settings-probe-*")
+	if err != nil {
+		return fmt.Errorf("settings dir not writable: %w", err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
 func (s *Store) persistLocked() error {
 	data, err := json.MarshalIndent(s.cfg, "", "  ")
 	if err != nil {
@@ -744,25 +725,6 @@ func validateService(service Service) error {
 	return nil
 }
 
-func validateSkill(skill Skill) error {
-	if skill.ID == "" {
-		return fmt.Errorf("skill id is required")
-	}
-	if !serviceIDPattern.MatchString(skill.ID) {
-		return fmt.Errorf("skill id must match [a-zA-Z0-9_-]+")
-	}
-	if strings.TrimSpace(skill.Name) == "" {
-		return fmt.Errorf("skill name is required")
-	}
-	if strings.TrimSpace(skill.Description) == "" {
-		return fmt.Errorf("skill description is required")
-	}
-	if strings.TrimSpace(skill.Prompt) == "" {
-		return fmt.Errorf("skill prompt is required")
-	}
-	return nil
-}
-
 func validateAgentPromptConfig(cfg AgentPromptConfig) error {
 	systemPrompt := strings.TrimSpace(cfg.SystemPrompt)
 	compressionPrompt := strings.TrimSpace(cfg.CompressionSystemPrompt)
@@ -809,14 +771,6 @@ func generateUniqueServiceID(existing []Service, name, endpoint, command string)
 	return generateUniqueID(used, []string{name, endpoint, command}, "service")
 }
 
-func generateUniqueSkillID(existing []Skill, name, prompt string) string {
-	used := make(map[string]struct{}, len(existing))
-	for _, skill := range existing {
-		used[skill.ID] = struct{}{}
-	}
-	return generateUniqueID(used, []string{name, prompt}, "skill")
-}
-
 func generateUniqueID(used map[string]struct{}, candidates []string, fallback string) string {
 	base := ""
 	for _, candidate := range candidates {
@@ -920,234 +874,6 @@ func (s *Store) findServiceIDForUpdateLocked(service Service) string {
 	return ""
 }
 
-func (s *Store) findSkillIDForUpdateLocked(skill Skill) string {
-	name := strings.TrimSpace(skill.Name)
-	if name == "" {
-		return ""
-	}
-
-	matchedID := ""
-	for _, existing := range s.cfg.Skills.Items {
-		if !strings.EqualFold(strings.TrimSpace(existing.Name), name) {
-			continue
-		}
-		if matchedID != "" {
-			return ""
-		}
-		matchedID = existing.ID
-	}
-	return matchedID
-}
-
-func (s *Store) findAutoSkillIDByNameLocked(name string) string {
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return ""
-	}
-
-	for _, existing := range s.cfg.Skills.Items {
-		if !isAutoSkillID(existing.ID) {
-			continue
-		}
-		if strings.EqualFold(strings.TrimSpace(existing.Name), name) {
-			return existing.ID
-		}
-	}
-	return ""
-}
-
-func (s *Store) generateAutoSkillIDLocked(name, prompt string) string {
-	seed := sanitizeIdentifier(name)
-	if seed == "" {
-		seed = sanitizeIdentifier(prompt)
-	}
-	if seed == "" {
-		seed = "skill"
-	}
-
-	candidate := autoSkillIDPrefix + seed
-	used := make(map[string]struct{}, len(s.cfg.Skills.Items))
-	for _, skill := range s.cfg.Skills.Items {
-		used[skill.ID] = struct{}{}
-	}
-	if _, exists := used[candidate]; !exists {
-		return candidate
-	}
-
-	for i := 2; ; i++ {
-		next := fmt.Sprintf("%s%s-%d", autoSkillIDPrefix, seed, i)
-		if _, exists := used[next]; !exists {
-			return next
-		}
-	}
-}
-
-func (s *Store) trimAutoSkillsLocked(limit int) {
-	if limit <= 0 {
-		s.cfg.Skills.Items = filterSkills(s.cfg.Skills.Items, func(skill Skill) bool {
-			return !isAutoSkillID(skill.ID)
-		})
-		return
-	}
-
-	type autoSkillWithIndex struct {
-		Index     int
-		UpdatedAt time.Time
-	}
-	autoSkills := make([]autoSkillWithIndex, 0, len(s.cfg.Skills.Items))
-	for i, skill := range s.cfg.Skills.Items {
-		if isAutoSkillID(skill.ID) {
-			autoSkills = append(autoSkills, autoSkillWithIndex{
-				Index:     i,
-				UpdatedAt: skill.UpdatedAt,
-			})
-		}
-	}
-	if len(autoSkills) <= limit {
-		return
-	}
-
-	sort.Slice(autoSkills, func(i, j int) bool {
-		if autoSkills[i].UpdatedAt.Equal(autoSkills[j].UpdatedAt) {
-			return autoSkills[i].Index < autoSkills[j].Index
-		}
-		return autoSkills[i].UpdatedAt.Before(autoSkills[j].UpdatedAt)
-	})
-
-	removeCount := len(autoSkills) - limit
-	removeIndex := make(map[int]struct{}, removeCount)
-	for i := 0; i < removeCount; i++ {
-		removeIndex[autoSkills[i].Index] = struct{}{}
-	}
-
-	next := make([]Skill, 0, len(s.cfg.Skills.Items)-removeCount)
-	for i, skill := range s.cfg.Skills.Items {
-		if _, drop := removeIndex[i]; drop {
-			continue
-		}
-		next = append(next, skill)
-	}
-	s.cfg.Skills.Items = next
-}
-
-func filterSkills(skills []Skill, keep func(Skill) bool) []Skill {
-	if len(skills) == 0 {
-		return nil
-	}
-	next := make([]Skill, 0, len(skills))
-	for _, skill := range skills {
-		if keep(skill) {
-			next = append(next, skill)
-		}
-	}
-	return next
-}
-
-func isAutoSkillID(id string) bool {
-	return strings.HasPrefix(strings.TrimSpace(id), autoSkillIDPrefix)
-}
-
-func trimSkillText(v string, max int) string {
-	v = strings.TrimSpace(v)
-	if v == "" || max <= 0 {
-		return ""
-	}
-	runes := []rune(v)
-	if len(runes) <= max {
-		return v
-	}
-	if max <= 3 {
-		return string(runes[:max])
-	}
-	return strings.TrimSpace(string(runes[:max-3])) + "..."
-}
-
-func normalizeSkillDescription(description, name, prompt string) string {
-	description = strings.TrimSpace(strings.ReplaceAll(description, "\n", " "))
-	if description != "" {
-		return trimSkillText(description, 140)
-	}
-
-	base := strings.TrimSpace(prompt)
-	if base == "" {
-		base = strings.TrimSpace(name)
-	}
-	if base == "" {
-		return ""
-	}
-	base = strings.ReplaceAll(base, "\n", " ")
-	return trimSkillText(base, 140)
-}
-
-func normalizeSkillStandardName(skill Skill) string {
-	raw := strings.TrimSpace(skill.ID)
-	if raw == "" {
-		raw = strings.TrimSpace(skill.Name)
-	}
-	raw = strings.ToLower(raw)
-
-	var b strings.Builder
-	lastDash := false
-	for _, r := range raw {
-		switch {
-		case r >= 'a' && r <= 'z':
-			b.WriteRune(r)
-			lastDash = false
-		case r >= '0' && r <= '9':
-			b.WriteRune(r)
-			lastDash = false
-		case r == '-' || r == '_':
-			if b.Len() == 0 || lastDash {
-				continue
-			}
-			b.WriteRune('-')
-			lastDash = true
-		default:
-			if b.Len() == 0 || lastDash {
-				continue
-			}
-			b.WriteRune('-')
-			lastDash = true
-		}
-	}
-
-	name := strings.Trim(b.String(), "-")
-	if name == "" {
-		name = "skill"
-	}
-	if len(name) > 64 {
-		name = strings.Trim(name[:64], "-")
-		if name == "" {
-			name = "skill"
-		}
-	}
-	return name
-}
-
-func renderSkillMarkdown(skill Skill) string {
-	prompt := strings.TrimSpace(skill.Prompt)
-	if prompt == "" {
-		return ""
-	}
-	manifestName := normalizeSkillStandardName(skill)
-	description := normalizeSkillDescription(skill.Description, skill.Name, skill.Prompt)
-	if description == "" {
-		return ""
-	}
-
-	return strings.TrimSpace(
-		"---\n" +
-			"name: " + quoteYAMLString(manifestName) + "\n" +
-			"description: " + quoteYAMLString(description) + "\n" +
-			"---\n\n" +
-			prompt,
-	)
-}
-
-func quoteYAMLString(v string) string {
-	return strconv.Quote(strings.TrimSpace(strings.ReplaceAll(v, "\n", " ")))
-}
-
 func cloneServices(in []Service) []Service {
 	out := make([]Service, len(in))
 	for i := range in {
@@ -1190,7 +916,7 @@ func cloneToolStates(in []ServiceToolState) []ServiceToolState {
 	return out
 }
 
-func normalizeServiceToolStates(states []ServiceToolState) []ServiceToolState {
+func normalizeServiceToolStates(states []ServiceToolState, defaultDisabled bool) []ServiceToolState {
 	if len(states) == 0 {
 		return nil
 	}
@@ -1201,13 +927,12 @@ func normalizeServiceToolStates(states []ServiceToolState) []ServiceToolState {
 		if name == "" {
 			continue
 		}
-		// Default is enabled; only store explicit non-default states.
-		if state.Enabled {
+		// Only store states that differ from the service's default.
+		if state.Enabled != defaultDisabled {
 			delete(byName, name)
 			continue
 		}
 		state.Name = name
-		state.Enabled = false
 		byName[name] = state
 	}
 	if len(byName) == 0 {
@@ -1237,5 +962,5 @@ func serviceToolEnabled(service Service, toolName string) bool {
 			return state.Enabled
 		}
 	}
-	return true
+	return !service.ToolsDefaultDisabled
 }
@@ -1,6 +1,7 @@
 package mcp
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -61,156 +62,6 @@ func TestStoreUpsertAndReload(t *testing.T) {
 	}
 }
 
-func TestStoreSkillCRUDAndPrompts(t *testing.T) {
-	settingsPath := filepath.Join(t.TempDir(), "settings.json")
-	store, err := NewStore(settingsPath)
-	if err != nil {
-		t.Fatalf("NewStore error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		ID:      "research",
-		Name:    "Research Skill",
-		Prompt:  "先检索再回答，给出来源。",
-		Enabled: true,
-	}); err != nil {
-		t.Fatalf("UpsertSkill error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		ID:      "research",
-		Name:    "Research Skill v2",
-		Prompt:  "先检索、再总结、最后给出来源。",
-		Enabled: false,
-	}); err != nil {
-		t.Fatalf("UpsertSkill update error: %v", err)
-	}
-
-	if err := store.SetSkillEnabled("research", true); err != nil {
-		t.Fatalf("SetSkillEnabled error: %v", err)
-	}
-
-	prompts := store.ListEnabledSkillPrompts()
-	if len(prompts) != 1 {
-		t.Fatalf("expected 1 enabled prompt, got %d", len(prompts))
-	}
-	if prompts[0] != "先检索、再总结、最后给出来源。" {
-		t.Fatalf("unexpected prompt: %q", prompts[0])
-	}
-
-	if err := store.DeleteSkill("research"); err != nil {
-		t.Fatalf("DeleteSkill error: %v", err)
-	}
-	if len(store.ListSkills()) != 0 {
-		t.Fatalf("expected no skills after delete")
-	}
-}
-
-func TestStoreUpsertAutoSkill_PersistedAndBounded(t *testing.T) {
-	settingsPath := filepath.Join(t.TempDir(), "settings.json")
-	store, err := NewStore(settingsPath)
-	if err != nil {
-		t.Fatalf("NewStore error: %v", err)
-	}
-
-	if err := store.UpsertAutoSkill("复盘框架", "先列事实、再列根因、最后列行动项。"); err != nil {
-		t.Fatalf("UpsertAutoSkill error: %v", err)
-	}
-	if err := store.UpsertAutoSkill("复盘框架", "先列事实时间线，再写根因和防复发动作。"); err != nil {
-		t.Fatalf("UpsertAutoSkill update error: %v", err)
-	}
-
-	skills := store.ListSkills()
-	if len(skills) != 1 {
-		t.Fatalf("expected one auto skill, got %d", len(skills))
-	}
-	if !strings.HasPrefix(skills[0].ID, autoSkillIDPrefix) {
-		t.Fatalf("expected auto skill id prefix, got %q", skills[0].ID)
-	}
-	if !skills[0].Enabled {
-		t.Fatalf("expected auto skill enabled")
-	}
-	if !strings.Contains(skills[0].Prompt, "防复发") {
-		t.Fatalf("expected updated auto skill prompt, got %q", skills[0].Prompt)
-	}
-
-	for i := 0; i < maxAutoSkillsRetained+3; i++ {
-		name := fmt.Sprintf("自动能力-%d", i)
-		prompt := fmt.Sprintf("这是第 %d 条自动能力，用于验证上限裁剪。", i)
-		if err := store.UpsertAutoSkill(name, prompt); err != nil {
-			t.Fatalf("UpsertAutoSkill #%d error: %v", i, err)
-		}
-	}
-
-	autoCount := 0
-	for _, skill := range store.ListSkills() {
-		if strings.HasPrefix(skill.ID, autoSkillIDPrefix) {
-			autoCount++
-		}
-	}
-	if autoCount != maxAutoSkillsRetained {
-		t.Fatalf("expected auto skill count capped to %d, got %d", maxAutoSkillsRetained, autoCount)
-	}
-}
-
-func TestStoreSkillCatalogIndexAndRead(t *testing.T) {
-	settingsPath := filepath.Join(t.TempDir(), "settings.json")
-	store, err := NewStore(settingsPath)
-	if err != nil {
-		t.Fatalf("NewStore error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		ID:          "code-review-playbook",
-		Name:        "代码评审手册",
-		Description: "用于代码评审与上线风险治理。",
-		Prompt:      "完整技能：先确认验收标准，再检查风险与回滚，最后给出上线建议。",
-		Enabled:     true,
-	}); err != nil {
-		t.Fatalf("UpsertSkill enabled error: %v", err)
-	}
-	if err := store.UpsertSkill(Skill{
-		ID:      "disabled-skill",
-		Name:    "禁用技能",
-		Prompt:  "这条不该出现在索引里",
-		Enabled: false,
-	}); err != nil {
-		t.Fatalf("UpsertSkill disabled error: %v", err)
-	}
-
-	index := store.ListEnabledSkillIndex()
-	if len(index) != 1 {
-		t.Fatalf("expected 1 enabled skill index line, got %d", len(index))
-	}
-	if !strings.Contains(index[0], "skill_id=code-review-playbook") {
-		t.Fatalf("unexpected skill index line: %q", index[0])
-	}
-	if !strings.Contains(index[0], "description=用于代码评审与上线风险治理。") {
-		t.Fatalf("expected description in skill index line, got %q", index[0])
-	}
-
-	prompt, ok := store.ReadEnabledSkillPrompt("code-review-playbook")
-	if !ok {
-		t.Fatalf("expected skill prompt by id")
-	}
-	if !strings.Contains(prompt, "---") || !strings.Contains(prompt, `name: "code-review-playbook"`) {
-		t.Fatalf("expected SKILL.md front matter, got %q", prompt)
-	}
-	if !strings.Contains(prompt, `description: "用于代码评审与上线风险治理。"`) {
-		t.Fatalf("expected SKILL.md description front matter, got %q", prompt)
-	}
-	if !strings.Contains(prompt, "验收标准") {
-		t.Fatalf("unexpected skill prompt: %q", prompt)
-	}
-
-	if _, ok := store.ReadEnabledSkillPrompt("disabled-skill"); ok {
-		t.Fatalf("disabled skill should not be readable")
-	}
-	if _, ok := store.ReadEnabledSkillPrompt("代码评审手册"); !ok {
-		t.Fatalf("expected name fallback read")
-	}
-}
-
 func TestStoreUpsertService_AutoGeneratesIDWhenMissing(t *testing.T) {
 	settingsPath := filepath.Join(t.TempDir(), "settings.json")
 	store, err := NewStore(settingsPath)
@@ -245,79 +96,6 @@ func TestStoreUpsertService_AutoGeneratesIDWhenMissing(t *testing.T) {
 	}
 }
 
-func TestStoreUpsertSkill_AutoGeneratesIDWhenMissing(t *testing.T) {
-	settingsPath := filepath.Join(t.TempDir(), "settings.json")
-	store, err := NewStore(settingsPath)
-	if err != nil {
-		t.Fatalf("NewStore error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		Name:    "Research Mode",
-		Prompt:  "先检索再回答",
-		Enabled: true,
-	}); err != nil {
-		t.Fatalf("UpsertSkill error: %v", err)
-	}
-	if err := store.UpsertSkill(Skill{
-		Name:    "Writing Mode",
-		Prompt:  "先检索再回答，附来源",
-		Enabled: false,
-	}); err != nil {
-		t.Fatalf("UpsertSkill second insert error: %v", err)
-	}
-
-	skills := store.ListSkills()
-	if len(skills) != 2 {
-		t.Fatalf("expected 2 skills, got %d", len(skills))
-	}
-	if skills[0].ID == "" || skills[1].ID == "" {
-		t.Fatalf("expected generated ids, got %+v", skills)
-	}
-	if skills[0].ID == skills[1].ID {
-		t.Fatalf("expected unique generated ids, got %q", skills[0].ID)
-	}
-}
-
-func TestStoreUpsertSkill_EmptyIDUpdatesExistingByName(t *testing.T) {
-	settingsPath := filepath.Join(t.TempDir(), "settings.json")
-	store, err := NewStore(settingsPath)
-	if err != nil {
-		t.Fatalf("NewStore error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		ID:      "research",
-		Name:    "Research Mode",
-		Prompt:  "先检索",
-		Enabled: true,
-	}); err != nil {
-		t.Fatalf("UpsertSkill error: %v", err)
-	}
-
-	if err := store.UpsertSkill(Skill{
-		Name:    "Research Mode",
-		Prompt:  "先检索再回答并附来源",
-		Enabled: false,
-	}); err != nil {
-		t.Fatalf("UpsertSkill update error: %v", err)
-	}
-
-	skills := store.ListSkills()
-	if len(skills) != 1 {
-		t.Fatalf("expected 1 skill after update, got %d", len(skills))
-	}
-	if skills[0].ID != "research" {
-		t.Fatalf("expected id keep research, got %q", skills[0].ID)
-	}
-	if skills[0].Prompt != "先检索再回答并附来源" {
-		t.Fatalf("expected prompt updated, got %q", skills[0].Prompt)
-	}
-	if skills[0].Enabled {
-		t.Fatalf("expected skill disabled after update")
-	}
-}
-
 func TestStoreUpsertService_EmptyIDUpdatesExistingByEndpoint(t *testing.T) {
 	settingsPath := filepath.Join(t.TempDir(), "settings.json")
 	store, err := NewStore(settingsPath)
@@ -412,6 +190,114 @@ func TestStoreSetServiceToolEnabled_Persisted(t *testing.T) {
 	}
 }
 
+func TestStoreToolsDefaultPolicy_Persisted(t *testing.T) {
+	for _, defaultDisabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("default_disabled=%v", defaultDisabled), func(t *testing.T) {
+			settingsPath := filepath.Join(t.TempDir(), "settings.json")
+			store, err := NewStore(settingsPath)
+			if err != nil {
+				t.Fatalf("NewStore error: %v", err)
+			}
+			if err := store.UpsertService(Service{
+				ID:                   "search",
+				Endpoint:             "https://example.com/mcp",
+				Enabled:              true,
+				ToolsDefaultDisabled: defaultDisabled,
+			}); err != nil {
+				t.Fatalf("UpsertService error: %v", err)
+			}
+
+			if got := store.IsServiceToolEnabled("search", "new_tool"); got != !defaultDisabled {
+				t.Fatalf("unknown tool enabled = %v, want %v", got, !defaultDisabled)
+			}
+			// Flip one tool away from the default.
+			if err := store.SetServiceToolEnabled("search", "flipped", defaultDisabled); err != nil {
+				t.Fatalf("SetServiceToolEnabled error: %v", err)
+			}
+
+			reloaded, err := NewStore(settingsPath)
+			if err != nil {
+				t.Fatalf("reload store error: %v", err)
+			}
+			svc, ok := reloaded.GetService("search")
+			if !ok || svc.ToolsDefaultDisabled != defaultDisabled {
+				t.Fatalf("expected policy to persist, got %+v", svc)
+			}
+			if len(svc.ToolStates) != 1 || svc.ToolStates[0].Name != "flipped" {
+				t.Fatalf("expected only the non-default state stored, got %+v", svc.ToolStates)
+			}
+			if got := reloaded.IsServiceToolEnabled("search", "flipped"); got != defaultDisabled {
+				t.Fatalf("flipped tool enabled = %v, want %v", got, defaultDisabled)
+			}
+			if got := reloaded.IsServiceToolEnabled("search", "other"); got != !defaultDisabled {
+				t.Fatalf("other tool enabled = %v, want %v", got, !defaultDisabled)
+			}
+
+			// Toggling back to the default drops the explicit state.
+			if err := reloaded.SetServiceToolEnabled("search", "flipped", !defaultDisabled); err != nil {
+				t.Fatalf("SetServiceToolEnabled back error: %v", err)
+			}
+			if svc, _ := reloaded.GetService("search"); len(svc.ToolStates) != 0 {
+				t.Fatalf("expected no stored states, got %+v", svc.ToolStates)
+			}
+		})
+	}
+}
+
+func TestStoreSetGroupEnabled_OnlyChangesMatchingServices(t *testing.T) {
+	settingsPath := filepath.Join(t.TempDir(), "settings.json")
+	store, err := NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	for _, svc := range []Service{
+		{ID: "search", Endpoint: "https://example.com/search", Group: "web", Enabled: true},
+		{ID: "fetch", Endpoint: "https://example.com/fetch", Group: " web ", Enabled: false},
+		{ID: "files", Endpoint: "https://example.com/files", Group: "local", Enabled: true},
+		{ID: "misc", Endpoint: "https://example.com/misc", Enabled: true},
+	} {
+		if err := store.UpsertService(svc); err != nil {
+			t.Fatalf("UpsertService %s error: %v", svc.ID, err)
+		}
+	}
+
+	enabledByID := func(s *Store) map[string]bool {
+		out := make(map[string]bool)
+		for _, svc := range s.ListServices() {
+			out[svc.ID] = svc.Enabled
+		}
+		return out
+	}
+
+	if err := store.SetGroupEnabled("web", false); err != nil {
+		t.Fatalf("SetGroupEnabled off error: %v", err)
+	}
+	got := enabledByID(store)
+	if got["search"] || got["fetch"] || !got["files"] || !got["misc"] {
+		t.Fatalf("unexpected states after disabling web: %+v", got)
+	}
+
+	if err := store.SetGroupEnabled("web", true); err != nil {
+		t.Fatalf("SetGroupEnabled on error: %v", err)
+	}
+	reloaded, err := NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("reload store error: %v", err)
+	}
+	got = enabledByID(reloaded)
+	if !got["search"] || !got["fetch"] || !got["files"] || !got["misc"] {
+		t.Fatalf("unexpected states after enabling web: %+v", got)
+	}
+	if svc, ok := reloaded.GetService("fetch"); !ok || svc.Group != "web" {
+		t.Fatalf("expected trimmed group to persist, got %+v", svc)
+	}
+
+	if err := store.SetGroupEnabled("missing", false); err == nil {
+		t.Fatalf("expected error for unknown group")
+	}
+}
+
 func TestStoreUpsertAgentPromptConfig_Persisted(t *testing.T) {
 	settingsPath := filepath.Join(t.TempDir(), "settings.json")
 	store, err := NewStore(settingsPath)
@@ -518,6 +404,102 @@ func TestStoreResetAgentPromptConfig(t *testing.T) {
 	}
 }
 
+func TestStoreAgentPromptHistory_RecordsAndReverts(t *testing.T) {
+	settingsPath := filepath.Join(t.TempDir(), "settings.json")
+	store, err := NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	defaults := store.GetAgentPromptConfig()
+
+	if err := store.UpsertAgentPromptConfig(AgentPromptConfig{
+		SystemPrompt:            "manual-system",
+		CompressionSystemPrompt: "manual-compression",
+	}); err != nil {
+		t.Fatalf("UpsertAgentPromptConfig error: %v", err)
+	}
+	if err := store.UpdateAgentPrompts("evolved-system", "evolved-compression"); err != nil {
+		t.Fatalf("UpdateAgentPrompts error: %v", err)
+	}
+	if err := store.UpdateAgentPrompts("evolved-system", "evolved-compression"); err != nil {
+		t.Fatalf("UpdateAgentPrompts error: %v", err)
+	}
+
+	history := store.ListAgentPromptHistory()
+	if len(history) != 3 {
+		t.Fatalf("expected initial + manual + evolution versions, got %+v", history)
+	}
+	if history[0].Version != 3 || history[0].Reason != "evolution" || history[0].SystemPrompt != "evolved-system" {
+		t.Fatalf("unexpected newest version: %+v", history[0])
+	}
+	if history[2].Version != 1 || history[2].Reason != "initial" || history[2].SystemPrompt != defaults.SystemPrompt {
+		t.Fatalf("unexpected initial version: %+v", history[2])
+	}
+	if history[0].CreatedAt.IsZero() {
+		t.Fatalf("expected version timestamp")
+	}
+
+	if err := store.RevertAgentPrompts(2); err != nil {
+		t.Fatalf("RevertAgentPrompts error: %v", err)
+	}
+	if err := store.RevertAgentPrompts(99); err == nil {
+		t.Fatalf("expected error for unknown version")
+	}
+
+	reloaded, err := NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("reload store error: %v", err)
+	}
+	cfg := reloaded.GetAgentPromptConfig()
+	if cfg.SystemPrompt != "manual-system" || cfg.CompressionSystemPrompt != "manual-compression" {
+		t.Fatalf("expected revert to manual version, got %+v", cfg)
+	}
+	history = reloaded.ListAgentPromptHistory()
+	if len(history) != 4 || history[0].Reason != "revert:v2" {
+		t.Fatalf("expected revert recorded as new version, got %+v", history)
+	}
+}
+
+func TestStoreRollbackAgentPrompts_StepsBackThroughEvolutions(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	defaults := store.GetAgentPromptConfig()
+
+	if err := store.UpdateAgentPrompts("evolved-1", "compression-1"); err != nil {
+		t.Fatalf("UpdateAgentPrompts error: %v", err)
+	}
+	if err := store.UpdateAgentPrompts("evolved-2", "compression-2"); err != nil {
+		t.Fatalf("UpdateAgentPrompts error: %v", err)
+	}
+
+	restored, err := store.RollbackAgentPrompts()
+	if err != nil {
+		t.Fatalf("RollbackAgentPrompts error: %v", err)
+	}
+	if restored.SystemPrompt != "evolved-1" || restored.Reason != "evolution" {
+		t.Fatalf("unexpected restored version: %+v", restored)
+	}
+	if cfg := store.GetAgentPromptConfig(); cfg.SystemPrompt != "evolved-1" || cfg.CompressionSystemPrompt != "compression-1" {
+		t.Fatalf("expected first evolution to be active, got %+v", cfg)
+	}
+	if latest := store.ListAgentPromptHistory()[0]; latest.Reason != "rollback:v2" || latest.CreatedAt.IsZero() {
+		t.Fatalf("expected rollback recorded with reason and timestamp, got %+v", latest)
+	}
+
+	// A second rollback keeps going back instead of undoing the first.
+	if _, err := store.RollbackAgentPrompts(); err != nil {
+		t.Fatalf("second RollbackAgentPrompts error: %v", err)
+	}
+	if cfg := store.GetAgentPromptConfig(); cfg.SystemPrompt != defaults.SystemPrompt {
+		t.Fatalf("expected defaults after second rollback, got %+v", cfg)
+	}
+	if _, err := store.RollbackAgentPrompts(); !errors.Is(err, ErrNoPreviousPrompts) {
+		t.Fatalf("expected ErrNoPreviousPrompts, got %v", err)
+	}
+}
+
 func TestStoreAgentHabitState_Persisted(t *testing.T) {
 	settingsPath := filepath.Join(t.TempDir(), "settings.json")
 	store, err := NewStore(settingsPath)
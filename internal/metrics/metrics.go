@@ -0,0 +1,234 @@
+// Package metrics keeps the process counters exposed on /metrics and renders
+// them in the Prometheus text exposition format. All methods are safe on a
+// nil *Metrics, so components record unconditionally.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// llmLatencyBuckets are upper bounds in seconds.
+var llmLatencyBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 45, 90}
+
+type Metrics struct {
+	mu sync.Mutex
+
+	turns        map[string]float64 // result
+	toolCalls    map[[2]string]float64
+	compressions float64
+	llmTokens    map[[2]string]float64 // purpose, kind
+	llmLatency   map[[2]string]*histogram
+	mcpUp        map[string]float64
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func New() *Metrics {
+	return &Metrics{
+		turns:      make(map[string]float64),
+		toolCalls:  make(map[[2]string]float64),
+		llmTokens:  make(map[[2]string]float64),
+		llmLatency: make(map[[2]string]*histogram),
+		mcpUp:      make(map[string]float64),
+	}
+}
+
+// IncTurn counts one finished user turn.
+func (m *Metrics) IncTurn(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.turns[resultLabel(err)]++
+}
+
+// IncToolCall counts one executed tool call by tool name.
+func (m *Metrics) IncToolCall(tool string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toolCalls[[2]string{tool, resultLabel(err)}]++
+}
+
+func (m *Metrics) IncCompression() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compressions++
+}
+
+// ObserveLLMRequest records the latency of one LLM API call.
+func (m *Metrics) ObserveLLMRequest(purpose string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{purpose, resultLabel(err)}
+	h := m.llmLatency[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(llmLatencyBuckets))}
+		m.llmLatency[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range llmLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// AddLLMTokens records token usage reported by the provider.
+func (m *Metrics) AddLLMTokens(purpose string, prompt, completion int) {
+	if m == nil || (prompt <= 0 && completion <= 0) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.llmTokens[[2]string{purpose, "prompt"}] += float64(max(prompt, 0))
+	m.llmTokens[[2]string{purpose, "completion"}] += float64(max(completion, 0))
+}
+
+// SetMCPServicesUp replaces the MCP service up/down gauges; services missing
+// from up (disabled or deleted) stop being reported.
+func (m *Metrics) SetMCPServicesUp(up map[string]bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mcpUp = make(map[string]float64, len(up))
+	for id, ok := range up {
+		if ok {
+			m.mcpUp[id] = 1
+		} else {
+			m.mcpUp[id] = 0
+		}
+	}
+}
+
+// WriteText renders all metrics in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeHeader(&b, "agent_turns_total", "counter", "User turns handled, by result.")
+	for _, result := range sortedKeys(m.turns) {
+		writeSample(&b, "agent_turns_total", []string{"result", result}, m.turns[result])
+	}
+	writeHeader(&b, "agent_tool_calls_total", "counter", "Tool calls executed, by tool and result.")
+	for _, key := range sortedPairs(m.toolCalls) {
+		writeSample(&b, "agent_tool_calls_total", []string{"tool", key[0], "result", key[1]}, m.toolCalls[key])
+	}
+	writeHeader(&b, "agent_compressions_total", "counter", "Context compressions applied.")
+	writeSample(&b, "agent_compressions_total", nil, m.compressions)
+	writeHeader(&b, "llm_tokens_total", "counter", "Tokens reported by the LLM provider, by purpose and kind.")
+	for _, key := range sortedPairs(m.llmTokens) {
+		writeSample(&b, "llm_tokens_total", []string{"purpose", key[0], "kind", key[1]}, m.llmTokens[key])
+	}
+	writeHeader(&b, "llm_request_duration_seconds", "histogram", "LLM API call latency, by purpose and result.")
+	for _, key := range sortedPairs(m.llmLatency) {
+		h := m.llmLatency[key]
+		labels := []string{"purpose", key[0], "result", key[1]}
+		var cumulative uint64
+		for i, bound := range llmLatencyBuckets {
+			cumulative += h.counts[i]
+			writeSample(&b, "llm_request_duration_seconds_bucket", append(labels, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(&b, "llm_request_duration_seconds_bucket", append(labels, "le", "+Inf"), float64(h.count))
+		writeSample(&b, "llm_request_duration_seconds_sum", labels, h.sum)
+		writeSample(&b, "llm_request_duration_seconds_count", labels, float64(h.count))
+	}
+	writeHeader(&b, "mcp_service_up", "gauge", "Whether an enabled MCP service answered its last tools/list (1) or not (0).")
+	for _, id := range sortedKeys(m.mcpUp) {
+		writeSample(&b, "mcp_service_up", []string{"service", id}, m.mcpUp[id])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one line; labels alternate name and value.
+func writeSample(b *strings.Builder, name string, labels []string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairs[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteText_RendersHistogramTokensAndGauges(t *testing.T) {
+	m := New()
+	m.ObserveLLMRequest("chat_reply", 300*time.Millisecond, nil)
+	m.ObserveLLMRequest("chat_reply", 3*time.Second, nil)
+	m.ObserveLLMRequest("chat_reply", 2*time.Minute, errors.New("timeout"))
+	m.AddLLMTokens("chat_reply", 120, 30)
+	m.SetMCPServicesUp(map[string]bool{"search": true, "files": false})
+	m.SetMCPServicesUp(map[string]bool{"search": true})
+
+	var b strings.Builder
+	if err := m.WriteText(&b); err != nil {
+		t.Fatalf("WriteText error: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE llm_request_duration_seconds histogram\n",
+		`llm_request_duration_seconds_bucket{purpose="chat_reply",result="ok",le="0.25"} 0`,
+		`llm_request_duration_seconds_bucket{purpose="chat_reply",result="ok",le="0.5"} 1`,
+		`llm_request_duration_seconds_bucket{purpose="chat_reply",result="ok",le="5"} 2`,
+		`llm_request_duration_seconds_bucket{purpose="chat_reply",result="ok",le="+Inf"} 2`,
+		`llm_request_duration_seconds_sum{purpose="chat_reply",result="ok"} 3.3`,
+		`llm_request_duration_seconds_bucket{purpose="chat_reply",result="error",le="90"} 0`,
+		`llm_request_duration_seconds_count{purpose="chat_reply",result="error"} 1`,
+		`llm_tokens_total{purpose="chat_reply",kind="prompt"} 120`,
+		`llm_tokens_total{purpose="chat_reply",kind="completion"} 30`,
+		`mcp_service_up{service="search"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `service="files"`) {
+		t.Fatalf("expected dropped service to stop being reported:\n%s", out)
+	}
+}
+
+func TestNilMetricsIsNoop(t *testing.T) {
+	var m *Metrics
+	m.IncTurn(nil)
+	m.IncToolCall("linux__bash", nil)
+	m.ObserveLLMRequest("chat_reply", time.Second, nil)
+	if err := m.WriteText(&strings.Builder{}); err != nil {
+		t.Fatalf("WriteText on nil: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Package redact masks known secret values (API keys, MCP auth tokens) in
+// text before it is persisted, logged or sent back to the model. All methods
+// are safe on a nil *Redactor, which redacts nothing.
+package redact
+
+import (
+	"sort"
+	"strings"
+)
+
+// Mask replaces every occurrence of a secret.
+const Mask = "***"
+
+// minSecretLen skips values too short to mask without mangling ordinary text.
+const minSecretLen = 6
+
+type Redactor struct {
+	secrets func() []string
+}
+
+// New returns a Redactor that asks secrets for the current values on every
+// call, so rotated or newly configured secrets are picked up without a restart.
+func New(secrets func() []string) *Redactor {
+	return &Redactor{secrets: secrets}
+}
+
+// Static returns a Redactor for a fixed set of secrets.
+func Static(secrets ...string) *Redactor {
+	return New(func() []string { return secrets })
+}
+
+// Redact replaces each known secret in text with Mask. Longer secrets are
+// replaced first so one secret containing another is masked as a whole.
+func (r *Redactor) Redact(text string) string {
+	if r == nil || r.secrets == nil || text == "" {
+		return text
+	}
+	values := make([]string, 0, 4)
+	for _, secret := range r.secrets() {
+		if secret = strings.TrimSpace(secret); len(secret) >= minSecretLen {
+			values = append(values, secret)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, secret := range values {
+		text = strings.ReplaceAll(text, secret, Mask)
+	}
+	return text
+}
@@ -0,0 +1,26 @@
+package redact
+
+import "testing"
+
+func TestRedact_MasksConfiguredSecrets(t *testing.T) {
+	token := "tok-abcdef"
+	r := New(func() []string { return []string{"sk-live-123456", token, "abc", ""} })
+
+	got := r.Redact("CERBER_API_KEY=sk-live-123456\nMCP=tok-abcdef-extra short=abc")
+	want := "CERBER_API_KEY=***\nMCP=***-extra short=abc"
+	if got != want {
+		t.Fatalf("Redact() = %q, want %q", got, want)
+	}
+
+	token = "tok-rotated"
+	if got := r.Redact("old tok-abcdef"); got != "old tok-abcdef" {
+		t.Fatalf("expected the secret source to be read on every call, got %q", got)
+	}
+}
+
+func TestRedact_NilRedactorIsNoop(t *testing.T) {
+	var r *Redactor
+	if got := r.Redact("sk-live-123456"); got != "sk-live-123456" {
+		t.Fatalf("nil redactor changed text: %q", got)
+	}
+}
@@ -3,6 +3,7 @@ package skills
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,11 +12,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -24,6 +28,11 @@ const (
 	maxAutoSkillNameRunes   = 24
 	maxAutoSkillPromptRunes = 180
 	builtinSkillSource      = "builtin"
+	autoSkillSource         = "auto-evolved"
+	skillsSHSkillSource     = "skills.sh"
+	gitSkillSource          = "git"
+	maxSkillTags            = 8
+	maxSkillFileBytes       = 256 << 10
 )
 
 var skillsSHSearchEndpoint = "https://skills.sh/api/search"
@@ -49,7 +58,7 @@ var builtinSkills = []Skill{
 		Description: "当用户要求安装/新增/删除/启停 Skill 时使用",
 		Prompt: strings.TrimSpace(
 			"先查现状：用 linux__bash 执行 curl -s http://127.0.0.1:8080/api/skills。\n" +
-				"先搜索候选：GET /api/skills/catalog/search?q=<需求关键词>&limit=8，做模糊匹配并给出候选技能列表。\n" +
+				"先搜索候选：调用内置工具 skills__catalog_search(query=<需求关键词>, limit=8)（不可用时再用 GET /api/skills/catalog/search?q=<需求关键词>&limit=8），做模糊匹配并给出候选技能列表。\n" +
 				"先让用户选定目标 skills.sh 链接并明确确认（例如：确认安装 <url>），未确认不得执行安装或删除。\n" +
 				"skills.sh 安装：POST /settings/skills/install(skills_sh_url)。\n" +
 				"手动新增/更新：POST /settings/skills/save(name,description,prompt,enabled=on)。\n" +
@@ -66,9 +75,17 @@ type Skill struct {
 	Name        string
 	Description string
 	Prompt      string
+	Tags        []string
 	Enabled     bool
 	Source      string
+	SourceURL   string
+	RepoURL     string
+	Ref         string
+	Commit      string
 	UpdatedAt   time.Time
+	// Priority comes from the SKILL.md "priority" field. Higher values win
+	// relevance ties during injection; 0 is the default.
+	Priority int
 }
 
 type CatalogSkill struct {
@@ -83,6 +100,10 @@ type CatalogSkill struct {
 type skillStateRecord struct {
 	Enabled   bool      `json:"enabled"`
 	Source    string    `json:"source,omitempty"`
+	SourceURL string    `json:"source_url,omitempty"`
+	RepoURL   string    `json:"repo_url,omitempty"`
+	Ref       string    `json:"ref,omitempty"`
+	Commit    string    `json:"commit,omitempty"`
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 }
 
@@ -90,12 +111,62 @@ type stateFile struct {
 	Skills map[string]skillStateRecord `json:"skills"`
 }
 
+// SkillLimits bounds the size of manually saved skills so a single pasted
+// prompt cannot bloat every turn.
+type SkillLimits struct {
+	MaxNameRunes        int
+	MaxDescriptionRunes int
+	MaxPromptRunes      int
+}
+
+func DefaultSkillLimits() SkillLimits {
+	return SkillLimits{
+		MaxNameRunes:        64,
+		MaxDescriptionRunes: 140,
+		MaxPromptRunes:      4000,
+	}
+}
+
+// CloneLimits bounds the git clone behind skill installs, updates and
+// previews: Timeout applies to the clone itself, independent of the caller's
+// context, and a clone larger than MaxRepoBytes (working tree plus .git) is
+// rejected.
+type CloneLimits struct {
+	Timeout      time.Duration
+	MaxRepoBytes int64
+}
+
+func DefaultCloneLimits() CloneLimits {
+	return CloneLimits{
+		Timeout:      60 * time.Second,
+		MaxRepoBytes: 50 << 20,
+	}
+}
+
+// DescriptionSummarizer produces a short "when to use" description for a skill.
+type DescriptionSummarizer func(ctx context.Context, name, prompt string) (string, error)
+
 type Store struct {
 	dir       string
 	statePath string
 
-	mu    sync.RWMutex
-	state stateFile
+	mu            sync.RWMutex
+	state         stateFile
+	summarizer    DescriptionSummarizer
+	maxCandidates int
+	limits        SkillLimits
+	cloneLimits   CloneLimits
+
+	// index caches the parsed SKILL.md of each skill so a listing only stats
+	// files that have not changed. It has its own lock because listings run
+	// under mu's read lock.
+	indexMu sync.Mutex
+	index   map[string]skillIndexEntry
+}
+
+type skillIndexEntry struct {
+	info  fs.FileInfo
+	front skillFrontmatter
 }
 
 func NewStore(dir, statePath string) (*Store, error) {
@@ -108,7 +179,7 @@ func NewStore(dir, statePath string) (*Store, error) {
 		return nil, fmt.Errorf("skills state file path is required")
 	}
 
-	s := &Store{dir: dir, statePath: statePath}
+	s := &Store{dir: dir, statePath: statePath, limits: DefaultSkillLimits(), cloneLimits: DefaultCloneLimits()}
 	if err := s.load(); err != nil {
 		return nil, err
 	}
@@ -127,17 +198,102 @@ func (s *Store) ListSkills() []Skill {
 }
 
 func (s *Store) ListEnabledSkillPrompts() []string {
-	skills := s.ListSkills()
+	skills := s.listEnabledSkillCandidates()
 	out := make([]string, 0, len(skills))
 	for _, skill := range skills {
-		if !skill.Enabled {
+		out = append(out, skill.Prompt)
+	}
+	return out
+}
+
+// SetMaxEnabledSkillCandidates caps how many enabled skills are handed to the
+// agent for scoring each turn. Zero means no cap.
+func (s *Store) SetMaxEnabledSkillCandidates(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	s.maxCandidates = n
+}
+
+// listEnabledSkillCandidates returns enabled skills with a prompt. When the
+// candidate cap is exceeded, builtin skills are kept first and the rest are
+// taken by priority, then most recent update.
+func (s *Store) listEnabledSkillCandidates() []Skill {
+	s.mu.RLock()
+	limit := s.maxCandidates
+	s.mu.RUnlock()
+
+	skills := s.ListSkills()
+	out := make([]Skill, 0, len(skills))
+	for _, skill := range skills {
+		skill.Prompt = strings.TrimSpace(skill.Prompt)
+		if !skill.Enabled || skill.Prompt == "" {
 			continue
 		}
+		out = append(out, skill)
+	}
+	if limit <= 0 || len(out) <= limit {
+		return out
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		iBuiltin := out[i].Source == builtinSkillSource
+		jBuiltin := out[j].Source == builtinSkillSource
+		if iBuiltin != jBuiltin {
+			return iBuiltin
+		}
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return out[i].UpdatedAt.After(out[j].UpdatedAt)
+	})
+	out = out[:limit]
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// ListEnabledAutoSkillPrompts returns the enabled prompts that were written by
+// night evolution rather than by hand or installed.
+func (s *Store) ListEnabledAutoSkillPrompts() []string {
+	skills := s.ListSkills()
+	out := make([]string, 0)
+	for _, skill := range skills {
+		if !skill.Enabled || !isAutoSkill(skill) {
+			continue
+		}
+		if prompt := strings.TrimSpace(skill.Prompt); prompt != "" {
+			out = append(out, prompt)
+		}
+	}
+	return out
+}
+
+// ListEnabledSkillPriorities maps each enabled prompt with a non-zero
+// priority to that priority.
+func (s *Store) ListEnabledSkillPriorities() map[string]int {
+	out := make(map[string]int)
+	for _, skill := range s.ListSkills() {
+		prompt := strings.TrimSpace(skill.Prompt)
+		if !skill.Enabled || prompt == "" || skill.Priority == 0 {
+			continue
+		}
+		out[prompt] = skill.Priority
+	}
+	return out
+}
+
+// ListEnabledSkillTags maps each enabled, tagged prompt to its tags.
+func (s *Store) ListEnabledSkillTags() map[string][]string {
+	skills := s.ListSkills()
+	out := make(map[string][]string)
+	for _, skill := range skills {
 		prompt := strings.TrimSpace(skill.Prompt)
-		if prompt == "" {
+		if !skill.Enabled || prompt == "" || len(skill.Tags) == 0 {
 			continue
 		}
-		out = append(out, prompt)
+		out[prompt] = append([]string(nil), skill.Tags...)
 	}
 	return out
 }
@@ -225,12 +381,162 @@ func (s *Store) ReadEnabledSkillPrompt(skillID string) (string, bool) {
 	return markdown, markdown != ""
 }
 
+// ListSkillFiles returns the files of an installed skill as slash-separated
+// paths relative to its directory, SKILL.md included. Hidden directories such
+// as .git are skipped.
+func (s *Store) ListSkillFiles(id string) ([]string, error) {
+	id = strings.TrimSpace(id)
+	if err := validateSkillID(id); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, err := s.skillRootLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, 4)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list skill files: %w", err)
+	}
+	return files, nil
+}
+
+// ReadSkillFile reads a text file bundled with a skill. relPath must stay
+// inside the skill directory, also after symlinks are resolved.
+func (s *Store) ReadSkillFile(id, relPath string) (string, error) {
+	id = strings.TrimSpace(id)
+	if err := validateSkillID(id); err != nil {
+		return "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, err := s.skillRootLocked(id)
+	if err != nil {
+		return "", err
+	}
+	path, err := resolveSkillFilePath(root, relPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("stat skill file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("skill file %q is not a regular file", relPath)
+	}
+	if info.Size() > maxSkillFileBytes {
+		return "", fmt.Errorf("skill file %q is %d bytes, exceeds the %d byte limit", relPath, info.Size(), maxSkillFileBytes)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read skill file: %w", err)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("skill file %q is not UTF-8 text", relPath)
+	}
+	return string(data), nil
+}
+
+func (s *Store) skillRootLocked(id string) (string, error) {
+	root := filepath.Join(s.dir, id)
+	if _, err := os.Stat(filepath.Join(root, "SKILL.md")); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("skill %q not found", id)
+		}
+		return "", fmt.Errorf("read skill: %w", err)
+	}
+	return root, nil
+}
+
+// SetCloneLimits replaces the clone bounds; zero fields keep the defaults.
+func (s *Store) SetCloneLimits(limits CloneLimits) {
+	defaults := DefaultCloneLimits()
+	if limits.Timeout <= 0 {
+		limits.Timeout = defaults.Timeout
+	}
+	if limits.MaxRepoBytes <= 0 {
+		limits.MaxRepoBytes = defaults.MaxRepoBytes
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cloneLimits = limits
+}
+
+// SetSkillLimits replaces the length limits for manual saves. Non-positive
+// fields keep their defaults.
+func (s *Store) SetSkillLimits(limits SkillLimits) {
+	defaults := DefaultSkillLimits()
+	if limits.MaxNameRunes <= 0 {
+		limits.MaxNameRunes = defaults.MaxNameRunes
+	}
+	if limits.MaxDescriptionRunes <= 0 {
+		limits.MaxDescriptionRunes = defaults.MaxDescriptionRunes
+	}
+	if limits.MaxPromptRunes <= 0 {
+		limits.MaxPromptRunes = defaults.MaxPromptRunes
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+}
+
 func (s *Store) UpsertSkill(skill Skill) error {
+	skill = normalizeSkillText(skill)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := validateSkillLength(skill, s.limits); err != nil {
+		return err
+	}
+	return s.upsertSkillLocked(skill)
+}
+
+// ImportSkill saves skill like UpsertSkill but without the manual-save length
+// limits, for skills carried over from older versions that had none.
+func (s *Store) ImportSkill(skill Skill) error {
+	skill = normalizeSkillText(skill)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.upsertSkillLocked(skill)
 }
 
+func normalizeSkillText(skill Skill) Skill {
+	skill.Name = strings.Join(strings.Fields(skill.Name), " ")
+	skill.Description = strings.Join(strings.Fields(skill.Description), " ")
+	skill.Prompt = normalizeSkillPrompt(skill.Prompt)
+	return skill
+}
+
 func (s *Store) upsertSkillLocked(skill Skill) error {
 	skills, err := s.listSkillsLocked()
 	if err != nil {
@@ -267,7 +573,7 @@ func (s *Store) upsertSkillLocked(skill Skill) error {
 	if err := os.MkdirAll(dirPath, 0o755); err != nil {
 		return fmt.Errorf("create skill dir: %w", err)
 	}
-	if err := os.WriteFile(filepath.Join(dirPath, "SKILL.md"), []byte(markdown+"\n"), 0o600); err != nil {
+	if err := writeFileAtomic(filepath.Join(dirPath, "SKILL.md"), []byte(markdown+"\n")); err != nil {
 		return fmt.Errorf("write skill file: %w", err)
 	}
 
@@ -320,6 +626,91 @@ func (s *Store) SetSkillEnabled(id string, enabled bool) error {
 	return s.persistLocked()
 }
 
+// SetAllEnabled enables or disables every installed skill, builtins included.
+func (s *Store) SetAllEnabled(enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setEnabledLocked(func(Skill) bool { return enabled })
+}
+
+// DisableAllNonBuiltin disables every skill whose Source is not "builtin" and
+// makes sure the builtin config-maintainer skills are enabled.
+func (s *Store) DisableAllNonBuiltin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setEnabledLocked(func(skill Skill) bool { return skill.Source == builtinSkillSource })
+}
+
+func (s *Store) setEnabledLocked(enabledFor func(Skill) bool) error {
+	skills, err := s.listSkillsLocked()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, skill := range skills {
+		enabled := enabledFor(skill)
+		record, ok := s.state.Skills[skill.ID]
+		if ok && record.Enabled == enabled {
+			continue
+		}
+		record.Enabled = enabled
+		record.UpdatedAt = now
+		s.state.Skills[skill.ID] = record
+	}
+	return s.persistLocked()
+}
+
+// ReindexResult reports how the state file changed after a reindex.
+type ReindexResult struct {
+	Added   int
+	Removed int
+	Total   int
+}
+
+// Reindex re-reads the skills directory and re-syncs the state file: records
+// whose SKILL.md vanished are dropped and newly found dirs are added as enabled.
+func (s *Store) Reindex() (ReindexResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skills, err := s.listSkillsLocked()
+	if err != nil {
+		return ReindexResult{}, err
+	}
+	if s.state.Skills == nil {
+		s.state.Skills = map[string]skillStateRecord{}
+	}
+
+	result := ReindexResult{Total: len(skills)}
+	present := make(map[string]struct{}, len(skills))
+	for _, skill := range skills {
+		present[skill.ID] = struct{}{}
+		if _, exists := s.state.Skills[skill.ID]; exists {
+			continue
+		}
+		s.state.Skills[skill.ID] = skillStateRecord{
+			Enabled:   true,
+			UpdatedAt: time.Now(),
+		}
+		result.Added++
+	}
+	for id := range s.state.Skills {
+		if _, ok := present[id]; ok {
+			continue
+		}
+		delete(s.state.Skills, id)
+		result.Removed++
+	}
+
+	if result.Added == 0 && result.Removed == 0 {
+		return result, nil
+	}
+	if err := s.persistLocked(); err != nil {
+		return ReindexResult{}, err
+	}
+	return result, nil
+}
+
 func (s *Store) UpsertAutoSkill(name, prompt string) error {
 	name = trimSkillText(name, maxAutoSkillNameRunes)
 	prompt = trimSkillText(prompt, maxAutoSkillPromptRunes)
@@ -349,7 +740,7 @@ func (s *Store) UpsertAutoSkill(name, prompt string) error {
 		Description: normalizeSkillDescription("", name, prompt),
 		Prompt:      prompt,
 		Enabled:     true,
-		Source:      "auto-evolved",
+		Source:      autoSkillSource,
 	}); err != nil {
 		return err
 	}
@@ -358,34 +749,241 @@ func (s *Store) UpsertAutoSkill(name, prompt string) error {
 	return s.persistLocked()
 }
 
-func (s *Store) InstallFromSkillsSH(ctx context.Context, rawURL string) (Skill, error) {
+func (s *Store) SetDescriptionSummarizer(fn DescriptionSummarizer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summarizer = fn
+}
+
+// RegenerateDescription rewrites the description in a skill's SKILL.md frontmatter.
+// It uses the configured summarizer when available and falls back to deriving
+// the description from the prompt. Other frontmatter fields are preserved.
+func (s *Store) RegenerateDescription(ctx context.Context, id string) (Skill, error) {
+	id = strings.TrimSpace(id)
+	if err := validateSkillID(id); err != nil {
+		return Skill{}, err
+	}
+
+	s.mu.RLock()
+	skillPath := filepath.Join(s.dir, id, "SKILL.md")
+	data, err := os.ReadFile(skillPath)
+	summarizer := s.summarizer
+	s.mu.RUnlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Skill{}, fmt.Errorf("skill %q not found", id)
+		}
+		return Skill{}, fmt.Errorf("read skill: %w", err)
+	}
+	name, _, prompt, _ := parseSkillMarkdown(string(data))
+	if strings.TrimSpace(name) == "" {
+		name = id
+	}
+	if strings.TrimSpace(prompt) == "" {
+		return Skill{}, fmt.Errorf("skill prompt is required")
+	}
+
+	// The summarizer may be a slow LLM call, so it runs without holding the lock.
+	description := ""
+	if summarizer != nil {
+		if generated, err := summarizer(ctx, name, prompt); err == nil {
+			description = strings.TrimSpace(generated)
+		}
+	}
+	description = normalizeSkillDescription(description, name, prompt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err = os.ReadFile(skillPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Skill{}, fmt.Errorf("skill %q not found", id)
+		}
+		return Skill{}, fmt.Errorf("read skill: %w", err)
+	}
+	markdown := setSkillMarkdownField(string(data), "name", name)
+	markdown = setSkillMarkdownField(markdown, "description", description)
+	if err := writeFileAtomic(skillPath, []byte(markdown+"\n")); err != nil {
+		return Skill{}, fmt.Errorf("write skill file: %w", err)
+	}
+
+	record, exists := s.state.Skills[id]
+	if !exists {
+		record.Enabled = true
+	}
+	record.UpdatedAt = time.Now()
+	s.state.Skills[id] = record
+	if err := s.persistLocked(); err != nil {
+		return Skill{}, err
+	}
+
+	skills, err := s.listSkillsLocked()
+	if err != nil {
+		return Skill{}, err
+	}
+	for _, skill := range skills {
+		if skill.ID == id {
+			return skill, nil
+		}
+	}
+	return Skill{}, fmt.Errorf("skill %q not found", id)
+}
+
+// InstallFromSkillsSH installs a skill from a skills.sh page URL. ref optionally
+// pins a branch, tag or commit; empty means the default branch.
+func (s *Store) InstallFromSkillsSH(ctx context.Context, rawURL, ref string) (Skill, error) {
 	rawURL = strings.TrimSpace(rawURL)
+	repoURL, skillID, err := parseSkillsSHURL(rawURL)
+	if err != nil {
+		return Skill{}, err
+	}
+	return s.installFromRepo(ctx, repoURL, skillID, skillsSHSkillSource, rawURL, ref)
+}
+
+// PreviewFromSkillsSH clones the skill behind a skills.sh page URL into a
+// temp dir and returns its parsed SKILL.md. Nothing is written to the skills
+// dir or the state file.
+func (s *Store) PreviewFromSkillsSH(ctx context.Context, rawURL string) (Skill, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	repoURL, skillID, err := parseSkillsSHURL(rawURL)
+	if err != nil {
+		return Skill{}, err
+	}
+	return s.previewFromRepo(ctx, repoURL, skillID, skillsSHSkillSource, rawURL)
+}
+
+// parseSkillsSHURL maps https://skills.sh/{owner}/{repo}/{skill} to the
+// GitHub clone URL and the skill id.
+func parseSkillsSHURL(rawURL string) (repoURL, skillID string, err error) {
 	if rawURL == "" {
-		return Skill{}, fmt.Errorf("skills.sh url is required")
+		return "", "", fmt.Errorf("skills.sh url is required")
 	}
 
 	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		return Skill{}, fmt.Errorf("invalid skills.sh url: %w", err)
+		return "", "", fmt.Errorf("invalid skills.sh url: %w", err)
 	}
 	host := strings.ToLower(strings.TrimSpace(parsed.Host))
 	if host != "skills.sh" && host != "www.skills.sh" {
-		return Skill{}, fmt.Errorf("url host must be skills.sh")
+		return "", "", fmt.Errorf("url host must be skills.sh")
 	}
 
 	segments := splitPathSegments(parsed.Path)
 	if len(segments) < 3 {
-		return Skill{}, fmt.Errorf("skills.sh url must be /{owner}/{repo}/{skill}")
+		return "", "", fmt.Errorf("skills.sh url must be /{owner}/{repo}/{skill}")
 	}
-	owner := segments[0]
-	repo := segments[1]
-	skillID := sanitizeIdentifier(segments[2])
+	skillID = sanitizeIdentifier(segments[2])
 	if skillID == "" {
-		return Skill{}, fmt.Errorf("invalid skill id from url")
+		return "", "", fmt.Errorf("invalid skill id from url")
+	}
+	return fmt.Sprintf("https://github.com/%s/%s.git", segments[0], segments[1]), skillID, nil
+}
+
+// InstallFromGitRepo installs skillID from any git-cloneable https, git or
+// ssh URL (including scp-style git@host:path). The repo URL is recorded as the
+// skill source URL; ref optionally pins a branch, tag or commit.
+func (s *Store) InstallFromGitRepo(ctx context.Context, repoURL, skillID, ref string) (Skill, error) {
+	repoURL = strings.TrimSpace(repoURL)
+	if err := validateGitRepoURL(repoURL); err != nil {
+		return Skill{}, err
+	}
+	id := sanitizeIdentifier(skillID)
+	if id == "" {
+		return Skill{}, fmt.Errorf("invalid skill id")
+	}
+	return s.installFromRepo(ctx, repoURL, id, gitSkillSource, repoURL, ref)
+}
+
+// UpdateSkill re-clones the recorded repo URL and ref of an installed skill
+// and overwrites its directory, keeping the enabled state.
+func (s *Store) UpdateSkill(ctx context.Context, id string) (Skill, error) {
+	id = strings.TrimSpace(id)
+	if err := validateSkillID(id); err != nil {
+		return Skill{}, err
+	}
+
+	s.mu.RLock()
+	record, exists := s.state.Skills[id]
+	s.mu.RUnlock()
+	if !exists {
+		return Skill{}, fmt.Errorf("skill %q not found", id)
 	}
+	if strings.TrimSpace(record.RepoURL) == "" {
+		return Skill{}, fmt.Errorf("skill %q has no recorded git source; only installed skills can be updated", id)
+	}
+	return s.syncFromRepo(ctx, record.RepoURL, id, record.Source, record.SourceURL, record.Ref, record.Enabled)
+}
 
-	repoURL := fmt.Sprintf("https://github.com/%s/%s.git", owner, repo)
-	return s.installFromRepo(ctx, repoURL, skillID, rawURL)
+// SkillMatch is an installed skill ranked against a search query.
+type SkillMatch struct {
+	Skill Skill
+	Score int
+}
+
+// SearchInstalledSkills ranks local skills by keyword hits. Each query term
+// scores highest in the name or tags, then the description, then the prompt.
+func (s *Store) SearchInstalledSkills(query string, limit int) ([]SkillMatch, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+	if limit <= 0 {
+		limit = 8
+	}
+	if limit > 50 {
+		limit = 50
+	}
+
+	terms := strings.Fields(query)
+	out := make([]SkillMatch, 0)
+	for _, skill := range s.ListSkills() {
+		if score := scoreInstalledSkill(skill, query, terms); score > 0 {
+			out = append(out, SkillMatch{Skill: skill, Score: score})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Skill.ID < out[j].Skill.ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func scoreInstalledSkill(skill Skill, query string, terms []string) int {
+	name := strings.ToLower(skill.Name + " " + skill.ID)
+	description := strings.ToLower(skill.Description)
+	prompt := strings.ToLower(skill.Prompt)
+
+	score := 0
+	for _, term := range terms {
+		if strings.Contains(name, term) || containsFold(skill.Tags, term) {
+			score += 6
+		}
+		if strings.Contains(description, term) {
+			score += 3
+		}
+		if hits := strings.Count(prompt, term); hits > 0 {
+			score += min(hits, 3)
+		}
+	}
+	if len(terms) > 1 && (strings.Contains(name, query) || strings.Contains(description, query) || strings.Contains(prompt, query)) {
+		score += 4
+	}
+	return score
+}
+
+func containsFold(items []string, target string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, target) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Store) SearchSkillsCatalog(ctx context.Context, query string, limit int) ([]CatalogSkill, error) {
@@ -459,35 +1057,118 @@ func (s *Store) SearchSkillsCatalog(ctx context.Context, query string, limit int
 	return out, nil
 }
 
-func (s *Store) installFromRepo(ctx context.Context, repoURL, skillID, source string) (Skill, error) {
-	repoURL = strings.TrimSpace(repoURL)
+func (s *Store) installFromRepo(ctx context.Context, repoURL, skillID, source, sourceURL, ref string) (Skill, error) {
+	return s.syncFromRepo(ctx, repoURL, skillID, source, sourceURL, ref, true)
+}
+
+// previewFromRepo reads skillID's SKILL.md from a temporary clone.
+func (s *Store) previewFromRepo(ctx context.Context, repoURL, skillID, source, sourceURL string) (Skill, error) {
 	skillID = sanitizeIdentifier(skillID)
-	if repoURL == "" || skillID == "" {
-		return Skill{}, fmt.Errorf("repo url and skill id are required")
+	srcDir, commit, cleanup, err := s.cloneSkillDir(ctx, repoURL, skillID, "")
+	if err != nil {
+		return Skill{}, err
 	}
+	defer cleanup()
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(srcDir, "SKILL.md"))
+	if err != nil {
+		return Skill{}, fmt.Errorf("read skill file: %w", err)
+	}
+	front := parseSkillFrontmatter(string(data))
+	name := front.Name
+	if name == "" {
+		name = skillID
+	}
+	return Skill{
+		ID:          skillID,
+		Name:        name,
+		Description: normalizeSkillDescription(front.Description, name, front.Prompt),
+		Prompt:      front.Prompt,
+		Tags:        front.Tags,
+		Priority:    front.Priority,
+		Source:      source,
+		SourceURL:   strings.TrimSpace(sourceURL),
+		RepoURL:     strings.TrimSpace(repoURL),
+		Commit:      commit,
+	}, nil
+}
+
+// cloneSkillDir clones repoURL at ref into a temp dir and locates skillID's
+// directory in it. cleanup removes the temp dir and must be called once err
+// is nil; on error the temp dir is already gone.
+func (s *Store) cloneSkillDir(ctx context.Context, repoURL, skillID, ref string) (srcDir, commit string, cleanup func(), err error) {
+	repoURL = strings.TrimSpace(repoURL)
+	ref = strings.TrimSpace(ref)
+	if repoURL == "" || skillID == "" {
+		return "", "", nil, fmt.Errorf("repo url and skill id are required")
+	}
+	if strings.HasPrefix(repoURL, "-") {
+		return "", "", nil, fmt.Errorf("invalid git repo url %q", repoURL)
+	}
+	if strings.HasPrefix(ref, "-") {
+		return "", "", nil, fmt.Errorf("invalid git ref %q", ref)
+	}
 
 	tmpRoot, err := os.MkdirTemp("", "skills-install-*")
 	if err != nil {
-		return Skill{}, fmt.Errorf("create temp dir: %w", err)
+		return "", "", nil, fmt.Errorf("create temp dir: %w", err)
 	}
-	defer os.RemoveAll(tmpRoot)
+	removeTmp := func() { _ = os.RemoveAll(tmpRoot) }
+	defer func() {
+		if err != nil {
+			removeTmp()
+		}
+	}()
+
+	s.mu.RLock()
+	limits := s.cloneLimits
+	s.mu.RUnlock()
+	cloneCtx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
 
 	repoPath := filepath.Join(tmpRoot, "repo")
-	cmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", repoURL, repoPath)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return Skill{}, fmt.Errorf("clone repo failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	if err := cloneRepoAtRef(cloneCtx, repoURL, ref, repoPath); err != nil {
+		if errors.Is(cloneCtx.Err(), context.DeadlineExceeded) {
+			return "", "", nil, fmt.Errorf("clone repo timed out after %s", limits.Timeout)
+		}
+		return "", "", nil, err
+	}
+	size, err := dirSize(repoPath)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("measure cloned repo: %w", err)
+	}
+	if size > limits.MaxRepoBytes {
+		return "", "", nil, fmt.Errorf("cloned repo is %d bytes, exceeds the %d byte limit", size, limits.MaxRepoBytes)
+	}
+	if out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "HEAD").Output(); err == nil {
+		commit = strings.TrimSpace(string(out))
 	}
 
-	srcDir, err := findSkillDir(repoPath, skillID)
+	srcDir, err = findSkillDir(repoPath, skillID)
 	if err != nil {
-		return Skill{}, err
+		return "", "", nil, err
 	}
 	if _, err := os.Stat(filepath.Join(srcDir, "SKILL.md")); err != nil {
-		return Skill{}, fmt.Errorf("skill file not found in repo: %w", err)
+		return "", "", nil, fmt.Errorf("skill file not found in repo: %w", err)
+	}
+	return srcDir, commit, removeTmp, nil
+}
+
+func (s *Store) syncFromRepo(ctx context.Context, repoURL, skillID, source, sourceURL, ref string, enabled bool) (Skill, error) {
+	repoURL = strings.TrimSpace(repoURL)
+	skillID = sanitizeIdentifier(skillID)
+	ref = strings.TrimSpace(ref)
+
+	// Cloning can take a while, so it runs before the lock is taken and
+	// readers keep seeing the previous skill until the swap below.
+	srcDir, commit, cleanup, err := s.cloneSkillDir(ctx, repoURL, skillID, ref)
+	if err != nil {
+		return Skill{}, err
 	}
+	defer cleanup()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	dstDir := filepath.Join(s.dir, skillID)
 	if err := os.RemoveAll(dstDir); err != nil {
@@ -498,8 +1179,12 @@ func (s *Store) installFromRepo(ctx context.Context, repoURL, skillID, source st
 	}
 
 	record := s.state.Skills[skillID]
-	record.Enabled = true
+	record.Enabled = enabled
 	record.Source = strings.TrimSpace(source)
+	record.SourceURL = strings.TrimSpace(sourceURL)
+	record.RepoURL = repoURL
+	record.Ref = ref
+	record.Commit = commit
 	record.UpdatedAt = time.Now()
 	s.state.Skills[skillID] = record
 	if err := s.persistLocked(); err != nil {
@@ -518,6 +1203,35 @@ func (s *Store) installFromRepo(ctx context.Context, repoURL, skillID, source st
 	return Skill{}, fmt.Errorf("installed skill %q not found", skillID)
 }
 
+// cloneRepoAtRef shallow-clones the default branch, or the given branch/tag.
+// Refs that cannot be cloned directly (e.g. commit hashes) fall back to a full
+// clone followed by a checkout.
+func cloneRepoAtRef(ctx context.Context, repoURL, ref, dst string) error {
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", repoURL, dst)
+	out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ref == "" {
+		return fmt.Errorf("clone repo failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+
+	if err := os.RemoveAll(dst); err != nil {
+		return fmt.Errorf("clear partial clone: %w", err)
+	}
+	if out, err := exec.CommandContext(ctx, "git", "clone", "--", repoURL, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("clone repo failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.CommandContext(ctx, "git", "-C", dst, "checkout", "--detach", ref).CombinedOutput(); err != nil {
+		return fmt.Errorf("checkout ref %q failed: %v (%s)", ref, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func (s *Store) load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -550,8 +1264,39 @@ func (s *Store) load() error {
 	if parsed.Skills == nil {
 		parsed.Skills = map[string]skillStateRecord{}
 	}
+	migrated := false
+	for id, record := range parsed.Skills {
+		if next, ok := migrateSourceURL(record); ok {
+			parsed.Skills[id] = next
+			migrated = true
+		}
+	}
 	s.state = parsed
-	return s.ensureBuiltinSkillsLocked()
+	if err := s.ensureBuiltinSkillsLocked(); err != nil {
+		return err
+	}
+	if migrated {
+		return s.persistLocked()
+	}
+	return nil
+}
+
+// migrateSourceURL splits records written before source kinds existed, when
+// the install URL itself was stored as the source.
+func migrateSourceURL(record skillStateRecord) (skillStateRecord, bool) {
+	source := strings.TrimSpace(record.Source)
+	if record.SourceURL != "" || (!strings.Contains(source, "://") && !strings.HasPrefix(source, "git@")) {
+		return record, false
+	}
+	record.SourceURL = source
+	record.Source = gitSkillSource
+	if parsed, err := url.Parse(source); err == nil {
+		host := strings.ToLower(parsed.Host)
+		if host == "skills.sh" || host == "www.skills.sh" {
+			record.Source = skillsSHSkillSource
+		}
+	}
+	return record, true
 }
 
 func (s *Store) persistLocked() error {
@@ -576,6 +1321,20 @@ func (s *Store) persistLocked() error {
 	return nil
 }
 
+func isVanishedPath(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// writeFileAtomic replaces path via a temp file and rename so readers never
+// observe a truncated SKILL.md.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 func (s *Store) ensureBuiltinSkillsLocked() error {
 	if s.state.Skills == nil {
 		s.state.Skills = map[string]skillStateRecord{}
@@ -619,7 +1378,7 @@ func (s *Store) ensureBuiltinSkillsLocked() error {
 			changed = true
 		}
 		if shouldWriteFile {
-			if err := os.WriteFile(skillPath, []byte(renderSkillMarkdown(builtin)+"\n"), 0o600); err != nil {
+			if err := writeFileAtomic(skillPath, []byte(renderSkillMarkdown(builtin)+"\n")); err != nil {
 				return fmt.Errorf("write builtin skill %q: %w", id, err)
 			}
 			changed = true
@@ -648,15 +1407,17 @@ func (s *Store) listSkillsLocked() ([]Skill, error) {
 			continue
 		}
 		skillPath := filepath.Join(s.dir, skillID, "SKILL.md")
-		data, err := os.ReadFile(skillPath)
+		front, info, err := s.readSkillIndex(skillPath)
 		if err != nil {
-			if os.IsNotExist(err) {
+			// The directory may vanish between ReadDir and ReadFile when it is
+			// removed outside the store; treat that as already gone.
+			if isVanishedPath(err) {
 				continue
 			}
 			return nil, fmt.Errorf("read %s: %w", skillPath, err)
 		}
 
-		name, description, prompt := parseSkillMarkdown(string(data))
+		name, description, prompt := front.Name, front.Description, front.Prompt
 		if strings.TrimSpace(name) == "" {
 			name = skillID
 		}
@@ -669,9 +1430,7 @@ func (s *Store) listSkillsLocked() ([]Skill, error) {
 		}
 		updatedAt := record.UpdatedAt
 		if updatedAt.IsZero() {
-			if info, statErr := os.Stat(skillPath); statErr == nil {
-				updatedAt = info.ModTime()
-			}
+			updatedAt = info.ModTime()
 		}
 
 		out = append(out, Skill{
@@ -679,8 +1438,14 @@ func (s *Store) listSkillsLocked() ([]Skill, error) {
 			Name:        strings.TrimSpace(name),
 			Description: strings.TrimSpace(description),
 			Prompt:      strings.TrimSpace(prompt),
+			Tags:        append([]string(nil), front.Tags...),
+			Priority:    front.Priority,
 			Enabled:     enabled,
 			Source:      strings.TrimSpace(record.Source),
+			SourceURL:   record.SourceURL,
+			RepoURL:     record.RepoURL,
+			Ref:         record.Ref,
+			Commit:      record.Commit,
 			UpdatedAt:   updatedAt,
 		})
 	}
@@ -689,6 +1454,36 @@ func (s *Store) listSkillsLocked() ([]Skill, error) {
 	return out, nil
 }
 
+// readSkillIndex returns the parsed frontmatter of skillPath, reading the
+// file only when it was replaced or changed since the last call. Every store
+// write renames a new file into place, so os.SameFile catches those even
+// within one mtime tick.
+func (s *Store) readSkillIndex(skillPath string) (skillFrontmatter, fs.FileInfo, error) {
+	info, err := os.Stat(skillPath)
+	if err != nil {
+		return skillFrontmatter{}, nil, err
+	}
+	s.indexMu.Lock()
+	cached, ok := s.index[skillPath]
+	s.indexMu.Unlock()
+	if ok && os.SameFile(cached.info, info) && cached.info.ModTime().Equal(info.ModTime()) && cached.info.Size() == info.Size() {
+		return cached.front, info, nil
+	}
+
+	data, err := os.ReadFile(skillPath)
+	if err != nil {
+		return skillFrontmatter{}, nil, err
+	}
+	front := parseSkillFrontmatter(string(data))
+	s.indexMu.Lock()
+	if s.index == nil {
+		s.index = make(map[string]skillIndexEntry)
+	}
+	s.index[skillPath] = skillIndexEntry{info: info, front: front}
+	s.indexMu.Unlock()
+	return front, info, nil
+}
+
 func (s *Store) trimAutoSkillsLocked(limit int) {
 	skills, err := s.listSkillsLocked()
 	if err != nil {
@@ -696,7 +1491,7 @@ func (s *Store) trimAutoSkillsLocked(limit int) {
 	}
 	autos := make([]Skill, 0)
 	for _, skill := range skills {
-		if strings.HasPrefix(strings.TrimSpace(skill.ID), autoSkillIDPrefix) {
+		if isAutoSkill(skill) {
 			autos = append(autos, skill)
 		}
 	}
@@ -719,47 +1514,113 @@ func (s *Store) trimAutoSkillsLocked(limit int) {
 	}
 }
 
-func parseSkillMarkdown(markdown string) (name, description, prompt string) {
+func parseSkillMarkdown(markdown string) (name, description, prompt string, tags []string) {
+	front := parseSkillFrontmatter(markdown)
+	return front.Name, front.Description, front.Prompt, front.Tags
+}
+
+type skillFrontmatter struct {
+	Name        string
+	Description string
+	Prompt      string
+	Tags        []string
+	Priority    int
+}
+
+func parseSkillFrontmatter(markdown string) skillFrontmatter {
 	text := strings.TrimSpace(strings.ReplaceAll(markdown, "\r\n", "\n"))
 	if text == "" {
-		return "", "", ""
+		return skillFrontmatter{}
 	}
 	if !strings.HasPrefix(text, "---\n") {
-		return "", "", text
+		return skillFrontmatter{Prompt: text}
 	}
 
 	rest := strings.TrimPrefix(text, "---\n")
 	idx := strings.Index(rest, "\n---\n")
 	if idx < 0 {
-		return "", "", text
+		return skillFrontmatter{Prompt: text}
 	}
 	header := rest[:idx]
 	body := strings.TrimSpace(rest[idx+5:])
 
+	var name, description string
+	var tags []string
+	priority := 0
+	inTagList := false
 	for _, line := range strings.Split(header, "\n") {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
+		if inTagList && strings.HasPrefix(line, "-") {
+			tags = append(tags, unquoteYAMLValue(strings.TrimSpace(strings.TrimPrefix(line, "-"))))
+			continue
+		}
+		inTagList = false
 		parts := strings.SplitN(line, ":", 2)
 		if len(parts) != 2 {
 			continue
 		}
 		key := strings.ToLower(strings.TrimSpace(parts[0]))
-		value := strings.TrimSpace(parts[1])
-		if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-			if unquoted, err := strconv.Unquote(value); err == nil {
-				value = unquoted
-			}
-		}
+		value := unquoteYAMLValue(strings.TrimSpace(parts[1]))
 		switch key {
 		case "name":
 			name = value
 		case "description":
 			description = value
+		case "tags":
+			if value == "" {
+				inTagList = true
+				continue
+			}
+			tags = append(tags, strings.Split(strings.Trim(value, "[]"), ",")...)
+		case "priority":
+			if n, err := strconv.Atoi(value); err == nil {
+				priority = n
+			}
+		}
+	}
+	return skillFrontmatter{
+		Name:        strings.TrimSpace(name),
+		Description: strings.TrimSpace(description),
+		Prompt:      body,
+		Tags:        normalizeSkillTags(tags),
+		Priority:    priority,
+	}
+}
+
+func unquoteYAMLValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
 		}
 	}
-	return strings.TrimSpace(name), strings.TrimSpace(description), body
+	return value
+}
+
+// normalizeSkillTags lowercases, trims and dedupes tags, keeping their order.
+func normalizeSkillTags(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(unquoteYAMLValue(strings.TrimSpace(tag))))
+		if tag == "" {
+			continue
+		}
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		out = append(out, tag)
+		if len(out) >= maxSkillTags {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
 }
 
 func renderSkillMarkdown(skill Skill) string {
@@ -768,19 +1629,86 @@ func renderSkillMarkdown(skill Skill) string {
 		name = strings.TrimSpace(skill.ID)
 	}
 	description := normalizeSkillDescription(skill.Description, name, skill.Prompt)
+	tagsLine := ""
+	if tags := normalizeSkillTags(skill.Tags); len(tags) > 0 {
+		tagsLine = "tags: [" + strings.Join(tags, ", ") + "]\n"
+	}
+	if skill.Priority != 0 {
+		tagsLine += "priority: " + strconv.Itoa(skill.Priority) + "\n"
+	}
 	return strings.TrimSpace(
 		"---\n" +
 			"name: " + quoteYAMLString(name) + "\n" +
 			"description: " + quoteYAMLString(description) + "\n" +
+			tagsLine +
 			"---\n\n" +
 			strings.TrimSpace(skill.Prompt),
 	)
 }
 
+// setSkillMarkdownField sets one frontmatter key, adding frontmatter if missing.
+func setSkillMarkdownField(markdown, key, value string) string {
+	text := strings.TrimSpace(strings.ReplaceAll(markdown, "\r\n", "\n"))
+	line := key + ": " + quoteYAMLString(value)
+	if !strings.HasPrefix(text, "---\n") {
+		return "---\n" + line + "\n---\n\n" + text
+	}
+	rest := strings.TrimPrefix(text, "---\n")
+	idx := strings.Index(rest, "\n---\n")
+	if idx < 0 {
+		return "---\n" + line + "\n---\n\n" + text
+	}
+	header := strings.Split(rest[:idx], "\n")
+	replaced := false
+	for i, raw := range header {
+		parts := strings.SplitN(raw, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), key) {
+			header[i] = line
+			replaced = true
+		}
+	}
+	if !replaced {
+		header = append(header, line)
+	}
+	return "---\n" + strings.Join(header, "\n") + rest[idx:]
+}
+
 func quoteYAMLString(v string) string {
 	return strconv.Quote(strings.TrimSpace(strings.ReplaceAll(v, "\n", " ")))
 }
 
+var scpLikeGitURLPattern = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*@[A-Za-z0-9.-]+:[^/].*$`)
+
+func validateGitRepoURL(repoURL string) error {
+	if repoURL == "" {
+		return fmt.Errorf("git repo url is required")
+	}
+	// git would read a leading "-" as an option.
+	if strings.HasPrefix(repoURL, "-") {
+		return fmt.Errorf("git repo url must not start with \"-\"")
+	}
+	if scpLikeGitURLPattern.MatchString(repoURL) {
+		return nil
+	}
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return fmt.Errorf("invalid git repo url: %w", err)
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "https", "git", "ssh":
+	default:
+		return fmt.Errorf("git repo url scheme must be https, git or ssh")
+	}
+	if strings.TrimSpace(parsed.Host) == "" {
+		return fmt.Errorf("git repo url host is required")
+	}
+	return nil
+}
+
+func isAutoSkill(skill Skill) bool {
+	return skill.Source == autoSkillSource || strings.HasPrefix(strings.TrimSpace(skill.ID), autoSkillIDPrefix)
+}
+
 func validateSkillID(id string) error {
 	id = strings.TrimSpace(id)
 	if id == "" {
@@ -927,6 +1855,41 @@ func trimSkillText(v string, max int) string {
 	return strings.TrimSpace(string(runes[:max-3])) + "..."
 }
 
+func validateSkillLength(skill Skill, limits SkillLimits) error {
+	if n := utf8.RuneCountInString(skill.Name); n > limits.MaxNameRunes {
+		return fmt.Errorf("skill name is too long: %d chars (max %d)", n, limits.MaxNameRunes)
+	}
+	if n := utf8.RuneCountInString(skill.Description); n > limits.MaxDescriptionRunes {
+		return fmt.Errorf("skill description is too long: %d chars (max %d)", n, limits.MaxDescriptionRunes)
+	}
+	if n := utf8.RuneCountInString(skill.Prompt); n > limits.MaxPromptRunes {
+		return fmt.Errorf("skill prompt is too long: %d chars (max %d)", n, limits.MaxPromptRunes)
+	}
+	return nil
+}
+
+// normalizeSkillPrompt unifies line endings, strips trailing spaces and
+// collapses runs of blank lines.
+func normalizeSkillPrompt(prompt string) string {
+	prompt = strings.ReplaceAll(prompt, "\r\n", "\n")
+	lines := strings.Split(prompt, "\n")
+	out := make([]string, 0, len(lines))
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
 func normalizeSkillDescription(description, name, prompt string) string {
 	description = strings.TrimSpace(strings.ReplaceAll(description, "\n", " "))
 	if description != "" {
@@ -967,7 +1930,7 @@ func findSkillDir(repoPath, skillID string) (string, error) {
 		filepath.Join(repoPath, skillID),
 	}
 	for _, dir := range candidates {
-		if stat, err := os.Stat(filepath.Join(dir, "SKILL.md")); err == nil && !stat.IsDir() {
+		if isRepoSkillDir(repoPath, dir) {
 			return dir, nil
 		}
 	}
@@ -984,7 +1947,7 @@ func findSkillDir(repoPath, skillID string) (string, error) {
 		if filepath.Base(path) != skillID {
 			return nil
 		}
-		if _, err := os.Stat(filepath.Join(path, "SKILL.md")); err != nil {
+		if !isRepoSkillDir(repoPath, path) {
 			return nil
 		}
 		rel, relErr := filepath.Rel(repoPath, path)
@@ -1007,6 +1970,86 @@ func findSkillDir(repoPath, skillID string) (string, error) {
 	return best, nil
 }
 
+// resolveSkillFilePath maps a slash-separated relative path to a file under
+// root, rejecting absolute paths and anything that resolves outside root.
+func resolveSkillFilePath(root, relPath string) (string, error) {
+	relPath = strings.TrimSpace(relPath)
+	if relPath == "" {
+		return "", fmt.Errorf("file path is required")
+	}
+	if strings.HasPrefix(relPath, "/") || filepath.IsAbs(relPath) {
+		return "", fmt.Errorf("file path must be relative to the skill directory")
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(relPath))
+	if escapesDir(cleaned) {
+		return "", fmt.Errorf("file path %q escapes the skill directory", relPath)
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("resolve skill dir: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(resolvedRoot, cleaned))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("skill file %q not found", relPath)
+		}
+		return "", fmt.Errorf("resolve skill file: %w", err)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || escapesDir(rel) {
+		return "", fmt.Errorf("file path %q escapes the skill directory", relPath)
+	}
+	return resolved, nil
+}
+
+func escapesDir(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// dirSize sums the sizes of regular files under root without following symlinks.
+// isRepoSkillDir reports whether dir holds a regular SKILL.md and is reached
+// from repoPath without following a symlink, so a cloned repo cannot point
+// the install at files outside itself.
+func isRepoSkillDir(repoPath, dir string) bool {
+	rel, err := filepath.Rel(repoPath, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	path := repoPath
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	info, err := os.Lstat(filepath.Join(dir, "SKILL.md"))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func dirSize(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
 func copyDir(srcDir, dstDir string) error {
 	if err := os.MkdirAll(dstDir, 0o755); err != nil {
 		return fmt.Errorf("create destination skill dir: %w", err)
@@ -1026,6 +2069,12 @@ func copyDir(srcDir, dstDir string) error {
 		if d.IsDir() {
 			return os.MkdirAll(target, 0o755)
 		}
+		// Symlinks and other special files are skipped: copying would
+		// dereference them and pull files from outside the repo into the
+		// skill, where skill__read_file exposes them.
+		if !d.Type().IsRegular() {
+			return nil
+		}
 		return copyFile(path, target)
 	})
 }
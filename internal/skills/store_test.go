@@ -2,13 +2,17 @@ package skills
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStoreUpsertAndReload(t *testing.T) {
@@ -95,6 +99,72 @@ func TestStoreFolderDiscovery_DefaultEnabled(t *testing.T) {
 	}
 }
 
+func TestStoreDisableAllNonBuiltin_KeepsBuiltinsEnabled(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	statePath := filepath.Join(root, "skills_state.json")
+	store, err := NewStore(skillsDir, statePath)
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if err := store.UpsertSkill(Skill{Name: "Research Mode", Prompt: "先检索再回答", Enabled: true}); err != nil {
+		t.Fatalf("UpsertSkill error: %v", err)
+	}
+	if err := store.UpsertAutoSkill("复盘习惯", "每天复盘"); err != nil {
+		t.Fatalf("UpsertAutoSkill error: %v", err)
+	}
+	if err := store.SetAllEnabled(false); err != nil {
+		t.Fatalf("SetAllEnabled error: %v", err)
+	}
+	for _, skill := range store.ListSkills() {
+		if skill.Enabled {
+			t.Fatalf("expected every skill disabled, %s is enabled", skill.ID)
+		}
+	}
+
+	// Builtins come back on even though they were switched off above.
+	if err := store.DisableAllNonBuiltin(); err != nil {
+		t.Fatalf("DisableAllNonBuiltin error: %v", err)
+	}
+
+	reloaded, err := NewStore(skillsDir, statePath)
+	if err != nil {
+		t.Fatalf("reload NewStore error: %v", err)
+	}
+	builtins := 0
+	for _, skill := range reloaded.ListSkills() {
+		isBuiltin := skill.Source == builtinSkillSource
+		if isBuiltin {
+			builtins++
+		}
+		if skill.Enabled != isBuiltin {
+			t.Fatalf("skill %s (source %q) enabled=%v", skill.ID, skill.Source, skill.Enabled)
+		}
+	}
+	if builtins != len(builtinSkills) {
+		t.Fatalf("expected %d builtin skills, got %d", len(builtinSkills), builtins)
+	}
+}
+
+func TestStoreSkillPriority_RoundTripsThroughFrontmatter(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if err := store.UpsertSkill(Skill{ID: "money", Name: "Money", Prompt: "涉及金额时先复核数字", Priority: 5, Enabled: true}); err != nil {
+		t.Fatalf("UpsertSkill error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "skills", "money", "SKILL.md"))
+	if err != nil || !strings.Contains(string(data), "priority: 5") {
+		t.Fatalf("expected priority in frontmatter, got %q (err %v)", data, err)
+	}
+	if got := store.ListEnabledSkillPriorities(); len(got) != 1 || got["涉及金额时先复核数字"] != 5 {
+		t.Fatalf("unexpected priorities: %v", got)
+	}
+}
+
 func TestInstallFromSkillsSH_InvalidURL(t *testing.T) {
 	root := t.TempDir()
 	store, err := NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
@@ -102,7 +172,7 @@ func TestInstallFromSkillsSH_InvalidURL(t *testing.T) {
 		t.Fatalf("NewStore error: %v", err)
 	}
 
-	if _, err := store.InstallFromSkillsSH(context.Background(), "https://example.com/foo/bar/baz"); err == nil {
+	if _, err := store.InstallFromSkillsSH(context.Background(), "https://example.com/foo/bar/baz", ""); err == nil {
 		t.Fatalf("expected host validation error")
 	}
 }
@@ -142,7 +212,7 @@ func TestInstallFromRepo_LocalGitRepo(t *testing.T) {
 		t.Fatalf("NewStore error: %v", err)
 	}
 
-	installed, err := store.installFromRepo(context.Background(), repo, "demo-skill", "https://skills.sh/demo/repo/demo-skill")
+	installed, err := store.installFromRepo(context.Background(), repo, "demo-skill", skillsSHSkillSource, "https://skills.sh/demo/repo/demo-skill", "")
 	if err != nil {
 		t.Fatalf("installFromRepo error: %v", err)
 	}
@@ -152,8 +222,332 @@ func TestInstallFromRepo_LocalGitRepo(t *testing.T) {
 	if !installed.Enabled {
 		t.Fatalf("expected installed skill enabled")
 	}
-	if !strings.Contains(installed.Source, "skills.sh") {
-		t.Fatalf("unexpected installed source: %q", installed.Source)
+	if installed.Source != skillsSHSkillSource || installed.SourceURL != "https://skills.sh/demo/repo/demo-skill" {
+		t.Fatalf("unexpected installed source: %q %q", installed.Source, installed.SourceURL)
+	}
+}
+
+func TestInstallFromRepo_SkipsSymlinksOutOfTheRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	secret := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(secret, []byte("host secret"), 0o600); err != nil {
+		t.Fatalf("write secret error: %v", err)
+	}
+	outside := filepath.Join(root, "outside", "evil-skill")
+	if err := os.MkdirAll(outside, 0o755); err != nil {
+		t.Fatalf("mkdir outside error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "SKILL.md"), []byte("---\nname: \"evil\"\n---\n\nhost prompt"), 0o600); err != nil {
+		t.Fatalf("write outside skill error: %v", err)
+	}
+
+	repo := filepath.Join(root, "repo")
+	skillDir := filepath.Join(repo, "skills", "demo-skill")
+	if err := os.MkdirAll(skillDir, 0o755); err != nil {
+		t.Fatalf("mkdir repo skill dir error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(skillDir, "SKILL.md"), []byte("---\nname: \"demo\"\ndescription: \"demo\"\n---\n\nbody"), 0o600); err != nil {
+		t.Fatalf("write repo skill file error: %v", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(skillDir, "ref.md")); err != nil {
+		t.Fatalf("symlink error: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(repo, "skills", "evil-skill")); err != nil {
+		t.Fatalf("symlink dir error: %v", err)
+	}
+
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test",
+			"GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test",
+			"GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v (%s)", args, err, strings.TrimSpace(string(out)))
+		}
+	}
+	runGit("init")
+	runGit("add", ".")
+	runGit("commit", "-m", "init")
+
+	skillsHome := filepath.Join(root, "skills-home")
+	store, err := NewStore(skillsHome, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	if _, err := store.installFromRepo(context.Background(), repo, "demo-skill", gitSkillSource, repo, ""); err != nil {
+		t.Fatalf("installFromRepo error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(skillsHome, "demo-skill", "ref.md")); !os.IsNotExist(err) {
+		t.Fatalf("expected the symlinked file to be skipped, got %v", err)
+	}
+	if _, err := store.installFromRepo(context.Background(), repo, "evil-skill", gitSkillSource, repo, ""); err == nil {
+		t.Fatalf("expected a skill dir reached through a symlink to be rejected")
+	}
+}
+
+func TestPreviewFromRepo_ReturnsPromptWithoutInstalling(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "skills", "demo-skill"), 0o755); err != nil {
+		t.Fatalf("mkdir repo skill dir error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "skills", "demo-skill", "SKILL.md"), []byte("---\nname: \"demo\"\ndescription: \"demo skill\"\n---\n\npreview body"), 0o600); err != nil {
+		t.Fatalf("write repo skill file error: %v", err)
+	}
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test",
+			"GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test",
+			"GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v (%s)", args, err, strings.TrimSpace(string(out)))
+		}
+	}
+	runGit("init")
+	runGit("add", ".")
+	runGit("commit", "-m", "init")
+
+	store, err := NewStore(filepath.Join(root, "skills-home"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	before := len(store.ListSkills())
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		t.Fatalf("mkdir tmp error: %v", err)
+	}
+	t.Setenv("TMPDIR", tmp)
+
+	preview, err := store.previewFromRepo(context.Background(), repo, "demo-skill", skillsSHSkillSource, "https://skills.sh/demo/repo/demo-skill")
+	if err != nil {
+		t.Fatalf("previewFromRepo error: %v", err)
+	}
+	if preview.Name != "demo" || preview.Prompt != "preview body" || preview.Commit == "" {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+	if got := len(store.ListSkills()); got != before {
+		t.Fatalf("preview must not install a skill: %d -> %d", before, got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "skills-home", "demo-skill")); !os.IsNotExist(err) {
+		t.Fatalf("expected no skill dir after preview, stat err: %v", err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("expected temp clone to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestInstallFromRepo_RejectsOversizeRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "skills", "big-skill"), 0o755); err != nil {
+		t.Fatalf("mkdir repo skill dir error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "skills", "big-skill", "SKILL.md"), []byte("---\nname: big\n---\n\nbody"), 0o600); err != nil {
+		t.Fatalf("write repo skill file error: %v", err)
+	}
+	// Random bytes so git cannot compress the blob below the cap.
+	blob := make([]byte, 256<<10)
+	for i := range blob {
+		blob[i] = byte((i*7919 + i/251*104729) % 251)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "skills", "big-skill", "data.bin"), blob, 0o600); err != nil {
+		t.Fatalf("write repo blob error: %v", err)
+	}
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test",
+			"GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test",
+			"GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v (%s)", args, err, strings.TrimSpace(string(out)))
+		}
+	}
+	runGit("init")
+	runGit("add", ".")
+	runGit("commit", "-m", "init")
+
+	store, err := NewStore(filepath.Join(root, "skills-home"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	store.SetCloneLimits(CloneLimits{MaxRepoBytes: 64 << 10})
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		t.Fatalf("mkdir tmp error: %v", err)
+	}
+	t.Setenv("TMPDIR", tmp)
+
+	_, err = store.installFromRepo(context.Background(), repo, "big-skill", gitSkillSource, repo, "")
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "skills-home", "big-skill")); !os.IsNotExist(err) {
+		t.Fatalf("expected no installed skill dir, stat err: %v", err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("expected temp clone to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestInstallFromGitRepo_ArbitraryRepoURL(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "gitlab-mirror")
+	if err := os.MkdirAll(filepath.Join(repo, "team-skills", "code-review"), 0o755); err != nil {
+		t.Fatalf("mkdir repo skill dir error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "team-skills", "code-review", "SKILL.md"), []byte("---\nname: \"code review\"\ndescription: \"review\"\n---\n\nreview diffs"), 0o600); err != nil {
+		t.Fatalf("write repo skill file error: %v", err)
+	}
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test",
+			"GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test",
+			"GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v (%s)", args, err, strings.TrimSpace(string(out)))
+		}
+	}
+	runGit("init")
+	runGit("add", ".")
+	runGit("commit", "-m", "init")
+
+	// Rewrite the remote URL to the local repo so the clone stays offline.
+	repoURL := "https://gitlab.example.com/team/skills.git"
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "url."+repo+".insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", repoURL)
+
+	store, err := NewStore(filepath.Join(root, "skills-home"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	for _, bad := range []string{"", "file:///tmp/repo", "http://gitlab.example.com/team/skills.git", "/tmp/repo", "--upload-pack=touch /tmp/pwned", "-oProxyCommand=x@host:repo", "-user@example.com:team/skills.git"} {
+		if _, err := store.InstallFromGitRepo(context.Background(), bad, "code-review", ""); err == nil {
+			t.Fatalf("expected url %q to be rejected", bad)
+		}
+	}
+	if _, err := store.InstallFromGitRepo(context.Background(), repoURL, "../..", ""); err == nil {
+		t.Fatalf("expected invalid skill id to be rejected")
+	}
+
+	installed, err := store.InstallFromGitRepo(context.Background(), repoURL, "code-review", "")
+	if err != nil {
+		t.Fatalf("InstallFromGitRepo error: %v", err)
+	}
+	if installed.ID != "code-review" || !installed.Enabled {
+		t.Fatalf("unexpected installed skill: %+v", installed)
+	}
+	if installed.Source != gitSkillSource || installed.SourceURL != repoURL {
+		t.Fatalf("expected git source %q, got %q %q", repoURL, installed.Source, installed.SourceURL)
+	}
+}
+
+func TestInstallFromRepo_PinsCommitAndUpdateReclonesRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	skillFile := filepath.Join(repo, "skills", "pinned", "SKILL.md")
+	if err := os.MkdirAll(filepath.Dir(skillFile), 0o755); err != nil {
+		t.Fatalf("mkdir repo skill dir error: %v", err)
+	}
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test",
+			"GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test",
+			"GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v (%s)", args, err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out))
+	}
+	writeSkill := func(body string) {
+		if err := os.WriteFile(skillFile, []byte("---\nname: \"pinned\"\ndescription: \"pinned\"\n---\n\n"+body), 0o600); err != nil {
+			t.Fatalf("write repo skill file error: %v", err)
+		}
+	}
+	runGit("init")
+	writeSkill("version one")
+	runGit("add", ".")
+	runGit("commit", "-m", "v1")
+	firstCommit := runGit("rev-parse", "HEAD")
+	writeSkill("version two")
+	runGit("commit", "-am", "v2")
+
+	store, err := NewStore(filepath.Join(root, "skills-home"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	installed, err := store.installFromRepo(context.Background(), repo, "pinned", gitSkillSource, repo, firstCommit)
+	if err != nil {
+		t.Fatalf("installFromRepo error: %v", err)
+	}
+	if installed.Prompt != "version one" {
+		t.Fatalf("expected pinned commit content, got %q", installed.Prompt)
+	}
+	if installed.Ref != firstCommit || installed.Commit != firstCommit || installed.RepoURL != repo {
+		t.Fatalf("expected ref and commit to be recorded, got %+v", installed)
+	}
+
+	if err := store.SetSkillEnabled("pinned", false); err != nil {
+		t.Fatalf("SetSkillEnabled error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "skills-home", "pinned", "SKILL.md"), []byte("---\nname: \"pinned\"\n---\n\nlocal edit"), 0o600); err != nil {
+		t.Fatalf("overwrite installed skill error: %v", err)
+	}
+	updated, err := store.UpdateSkill(context.Background(), "pinned")
+	if err != nil {
+		t.Fatalf("UpdateSkill error: %v", err)
+	}
+	if updated.Prompt != "version one" {
+		t.Fatalf("expected update to re-clone the pinned ref, got %q", updated.Prompt)
+	}
+	if updated.Enabled {
+		t.Fatalf("expected update to keep the skill disabled")
+	}
+
+	if err := store.UpsertSkill(Skill{ID: "manual", Name: "manual", Description: "manual", Prompt: "manual", Enabled: true}); err != nil {
+		t.Fatalf("UpsertSkill error: %v", err)
+	}
+	if _, err := store.UpdateSkill(context.Background(), "manual"); err == nil || !strings.Contains(err.Error(), "no recorded git source") {
+		t.Fatalf("expected manual skill update to be rejected, got %v", err)
 	}
 }
 
@@ -211,6 +605,9 @@ func TestStoreHasBuiltinConfigSkills(t *testing.T) {
 	if !strings.Contains(skillsSkill.Prompt, "/api/skills/catalog/search") {
 		t.Fatalf("builtin skills skill should include catalog search endpoint, got: %q", skillsSkill.Prompt)
 	}
+	if !strings.Contains(skillsSkill.Prompt, "skills__catalog_search") {
+		t.Fatalf("builtin skills skill should prefer the catalog search tool, got: %q", skillsSkill.Prompt)
+	}
 	if !strings.Contains(skillsSkill.Prompt, "未确认不得执行安装或删除") {
 		t.Fatalf("builtin skills skill should require user confirmation, got: %q", skillsSkill.Prompt)
 	}
@@ -264,3 +661,464 @@ func TestSearchSkillsCatalog(t *testing.T) {
 		t.Fatalf("unexpected skill url: %q", items[0].URL)
 	}
 }
+
+func TestRegenerateDescription_HeuristicFallbackPreservesFrontmatter(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	store, err := NewStore(skillsDir, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	skillDir := filepath.Join(skillsDir, "release-check")
+	if err := os.MkdirAll(skillDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	markdown := "---\nname: \"Release Check\"\ndescription: \"stale description\"\nlicense: MIT\n---\n\n发布前执行最小回归用例并记录结果。"
+	if err := os.WriteFile(filepath.Join(skillDir, "SKILL.md"), []byte(markdown), 0o600); err != nil {
+		t.Fatalf("write skill: %v", err)
+	}
+
+	updated, err := store.RegenerateDescription(context.Background(), "release-check")
+	if err != nil {
+		t.Fatalf("RegenerateDescription error: %v", err)
+	}
+	if updated.Description != "发布前执行最小回归用例并记录结果。" {
+		t.Fatalf("expected description derived from prompt, got %q", updated.Description)
+	}
+
+	data, err := os.ReadFile(filepath.Join(skillDir, "SKILL.md"))
+	if err != nil {
+		t.Fatalf("read skill: %v", err)
+	}
+	text := string(data)
+	if strings.Contains(text, "stale description") {
+		t.Fatalf("expected stale description replaced, got %q", text)
+	}
+	if !strings.Contains(text, "license: MIT") {
+		t.Fatalf("expected other frontmatter preserved, got %q", text)
+	}
+
+	if _, err := store.RegenerateDescription(context.Background(), "../escape"); err == nil {
+		t.Fatalf("expected invalid id to be rejected")
+	}
+}
+
+func TestReindex_PrunesVanishedDirsAndAddsNewOnes(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	statePath := filepath.Join(root, "skills_state.json")
+	store, err := NewStore(skillsDir, statePath)
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if err := store.UpsertSkill(Skill{ID: "stale", Name: "stale", Description: "stale skill", Prompt: "old", Enabled: false}); err != nil {
+		t.Fatalf("UpsertSkill error: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(skillsDir, "stale")); err != nil {
+		t.Fatalf("remove dir error: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(skillsDir, "fresh"), 0o755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	content := "---\nname: \"fresh\"\ndescription: \"fresh skill\"\n---\n\nrun fresh"
+	if err := os.WriteFile(filepath.Join(skillsDir, "fresh", "SKILL.md"), []byte(content), 0o600); err != nil {
+		t.Fatalf("write SKILL.md error: %v", err)
+	}
+
+	result, err := store.Reindex()
+	if err != nil {
+		t.Fatalf("Reindex error: %v", err)
+	}
+	if result.Added != 1 || result.Removed != 1 {
+		t.Fatalf("expected 1 added and 1 removed, got %+v", result)
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("read state error: %v", err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("decode state error: %v", err)
+	}
+	if _, ok := state.Skills["stale"]; ok {
+		t.Fatalf("expected stale record to be pruned, got %+v", state.Skills)
+	}
+	if record, ok := state.Skills["fresh"]; !ok || !record.Enabled {
+		t.Fatalf("expected fresh record to be added as enabled, got %+v", state.Skills)
+	}
+
+	again, err := store.Reindex()
+	if err != nil {
+		t.Fatalf("Reindex error: %v", err)
+	}
+	if again.Added != 0 || again.Removed != 0 {
+		t.Fatalf("expected second reindex to be a no-op, got %+v", again)
+	}
+}
+
+func TestParseSkillMarkdown_Tags(t *testing.T) {
+	cases := []struct {
+		name     string
+		markdown string
+		want     []string
+	}{
+		{"inline list", "---\nname: \"a\"\ntags: [Coding, \"ops\", coding]\n---\n\nbody", []string{"coding", "ops"}},
+		{"comma separated", "---\nname: a\ntags: planning, writing\n---\n\nbody", []string{"planning", "writing"}},
+		{"block list", "---\nname: a\ntags:\n  - research\n  - \"learning\"\ndescription: d\n---\n\nbody", []string{"research", "learning"}},
+		{"untagged", "---\nname: a\n---\n\nbody", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, _, prompt, tags := parseSkillMarkdown(tc.markdown)
+			if name != "a" || prompt != "body" {
+				t.Fatalf("unexpected name/prompt: %q %q", name, prompt)
+			}
+			if strings.Join(tags, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("expected tags %v, got %v", tc.want, tags)
+			}
+		})
+	}
+
+	_, description, _, _ := parseSkillMarkdown("---\nname: a\ntags:\n  - research\ndescription: \"after list\"\n---\n\nbody")
+	if description != "after list" {
+		t.Fatalf("expected keys after a tag list to still parse, got %q", description)
+	}
+}
+
+func TestUpsertSkill_PersistsTags(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if err := store.UpsertSkill(Skill{ID: "tagged", Name: "tagged", Description: "d", Prompt: "p", Tags: []string{" Coding ", "", "ops"}, Enabled: true}); err != nil {
+		t.Fatalf("UpsertSkill error: %v", err)
+	}
+	for _, skill := range store.ListSkills() {
+		if skill.ID == "tagged" {
+			if strings.Join(skill.Tags, ",") != "coding,ops" {
+				t.Fatalf("unexpected tags: %v", skill.Tags)
+			}
+			if got := store.ListEnabledSkillTags()["p"]; strings.Join(got, ",") != "coding,ops" {
+				t.Fatalf("unexpected enabled skill tags: %v", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected tagged skill")
+}
+
+func TestListEnabledSkillPrompts_CapsCandidatesForLargeLibraries(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	base := time.Now().Add(-24 * time.Hour)
+	const total = 300
+	for i := 0; i < total; i++ {
+		id := fmt.Sprintf("bulk-%03d", i)
+		dir := filepath.Join(skillsDir, id)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir error: %v", err)
+		}
+		skillPath := filepath.Join(dir, "SKILL.md")
+		content := fmt.Sprintf("---\nname: %q\ndescription: \"bulk skill\"\n---\n\nbulk prompt %03d", id, i)
+		if err := os.WriteFile(skillPath, []byte(content), 0o600); err != nil {
+			t.Fatalf("write SKILL.md error: %v", err)
+		}
+		modTime := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(skillPath, modTime, modTime); err != nil {
+			t.Fatalf("chtimes error: %v", err)
+		}
+	}
+
+	store, err := NewStore(skillsDir, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	if got := len(store.ListEnabledSkillPrompts()); got != total+len(builtinSkills) {
+		t.Fatalf("expected all %d prompts without a cap, got %d", total+len(builtinSkills), got)
+	}
+
+	const limit = 40
+	store.SetMaxEnabledSkillCandidates(limit)
+	prompts := store.ListEnabledSkillPrompts()
+	if len(prompts) != limit {
+		t.Fatalf("expected %d candidates, got %d", limit, len(prompts))
+	}
+	joined := strings.Join(prompts, "\n")
+	for _, builtin := range builtinSkills {
+		if !strings.Contains(joined, builtin.Prompt) {
+			t.Fatalf("expected builtin skill %q to be kept", builtin.ID)
+		}
+	}
+	newest := limit - len(builtinSkills)
+	for i := total - newest; i < total; i++ {
+		if !strings.Contains(joined, fmt.Sprintf("bulk prompt %03d", i)) {
+			t.Fatalf("expected recently updated skill %d to be kept", i)
+		}
+	}
+	if strings.Contains(joined, fmt.Sprintf("bulk prompt %03d", total-newest-1)) {
+		t.Fatalf("expected older skills beyond the cap to be dropped")
+	}
+}
+
+func TestListSkills_RereadsSkillFilesChangedOutsideTheStore(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	skillPath := filepath.Join(skillsDir, "notes", "SKILL.md")
+	if err := os.MkdirAll(filepath.Dir(skillPath), 0o755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	write := func(prompt string, modTime time.Time) {
+		t.Helper()
+		content := "---\nname: \"notes\"\ndescription: \"notes skill\"\n---\n\n" + prompt
+		if err := os.WriteFile(skillPath, []byte(content), 0o600); err != nil {
+			t.Fatalf("write SKILL.md error: %v", err)
+		}
+		if err := os.Chtimes(skillPath, modTime, modTime); err != nil {
+			t.Fatalf("chtimes error: %v", err)
+		}
+	}
+	base := time.Now().Add(-time.Hour)
+	write("prompt one", base)
+
+	store, err := NewStore(skillsDir, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	prompt := func() string {
+		for _, skill := range store.ListSkills() {
+			if skill.ID == "notes" {
+				return skill.Prompt
+			}
+		}
+		return ""
+	}
+	if got := prompt(); got != "prompt one" {
+		t.Fatalf("expected first prompt, got %q", got)
+	}
+
+	// Same size, rewritten in place: only the mtime tells the change apart.
+	write("prompt two", base.Add(time.Minute))
+	if got := prompt(); got != "prompt two" {
+		t.Fatalf("expected the edited prompt to be reread, got %q", got)
+	}
+}
+
+func TestUpsertSkill_EnforcesLengthLimits(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	store.SetSkillLimits(SkillLimits{MaxPromptRunes: 50})
+
+	err = store.UpsertSkill(Skill{
+		Name:    "Too Long",
+		Prompt:  strings.Repeat("长", 51),
+		Enabled: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "prompt is too long") {
+		t.Fatalf("expected over-long prompt to be rejected, got %v", err)
+	}
+	err = store.UpsertSkill(Skill{
+		Name:    strings.Repeat("n", 65),
+		Prompt:  "short",
+		Enabled: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "name is too long") {
+		t.Fatalf("expected default name limit to apply, got %v", err)
+	}
+
+	if err := store.UpsertSkill(Skill{
+		Name:        "  Incident   Review ",
+		Description: "当 处理\n线上事故时使用",
+		Prompt:      "先定级。  \r\n\r\n\r\n\r\n再复盘。",
+		Enabled:     true,
+	}); err != nil {
+		t.Fatalf("expected valid skill to be accepted, got %v", err)
+	}
+	var saved Skill
+	for _, item := range store.ListSkills() {
+		if item.Name == "Incident Review" {
+			saved = item
+		}
+	}
+	if saved.ID == "" {
+		t.Fatalf("expected normalized skill name, got %+v", store.ListSkills())
+	}
+	if saved.Description != "当 处理 线上事故时使用" {
+		t.Fatalf("unexpected description: %q", saved.Description)
+	}
+	if saved.Prompt != "先定级。\n\n再复盘。" {
+		t.Fatalf("unexpected prompt: %q", saved.Prompt)
+	}
+}
+
+func TestSearchInstalledSkills_RanksByRelevance(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewStore(filepath.Join(root, "skills"), filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+	for _, skill := range []Skill{
+		{ID: "incident-review", Name: "Incident Review", Description: "当处理线上 incident 时使用", Prompt: "先定级 incident，再复盘。", Enabled: true},
+		{ID: "oncall-notes", Name: "Oncall Notes", Description: "值班记录", Prompt: "记录每个 incident 的时间线。", Enabled: true},
+		{ID: "postmortem", Name: "Postmortem", Description: "复盘模板", Prompt: "整理根因与改进项。", Tags: []string{"incident"}, Enabled: false},
+		{ID: "weekly-plan", Name: "Weekly Plan", Description: "周计划", Prompt: "列出本周目标。", Enabled: true},
+	} {
+		if err := store.UpsertSkill(skill); err != nil {
+			t.Fatalf("UpsertSkill(%s) error: %v", skill.ID, err)
+		}
+	}
+
+	matches, err := store.SearchInstalledSkills("Incident", 10)
+	if err != nil {
+		t.Fatalf("SearchInstalledSkills error: %v", err)
+	}
+	got := make([]string, 0, len(matches))
+	for _, match := range matches {
+		got = append(got, match.Skill.ID)
+	}
+	want := []string{"incident-review", "postmortem", "oncall-notes"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected ranking: got %v, want %v", got, want)
+	}
+
+	limited, err := store.SearchInstalledSkills("incident", 1)
+	if err != nil || len(limited) != 1 || limited[0].Skill.ID != "incident-review" {
+		t.Fatalf("expected limit to keep top match, got %+v, err=%v", limited, err)
+	}
+	if _, err := store.SearchInstalledSkills("  ", 5); err == nil {
+		t.Fatalf("expected error for empty query")
+	}
+}
+
+func TestStore_ConcurrentUpsertDeleteAndRead(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	store, err := NewStore(skillsDir, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	const workers = 4
+	const rounds = 40
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds*4)
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				id := fmt.Sprintf("stress-%d-%d", w, i%5)
+				if err := store.UpsertSkill(Skill{ID: id, Name: id, Prompt: "prompt " + id, Enabled: true}); err != nil {
+					errs <- fmt.Errorf("upsert %s: %w", id, err)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				id := fmt.Sprintf("stress-%d-%d", w, i%5)
+				if i%2 == 0 {
+					if err := store.DeleteSkill(id); err != nil {
+						errs <- fmt.Errorf("delete %s: %w", id, err)
+					}
+				} else {
+					// Simulate a skill dropped in and removed outside the store
+					// while readers are listing.
+					dir := filepath.Join(skillsDir, fmt.Sprintf("external-%d-%d", w, i))
+					if err := os.MkdirAll(dir, 0o755); err == nil {
+						_ = writeFileAtomic(filepath.Join(dir, "SKILL.md"), []byte("external prompt"))
+					}
+					_ = os.RemoveAll(dir)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				skills := store.ListSkills()
+				if skills == nil {
+					errs <- fmt.Errorf("ListSkills returned the error path")
+					continue
+				}
+				builtins := 0
+				for _, skill := range skills {
+					if strings.TrimSpace(skill.Prompt) == "" {
+						errs <- fmt.Errorf("skill %s listed with empty prompt", skill.ID)
+					}
+					if skill.Source == builtinSkillSource {
+						builtins++
+					}
+				}
+				if builtins != len(builtinSkills) {
+					errs <- fmt.Errorf("expected %d builtin skills, got %d", len(builtinSkills), builtins)
+				}
+				if prompt, ok := store.ReadEnabledSkillPrompt(fmt.Sprintf("stress-%d-%d", w, i%5)); ok && !strings.Contains(prompt, "prompt stress-") {
+					errs <- fmt.Errorf("read partial skill file: %q", prompt)
+				}
+				_ = store.ListEnabledSkillPrompts()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReadSkillFile_ReadsSiblingAndRejectsTraversal(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	if err := os.MkdirAll(filepath.Join(skillsDir, "deploy", "scripts"), 0o755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	files := map[string]string{
+		filepath.Join(skillsDir, "deploy", "SKILL.md"):             "---\nname: \"deploy\"\ndescription: \"deploy\"\n---\n\nrun scripts/deploy.sh",
+		filepath.Join(skillsDir, "deploy", "scripts", "deploy.sh"): "#!/bin/sh\necho deploy\n",
+		filepath.Join(root, "secret.txt"):                          "top secret",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(skillsDir, "deploy", "link.txt")); err != nil {
+		t.Fatalf("symlink error: %v", err)
+	}
+
+	store, err := NewStore(skillsDir, filepath.Join(root, "skills_state.json"))
+	if err != nil {
+		t.Fatalf("NewStore error: %v", err)
+	}
+
+	listed, err := store.ListSkillFiles("deploy")
+	if err != nil {
+		t.Fatalf("ListSkillFiles error: %v", err)
+	}
+	if strings.Join(listed, ",") != "SKILL.md,scripts/deploy.sh" {
+		t.Fatalf("unexpected files: %v", listed)
+	}
+
+	content, err := store.ReadSkillFile("deploy", "scripts/deploy.sh")
+	if err != nil {
+		t.Fatalf("ReadSkillFile error: %v", err)
+	}
+	if !strings.Contains(content, "echo deploy") {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	for _, rel := range []string{"../../secret.txt", "scripts/../../../secret.txt", "/etc/passwd", "link.txt"} {
+		if _, err := store.ReadSkillFile("deploy", rel); err == nil {
+			t.Fatalf("expected %q to be rejected", rel)
+		}
+	}
+	if _, err := store.ReadSkillFile("../deploy", "SKILL.md"); err == nil {
+		t.Fatalf("expected invalid skill id to be rejected")
+	}
+}
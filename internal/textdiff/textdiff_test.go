@@ -0,0 +1,29 @@
+package textdiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLines_ReportsChangedLines(t *testing.T) {
+	from := "你是助手。\n回答要简洁。\n不使用表情符号。"
+	to := "你是助手。\n回答要详细并给出例子。\n不使用表情符号。\n先确认需求。"
+
+	got := Lines(from, to)
+	want := []Line{
+		{Op: Equal, Text: "你是助手。"},
+		{Op: Delete, Text: "回答要简洁。"},
+		{Op: Insert, Text: "回答要详细并给出例子。"},
+		{Op: Equal, Text: "不使用表情符号。"},
+		{Op: Insert, Text: "先确认需求。"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diff:\n got %+v\nwant %+v", got, want)
+	}
+	if !Changed(got) {
+		t.Fatalf("expected Changed to report the edits")
+	}
+	if Changed(Lines(from, from)) {
+		t.Fatalf("identical texts must not be reported as changed")
+	}
+}
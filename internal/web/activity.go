@@ -0,0 +1,132 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llm"
+)
+
+const (
+	activitySubscriberBuffer = 32
+	activityKeepAlive        = 15 * time.Second
+)
+
+type activityEvent struct {
+	Type         string    `json:"type"`
+	Round        int       `json:"round,omitempty"`
+	MessageCount int       `json:"message_count,omitempty"`
+	Tool         string    `json:"tool,omitempty"`
+	Progress     float64   `json:"progress,omitempty"`
+	Total        float64   `json:"total,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Content      string    `json:"content,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// activityHub implements agent.EventSink and fans events out to SSE clients.
+type activityHub struct {
+	mu          sync.Mutex
+	subscribers map[chan activityEvent]struct{}
+}
+
+func newActivityHub() *activityHub {
+	return &activityHub{subscribers: make(map[chan activityEvent]struct{})}
+}
+
+func (h *activityHub) subscribe() chan activityEvent {
+	ch := make(chan activityEvent, activitySubscriberBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *activityHub) unsubscribe(ch chan activityEvent) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+func (h *activityHub) publish(event activityEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (h *activityHub) OnCompression(messageCount int) {
+	h.publish(activityEvent{Type: "compression", MessageCount: messageCount})
+}
+
+func (h *activityHub) OnRound(round int) {
+	h.publish(activityEvent{Type: "round", Round: round})
+}
+
+func (h *activityHub) OnToolCall(call conversation.ToolCall) {
+	h.publish(activityEvent{Type: "tool_call", Tool: call.Name, Error: call.Error})
+}
+
+func (h *activityHub) OnToolProgress(tool string, progress llm.ToolProgress) {
+	h.publish(activityEvent{Type: "tool_progress", Tool: tool, Progress: progress.Progress, Total: progress.Total, Content: progress.Message})
+}
+
+func (h *activityHub) OnReply(reply string) {
+	h.publish(activityEvent{Type: "reply", Content: reply})
+}
+
+func (s *Server) handleChatStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := s.activity.subscribe()
+	defer s.activity.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(activityKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
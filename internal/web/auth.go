@@ -0,0 +1,64 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig protects every route except the /healthz and /readyz probes.
+// Token is accepted as a bearer token or as the basic-auth password;
+// Username/Password enable plain basic auth. Leaving all fields empty
+// disables authentication.
+type AuthConfig struct {
+	Token    string
+	Username string
+	Password string
+}
+
+func (c AuthConfig) enabled() bool {
+	return c.Token != "" || (c.Username != "" && c.Password != "")
+}
+
+// WithAuth wraps next with the configured authentication.
+func WithAuth(next http.Handler, cfg AuthConfig) http.Handler {
+	if !cfg.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || cfg.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="laughing-barnacle", charset="UTF-8"`)
+		http.Error(w, "未授权", http.StatusUnauthorized)
+	})
+}
+
+func (c AuthConfig) authorized(r *http.Request) bool {
+	if c.Token != "" {
+		header := r.Header.Get("Authorization")
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok && secureEqual(strings.TrimSpace(token), c.Token) {
+			return true
+		}
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if c.Token != "" && secureEqual(pass, c.Token) {
+		return true
+	}
+	if c.Username != "" && c.Password != "" {
+		// Evaluate both comparisons so timing does not reveal which one failed.
+		userOK := secureEqual(user, c.Username)
+		passOK := secureEqual(pass, c.Password)
+		return userOK && passOK
+	}
+	return false
+}
+
+func secureEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
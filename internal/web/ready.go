@@ -0,0 +1,91 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readySettingsCheckTTL is how long a settings-file check result is reused.
+var readySettingsCheckTTL = 10 * time.Second
+
+// readyCheck is one dependency /readyz verifies.
+type readyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// AddReadyCheck registers a dependency check run on every /readyz request;
+// slow checks should be wrapped with CachedCheck.
+func (s *Server) AddReadyCheck(name string, check func(ctx context.Context) error) {
+	s.readyChecks = append(s.readyChecks, readyCheck{name: name, check: check})
+}
+
+// CachedCheck runs check at most once per ttl and reuses its last result in
+// between, so frequent probes do not hammer the dependency.
+func CachedCheck(ttl time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	var (
+		mu      sync.Mutex
+		until   time.Time
+		lastErr error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().Before(until) {
+			return lastErr
+		}
+		lastErr = check(ctx)
+		until = time.Now().Add(ttl)
+		return lastErr
+	}
+}
+
+// PingURLCheck reports url reachable when it answers with any status below
+// 500; auth errors still prove the endpoint is up, and nothing is billed.
+func PingURLCheck(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("build ping request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("ping %s: %w", url, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("ping %s: status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// handleReadyz is the readiness probe: 200 when every registered check
+// passes, otherwise 503 listing the names of the failing ones. It is served
+// without authentication, so error details only go to the log. /healthz
+// stays a plain liveness probe.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	failing := make([]string, 0)
+	for _, c := range s.readyChecks {
+		if err := c.check(ctx); err != nil {
+			slog.Warn("readiness check failed", "check", c.name, "error", err)
+			failing = append(failing, c.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "unavailable", "failing": failing})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
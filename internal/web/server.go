@@ -4,10 +4,14 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,7 +20,9 @@ import (
 	"laughing-barnacle/internal/conversation"
 	"laughing-barnacle/internal/llmlog"
 	"laughing-barnacle/internal/mcp"
+	"laughing-barnacle/internal/metrics"
 	"laughing-barnacle/internal/skills"
+	"laughing-barnacle/internal/textdiff"
 )
 
 //go:embed templates/*.html
@@ -29,19 +35,36 @@ type Server struct {
 	mcpStore   *mcp.Store
 	mcpTools   *mcp.ToolProvider
 	skillStore *skills.Store
+	activity   *activityHub
+	limiter    *rateLimiter
+	metrics    *metrics.Metrics
 	tmpl       *template.Template
+	// apiKeyMissing flags that the LLM has no API key configured yet.
+	apiKeyMissing bool
+	readyChecks   []readyCheck
 }
 
 type chatPageData struct {
 	Summary        string
 	Messages       []conversation.Message
 	Error          string
+	Notice         string
 	RetryAvailable bool
 	Draft          string
+	CSRFToken      string
+	APIKeyMissing  bool
 }
 
 type logsPageData struct {
-	Entries []llmlog.Entry
+	Entries    []llmlog.Entry
+	Purposes   []string
+	Purpose    string
+	TurnID     string
+	ErrorsOnly bool
+	Since      string
+	Error      string
+	Notice     string
+	CSRFToken  string
 }
 
 type settingsSection struct {
@@ -51,19 +74,30 @@ type settingsSection struct {
 }
 
 type mcpServiceView struct {
-	ID          string
-	Name        string
-	Endpoint    string
-	Command     string
-	Args        string
-	Transport   string
-	Enabled     bool
-	UpdatedAt   string
-	Connected   bool
-	ToolCount   int
-	Tools       []mcpServiceToolView
-	StatusLabel string
-	StatusError string
+	ID           string
+	Name         string
+	Endpoint     string
+	Command      string
+	Args         string
+	Transport    string
+	Group        string
+	Enabled      bool
+	ToolsOptIn   bool
+	UpdatedAt    string
+	Connected    bool
+	ToolCount    int
+	Tools        []mcpServiceToolView
+	Capabilities string
+	StatusLabel  string
+	StatusError  string
+}
+
+// mcpServiceGroupView lists the services sharing a group; ungrouped services
+// come last under an empty Name.
+type mcpServiceGroupView struct {
+	Name       string
+	Services   []mcpServiceView
+	AnyEnabled bool
 }
 
 type mcpServiceToolView struct {
@@ -73,13 +107,19 @@ type mcpServiceToolView struct {
 }
 
 type settingsPageData struct {
-	ActiveSection string
-	Sections      []settingsSection
-	Services      []mcpServiceView
-	Skills        []skillView
-	AgentPrompts  agentPromptsView
-	Success       string
-	Error         string
+	CSRFToken        string
+	APIKeyConfigured bool
+	ActiveSection    string
+	Sections         []settingsSection
+	Services         []mcpServiceView
+	ServiceGroups    []mcpServiceGroupView
+	Skills           []skillView
+	AgentPrompts     agentPromptsView
+	PromptHistory    []promptVersionView
+	PromptDiff       *promptDiffView
+	PromptDiffError  string
+	Success          string
+	Error            string
 }
 
 type skillView struct {
@@ -87,7 +127,14 @@ type skillView struct {
 	Name        string
 	Description string
 	Prompt      string
+	Tags        string
+	Priority    int
 	Source      string
+	SourceURL   string
+	SourceLink  bool
+	Ref         string
+	Commit      string
+	Updatable   bool
 	Enabled     bool
 	UpdatedAt   string
 }
@@ -98,6 +145,24 @@ type agentPromptsView struct {
 	UpdatedAt               string
 }
 
+type promptVersionView struct {
+	Version   int
+	Reason    string
+	CreatedAt string
+	Preview   string
+	Current   bool
+}
+
+// promptDiffView compares the current agent prompts (the "to" side) with the
+// builtin defaults or the previous stored version.
+type promptDiffView struct {
+	Against           string          `json:"against"`
+	AgainstVersion    int             `json:"against_version,omitempty"`
+	Changed           bool            `json:"changed"`
+	SystemPrompt      []textdiff.Line `json:"system_prompt"`
+	CompressionPrompt []textdiff.Line `json:"compression_system_prompt"`
+}
+
 type apiMCPService struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
@@ -105,15 +170,35 @@ type apiMCPService struct {
 	Endpoint  string    `json:"endpoint,omitempty"`
 	Command   string    `json:"command,omitempty"`
 	Args      []string  `json:"args,omitempty"`
+	Group     string    `json:"group,omitempty"`
 	Enabled   bool      `json:"enabled"`
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 }
 
+type apiLogEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Purpose    string    `json:"purpose"`
+	TurnID     string    `json:"turn_id,omitempty"`
+	Model      string    `json:"model"`
+	Request    string    `json:"request,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StatusCode int       `json:"status_code"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
 type apiSkill struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Priority    int       `json:"priority,omitempty"`
 	Source      string    `json:"source,omitempty"`
+	SourceURL   string    `json:"source_url,omitempty"`
+	RepoURL     string    `json:"repo_url,omitempty"`
+	Ref         string    `json:"ref,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
 	Enabled     bool      `json:"enabled"`
 	UpdatedAt   time.Time `json:"updated_at,omitempty"`
 }
@@ -131,40 +216,92 @@ func NewServer(
 		return nil, err
 	}
 
-	return &Server{
+	activity := newActivityHub()
+	if agent != nil {
+		agent.SetEventSink(activity)
+	}
+
+	s := &Server{
 		agent:      agent,
 		convStore:  convStore,
 		logStore:   logStore,
 		mcpStore:   mcpStore,
 		mcpTools:   mcpTools,
 		skillStore: skillStore,
+		activity:   activity,
 		tmpl:       tmpl,
-	}, nil
+	}
+	if mcpStore != nil {
+		// CheckHealth writes a probe file, so anonymous probes must not
+		// reach it on every request.
+		s.AddReadyCheck("settings", CachedCheck(readySettingsCheckTTL, func(context.Context) error {
+			return mcpStore.CheckHealth()
+		}))
+	}
+	return s, nil
 }
 
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/", s.handleRoot)
 	mux.HandleFunc("/chat", s.handleChatPage)
-	mux.HandleFunc("/chat/send", s.handleChatSend)
-	mux.HandleFunc("/chat/retry", s.handleChatRetry)
+	mux.HandleFunc("/chat/send", s.rateLimited(csrfProtected(s.handleChatSend)))
+	mux.HandleFunc("/chat/retry", s.rateLimited(csrfProtected(s.handleChatRetry)))
+	mux.HandleFunc("/chat/edit", csrfProtected(s.handleChatEdit))
+	mux.HandleFunc("/chat/delete", csrfProtected(s.handleChatDelete))
+	mux.HandleFunc("/chat/recompress", s.rateLimited(csrfProtected(s.handleChatRecompress)))
+	mux.HandleFunc("/chat/stream", s.handleChatStream)
+	mux.HandleFunc("/chat/export.md", s.handleChatExport)
 	mux.HandleFunc("/chat/settings", s.handleSettingsShortcut)
 	mux.HandleFunc("/config", s.handleSettingsShortcut)
 	mux.HandleFunc("/logs", s.handleLogsPage)
+	mux.HandleFunc("/logs/clear", csrfProtected(s.handleLogsClear))
 	mux.HandleFunc("/settings", s.handleSettingsPage)
-	mux.HandleFunc("/settings/mcp/save", s.handleSettingsMCPSave)
-	mux.HandleFunc("/settings/mcp/delete", s.handleSettingsMCPDelete)
-	mux.HandleFunc("/settings/mcp/toggle", s.handleSettingsMCPToggle)
-	mux.HandleFunc("/settings/mcp/tool/toggle", s.handleSettingsMCPToolToggle)
-	mux.HandleFunc("/settings/skills/install", s.handleSettingsSkillInstall)
-	mux.HandleFunc("/settings/skills/save", s.handleSettingsSkillSave)
-	mux.HandleFunc("/settings/skills/delete", s.handleSettingsSkillDelete)
-	mux.HandleFunc("/settings/skills/toggle", s.handleSettingsSkillToggle)
-	mux.HandleFunc("/settings/llm/prompts/save", s.handleSettingsLLMPromptsSave)
-	mux.HandleFunc("/settings/llm/prompts/reset", s.handleSettingsLLMPromptsReset)
+	mux.HandleFunc("/settings/mcp/save", csrfProtected(s.handleSettingsMCPSave))
+	mux.HandleFunc("/settings/mcp/delete", csrfProtected(s.handleSettingsMCPDelete))
+	mux.HandleFunc("/settings/mcp/toggle", csrfProtected(s.handleSettingsMCPToggle))
+	mux.HandleFunc("/settings/mcp/group/toggle", csrfProtected(s.handleSettingsMCPGroupToggle))
+	mux.HandleFunc("/settings/mcp/tool/toggle", csrfProtected(s.handleSettingsMCPToolToggle))
+	mux.HandleFunc("/settings/skills/install", csrfProtected(s.handleSettingsSkillInstall))
+	mux.HandleFunc("/settings/skills/install-git", csrfProtected(s.handleSettingsSkillInstallGit))
+	mux.HandleFunc("/settings/skills/update", csrfProtected(s.handleSettingsSkillUpdate))
+	mux.HandleFunc("/settings/skills/save", csrfProtected(s.handleSettingsSkillSave))
+	mux.HandleFunc("/settings/skills/delete", csrfProtected(s.handleSettingsSkillDelete))
+	mux.HandleFunc("/settings/skills/toggle", csrfProtected(s.handleSettingsSkillToggle))
+	mux.HandleFunc("/settings/skills/bulk", csrfProtected(s.handleSettingsSkillBulk))
+	mux.HandleFunc("/settings/skills/regenerate-description", csrfProtected(s.handleSettingsSkillRegenerateDescription))
+	mux.HandleFunc("/settings/skills/reindex", csrfProtected(s.handleSettingsSkillsReindex))
+	mux.HandleFunc("/settings/llm/prompts/save", csrfProtected(s.handleSettingsLLMPromptsSave))
+	mux.HandleFunc("/settings/llm/prompts/reset", csrfProtected(s.handleSettingsLLMPromptsReset))
+	mux.HandleFunc("/settings/llm/prompts/revert", csrfProtected(s.handleSettingsLLMPromptsRevert))
+	mux.HandleFunc("/settings/llm/prompts/rollback", csrfProtected(s.handleSettingsLLMPromptsRollback))
+	mux.HandleFunc("/settings/llm/evolve", csrfProtected(s.handleSettingsLLMEvolve))
+	mux.HandleFunc("/api/agent/prompts/history", s.handleAPIAgentPromptHistory)
+	mux.HandleFunc("/api/llm/prompts/diff", s.handleAPILLMPromptsDiff)
+	mux.HandleFunc("/api/logs", s.handleAPILogs)
+	mux.HandleFunc("/api/turns", s.handleAPITurns)
+	mux.HandleFunc("/api/turns/", s.handleAPITurn)
 	mux.HandleFunc("/api/mcp/services", s.handleAPIMCPServices)
+	mux.HandleFunc("/api/mcp/refresh", csrfProtected(s.handleAPIMCPRefresh))
+	mux.HandleFunc("/api/mcp/stats", s.handleAPIMCPStats)
 	mux.HandleFunc("/api/skills", s.handleAPISkills)
-	mux.HandleFunc("/api/skills/catalog/search", s.handleAPISkillsCatalogSearch)
+	mux.HandleFunc("/api/skills/search", s.handleAPISkillsSearch)
+	mux.HandleFunc("/api/skills/preview", s.handleAPISkillsPreview)
+	mux.HandleFunc("/api/skills/catalog/search", s.rateLimited(s.handleAPISkillsCatalogSearch))
+	mux.HandleFunc("/api/skills/catalog/preview", s.rateLimited(s.handleAPISkillsCatalogPreview))
 	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+}
+
+// SetMetrics enables /metrics; without it the endpoint returns 404.
+func (s *Server) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+}
+
+// SetAPIKeyConfigured records whether the LLM API key is set so the pages
+// can warn about it instead of failing with a generic error.
+func (s *Server) SetAPIKeyConfigured(configured bool) {
+	s.apiKeyMissing = !configured
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -181,8 +318,11 @@ func (s *Server) handleChatPage(w http.ResponseWriter, r *http.Request) {
 		Summary:        summary,
 		Messages:       messages,
 		Error:          r.URL.Query().Get("error"),
+		Notice:         r.URL.Query().Get("notice"),
 		RetryAvailable: r.URL.Query().Get("retry") == "1",
 		Draft:          r.URL.Query().Get("draft"),
+		CSRFToken:      csrfToken(w, r),
+		APIKeyMissing:  s.apiKeyMissing,
 	}
 	_ = s.tmpl.ExecuteTemplate(w, "chat.html", data)
 }
@@ -209,6 +349,18 @@ func (s *Server) handleChatSend(w http.ResponseWriter, r *http.Request) {
 
 	if _, err := s.agent.HandleUserMessage(ctx, message); err != nil {
 		query := url.Values{}
+		if errors.Is(err, conversation.ErrPersist) {
+			query.Set("error", persistFailureMessage(err))
+			http.Redirect(w, r, "/chat?"+query.Encode(), http.StatusFound)
+			return
+		}
+		if errors.Is(err, agent.ErrAgentBusy) {
+			// The message was not recorded, so keep it as a draft without offering a retry.
+			query.Set("error", agentBusyMessage)
+			query.Set("draft", message)
+			http.Redirect(w, r, "/chat?"+query.Encode(), http.StatusFound)
+			return
+		}
 		query.Set("error", err.Error())
 		query.Set("retry", "1")
 		query.Set("draft", message)
@@ -230,6 +382,16 @@ func (s *Server) handleChatRetry(w http.ResponseWriter, r *http.Request) {
 
 	if _, err := s.agent.RetryLastUserMessage(ctx); err != nil {
 		query := url.Values{}
+		if errors.Is(err, conversation.ErrPersist) {
+			query.Set("error", persistFailureMessage(err))
+			http.Redirect(w, r, "/chat?"+query.Encode(), http.StatusFound)
+			return
+		}
+		if errors.Is(err, agent.ErrAgentBusy) {
+			query.Set("error", agentBusyMessage)
+			http.Redirect(w, r, "/chat?"+query.Encode(), http.StatusFound)
+			return
+		}
 		query.Set("error", err.Error())
 		query.Set("retry", "1")
 		http.Redirect(w, r, "/chat?"+query.Encode(), http.StatusFound)
@@ -239,11 +401,212 @@ func (s *Server) handleChatRetry(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/chat", http.StatusFound)
 }
 
+func (s *Server) handleChatRecompress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("请求参数解析失败"), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	summary, err := s.agent.RecompressNow(ctx, r.FormValue("force") == "on")
+	if err != nil {
+		message := "重新压缩失败: " + err.Error()
+		switch {
+		case errors.Is(err, agent.ErrSleepWindow):
+			message = "当前是休息时段，已跳过重新压缩；如需执行请勾选“休息时段仍执行”"
+		case errors.Is(err, agent.ErrAgentBusy):
+			message = agentBusyMessage
+		case errors.Is(err, conversation.ErrPersist):
+			message = persistFailureMessage(err)
+		}
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape(message), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/chat?notice="+url.QueryEscape("已重新压缩上下文，新摘要：\n"+summary), http.StatusFound)
+}
+
+// agentBusyMessage is shown when too many requests already wait for the
+// running turn.
+const agentBusyMessage = "正在处理之前的消息，排队已满，请稍后再试"
+
+// persistFailureMessage explains that the turn happened but was not saved.
+func persistFailureMessage(err error) string {
+	return "对话未能保存到磁盘（重启后可能丢失）: " + err.Error()
+}
+
+func (s *Server) handleChatEdit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("请求参数解析失败"), http.StatusFound)
+		return
+	}
+
+	index, err := strconv.Atoi(strings.TrimSpace(r.FormValue("index")))
+	if err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("消息序号无效"), http.StatusFound)
+		return
+	}
+	if err := s.convStore.EditMessage(index, r.FormValue("content")); err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("修改消息失败: "+err.Error()), http.StatusFound)
+		return
+	}
+
+	// An edited trailing user message has no reply yet; offer the retry path.
+	_, messages := s.convStore.Snapshot()
+	if index == len(messages)-1 && messages[index].Role == "user" {
+		http.Redirect(w, r, "/chat?retry=1", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/chat", http.StatusFound)
+}
+
+func (s *Server) handleChatDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("请求参数解析失败"), http.StatusFound)
+		return
+	}
+
+	index, err := strconv.Atoi(strings.TrimSpace(r.FormValue("index")))
+	if err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("消息序号无效"), http.StatusFound)
+		return
+	}
+	if err := s.convStore.DeleteMessage(index); err != nil {
+		http.Redirect(w, r, "/chat?error="+url.QueryEscape("删除消息失败: "+err.Error()), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/chat", http.StatusFound)
+}
+
+func (s *Server) handleChatExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="conversation.md"`)
+	_, _ = io.WriteString(w, s.convStore.ExportMarkdown())
+}
+
 func (s *Server) handleLogsPage(w http.ResponseWriter, r *http.Request) {
-	data := logsPageData{Entries: s.logStore.List()}
+	query := r.URL.Query()
+	data := logsPageData{
+		Purposes:   s.logStore.Purposes(),
+		Purpose:    strings.TrimSpace(query.Get("purpose")),
+		TurnID:     strings.TrimSpace(query.Get("turn")),
+		ErrorsOnly: query.Get("error") == "1",
+		Since:      strings.TrimSpace(query.Get("since")),
+		Notice:     strings.TrimSpace(query.Get("notice")),
+		CSRFToken:  csrfToken(w, r),
+	}
+	opts, err := parseLogFilter(query, time.Now())
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Entries = s.logStore.Filter(opts)
 	_ = s.tmpl.ExecuteTemplate(w, "logs.html", data)
 }
 
+func (s *Server) handleLogsClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, "/logs?notice="+url.QueryEscape("请求参数解析失败"), http.StatusFound)
+		return
+	}
+	if r.FormValue("confirm") != "yes" {
+		http.Redirect(w, r, "/logs?notice="+url.QueryEscape("未勾选确认，日志未清空"), http.StatusFound)
+		return
+	}
+	notice := "日志已清空"
+	if err := s.logStore.Clear(); err != nil {
+		notice = "日志已从页面清空，但写入日志文件失败：" + err.Error()
+	}
+	http.Redirect(w, r, "/logs?notice="+url.QueryEscape(notice), http.StatusFound)
+}
+
+func (s *Server) handleAPILogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	query := r.URL.Query()
+	opts, err := parseLogFilter(query, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+		return
+	}
+	opts.Limit = 50
+	if rawLimit := strings.TrimSpace(query.Get("limit")); rawLimit != "" {
+		if parsed, err := strconv.Atoi(rawLimit); err == nil && parsed > 0 {
+			opts.Limit = parsed
+		}
+	}
+
+	entries := s.logStore.Filter(opts)
+	items := make([]apiLogEntry, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, apiLogEntry{
+			ID:         entry.ID,
+			Time:       entry.Time,
+			Purpose:    entry.Purpose,
+			TurnID:     entry.TurnID,
+			Model:      entry.Model,
+			Request:    entry.Request,
+			Response:   entry.Response,
+			Error:      entry.Error,
+			StatusCode: entry.StatusCode,
+			DurationMS: entry.DurationMS,
+		})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"entries": items})
+}
+
+// parseLogFilter reads purpose, turn, error=1 and since from a query. since accepts
+// RFC3339, a date (2006-01-02, local time) or a lookback duration such as 2h.
+func parseLogFilter(query url.Values, now time.Time) (llmlog.FilterOptions, error) {
+	opts := llmlog.FilterOptions{
+		Purpose:    strings.TrimSpace(query.Get("purpose")),
+		TurnID:     strings.TrimSpace(query.Get("turn")),
+		ErrorsOnly: query.Get("error") == "1",
+	}
+	since := strings.TrimSpace(query.Get("since"))
+	if since == "" {
+		return opts, nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		opts.Since = t
+		return opts, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		opts.Since = t
+		return opts, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil && d > 0 {
+		opts.Since = now.Add(-d)
+		return opts, nil
+	}
+	return opts, fmt.Errorf("invalid since %q: use RFC3339, YYYY-MM-DD or a duration like 2h", since)
+}
+
 func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 	section := strings.TrimSpace(r.URL.Query().Get("section"))
 	if section == "" {
@@ -254,7 +617,9 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := settingsPageData{
-		ActiveSection: section,
+		CSRFToken:        csrfToken(w, r),
+		APIKeyConfigured: !s.apiKeyMissing,
+		ActiveSection:    section,
 		Sections: []settingsSection{
 			{Key: "mcp", Title: "MCP 服务", Description: "管理 Agent 可用的 MCP 工具服务"},
 			{Key: "llm", Title: "提示词策略", Description: "配置 Agent 系统提示词与压缩提示词"},
@@ -278,9 +643,11 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 				Command:   status.Service.Command,
 				Args:      strings.Join(status.Service.Args, " "),
 				Transport: displayTransport(status.Service.Transport),
+				Group:     status.Service.Group,
 				Enabled:   status.Service.Enabled,
 				UpdatedAt: status.Service.UpdatedAt.Format("2006-01-02 15:04:05"),
 			}
+			view.ToolsOptIn = status.Service.ToolsDefaultDisabled
 			switch {
 			case !status.Service.Enabled:
 				view.StatusLabel = "已禁用"
@@ -288,6 +655,7 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 				view.Connected = true
 				view.StatusLabel = "连接正常"
 				view.ToolCount = status.ToolCount
+				view.Capabilities = displayCapabilities(status.Capabilities)
 				view.Tools = make([]mcpServiceToolView, 0, len(status.Tools))
 				for _, tool := range status.Tools {
 					view.Tools = append(view.Tools, mcpServiceToolView{
@@ -302,6 +670,7 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 			}
 			data.Services = append(data.Services, view)
 		}
+		data.ServiceGroups = groupServiceViews(data.Services)
 	} else if section == "skills" {
 		allSkills := s.skillStore.ListSkills()
 		data.Skills = make([]skillView, 0, len(allSkills))
@@ -311,7 +680,14 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 				Name:        skill.Name,
 				Description: skill.Description,
 				Prompt:      skill.Prompt,
-				Source:      skill.Source,
+				Tags:        strings.Join(skill.Tags, ", "),
+				Priority:    skill.Priority,
+				Source:      displaySkillSource(skill.Source),
+				SourceURL:   skill.SourceURL,
+				SourceLink:  isWebURL(skill.SourceURL),
+				Ref:         skill.Ref,
+				Commit:      trimCommit(skill.Commit),
+				Updatable:   skill.RepoURL != "",
 				Enabled:     skill.Enabled,
 			}
 			if !skill.UpdatedAt.IsZero() {
@@ -328,6 +704,28 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 		if !cfg.UpdatedAt.IsZero() {
 			data.AgentPrompts.UpdatedAt = cfg.UpdatedAt.Format("2006-01-02 15:04:05")
 		}
+		for _, item := range s.mcpStore.ListAgentPromptHistory() {
+			data.PromptHistory = append(data.PromptHistory, promptVersionView{
+				Version:   item.Version,
+				Reason:    item.Reason,
+				CreatedAt: item.CreatedAt.Format("2006-01-02 15:04:05"),
+				Preview:   previewText(item.SystemPrompt, 80),
+				Current: item.SystemPrompt == cfg.SystemPrompt &&
+					item.CompressionSystemPrompt == cfg.CompressionSystemPrompt,
+			})
+		}
+		against := strings.TrimSpace(r.URL.Query().Get("diff"))
+		if against == "" {
+			against = "previous"
+			if _, ok := s.mcpStore.PreviousAgentPromptVersion(); !ok {
+				against = "default"
+			}
+		}
+		if diff, err := s.agentPromptDiff(against); err != nil {
+			data.PromptDiffError = err.Error()
+		} else {
+			data.PromptDiff = &diff
+		}
 	}
 
 	_ = s.tmpl.ExecuteTemplate(w, "settings.html", data)
@@ -350,8 +748,10 @@ func (s *Server) handleSettingsMCPSave(w http.ResponseWriter, r *http.Request) {
 		Command:   strings.TrimSpace(r.FormValue("command")),
 		Transport: strings.TrimSpace(r.FormValue("transport")),
 		AuthToken: strings.TrimSpace(r.FormValue("auth_token")),
+		Group:     strings.TrimSpace(r.FormValue("group")),
 		Enabled:   r.FormValue("enabled") == "on",
 	}
+	service.ToolsDefaultDisabled = r.FormValue("tools_default_disabled") == "on"
 	args, err := parseJSONArgsList(strings.TrimSpace(r.FormValue("args_json")))
 	if err != nil {
 		s.redirectSettings(w, r, "mcp", "", err.Error())
@@ -407,6 +807,29 @@ func (s *Server) handleSettingsMCPToggle(w http.ResponseWriter, r *http.Request)
 	s.redirectSettings(w, r, "mcp", fmt.Sprintf("MCP 服务 %s 已禁用", id), "")
 }
 
+func (s *Server) handleSettingsMCPGroupToggle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "mcp", "", "请求参数解析失败")
+		return
+	}
+	group := strings.TrimSpace(r.FormValue("group"))
+	enable := r.FormValue("enabled") == "true"
+	if err := s.mcpStore.SetGroupEnabled(group, enable); err != nil {
+		s.redirectSettings(w, r, "mcp", "", err.Error())
+		return
+	}
+	s.mcpTools.InvalidateCache()
+	if enable {
+		s.redirectSettings(w, r, "mcp", fmt.Sprintf("分组 %s 的服务已全部启用", group), "")
+		return
+	}
+	s.redirectSettings(w, r, "mcp", fmt.Sprintf("分组 %s 的服务已全部禁用", group), "")
+}
+
 func (s *Server) handleSettingsMCPToolToggle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -444,7 +867,8 @@ func (s *Server) handleSettingsSkillInstall(w http.ResponseWriter, r *http.Reque
 	rawURL := strings.TrimSpace(r.FormValue("skills_sh_url"))
 	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
 	defer cancel()
-	installed, err := s.skillStore.InstallFromSkillsSH(ctx, rawURL)
+	ref := strings.TrimSpace(r.FormValue("ref"))
+	installed, err := s.skillStore.InstallFromSkillsSH(ctx, rawURL, ref)
 	if err != nil {
 		s.redirectSettings(w, r, "skills", "", err.Error())
 		return
@@ -452,6 +876,50 @@ func (s *Server) handleSettingsSkillInstall(w http.ResponseWriter, r *http.Reque
 	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skill 已安装：%s (%s)", installed.Name, installed.ID), "")
 }
 
+func (s *Server) handleSettingsSkillInstallGit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "skills", "", "请求参数解析失败")
+		return
+	}
+
+	repoURL := strings.TrimSpace(r.FormValue("repo_url"))
+	skillID := strings.TrimSpace(r.FormValue("skill_id"))
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+	ref := strings.TrimSpace(r.FormValue("ref"))
+	installed, err := s.skillStore.InstallFromGitRepo(ctx, repoURL, skillID, ref)
+	if err != nil {
+		s.redirectSettings(w, r, "skills", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skill 已安装：%s (%s)", installed.Name, installed.ID), "")
+}
+
+func (s *Server) handleSettingsSkillUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "skills", "", "请求参数解析失败")
+		return
+	}
+
+	id := strings.TrimSpace(r.FormValue("id"))
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+	updated, err := s.skillStore.UpdateSkill(ctx, id)
+	if err != nil {
+		s.redirectSettings(w, r, "skills", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skill 已更新：%s (%s)", updated.ID, trimCommit(updated.Commit)), "")
+}
+
 func (s *Server) handleSettingsSkillSave(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -462,11 +930,22 @@ func (s *Server) handleSettingsSkillSave(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	priority := 0
+	if raw := strings.TrimSpace(r.FormValue("priority")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			s.redirectSettings(w, r, "skills", "", "优先级必须是整数")
+			return
+		}
+		priority = parsed
+	}
 	skill := skills.Skill{
 		ID:          "",
 		Name:        strings.TrimSpace(r.FormValue("name")),
 		Description: strings.TrimSpace(r.FormValue("description")),
 		Prompt:      strings.TrimSpace(r.FormValue("prompt")),
+		Tags:        strings.Split(r.FormValue("tags"), ","),
+		Priority:    priority,
 		Enabled:     r.FormValue("enabled") == "on",
 	}
 	if err := s.skillStore.UpsertSkill(skill); err != nil {
@@ -517,6 +996,76 @@ func (s *Server) handleSettingsSkillToggle(w http.ResponseWriter, r *http.Reques
 	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skill %s 已禁用", id), "")
 }
 
+// handleSettingsSkillBulk applies action enable_all, disable_all or
+// builtin_only to every installed skill.
+func (s *Server) handleSettingsSkillBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "skills", "", "请求参数解析失败")
+		return
+	}
+
+	var err error
+	var success string
+	switch strings.TrimSpace(r.FormValue("action")) {
+	case "enable_all":
+		err = s.skillStore.SetAllEnabled(true)
+		success = "已启用全部 Skill"
+	case "disable_all":
+		err = s.skillStore.SetAllEnabled(false)
+		success = "已禁用全部 Skill"
+	case "builtin_only":
+		err = s.skillStore.DisableAllNonBuiltin()
+		success = "已禁用全部非内置 Skill，仅保留内置 Skill"
+	default:
+		s.redirectSettings(w, r, "skills", "", "未知的批量操作")
+		return
+	}
+	if err != nil {
+		s.redirectSettings(w, r, "skills", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "skills", success, "")
+}
+
+func (s *Server) handleSettingsSkillRegenerateDescription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "skills", "", "请求参数解析失败")
+		return
+	}
+
+	id := strings.TrimSpace(r.FormValue("id"))
+	ctx, cancel := context.WithTimeout(r.Context(), 45*time.Second)
+	defer cancel()
+	updated, err := s.skillStore.RegenerateDescription(ctx, id)
+	if err != nil {
+		s.redirectSettings(w, r, "skills", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skill %s 描述已刷新：%s", updated.ID, updated.Description), "")
+}
+
+func (s *Server) handleSettingsSkillsReindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.skillStore.Reindex()
+	if err != nil {
+		s.redirectSettings(w, r, "skills", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "skills", fmt.Sprintf("Skills 已重新索引：共 %d 个，新增 %d 个，移除 %d 个", result.Total, result.Added, result.Removed), "")
+}
+
 func (s *Server) handleSettingsLLMPromptsSave(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -550,6 +1099,187 @@ func (s *Server) handleSettingsLLMPromptsReset(w http.ResponseWriter, r *http.Re
 	s.redirectSettings(w, r, "llm", "已重置为内置默认提示词", "")
 }
 
+func (s *Server) handleSettingsLLMPromptsRevert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "llm", "", "请求参数解析失败")
+		return
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(r.FormValue("version")))
+	if err != nil || version <= 0 {
+		s.redirectSettings(w, r, "llm", "", "版本号无效")
+		return
+	}
+	if err := s.mcpStore.RevertAgentPrompts(version); err != nil {
+		s.redirectSettings(w, r, "llm", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "llm", fmt.Sprintf("已回滚到提示词版本 v%d", version), "")
+}
+
+func (s *Server) handleSettingsLLMPromptsRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "llm", "", "请求参数解析失败")
+		return
+	}
+
+	restored, err := s.mcpStore.RollbackAgentPrompts()
+	if errors.Is(err, mcp.ErrNoPreviousPrompts) {
+		s.redirectSettings(w, r, "llm", "", "没有可回退的上一版本")
+		return
+	}
+	if err != nil {
+		s.redirectSettings(w, r, "llm", "", err.Error())
+		return
+	}
+	s.redirectSettings(w, r, "llm", fmt.Sprintf("已回退到上一版本提示词 v%d", restored.Version), "")
+}
+
+func (s *Server) handleSettingsLLMEvolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.redirectSettings(w, r, "llm", "", "请求参数解析失败")
+		return
+	}
+	if s.agent == nil {
+		s.redirectSettings(w, r, "llm", "", "Agent 未初始化")
+		return
+	}
+
+	result, err := s.agent.RunPromptEvolutionNow(r.Context(), r.FormValue("force") == "on")
+	if err != nil {
+		s.redirectSettings(w, r, "llm", "", "提示词进化失败："+err.Error())
+		return
+	}
+	if result.Skipped {
+		s.redirectSettings(w, r, "llm", "", "今天已执行过提示词进化；如需再次执行请勾选“强制执行”")
+		return
+	}
+	status := "提示词未变更"
+	if result.PromptsUpdated {
+		status = "提示词已更新"
+	}
+	message := fmt.Sprintf("提示词进化完成：%s，沉淀/更新 %d 条 Skill", status, result.EvolvedSkills)
+	if result.Reflection != "" {
+		message += "\n" + result.Reflection
+	}
+	s.redirectSettings(w, r, "llm", message, "")
+}
+
+func (s *Server) handleAPIAgentPromptHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"current":  s.mcpStore.GetAgentPromptConfig(),
+		"versions": s.mcpStore.ListAgentPromptHistory(),
+	})
+}
+
+// handleAPITurns lists the retained turn traces, newest first, without
+// their tool call details.
+func (s *Server) handleAPITurns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var traces []agent.TurnTrace
+	if s.agent != nil {
+		traces = s.agent.TurnTraces()
+	}
+	items := make([]map[string]any, 0, len(traces))
+	for _, trace := range traces {
+		items = append(items, map[string]any{
+			"id":          trace.ID,
+			"input":       previewText(trace.Input, 80),
+			"started_at":  trace.StartedAt,
+			"duration_ms": trace.DurationMS,
+			"rounds":      trace.Rounds,
+			"tool_calls":  len(trace.ToolCalls),
+			"error":       trace.Error,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"turns": items})
+}
+
+func (s *Server) handleAPITurn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	id := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/turns/"))
+	var trace agent.TurnTrace
+	ok := false
+	if s.agent != nil {
+		trace, ok = s.agent.TurnTrace(id)
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "turn not found"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(trace)
+}
+
+func (s *Server) handleAPILLMPromptsDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	against := strings.TrimSpace(r.URL.Query().Get("against"))
+	if against == "" {
+		against = "previous"
+	}
+	diff, err := s.agentPromptDiff(against)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(diff)
+}
+
+// agentPromptDiff diffs the current prompts against "default" (the builtin
+// prompts) or "previous" (the version a rollback would restore).
+func (s *Server) agentPromptDiff(against string) (promptDiffView, error) {
+	view := promptDiffView{Against: against}
+	var base mcp.AgentPromptConfig
+	switch against {
+	case "default":
+		base = mcp.DefaultAgentPromptConfig()
+	case "previous":
+		prev, ok := s.mcpStore.PreviousAgentPromptVersion()
+		if !ok {
+			return promptDiffView{}, errors.New("没有可对比的上一版本")
+		}
+		view.AgainstVersion = prev.Version
+		base = mcp.AgentPromptConfig{SystemPrompt: prev.SystemPrompt, CompressionSystemPrompt: prev.CompressionSystemPrompt}
+	default:
+		return promptDiffView{}, errors.New("against 仅支持 default 或 previous")
+	}
+	current := s.mcpStore.GetAgentPromptConfig()
+	view.SystemPrompt = textdiff.Lines(base.SystemPrompt, current.SystemPrompt)
+	view.CompressionPrompt = textdiff.Lines(base.CompressionSystemPrompt, current.CompressionSystemPrompt)
+	view.Changed = textdiff.Changed(view.SystemPrompt) || textdiff.Changed(view.CompressionPrompt)
+	return view, nil
+}
+
 func (s *Server) handleAPIMCPServices(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -565,6 +1295,7 @@ func (s *Server) handleAPIMCPServices(w http.ResponseWriter, r *http.Request) {
 			Endpoint:  strings.TrimSpace(svc.Endpoint),
 			Command:   strings.TrimSpace(svc.Command),
 			Args:      append([]string(nil), svc.Args...),
+			Group:     svc.Group,
 			Enabled:   svc.Enabled,
 			UpdatedAt: svc.UpdatedAt,
 		})
@@ -573,19 +1304,62 @@ func (s *Server) handleAPIMCPServices(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]any{"services": items})
 }
 
+func (s *Server) handleAPIMCPRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s.mcpTools == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "MCP 未启用"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	// Prompts are re-listed lazily; tools are re-listed right away.
+	s.mcpTools.InvalidateCache()
+	report := s.mcpTools.RefreshToolsReport(ctx)
+	_ = json.NewEncoder(w).Encode(map[string]any{"services": report})
+}
+
+func (s *Server) handleAPIMCPStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s.mcpTools == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "MCP 未启用"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"tools": s.mcpTools.Stats()})
+}
+
 func (s *Server) handleAPISkills(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
 	skillsList := s.skillStore.ListSkills()
 	items := make([]apiSkill, 0, len(skillsList))
 	for _, item := range skillsList {
+		if tag != "" && !slices.Contains(item.Tags, tag) {
+			continue
+		}
 		items = append(items, apiSkill{
 			ID:          item.ID,
 			Name:        item.Name,
 			Description: item.Description,
+			Tags:        item.Tags,
+			Priority:    item.Priority,
 			Source:      item.Source,
+			SourceURL:   item.SourceURL,
+			RepoURL:     item.RepoURL,
+			Ref:         item.Ref,
+			Commit:      item.Commit,
 			Enabled:     item.Enabled,
 			UpdatedAt:   item.UpdatedAt,
 		})
@@ -594,6 +1368,91 @@ func (s *Server) handleAPISkills(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]any{"skills": items})
 }
 
+// handleAPISkillsPreview shows which skills the next turn would inject if
+// input were sent now; nothing is persisted.
+func (s *Server) handleAPISkillsPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	input := strings.TrimSpace(r.URL.Query().Get("input"))
+	skills := []agent.SkillInjectionPreview{}
+	if s.agent != nil {
+		preview, err := s.agent.PreviewSkillInjection(r.Context(), input)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+			return
+		}
+		skills = preview
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"input":  input,
+		"skills": skills,
+	})
+}
+
+func (s *Server) handleAPISkillsSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error": "query parameter q is required",
+		})
+		return
+	}
+
+	limit := 8
+	if rawLimit := strings.TrimSpace(r.URL.Query().Get("limit")); rawLimit != "" {
+		if parsed, err := strconv.Atoi(rawLimit); err == nil {
+			limit = parsed
+		}
+	}
+
+	matches, err := s.skillStore.SearchInstalledSkills(query, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	type apiSkillMatch struct {
+		apiSkill
+		Score int `json:"score"`
+	}
+	items := make([]apiSkillMatch, 0, len(matches))
+	for _, match := range matches {
+		items = append(items, apiSkillMatch{
+			apiSkill: apiSkill{
+				ID:          match.Skill.ID,
+				Name:        match.Skill.Name,
+				Description: match.Skill.Description,
+				Tags:        match.Skill.Tags,
+				Source:      match.Skill.Source,
+				SourceURL:   match.Skill.SourceURL,
+				RepoURL:     match.Skill.RepoURL,
+				Ref:         match.Skill.Ref,
+				Commit:      match.Skill.Commit,
+				Enabled:     match.Skill.Enabled,
+				UpdatedAt:   match.Skill.UpdatedAt,
+			},
+			Score: match.Score,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"query":  query,
+		"skills": items,
+	})
+}
+
 func (s *Server) handleAPISkillsCatalogSearch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -633,6 +1492,46 @@ func (s *Server) handleAPISkillsCatalogSearch(w http.ResponseWriter, r *http.Req
 	})
 }
 
+// handleAPISkillsCatalogPreview returns the SKILL.md content behind a
+// skills.sh URL without installing it.
+func (s *Server) handleAPISkillsCatalogPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rawURL := strings.TrimSpace(r.URL.Query().Get("url"))
+	if rawURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error": "query parameter url is required",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+	defer cancel()
+	skill, err := s.skillStore.PreviewFromSkillsSH(ctx, rawURL)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":          skill.ID,
+		"name":        skill.Name,
+		"description": skill.Description,
+		"prompt":      skill.Prompt,
+		"tags":        skill.Tags,
+		"priority":    skill.Priority,
+		"source_url":  skill.SourceURL,
+		"repo_url":    skill.RepoURL,
+		"commit":      skill.Commit,
+	})
+}
+
 func (s *Server) redirectSettings(w http.ResponseWriter, r *http.Request, section, success, failure string) {
 	values := url.Values{}
 	if strings.TrimSpace(section) == "" {
@@ -653,6 +1552,99 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.metrics == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = s.metrics.WriteText(w)
+}
+
+func displayCapabilities(caps mcp.ServerCapabilities) string {
+	names := make([]string, 0, 4)
+	if caps.Tools {
+		names = append(names, "tools")
+	}
+	if caps.Resources {
+		names = append(names, "resources")
+	}
+	if caps.Prompts {
+		names = append(names, "prompts")
+	}
+	if caps.Logging {
+		names = append(names, "logging")
+	}
+	if len(names) == 0 {
+		return "(未声明)"
+	}
+	out := strings.Join(names, ", ")
+	if caps.ProtocolVersion != "" {
+		out += "（协议 " + caps.ProtocolVersion + "）"
+	}
+	return out
+}
+
+func displaySkillSource(source string) string {
+	switch strings.TrimSpace(source) {
+	case "":
+		return "(local)"
+	case "auto-evolved":
+		return "自动进化"
+	case "builtin":
+		return "内置"
+	default:
+		return source
+	}
+}
+
+func isWebURL(raw string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func trimCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+func previewText(text string, limit int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
+
+func groupServiceViews(services []mcpServiceView) []mcpServiceGroupView {
+	var groups []mcpServiceGroupView
+	index := make(map[string]int)
+	for _, svc := range services {
+		i, ok := index[svc.Group]
+		if !ok {
+			i = len(groups)
+			index[svc.Group] = i
+			groups = append(groups, mcpServiceGroupView{Name: svc.Group})
+		}
+		groups[i].Services = append(groups[i].Services, svc)
+		groups[i].AnyEnabled = groups[i].AnyEnabled || svc.Enabled
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if (groups[i].Name == "") != (groups[j].Name == "") {
+			return groups[j].Name == ""
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
 func displayTransport(raw string) string {
 	switch strings.ToLower(strings.TrimSpace(raw)) {
 	case "sse":
@@ -0,0 +1,550 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"laughing-barnacle/internal/agent"
+	"laughing-barnacle/internal/conversation"
+	"laughing-barnacle/internal/llm"
+	"laughing-barnacle/internal/llmlog"
+	"laughing-barnacle/internal/mcp"
+	"laughing-barnacle/internal/metrics"
+	"laughing-barnacle/internal/skills"
+)
+
+type stubLLM struct {
+	reply string
+}
+
+func (s *stubLLM) Chat(_ context.Context, _ llm.ChatRequest) (llm.ChatResponse, error) {
+	return llm.ChatResponse{Content: s.reply}, nil
+}
+
+func newTestServer(t *testing.T, llmClient llm.Client) (*Server, *agent.Agent, *conversation.Store) {
+	t.Helper()
+	store := conversation.NewStore()
+	agentSvc := agent.New(agent.Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          2,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+	}, store, llmClient, nil)
+	srv, err := NewServer(agentSvc, store, llmlog.NewStore(10), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	return srv, agentSvc, store
+}
+
+const testCSRFToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func withCSRF(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeaderName, testCSRFToken)
+}
+
+func TestChatStream_DeliversAgentEvents(t *testing.T) {
+	srv, agentSvc, _ := newTestServer(t, &stubLLM{reply: "streamed-reply"})
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	httpSrv := httptest.NewServer(mux)
+	defer httpSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpSrv.URL+"/chat/stream", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connect stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	sawRound := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v (saw round=%v)", err, sawRound)
+		}
+		line = strings.TrimSpace(line)
+		if line == "event: round" {
+			sawRound = true
+		}
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, "streamed-reply") {
+			break
+		}
+	}
+	if !sawRound {
+		t.Fatalf("expected round event before reply")
+	}
+}
+
+func TestChatEditAndDelete_AllowRetryOfEditedMessage(t *testing.T) {
+	srv, _, store := newTestServer(t, &stubLLM{reply: "fixed-reply"})
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	store.Append("user", "helo")
+	store.Append("assistant", "bad-reply")
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		withCSRF(req)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	page := httptest.NewRecorder()
+	mux.ServeHTTP(page, httptest.NewRequest(http.MethodGet, "/chat", nil))
+	if !strings.Contains(page.Body.String(), `action="/chat/edit"`) || !strings.Contains(page.Body.String(), `name="index" value="1"`) {
+		t.Fatalf("expected per-message edit controls on chat page")
+	}
+
+	if rec := post("/chat/delete", url.Values{"index": {"1"}}); rec.Header().Get("Location") != "/chat" {
+		t.Fatalf("unexpected delete redirect: %q", rec.Header().Get("Location"))
+	}
+	if rec := post("/chat/edit", url.Values{"index": {"0"}, "content": {"hello"}}); rec.Header().Get("Location") != "/chat?retry=1" {
+		t.Fatalf("expected retry redirect after editing last user message, got %q", rec.Header().Get("Location"))
+	}
+	if rec := post("/chat/edit", url.Values{"index": {"5"}, "content": {"x"}}); !strings.Contains(rec.Header().Get("Location"), "error=") {
+		t.Fatalf("expected error redirect for out-of-range index, got %q", rec.Header().Get("Location"))
+	}
+
+	post("/chat/retry", url.Values{})
+	_, messages := store.Snapshot()
+	if len(messages) != 2 || messages[0].Content != "hello" || messages[1].Content != "fixed-reply" {
+		t.Fatalf("unexpected messages after retry: %+v", messages)
+	}
+}
+
+func TestChatSend_RateLimitedPerClient(t *testing.T) {
+	srv, _, _ := newTestServer(t, &stubLLM{reply: "ok"})
+	srv.SetRateLimit(3)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/chat/send", strings.NewReader("message=hi"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		withCSRF(req)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := send("10.0.0.1:5000"); rec.Code != http.StatusFound {
+			t.Fatalf("request %d: expected redirect, got %d", i, rec.Code)
+		}
+	}
+	rec := send("10.0.0.1:5001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after limit, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+	if rec := send("10.0.0.2:5000"); rec.Code != http.StatusFound {
+		t.Fatalf("expected other client to be unaffected, got %d", rec.Code)
+	}
+
+	health := httptest.NewRecorder()
+	for i := 0; i < 5; i++ {
+		health = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		mux.ServeHTTP(health, req)
+	}
+	if health.Code != http.StatusOK {
+		t.Fatalf("expected /healthz to stay unlimited, got %d", health.Code)
+	}
+}
+
+func TestWithAuth_RejectsMissingCredentialsAndAcceptsValidOnes(t *testing.T) {
+	srv, _, _ := newTestServer(t, &stubLLM{reply: "ok"})
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	handler := WithAuth(mux, AuthConfig{Token: "secret-token", Username: "admin", Password: "pw"})
+
+	get := func(path string, setup func(*http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if setup != nil {
+			setup(req)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("/chat", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", code)
+	}
+	if code := get("/chat", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong token, got %d", code)
+	}
+	if code := get("/chat", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret-token") }); code != http.StatusOK {
+		t.Fatalf("expected 200 for bearer token, got %d", code)
+	}
+	if code := get("/chat", func(r *http.Request) { r.SetBasicAuth("anyone", "secret-token") }); code != http.StatusOK {
+		t.Fatalf("expected 200 for token as basic password, got %d", code)
+	}
+	if code := get("/chat", func(r *http.Request) { r.SetBasicAuth("admin", "pw") }); code != http.StatusOK {
+		t.Fatalf("expected 200 for basic credentials, got %d", code)
+	}
+	if code := get("/healthz", nil); code != http.StatusOK {
+		t.Fatalf("expected /healthz to stay public, got %d", code)
+	}
+	if WithAuth(mux, AuthConfig{}) != http.Handler(mux) {
+		t.Fatalf("expected auth to be disabled without credentials")
+	}
+}
+
+func TestCSRF_RejectsPostWithoutValidToken(t *testing.T) {
+	srv, _, store := newTestServer(t, &stubLLM{reply: "ok"})
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	page := httptest.NewRecorder()
+	mux.ServeHTTP(page, httptest.NewRequest(http.MethodGet, "/chat", nil))
+	var issued *http.Cookie
+	for _, cookie := range page.Result().Cookies() {
+		if cookie.Name == csrfCookieName {
+			issued = cookie
+		}
+	}
+	if issued == nil || !strings.Contains(page.Body.String(), `name="csrf_token" value="`+issued.Value+`"`) {
+		t.Fatalf("expected chat page to issue a csrf cookie embedded in its forms")
+	}
+
+	post := func(token string, cookie *http.Cookie) int {
+		form := url.Values{"message": {"hi"}}
+		if token != "" {
+			form.Set("csrf_token", token)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/chat/send", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("", issued); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without token, got %d", code)
+	}
+	if code := post(issued.Value, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without cookie, got %d", code)
+	}
+	if code := post(testCSRFToken, issued); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for mismatched token, got %d", code)
+	}
+	if _, messages := store.Snapshot(); len(messages) != 0 {
+		t.Fatalf("rejected posts must not reach the agent, got %+v", messages)
+	}
+	if code := post(issued.Value, issued); code != http.StatusFound {
+		t.Fatalf("expected valid token to be accepted, got %d", code)
+	}
+}
+
+func TestAPILogs_FiltersByPurposeAndErrors(t *testing.T) {
+	srv, _, _ := newTestServer(t, &stubLLM{reply: "ok"})
+	srv.logStore.Add(llmlog.Entry{Purpose: "chat_reply"})
+	srv.logStore.Add(llmlog.Entry{Purpose: "compress_context", Error: "timeout"})
+	srv.logStore.Add(llmlog.Entry{Purpose: "compress_context"})
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	get := func(target string) (int, []apiLogEntry) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var payload struct {
+			Entries []apiLogEntry `json:"entries"`
+		}
+		_ = json.NewDecoder(rec.Body).Decode(&payload)
+		return rec.Code, payload.Entries
+	}
+
+	if _, entries := get("/api/logs?purpose=compress_context"); len(entries) != 2 {
+		t.Fatalf("expected 2 compress_context entries, got %+v", entries)
+	}
+	if _, entries := get("/api/logs?purpose=compress_context&error=1"); len(entries) != 1 || entries[0].Error != "timeout" {
+		t.Fatalf("expected one failed compression, got %+v", entries)
+	}
+	if _, entries := get("/api/logs?limit=1"); len(entries) != 1 || entries[0].Purpose != "compress_context" {
+		t.Fatalf("expected newest entry only, got %+v", entries)
+	}
+	if code, _ := get("/api/logs?since=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid since, got %d", code)
+	}
+
+	page := httptest.NewRecorder()
+	mux.ServeHTTP(page, httptest.NewRequest(http.MethodGet, "/logs?error=1", nil))
+	if body := page.Body.String(); !strings.Contains(body, "timeout") || strings.Count(body, "<article") != 1 {
+		t.Fatalf("expected logs page to show only the error entry")
+	}
+}
+
+func TestAPISkills_IncludesRecordedSourceURL(t *testing.T) {
+	root := t.TempDir()
+	skillsDir := filepath.Join(root, "skills")
+	if err := os.MkdirAll(filepath.Join(skillsDir, "demo"), 0o755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(skillsDir, "demo", "SKILL.md"), []byte("---\nname: \"demo\"\n---\n\nrun demo"), 0o600); err != nil {
+		t.Fatalf("write SKILL.md error: %v", err)
+	}
+	// Legacy state stored the install URL as the source itself.
+	state := `{"skills":{"demo":{"enabled":true,"source":"https://skills.sh/acme/tools/demo","repo_url":"https://github.com/acme/tools.git","ref":"v1.0.0"}}}`
+	statePath := filepath.Join(root, "skills_state.json")
+	if err := os.WriteFile(statePath, []byte(state), 0o600); err != nil {
+		t.Fatalf("write state error: %v", err)
+	}
+	skillStore, err := skills.NewStore(skillsDir, statePath)
+	if err != nil {
+		t.Fatalf("skills.NewStore error: %v", err)
+	}
+	srv, err := NewServer(nil, conversation.NewStore(), llmlog.NewStore(10), nil, nil, skillStore)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/skills", nil))
+	var payload struct {
+		Skills []apiSkill `json:"skills"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode response: %v (%s)", err, rec.Body.String())
+	}
+	for _, item := range payload.Skills {
+		if item.ID != "demo" {
+			continue
+		}
+		if item.Source != "skills.sh" || item.SourceURL != "https://skills.sh/acme/tools/demo" {
+			t.Fatalf("unexpected source fields: %+v", item)
+		}
+		if item.RepoURL != "https://github.com/acme/tools.git" || item.Ref != "v1.0.0" {
+			t.Fatalf("unexpected repo fields: %+v", item)
+		}
+		return
+	}
+	t.Fatalf("demo skill missing from %s", rec.Body.String())
+}
+
+type toolThenReplyLLM struct {
+	calls int
+}
+
+func (s *toolThenReplyLLM) Chat(_ context.Context, _ llm.ChatRequest) (llm.ChatResponse, error) {
+	s.calls++
+	if s.calls == 1 {
+		return llm.ChatResponse{ToolCalls: []llm.ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: llm.ToolFunctionCall{Name: "linux__bash", Arguments: `{"command":"echo hi"}`},
+		}}}, nil
+	}
+	return llm.ChatResponse{Content: "done"}, nil
+}
+
+func TestMetrics_CountsTurnsAndToolCalls(t *testing.T) {
+	appMetrics := metrics.New()
+	store := conversation.NewStore()
+	agentSvc := agent.New(agent.Config{
+		Model:                      "test-model",
+		MaxRecentMessages:          10,
+		CompressionTriggerMessages: 99,
+		CompressionTriggerChars:    99999,
+		KeepRecentAfterCompression: 1,
+		MaxCompressionLoopsPerTurn: 1,
+		MaxToolCallRounds:          3,
+		SystemPrompt:               "system",
+		CompressionSystemPrompt:    "compressor",
+		Metrics:                    appMetrics,
+	}, store, &toolThenReplyLLM{}, nil)
+	srv, err := NewServer(agentSvc, store, llmlog.NewStore(10), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	srv.SetMetrics(appMetrics)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	if _, err := agentSvc.HandleUserMessage(context.Background(), "run it"); err != nil {
+		t.Fatalf("HandleUserMessage error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`agent_turns_total{result="ok"} 1`,
+		`agent_tool_calls_total{tool="linux__bash",result="ok"} 1`,
+		`agent_compressions_total 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestAPIMCPRefresh_RelistsToolsAndReportsPerService(t *testing.T) {
+	var listCalls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+		switch req["method"] {
+		case "initialize":
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2025-06-18"}}`))
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/list":
+			listCalls.Add(1)
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"fetch"},{"name":"search"}]}}`))
+		}
+	}))
+	defer ts.Close()
+
+	mcpStore, err := mcp.NewStore(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("mcp.NewStore error: %v", err)
+	}
+	for _, id := range []string{"web", "broken"} {
+		if err := mcpStore.UpsertService(mcp.Service{ID: id, Endpoint: ts.URL + "/" + id, Enabled: true}); err != nil {
+			t.Fatalf("UpsertService %s error: %v", id, err)
+		}
+	}
+	provider := mcp.NewToolProvider(mcpStore, mcp.NewHTTPClient(3*time.Second, ""), time.Hour)
+	if _, err := provider.ListTools(context.Background()); err != nil {
+		t.Fatalf("ListTools error: %v", err)
+	}
+	srv, err := NewServer(nil, conversation.NewStore(), llmlog.NewStore(10), mcpStore, provider, nil)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mcp/refresh", nil)
+	withCSRF(req)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var payload struct {
+		Services []mcp.ServiceRefresh `json:"services"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode response: %v (%s)", err, rec.Body.String())
+	}
+	if len(payload.Services) != 2 {
+		t.Fatalf("expected 2 services, got %+v", payload.Services)
+	}
+	if got := payload.Services[0]; got.ServiceID != "broken" || got.Error == "" {
+		t.Fatalf("expected refresh error for broken service, got %+v", got)
+	}
+	if got := payload.Services[1]; got.ServiceID != "web" || got.ToolCount != 2 || got.Error != "" {
+		t.Fatalf("unexpected web service report: %+v", got)
+	}
+	if n := listCalls.Load(); n != 2 {
+		t.Fatalf("expected refresh to bypass the fresh cache, got %d tools/list calls", n)
+	}
+
+	tools, err := provider.ListTools(context.Background())
+	if err != nil {
+		t.Fatalf("ListTools error: %v", err)
+	}
+	if len(tools) != 2 || listCalls.Load() != 2 {
+		t.Fatalf("expected repopulated cache to serve %d tools without relisting, calls=%d", len(tools), listCalls.Load())
+	}
+}
+
+func TestReadyz_ReportsFailingDependencyChecks(t *testing.T) {
+	prevTTL := readySettingsCheckTTL
+	readySettingsCheckTTL = 0
+	defer func() { readySettingsCheckTTL = prevTTL }()
+	settingsPath := filepath.Join(t.TempDir(), "settings.json")
+	mcpStore, err := mcp.NewStore(settingsPath)
+	if err != nil {
+		t.Fatalf("mcp.NewStore error: %v", err)
+	}
+	srv, err := NewServer(nil, conversation.NewStore(), llmlog.NewStore(10), mcpStore, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/readyz"); rec.Code != http.StatusOK {
+		t.Fatalf("expected ready with a healthy settings file, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := os.WriteFile(settingsPath, []byte("{broken"), 0o600); err != nil {
+		t.Fatalf("corrupt settings: %v", err)
+	}
+	rec := get("/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for unreadable settings, got %d", rec.Code)
+	}
+	var payload struct {
+		Failing []string `json:"failing"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode response: %v (%s)", err, rec.Body.String())
+	}
+	if len(payload.Failing) != 1 || payload.Failing[0] != "settings" {
+		t.Fatalf("unexpected failing checks: %+v", payload.Failing)
+	}
+	if strings.Contains(rec.Body.String(), settingsPath) {
+		t.Fatalf("unauthenticated readiness output must not leak error details: %s", rec.Body.String())
+	}
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("expected liveness to stay ok, got %d", rec.Code)
+	}
+}